@@ -0,0 +1,65 @@
+package alarms
+
+import (
+	"log"
+	"time"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/queue"
+)
+
+// Raise creates a server alarm for a device and publishes it to the alarm queue
+func Raise(deviceID, alarmType, title, message, severity string) (*models.Alarm, error) {
+	alarm := models.Alarm{
+		DeviceID:  deviceID,
+		Type:      "server",
+		AlarmType: alarmType,
+		Title:     title,
+		Message:   message,
+		Severity:  severity,
+		Timestamp: time.Now().Unix(),
+	}
+
+	if err := database.DB.Create(&alarm).Error; err != nil {
+		return nil, err
+	}
+
+	if err := queue.PublishAlarm(deviceID, alarmType, message, severity); err != nil {
+		log.Printf("Failed to publish alarm %s for device %s: %v", alarmType, deviceID, err)
+	}
+
+	return &alarm, nil
+}
+
+// RaiseOnce raises an alarm unless an unresolved alarm of the same type is already open for the device
+func RaiseOnce(deviceID, alarmType, title, message, severity string) (*models.Alarm, bool, error) {
+	open, err := IsOpen(deviceID, alarmType)
+	if err != nil {
+		return nil, false, err
+	}
+	if open {
+		return nil, false, nil
+	}
+
+	alarm, err := Raise(deviceID, alarmType, title, message, severity)
+	if err != nil {
+		return nil, false, err
+	}
+	return alarm, true, nil
+}
+
+// IsOpen reports whether the device has an unresolved alarm of the given type
+func IsOpen(deviceID, alarmType string) (bool, error) {
+	var count int64
+	err := database.DB.Model(&models.Alarm{}).
+		Where("device_id = ? AND alarm_type = ? AND resolved = ?", deviceID, alarmType, false).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// Resolve marks all unresolved alarms of the given type for the device as resolved
+func Resolve(deviceID, alarmType string) error {
+	return database.DB.Model(&models.Alarm{}).
+		Where("device_id = ? AND alarm_type = ? AND resolved = ?", deviceID, alarmType, false).
+		Update("resolved", true).Error
+}
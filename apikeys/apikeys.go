@@ -0,0 +1,184 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+	"tsimserver/auth"
+	"tsimserver/cache"
+	"tsimserver/database"
+	"tsimserver/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// KeyPrefix starts every API key so it can be told apart from a JWT
+const KeyPrefix = "tsk_"
+
+// prefixLength is how many leading characters of a key are stored in clear
+const prefixLength = 12
+
+var (
+	// ErrInvalidKey is returned for an unknown, revoked or inactive key
+	ErrInvalidKey = errors.New("invalid API key")
+	// ErrExpired is returned for a key past its expiry
+	ErrExpired = errors.New("API key expired")
+	// ErrIPNotAllowed is returned when the caller's IP is not on the key's allowlist
+	ErrIPNotAllowed = errors.New("IP address not allowed for this API key")
+	// ErrRateLimited is returned when the key exceeded its requests per minute
+	ErrRateLimited = errors.New("API key rate limit exceeded")
+)
+
+// IsKey reports whether a credential looks like an API key
+func IsKey(credential string) bool {
+	return strings.HasPrefix(credential, KeyPrefix)
+}
+
+// Generate creates a new key for a record and returns the plain key, which is not stored
+func Generate(key *models.APIKey) (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	plain := KeyPrefix + hex.EncodeToString(buf)
+	key.Prefix = plain[:prefixLength]
+	key.KeyHash = hash(plain)
+	return plain, nil
+}
+
+// Authenticate looks up the key and checks its expiry, IP allowlist and rate limit
+func Authenticate(plain, ip string) (*models.APIKey, error) {
+	var key models.APIKey
+	if err := database.DB.Where("key_hash = ? AND is_active = ?", hash(plain), true).First(&key).Error; err != nil {
+		return nil, ErrInvalidKey
+	}
+
+	now := time.Now()
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return &key, ErrExpired
+	}
+	if !ipAllowed(key.AllowedIPs, ip) {
+		return &key, ErrIPNotAllowed
+	}
+	if key.RateLimit > 0 {
+		count, err := cache.IncrementAPIKeyRequests(key.ID, now.Unix()/60)
+		if err != nil {
+			// The limit is not enforced while Redis is unavailable
+			log.Printf("Failed to count requests of API key %d: %v", key.ID, err)
+		} else if count > int64(key.RateLimit) {
+			RecordUsage(&key, ip, 429, true)
+			return &key, ErrRateLimited
+		}
+	}
+
+	return &key, nil
+}
+
+// RecordUsage updates the usage figures of a key after a request
+func RecordUsage(key *models.APIKey, ip string, status int, rateLimited bool) {
+	now := time.Now()
+	usage := models.APIKeyUsage{APIKeyID: key.ID, Day: now.Format("2006-01-02"), Requests: 1}
+	if status >= 400 {
+		usage.Errors = 1
+	}
+	if rateLimited {
+		usage.RateLimited = 1
+	}
+
+	err := database.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "api_key_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"requests":     gorm.Expr("api_key_usages.requests + ?", usage.Requests),
+			"errors":       gorm.Expr("api_key_usages.errors + ?", usage.Errors),
+			"rate_limited": gorm.Expr("api_key_usages.rate_limited + ?", usage.RateLimited),
+			"updated_at":   now,
+		}),
+	}).Create(&usage).Error
+	if err != nil {
+		log.Printf("Failed to record usage of API key %d: %v", key.ID, err)
+	}
+
+	if rateLimited {
+		return
+	}
+	database.DB.Model(&models.APIKey{}).Where("id = ?", key.ID).Updates(map[string]interface{}{
+		"last_used_at": now,
+		"last_used_ip": ip,
+		"usage_count":  gorm.Expr("usage_count + 1"),
+	})
+}
+
+// Allows reports whether a key grants an action on a resource
+func Allows(key *models.APIKey, resource, action string) bool {
+	for _, permission := range key.Permissions {
+		if permission == resource+":"+action || permission == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Scope returns the sites and device groups a key may use devices in. Keys limited to
+// both sites and device groups only use the listed groups on the listed sites.
+func Scope(key *models.APIKey) auth.Scope {
+	switch {
+	case len(key.SiteIDs) == 0 && len(key.DeviceGroupIDs) == 0:
+		return auth.Scope{All: true}
+	case len(key.DeviceGroupIDs) == 0:
+		return auth.Scope{SiteIDs: key.SiteIDs}
+	case len(key.SiteIDs) == 0:
+		return auth.Scope{DeviceGroupIDs: key.DeviceGroupIDs}
+	}
+
+	var groupIDs []uint
+	database.DB.Model(&models.DeviceGroup{}).
+		Where("id IN ? AND site_id IN ?", key.DeviceGroupIDs, key.SiteIDs).
+		Pluck("id", &groupIDs)
+	return auth.Scope{DeviceGroupIDs: groupIDs}
+}
+
+// ValidIPRule reports whether an allowlist entry is an IP address or CIDR range
+func ValidIPRule(rule string) bool {
+	if strings.Contains(rule, "/") {
+		_, _, err := net.ParseCIDR(rule)
+		return err == nil
+	}
+	return net.ParseIP(rule) != nil
+}
+
+// ipAllowed checks an IP against an allowlist of addresses and CIDR ranges
+func ipAllowed(rules []string, ip string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, rule := range rules {
+		if strings.Contains(rule, "/") {
+			if _, network, err := net.ParseCIDR(rule); err == nil && network.Contains(addr) {
+				return true
+			}
+			continue
+		}
+		if allowed := net.ParseIP(rule); allowed != nil && allowed.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// hash returns the stored form of a key
+func hash(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
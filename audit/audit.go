@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"strings"
+	"tsimserver/database"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// localsKey holds the change a handler reported for the audit middleware
+const localsKey = "audit_change"
+
+// routePrefix is cut from routes to find the type of their target
+const routePrefix = "/api/v1/"
+
+// ignoredFields change on every save and are left out of diffs
+var ignoredFields = map[string]bool{
+	"updated_at": true,
+}
+
+// secretFields are dropped from recorded targets even where the API returns them
+var secretFields = map[string]bool{
+	"access_token":  true,
+	"refresh_token": true,
+	"sessions":      true,
+}
+
+// change is what a handler reports about the target of its action
+type change struct {
+	targetType string
+	targetID   string
+	before     interface{}
+	after      interface{}
+}
+
+// Change reports the target of a request and its state before and after the handler
+// changed it. Before is nil for created targets and after is nil for deleted ones. The
+// audit middleware records it with the request once the handler returns.
+func Change(c *fiber.Ctx, targetType, targetID string, before, after interface{}) {
+	c.Locals(localsKey, &change{
+		targetType: targetType,
+		targetID:   targetID,
+		before:     before,
+		after:      after,
+	})
+}
+
+// RecordRequest appends the event of a finished request to the audit log. Without a
+// change reported by the handler the target is taken from the route: the resource after
+// /api/v1/ and the first route parameter.
+func RecordRequest(c *fiber.Ctx, status int) {
+	route := c.Route()
+	event := models.AuditEvent{
+		IPAddress: c.IP(),
+		UserAgent: c.Get("User-Agent"),
+		Action:    c.Method() + " " + route.Path,
+		Status:    status,
+	}
+
+	if userID, ok := c.Locals("user_id").(uint); ok {
+		event.ActorID = &userID
+	}
+	if user, ok := c.Locals("user").(*models.User); ok {
+		event.ActorName = user.Username
+	}
+	if key, ok := c.Locals("api_key").(*models.APIKey); ok {
+		event.APIKeyID = &key.ID
+	}
+	if tenantID, ok := c.Locals("tenant_id").(uint); ok && tenantID != 0 {
+		event.TenantID = &tenantID
+	}
+
+	event.TargetType, _, _ = strings.Cut(strings.TrimPrefix(route.Path, routePrefix), "/")
+	if len(route.Params) > 0 {
+		event.TargetID = c.Params(route.Params[0])
+	}
+
+	if reported, ok := c.Locals(localsKey).(*change); ok {
+		event.TargetType = reported.targetType
+		event.TargetID = reported.targetID
+		event.Before = toMap(reported.before)
+		event.After = toMap(reported.after)
+		event.Diff = Diff(event.Before, event.After)
+	}
+
+	Record(&event)
+}
+
+// Record appends an event to the audit log. A failed write is logged and does not fail
+// the request that caused it.
+func Record(event *models.AuditEvent) {
+	if err := database.DB.Create(event).Error; err != nil {
+		log.Printf("Failed to record audit event %s: %v", event.Action, err)
+	}
+}
+
+// Diff returns the fields that differ between the before and after state of a target,
+// or nil unless both are known
+func Diff(before, after map[string]interface{}) map[string]models.AuditFieldChange {
+	if before == nil || after == nil {
+		return nil
+	}
+
+	diff := make(map[string]models.AuditFieldChange)
+	for field, value := range after {
+		if !ignoredFields[field] && !reflect.DeepEqual(before[field], value) {
+			diff[field] = models.AuditFieldChange{Before: before[field], After: value}
+		}
+	}
+	for field, value := range before {
+		if _, ok := after[field]; !ok && !ignoredFields[field] {
+			diff[field] = models.AuditFieldChange{Before: value}
+		}
+	}
+	return diff
+}
+
+// toMap converts a target to its JSON fields, so fields hidden from the API such as
+// password hashes stay out of the audit log too, as do session tokens. Values that are not JSON objects are
+// kept under "value".
+func toMap(target interface{}) map[string]interface{} {
+	if target == nil || (reflect.ValueOf(target).Kind() == reflect.Ptr && reflect.ValueOf(target).IsNil()) {
+		return nil
+	}
+
+	data, err := json.Marshal(target)
+	if err != nil {
+		log.Printf("Failed to encode audit target: %v", err)
+		return nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		var value interface{}
+		json.Unmarshal(data, &value)
+		return map[string]interface{}{"value": value}
+	}
+	for field := range secretFields {
+		delete(fields, field)
+	}
+	return fields
+}
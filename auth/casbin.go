@@ -1,103 +1,192 @@
 package auth
 
 import (
+	"fmt"
 	"log"
 	"tsimserver/config"
 	"tsimserver/database"
 	"tsimserver/models"
 
 	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/util"
 	gormadapter "github.com/casbin/gorm-adapter/v3"
+	"gorm.io/gorm"
 )
 
-var Enforcer *casbin.Enforcer
+// allDomains is the domain of role assignments that are not limited to a site or device group
+const allDomains = "*"
 
-// InitCasbin initializes Casbin enforcer
+// Enforcer holds the policies of the casbin_rule table, rewritten from the roles,
+// permissions and role assignments tables by UpdatePolicies
+var Enforcer *casbin.SyncedEnforcer
+
+// InitCasbin initializes Casbin enforcer. Redis must be connected for the policy watcher.
 func InitCasbin() error {
-	// Initialize Gorm adapter
-	adapter, err := gormadapter.NewAdapterByDB(database.DB)
-	if err != nil {
+	if err := InitEnforcer(config.AppConfig.Casbin.ModelPath); err != nil {
 		return err
 	}
 
-	// Create enforcer
-	Enforcer, err = casbin.NewEnforcer(config.AppConfig.Casbin.ModelPath, adapter)
+	// Reload policies when another server instance changes them
+	watcher = NewRedisWatcher()
+	if err := Enforcer.SetWatcher(watcher); err != nil {
+		return err
+	}
+	watcher.SetUpdateCallback(func(string) {
+		if err := Enforcer.LoadPolicy(); err != nil {
+			log.Printf("Failed to reload Casbin policies: %v", err)
+		}
+	})
+
+	// Rebuild policies from roles and role assignments, which are the source of truth
+	if err := SyncPoliciesFromDatabase(); err != nil {
+		return err
+	}
+
+	log.Println("Casbin enforcer initialized successfully")
+	return nil
+}
+
+// InitEnforcer creates the enforcer on the casbin_rule table without the policy watcher, for
+// a single instance such as tools and tests
+func InitEnforcer(modelPath string) error {
+	adapter, err := gormadapter.NewAdapterByDB(database.DB)
 	if err != nil {
 		return err
 	}
 
-	// Load policies from database
-	err = Enforcer.LoadPolicy()
+	Enforcer, err = casbin.NewSyncedEnforcer(modelPath, adapter)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Casbin enforcer initialized successfully")
+	// Role assignments in the "*" domain apply to every site and device group
+	Enforcer.AddNamedDomainMatchingFunc("g", "KeyMatch", util.KeyMatch)
 	return nil
 }
 
-// CheckPermission checks if user has permission for resource and action
+// CheckPermission checks if user has permission for resource and action in at least
+// one site or device group
 func CheckPermission(userID uint, resource, action string) (bool, error) {
-	// Get user roles
-	var userRoles []models.UserRole
-	if err := database.DB.Preload("Role").Where("user_id = ?", userID).Find(&userRoles).Error; err != nil {
+	scope, err := PermissionScope(userID, resource, action)
+	if err != nil {
 		return false, err
 	}
+	return !scope.Empty(), nil
+}
 
-	// Check permission for each role
-	for _, userRole := range userRoles {
-		if userRole.Role != nil && userRole.Role.IsActive {
-			allowed, err := Enforcer.Enforce(userRole.Role.Name, resource, action)
-			if err != nil {
-				return false, err
+// PermissionScope returns the sites and device groups where a user has permission for
+// resource and action
+func PermissionScope(userID uint, resource, action string) (Scope, error) {
+	var scope Scope
+
+	// Get the domains of the user's role assignments
+	assignments, err := Enforcer.GetFilteredGroupingPolicy(0, userSubject(userID))
+	if err != nil {
+		return scope, err
+	}
+
+	// Check permission in the domain of each role assignment
+	for _, assignment := range assignments {
+		domain := assignment[2]
+		allowed, err := Enforcer.Enforce(userSubject(userID), domain, resource, action)
+		if err != nil {
+			return scope, err
+		}
+		if allowed {
+			scope.add(domain)
+		}
+	}
+
+	return scope, nil
+}
+
+// EffectivePermission is a permission a user holds through its roles, with where it holds it
+type EffectivePermission struct {
+	Resource string   `json:"resource"`
+	Action   string   `json:"action"`
+	Roles    []string `json:"roles"`
+	Scope    Scope    `json:"scope"`
+}
+
+// EffectivePermissions returns the permissions the enforcer grants a user
+func EffectivePermissions(userID uint) ([]EffectivePermission, error) {
+	assignments, err := Enforcer.GetFilteredGroupingPolicy(0, userSubject(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	var permissions []EffectivePermission
+	index := make(map[string]int)
+	for _, assignment := range assignments {
+		role, domain := assignment[1], assignment[2]
+		policies, err := Enforcer.GetFilteredPolicy(0, role)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, policy := range policies {
+			key := policy[1] + ":" + policy[2]
+			i, ok := index[key]
+			if !ok {
+				i = len(permissions)
+				index[key] = i
+				permissions = append(permissions, EffectivePermission{Resource: policy[1], Action: policy[2]})
 			}
-			if allowed {
-				return true, nil
+			if !containsString(permissions[i].Roles, role) {
+				permissions[i].Roles = append(permissions[i].Roles, role)
 			}
+			permissions[i].Scope.add(domain)
 		}
 	}
 
-	return false, nil
+	return permissions, nil
 }
 
-// AddRoleForUser assigns a role to user
-func AddRoleForUser(userID uint, roleID uint) error {
+// AddRoleForUser assigns a role to user, limited to a site or device group when
+// siteID or deviceGroupID is set
+func AddRoleForUser(userID uint, roleID uint, siteID, deviceGroupID *uint) error {
 	// Check if role assignment already exists
+	query := database.DB.Where("user_id = ? AND role_id = ?", userID, roleID)
+	if siteID != nil {
+		query = query.Where("site_id = ?", *siteID)
+	} else {
+		query = query.Where("site_id IS NULL")
+	}
+	if deviceGroupID != nil {
+		query = query.Where("device_group_id = ?", *deviceGroupID)
+	} else {
+		query = query.Where("device_group_id IS NULL")
+	}
 	var existingRole models.UserRole
-	result := database.DB.Where("user_id = ? AND role_id = ?", userID, roleID).First(&existingRole)
-	if result.Error == nil {
+	if query.First(&existingRole).Error == nil {
 		return nil // Already exists
 	}
 
 	// Create new role assignment
 	userRole := models.UserRole{
-		UserID: userID,
-		RoleID: roleID,
-	}
-
-	if err := database.DB.Create(&userRole).Error; err != nil {
-		return err
+		UserID:        userID,
+		RoleID:        roleID,
+		SiteID:        siteID,
+		DeviceGroupID: deviceGroupID,
 	}
 
-	// Update Casbin policies
-	return Enforcer.LoadPolicy()
+	return UpdatePolicies(func(tx *gorm.DB) error {
+		return tx.Create(&userRole).Error
+	})
 }
 
-// RemoveRoleForUser removes a role from user
+// RemoveRoleForUser removes a role from user in every site and device group
 func RemoveRoleForUser(userID uint, roleID uint) error {
-	// Remove role assignment
-	if err := database.DB.Where("user_id = ? AND role_id = ?", userID, roleID).Delete(&models.UserRole{}).Error; err != nil {
-		return err
-	}
-
-	// Update Casbin policies
-	return Enforcer.LoadPolicy()
+	return UpdatePolicies(func(tx *gorm.DB) error {
+		return tx.Where("user_id = ? AND role_id = ?", userID, roleID).Delete(&models.UserRole{}).Error
+	})
 }
 
 // GetUserRoles returns all roles for a user
 func GetUserRoles(userID uint) ([]models.Role, error) {
 	var roles []models.Role
 	err := database.DB.Table("roles").
+		Distinct("roles.*").
 		Joins("JOIN user_roles ON roles.id = user_roles.role_id").
 		Where("user_roles.user_id = ? AND roles.is_active = ?", userID, true).
 		Find(&roles).Error
@@ -118,26 +207,110 @@ func GetRolePermissions(roleID uint) ([]models.Permission, error) {
 
 // SyncPoliciesFromDatabase syncs Casbin policies with database
 func SyncPoliciesFromDatabase() error {
-	// Clear existing policies
-	Enforcer.ClearPolicy()
+	return UpdatePolicies(func(tx *gorm.DB) error {
+		return nil
+	})
+}
 
-	// Load role permissions from database
-	var rolePermissions []models.RolePermission
-	err := database.DB.Preload("Role").Preload("Permission").Find(&rolePermissions).Error
+// UpdatePolicies applies a change to roles, permissions or role assignments and rewrites
+// the casbin_rule table from them in the same transaction. The enforcer of this and every
+// other server instance then reloads the policies.
+func UpdatePolicies(change func(tx *gorm.DB) error) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := change(tx); err != nil {
+			return err
+		}
+
+		// Serialize rewrites from concurrent requests and server instances. SQLite, used
+		// in tests, only ever has one writer.
+		if tx.Dialector.Name() == "postgres" {
+			if err := tx.Exec("LOCK TABLE casbin_rule IN EXCLUSIVE MODE").Error; err != nil {
+				return err
+			}
+		}
+
+		rules, err := buildRules(tx)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("1 = 1").Delete(&gormadapter.CasbinRule{}).Error; err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			return nil
+		}
+		return tx.Create(&rules).Error
+	})
 	if err != nil {
 		return err
 	}
 
-	// Add policies to Casbin
+	if err := Enforcer.LoadPolicy(); err != nil {
+		return err
+	}
+	notifyPolicyChange()
+	return nil
+}
+
+// buildRules returns the Casbin rules of the active roles: a p rule per permission and a g rule
+// per role assignment, in the domain it is limited to
+func buildRules(tx *gorm.DB) ([]gormadapter.CasbinRule, error) {
+	var rules []gormadapter.CasbinRule
+	seen := make(map[gormadapter.CasbinRule]bool)
+	add := func(rule gormadapter.CasbinRule) {
+		if !seen[rule] {
+			seen[rule] = true
+			rules = append(rules, rule)
+		}
+	}
+
+	// Load role permissions from database
+	var rolePermissions []models.RolePermission
+	if err := tx.Preload("Role").Preload("Permission").Find(&rolePermissions).Error; err != nil {
+		return nil, err
+	}
 	for _, rp := range rolePermissions {
 		if rp.Role != nil && rp.Permission != nil && rp.Role.IsActive && rp.Permission.IsActive {
-			_, err := Enforcer.AddPolicy(rp.Role.Name, rp.Permission.Resource, rp.Permission.Action)
-			if err != nil {
-				log.Printf("Error adding policy: %v", err)
-			}
+			add(gormadapter.CasbinRule{Ptype: "p", V0: rp.Role.Name, V1: rp.Permission.Resource, V2: rp.Permission.Action})
+		}
+	}
+
+	// Load role assignments from database
+	var userRoles []models.UserRole
+	if err := tx.Preload("Role").Find(&userRoles).Error; err != nil {
+		return nil, err
+	}
+	for _, ur := range userRoles {
+		if ur.Role != nil && ur.Role.IsActive {
+			add(gormadapter.CasbinRule{Ptype: "g", V0: userSubject(ur.UserID), V1: ur.Role.Name, V2: roleDomain(ur)})
 		}
 	}
 
-	// Save policies
-	return Enforcer.SavePolicy()
+	return rules, nil
+}
+
+// userSubject is the Casbin subject of a user
+func userSubject(userID uint) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// roleDomain is the Casbin domain a role assignment is limited to
+func roleDomain(userRole models.UserRole) string {
+	switch {
+	case userRole.DeviceGroupID != nil:
+		return fmt.Sprintf("group:%d", *userRole.DeviceGroupID)
+	case userRole.SiteID != nil:
+		return fmt.Sprintf("site:%d", *userRole.SiteID)
+	}
+	return allDomains
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
 }
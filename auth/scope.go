@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"strconv"
+	"strings"
+	"tsimserver/database"
+	"tsimserver/models"
+
+	"gorm.io/gorm"
+)
+
+// scopedGroups matches devices whose device group is in the scope, directly or through its site
+const scopedGroups = "devices.device_group_id IN ? OR devices.device_group_id IN (SELECT id FROM device_groups WHERE site_id IN ?)"
+
+// deviceResources are the resources whose permissions can be limited to sites and device
+// groups. Handlers of these resources act only on devices in the scope; every other
+// resource, such as users, roles or api_keys, needs the permission for all domains.
+var deviceResources = map[string]bool{
+	"alarms":  true,
+	"calls":   true,
+	"devices": true,
+	"sms":     true,
+	"ussd":    true,
+}
+
+// DeviceScoped reports whether permissions for a resource can be limited to sites and
+// device groups
+func DeviceScoped(resource string) bool {
+	return deviceResources[resource]
+}
+
+// Scope lists the sites and device groups where a user holds a permission
+type Scope struct {
+	All            bool   `json:"all"` // every site and device group
+	SiteIDs        []uint `json:"site_ids"`
+	DeviceGroupIDs []uint `json:"device_group_ids"`
+}
+
+// Empty reports whether the scope grants nothing
+func (s Scope) Empty() bool {
+	return !s.All && len(s.SiteIDs) == 0 && len(s.DeviceGroupIDs) == 0
+}
+
+// add extends the scope with a Casbin domain: "*", "site:<id>" or "group:<id>"
+func (s *Scope) add(domain string) {
+	if domain == allDomains {
+		s.All = true
+		return
+	}
+
+	kind, idStr, _ := strings.Cut(domain, ":")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return
+	}
+	switch kind {
+	case "site":
+		if !containsID(s.SiteIDs, uint(id)) {
+			s.SiteIDs = append(s.SiteIDs, uint(id))
+		}
+	case "group":
+		if !containsID(s.DeviceGroupIDs, uint(id)) {
+			s.DeviceGroupIDs = append(s.DeviceGroupIDs, uint(id))
+		}
+	}
+}
+
+// Covers reports whether the scope includes a role assignment's domain: every site and
+// device group when both IDs are nil, or the site or device group
+func (s Scope) Covers(siteID, deviceGroupID *uint) bool {
+	switch {
+	case s.All:
+		return true
+	case deviceGroupID != nil:
+		return s.AllowsDeviceGroup(*deviceGroupID)
+	case siteID != nil:
+		return containsID(s.SiteIDs, *siteID)
+	}
+	return false
+}
+
+// Intersect returns the sites and device groups in both scopes. A device group is in both
+// when each scope holds it directly or through its site.
+func (s Scope) Intersect(other Scope) Scope {
+	switch {
+	case s.All:
+		return other
+	case other.All:
+		return s
+	}
+
+	var both Scope
+	for _, siteID := range s.SiteIDs {
+		if containsID(other.SiteIDs, siteID) {
+			both.SiteIDs = append(both.SiteIDs, siteID)
+		}
+	}
+	for _, groupID := range s.DeviceGroupIDs {
+		if other.AllowsDeviceGroup(groupID) {
+			both.DeviceGroupIDs = append(both.DeviceGroupIDs, groupID)
+		}
+	}
+	for _, groupID := range other.DeviceGroupIDs {
+		if !containsID(both.DeviceGroupIDs, groupID) && s.AllowsDeviceGroup(groupID) {
+			both.DeviceGroupIDs = append(both.DeviceGroupIDs, groupID)
+		}
+	}
+	return both
+}
+
+// AllowsDevice reports whether a device is in the scope, checking its device group and site
+func (s Scope) AllowsDevice(deviceID string) bool {
+	if s.All {
+		return true
+	}
+
+	var device models.Device
+	if err := database.DB.Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return false
+	}
+	if device.DeviceGroupID == nil {
+		return false
+	}
+	return s.AllowsDeviceGroup(*device.DeviceGroupID)
+}
+
+// AllowsDeviceGroup reports whether a device group is in the scope, directly or through its site
+func (s Scope) AllowsDeviceGroup(deviceGroupID uint) bool {
+	if s.All || containsID(s.DeviceGroupIDs, deviceGroupID) {
+		return true
+	}
+	if len(s.SiteIDs) == 0 {
+		return false
+	}
+
+	var group models.DeviceGroup
+	if err := database.DB.Where("id = ?", deviceGroupID).First(&group).Error; err != nil {
+		return false
+	}
+	return containsID(s.SiteIDs, group.SiteID)
+}
+
+// ScopeDevices limits a query on the devices table to the devices in the scope
+func (s Scope) ScopeDevices(query *gorm.DB) *gorm.DB {
+	if s.All {
+		return query
+	}
+	return query.Where("("+scopedGroups+")", idsOrNone(s.DeviceGroupIDs), idsOrNone(s.SiteIDs))
+}
+
+// ScopeDeviceRecords limits a query on a table with a device_id column, such as
+// sms_messages or alarms, to records of devices in the scope
+func (s Scope) ScopeDeviceRecords(query *gorm.DB, table string) *gorm.DB {
+	if s.All {
+		return query
+	}
+	return query.Where(table+".device_id IN (SELECT devices.device_id FROM devices WHERE "+scopedGroups+")",
+		idsOrNone(s.DeviceGroupIDs), idsOrNone(s.SiteIDs))
+}
+
+// idsOrNone returns ids, or an ID no record has so IN never matches an empty list
+func idsOrNone(ids []uint) []uint {
+	if len(ids) == 0 {
+		return []uint{0}
+	}
+	return ids
+}
+
+// containsID reports whether ids contains id
+func containsID(ids []uint, id uint) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/testutil"
+)
+
+func TestScopeIntersect(t *testing.T) {
+	testutil.LoadConfig(t)
+	testutil.OpenDatabase(t, &models.Site{}, &models.DeviceGroup{})
+
+	// Two sites with two device groups each
+	var sites []uint
+	var groups [][]uint
+	for _, name := range []string{"first", "second"} {
+		site := models.Site{Name: name, Country: "TR", PhoneCode: "+90"}
+		if err := database.DB.Create(&site).Error; err != nil {
+			t.Fatalf("creating site: %v", err)
+		}
+		var ids []uint
+		for _, suffix := range []string{"-a", "-b"} {
+			group := models.DeviceGroup{SiteID: site.ID, Name: name + suffix}
+			if err := database.DB.Create(&group).Error; err != nil {
+				t.Fatalf("creating device group: %v", err)
+			}
+			ids = append(ids, group.ID)
+		}
+		sites = append(sites, site.ID)
+		groups = append(groups, ids)
+	}
+	first, second := sites[0], sites[1]
+
+	tests := []struct {
+		name string
+		a, b Scope
+		want Scope
+	}{
+		{"all", Scope{All: true}, Scope{SiteIDs: []uint{first}}, Scope{SiteIDs: []uint{first}}},
+		{"sites", Scope{SiteIDs: []uint{first, second}}, Scope{SiteIDs: []uint{second}}, Scope{SiteIDs: []uint{second}}},
+		{"group on site", Scope{SiteIDs: []uint{first}}, Scope{DeviceGroupIDs: []uint{groups[0][1], groups[1][0]}},
+			Scope{DeviceGroupIDs: []uint{groups[0][1]}}},
+		{"site of group", Scope{DeviceGroupIDs: []uint{groups[1][0]}}, Scope{SiteIDs: []uint{second}},
+			Scope{DeviceGroupIDs: []uint{groups[1][0]}}},
+		{"disjoint", Scope{SiteIDs: []uint{first}}, Scope{SiteIDs: []uint{second}}, Scope{}},
+	}
+	for _, tt := range tests {
+		got := tt.a.Intersect(tt.b)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %+v.Intersect(%+v) = %+v, want %+v", tt.name, tt.a, tt.b, got, tt.want)
+		}
+		if reverse := tt.b.Intersect(tt.a); !reflect.DeepEqual(reverse, tt.want) {
+			t.Errorf("%s: intersection is not symmetric, reversed = %+v", tt.name, reverse)
+		}
+	}
+}
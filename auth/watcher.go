@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"tsimserver/cache"
+)
+
+// policyChannel is the Redis channel server instances announce policy changes on
+const policyChannel = "tsimserver:casbin:policy"
+
+// watcher is the policy watcher of the enforcer
+var watcher *RedisWatcher
+
+// RedisWatcher tells other server instances to reload their Casbin policies over Redis
+// pub/sub. Messages carry the ID of the sending instance so it skips its own.
+type RedisWatcher struct {
+	instanceID string
+	callback   func(string)
+	cancel     context.CancelFunc
+}
+
+// NewRedisWatcher creates a watcher and starts listening for policy changes
+func NewRedisWatcher() *RedisWatcher {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &RedisWatcher{
+		instanceID: hex.EncodeToString(buf),
+		cancel:     cancel,
+	}
+	go w.listen(ctx)
+	return w
+}
+
+// SetUpdateCallback sets the function called when another instance changed the policies
+func (w *RedisWatcher) SetUpdateCallback(callback func(string)) error {
+	w.callback = callback
+	return nil
+}
+
+// Update announces a policy change to the other instances
+func (w *RedisWatcher) Update() error {
+	return cache.RedisClient.Publish(context.Background(), policyChannel, w.instanceID).Err()
+}
+
+// Close stops listening for policy changes
+func (w *RedisWatcher) Close() {
+	w.cancel()
+}
+
+// listen reloads policies on changes announced by other instances
+func (w *RedisWatcher) listen(ctx context.Context) {
+	pubsub := cache.RedisClient.Subscribe(ctx, policyChannel)
+	defer pubsub.Close()
+
+	for message := range pubsub.Channel() {
+		if message.Payload == w.instanceID || w.callback == nil {
+			continue
+		}
+		log.Printf("Reloading Casbin policies changed by instance %s", message.Payload)
+		w.callback(message.Payload)
+	}
+}
+
+// notifyPolicyChange tells other instances to reload after this one rewrote the policies.
+// A failed announcement is logged, the change itself is already committed.
+func notifyPolicyChange() {
+	if watcher == nil {
+		return
+	}
+	if err := watcher.Update(); err != nil {
+		log.Printf("Failed to announce Casbin policy change: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package authaudit
+
+import (
+	"log"
+	"tsimserver/database"
+	"tsimserver/models"
+)
+
+// Events of the authentication audit trail
+const (
+	EventLoginSuccess       = "login_success"
+	EventLoginFailure       = "login_failure"
+	EventLoginBlocked       = "login_blocked" // attempt refused by a lockout or wait
+	EventAccountLocked      = "account_locked"
+	EventIPLocked           = "ip_locked"
+	EventAccountUnlocked    = "account_unlocked"
+	EventIPUnlocked         = "ip_unlocked"
+	EventLogout             = "logout"
+	EventRegister           = "register"
+	EventRegisterRejected   = "register_rejected"
+	EventMFAFailure         = "mfa_failure"
+	EventMFAEnabled         = "mfa_enabled"
+	EventMFADisabled        = "mfa_disabled"
+	EventMFAReset           = "mfa_reset"
+	EventRecoveryCodes      = "mfa_recovery_codes_regenerated"
+	EventSSOLogin           = "sso_login"
+	EventSSOFailure         = "sso_failure"
+	EventPasswordChanged    = "password_changed"
+	EventPasswordResetSent  = "password_reset_requested"
+	EventPasswordReset      = "password_reset"
+	EventTenantSwitched     = "tenant_switched"
+	EventSessionRevoked     = "session_revoked"
+	EventRefreshTokenReused = "refresh_token_reused" // a rotated refresh token was replayed, its family is revoked
+	EventInvitationCreated  = "invitation_created"
+	EventInvitationRevoked  = "invitation_revoked"
+)
+
+// Record appends an event to the audit trail. A failed write is logged and does not fail
+// the request that caused it.
+func Record(event *models.AuthEvent) {
+	if err := database.DB.Create(event).Error; err != nil {
+		log.Printf("Failed to record auth event %s: %v", event.Event, err)
+	}
+}
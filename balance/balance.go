@@ -0,0 +1,326 @@
+package balance
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"tsimserver/alarms"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/dispatch"
+	"tsimserver/models"
+	"tsimserver/types"
+
+	"gorm.io/gorm"
+)
+
+// Check states
+const (
+	StatusPending   = "pending"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusTimeout   = "timeout"
+)
+
+// Alarm types raised by balance monitoring
+const (
+	AlarmLowBalance  = "low_balance"
+	AlarmCheckFailed = "balance_check_failed"
+)
+
+// ErrNoUSSDCode is returned when neither the request nor the operator configuration provides a code
+var ErrNoUSSDCode = errors.New("no balance USSD code configured for this SIM's operator")
+
+// OperatorConfig returns the active balance configuration matching a SIM card.
+// A network (MCC/MNC) match wins over an operator name match.
+func OperatorConfig(sim *models.SIMCard) (*models.OperatorBalanceConfig, error) {
+	var cfg models.OperatorBalanceConfig
+	result := database.DB.
+		Where("is_active = ?", true).
+		Where("(mcc <> '' AND mcc = ? AND mnc = ?) OR (mcc = '' AND LOWER(operator) = LOWER(?))", sim.MCC, sim.MNC, sim.Operator).
+		Order("mcc DESC").Limit(1).Find(&cfg)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &cfg, nil
+}
+
+// Check sends a balance query for a SIM card. ussdCode overrides the operator code when set.
+func Check(sim *models.SIMCard, ussdCode string, scheduled bool) (*models.SIMBalanceCheck, error) {
+	if ussdCode == "" {
+		cfg, err := OperatorConfig(sim)
+		if err != nil {
+			return nil, err
+		}
+		if cfg == nil || cfg.USSDCode == "" {
+			return nil, ErrNoUSSDCode
+		}
+		ussdCode = cfg.USSDCode
+	}
+
+	slot, _ := strconv.Atoi(sim.Identifier)
+	check := models.SIMBalanceCheck{
+		SIMCardID: sim.ID,
+		DeviceID:  sim.DeviceID,
+		SimSlot:   slot,
+		USSDCode:  ussdCode,
+		Status:    StatusPending,
+		Scheduled: scheduled,
+	}
+	if err := database.DB.Create(&check).Error; err != nil {
+		return nil, err
+	}
+
+	// The check ID doubles as the internal log ID so results map back without collisions
+	command := types.CheckBalanceCommand{
+		Type:          "check_balance",
+		SimSlot:       slot,
+		USSDCode:      ussdCode,
+		InternalLogID: int(check.ID),
+	}
+	if err := dispatch.ToDevice(sim.DeviceID, command); err != nil {
+		recordFailure(&check, StatusFailed, err.Error())
+		return &check, err
+	}
+
+	return &check, nil
+}
+
+// ApplyResult parses a balance_result message and updates the SIM balance
+func ApplyResult(deviceID string, result types.BalanceResult) error {
+	var check models.SIMBalanceCheck
+	if err := database.DB.Where("id = ? AND device_id = ?", result.InternalLogID, deviceID).First(&check).Error; err != nil {
+		return fmt.Errorf("balance check %d not found for device %s", result.InternalLogID, deviceID)
+	}
+
+	// Late results after a timeout are ignored
+	if check.Status != StatusPending {
+		return nil
+	}
+
+	check.RawResponse = result.Result
+	if !result.Success {
+		return recordFailure(&check, StatusFailed, result.ErrorMessage)
+	}
+
+	var sim models.SIMCard
+	if err := database.DB.Unscoped().Where("id = ?", check.SIMCardID).First(&sim).Error; err != nil {
+		return err
+	}
+
+	cfg, err := OperatorConfig(&sim)
+	if err != nil {
+		return err
+	}
+	if cfg == nil || cfg.Pattern == "" {
+		return recordFailure(&check, StatusFailed, "no balance parser configured for this SIM's operator")
+	}
+
+	parsed, err := Parse(cfg, result.Result)
+	if err != nil {
+		return recordFailure(&check, StatusFailed, err.Error())
+	}
+
+	now := time.Now()
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&check).Updates(map[string]interface{}{
+			"status":       StatusCompleted,
+			"raw_response": result.Result,
+			"amount":       parsed.Amount,
+			"currency":     parsed.Currency,
+			"completed_at": now,
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&sim).Updates(map[string]interface{}{
+			"balance":            parsed.Amount,
+			"balance_currency":   parsed.Currency,
+			"balance_checked_at": now,
+			"balance_failures":   0,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := alarms.Resolve(deviceID, AlarmCheckFailed); err != nil {
+		log.Printf("Failed to resolve balance check alarm for device %s: %v", deviceID, err)
+	}
+
+	evaluateLowBalance(&sim, parsed, threshold(cfg))
+	return nil
+}
+
+// StartScheduler starts the background job that queries SIM balances periodically
+func StartScheduler() {
+	interval := time.Duration(config.AppConfig.Balance.SchedulerInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			expireChecks(now)
+			scheduleChecks(now)
+		}
+	}()
+
+	log.Printf("Balance scheduler started (interval %s)", interval)
+}
+
+// scheduleChecks queries active SIMs of online devices whose balance is due
+func scheduleChecks(now time.Time) {
+	var sims []models.SIMCard
+	if err := database.DB.
+		Joins("JOIN devices ON devices.device_id = sim_cards.device_id AND devices.deleted_at IS NULL").
+		Where("sim_cards.is_active = ? AND sim_cards.is_enabled = ?", true, true).
+		Where("devices.operator_status = ? AND devices.is_active = ?", "online", true).
+		Find(&sims).Error; err != nil {
+		log.Printf("Failed to load SIM cards for balance checks: %v", err)
+		return
+	}
+
+	for i := range sims {
+		sim := &sims[i]
+
+		cfg, err := OperatorConfig(sim)
+		if err != nil || cfg == nil || cfg.USSDCode == "" {
+			continue
+		}
+		if !isDue(sim, cfg, now) {
+			continue
+		}
+
+		if _, err := Check(sim, cfg.USSDCode, true); err != nil {
+			log.Printf("Failed to schedule balance check for SIM %d: %v", sim.ID, err)
+		}
+	}
+}
+
+// isDue reports whether a SIM needs a new balance check
+func isDue(sim *models.SIMCard, cfg *models.OperatorBalanceConfig, now time.Time) bool {
+	minutes := cfg.CheckInterval
+	if minutes <= 0 {
+		minutes = config.AppConfig.Balance.CheckInterval
+	}
+	if minutes <= 0 {
+		return false
+	}
+
+	// The latest attempt counts, so failing SIMs are retried on the same cadence
+	var last models.SIMBalanceCheck
+	result := database.DB.Where("sim_card_id = ?", sim.ID).Order("created_at DESC").Limit(1).Find(&last)
+	if result.Error != nil {
+		return false
+	}
+	if result.RowsAffected == 0 {
+		return true
+	}
+	if last.Status == StatusPending {
+		return false
+	}
+	return now.Sub(last.CreatedAt) >= time.Duration(minutes)*time.Minute
+}
+
+// expireChecks fails checks the device never answered
+func expireChecks(now time.Time) {
+	timeout := time.Duration(config.AppConfig.Balance.CheckTimeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+
+	var checks []models.SIMBalanceCheck
+	if err := database.DB.Where("status = ? AND created_at < ?", StatusPending, now.Add(-timeout)).
+		Find(&checks).Error; err != nil {
+		log.Printf("Failed to load stale balance checks: %v", err)
+		return
+	}
+
+	for i := range checks {
+		if err := recordFailure(&checks[i], StatusTimeout, "device did not answer in time"); err != nil {
+			log.Printf("Failed to expire balance check %d: %v", checks[i].ID, err)
+		}
+	}
+}
+
+// recordFailure closes a check as failed and raises an alarm after repeated failures
+func recordFailure(check *models.SIMBalanceCheck, status, message string) error {
+	now := time.Now()
+	check.Status = status
+	check.ErrorMessage = message
+	check.CompletedAt = &now
+
+	if err := database.DB.Model(check).Updates(map[string]interface{}{
+		"status":        status,
+		"raw_response":  check.RawResponse,
+		"error_message": message,
+		"completed_at":  now,
+	}).Error; err != nil {
+		return err
+	}
+
+	if err := database.DB.Unscoped().Model(&models.SIMCard{}).Where("id = ?", check.SIMCardID).
+		Update("balance_failures", gorm.Expr("balance_failures + 1")).Error; err != nil {
+		return err
+	}
+
+	var sim models.SIMCard
+	if err := database.DB.Unscoped().Where("id = ?", check.SIMCardID).First(&sim).Error; err != nil {
+		return err
+	}
+
+	limit := config.AppConfig.Balance.FailureAlarmAfter
+	if limit > 0 && sim.BalanceFailures >= limit {
+		alarmMessage := fmt.Sprintf("Balance check of SIM in slot %s failed %d times in a row: %s",
+			sim.Identifier, sim.BalanceFailures, message)
+		if _, _, err := alarms.RaiseOnce(sim.DeviceID, AlarmCheckFailed, "Balance check failing", alarmMessage, "medium"); err != nil {
+			log.Printf("Failed to raise balance check alarm for device %s: %v", sim.DeviceID, err)
+		}
+	}
+	return nil
+}
+
+// evaluateLowBalance raises or resolves the low balance alarm of the SIM's device
+func evaluateLowBalance(sim *models.SIMCard, parsed *Result, limit float64) {
+	if limit <= 0 {
+		return
+	}
+
+	if parsed.Amount < limit {
+		message := fmt.Sprintf("Balance of SIM in slot %s is %.2f %s, below %.2f",
+			sim.Identifier, parsed.Amount, strings.TrimSpace(parsed.Currency), limit)
+		if _, _, err := alarms.RaiseOnce(sim.DeviceID, AlarmLowBalance, "Low SIM balance", message, "high"); err != nil {
+			log.Printf("Failed to raise low balance alarm for device %s: %v", sim.DeviceID, err)
+		}
+		return
+	}
+
+	// Other SIMs of the device may still be low
+	var low int64
+	database.DB.Model(&models.SIMCard{}).
+		Where("device_id = ? AND id <> ? AND balance IS NOT NULL AND balance < ?", sim.DeviceID, sim.ID, limit).
+		Count(&low)
+	if low == 0 {
+		if err := alarms.Resolve(sim.DeviceID, AlarmLowBalance); err != nil {
+			log.Printf("Failed to resolve low balance alarm for device %s: %v", sim.DeviceID, err)
+		}
+	}
+}
+
+// threshold returns the low balance threshold for an operator
+func threshold(cfg *models.OperatorBalanceConfig) float64 {
+	if cfg != nil && cfg.LowBalanceThreshold > 0 {
+		return cfg.LowBalanceThreshold
+	}
+	return config.AppConfig.Balance.LowBalanceThreshold
+}
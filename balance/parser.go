@@ -0,0 +1,143 @@
+package balance
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"tsimserver/models"
+)
+
+// Parser types
+const (
+	ParserRegex    = "regex"
+	ParserTemplate = "template"
+)
+
+// Template placeholders and the expressions they expand to
+var templatePlaceholders = map[string]string{
+	"{amount}":   `(?P<amount>-?[0-9][0-9.,]*)`,
+	"{currency}": `(?P<currency>[\p{L}\p{Sc}]+)`,
+	"{*}":        `.*?`,
+}
+
+var placeholderPattern = regexp.MustCompile(`\{amount\}|\{currency\}|\{\*\}`)
+
+// Result is the amount and currency parsed from a balance response
+type Result struct {
+	Amount   float64
+	Currency string
+}
+
+// Compile turns an operator parser definition into a regular expression with an amount group
+func Compile(parserType, pattern string) (*regexp.Regexp, error) {
+	var expr string
+	switch parserType {
+	case ParserRegex:
+		expr = pattern
+	case ParserTemplate:
+		expr = templateToRegex(pattern)
+	default:
+		return nil, fmt.Errorf("unknown parser type %q", parserType)
+	}
+
+	re, err := regexp.Compile("(?is)" + expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	if re.SubexpIndex("amount") < 0 {
+		return nil, errors.New("pattern must capture an amount")
+	}
+	return re, nil
+}
+
+// Parse extracts the balance from a USSD response using the operator configuration
+func Parse(cfg *models.OperatorBalanceConfig, response string) (*Result, error) {
+	re, err := Compile(cfg.ParserType, cfg.Pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	match := re.FindStringSubmatch(response)
+	if match == nil {
+		return nil, errors.New("response does not match the balance pattern")
+	}
+
+	amount, err := ParseAmount(match[re.SubexpIndex("amount")])
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Amount: amount, Currency: cfg.Currency}
+	if i := re.SubexpIndex("currency"); i >= 0 && match[i] != "" {
+		result.Currency = match[i]
+	}
+	return result, nil
+}
+
+// ParseAmount reads amounts written as 1234.56, 1.234,56 or 1,234.56
+func ParseAmount(raw string) (float64, error) {
+	value := strings.Trim(strings.TrimSpace(raw), ".,")
+	lastDot := strings.LastIndex(value, ".")
+	lastComma := strings.LastIndex(value, ",")
+
+	switch {
+	case lastDot >= 0 && lastComma >= 0:
+		// The separator that comes last is the decimal one
+		if lastComma > lastDot {
+			value = strings.ReplaceAll(value, ".", "")
+			value = strings.Replace(value, ",", ".", 1)
+		} else {
+			value = strings.ReplaceAll(value, ",", "")
+		}
+	case lastComma >= 0:
+		// A single comma followed by one or two digits is a decimal comma
+		if strings.Count(value, ",") == 1 && len(value)-lastComma-1 <= 2 {
+			value = strings.Replace(value, ",", ".", 1)
+		} else {
+			value = strings.ReplaceAll(value, ",", "")
+		}
+	case lastDot >= 0:
+		// Repeated dots or a dot followed by three digits are thousands separators
+		if strings.Count(value, ".") > 1 || len(value)-lastDot-1 == 3 {
+			value = strings.ReplaceAll(value, ".", "")
+		}
+	}
+
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", raw)
+	}
+	return amount, nil
+}
+
+// templateToRegex quotes the literal parts of a template and expands its placeholders
+func templateToRegex(template string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range placeholderPattern.FindAllStringIndex(template, -1) {
+		b.WriteString(quoteLiteral(template[last:loc[0]]))
+		b.WriteString(templatePlaceholders[template[loc[0]:loc[1]]])
+		last = loc[1]
+	}
+	b.WriteString(quoteLiteral(template[last:]))
+	return b.String()
+}
+
+// quoteLiteral escapes template text and lets any whitespace run match any other
+func quoteLiteral(text string) string {
+	fields := strings.Fields(text)
+	for i, field := range fields {
+		fields[i] = regexp.QuoteMeta(field)
+	}
+
+	quoted := strings.Join(fields, `\s+`)
+	if len(text) > 0 && strings.TrimSpace(text[:1]) == "" {
+		quoted = `\s*` + quoted
+	}
+	if len(text) > 0 && strings.TrimSpace(text[len(text)-1:]) == "" && len(fields) > 0 {
+		quoted += `\s*`
+	}
+	return quoted
+}
@@ -92,6 +92,35 @@ func RemoveDeviceConnection(deviceID string) error {
 	return Delete(key)
 }
 
+// SetDeviceHeartbeat stores the time of the last heartbeat received from a device
+func SetDeviceHeartbeat(deviceID string, at time.Time, expiration time.Duration) error {
+	key := fmt.Sprintf("device:heartbeat:%s", deviceID)
+	return Set(key, at.Unix(), expiration)
+}
+
+// GetDeviceHeartbeat retrieves the time of the last heartbeat received from a device
+func GetDeviceHeartbeat(deviceID string) (time.Time, error) {
+	key := fmt.Sprintf("device:heartbeat:%s", deviceID)
+	unix, err := RedisClient.Get(ctx, key).Int64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unix, 0), nil
+}
+
+// IncrementAPIKeyRequests counts a request of an API key in the given minute window
+func IncrementAPIKeyRequests(keyID uint, window int64) (int64, error) {
+	key := fmt.Sprintf("api_key:rate:%d:%d", keyID, window)
+	count, err := RedisClient.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		RedisClient.Expire(ctx, key, 2*time.Minute)
+	}
+	return count, nil
+}
+
 // SetSession stores user session
 func SetSession(token string, userID uint, expiration time.Duration) error {
 	key := fmt.Sprintf("session:%s", token)
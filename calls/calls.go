@@ -0,0 +1,310 @@
+package calls
+
+import (
+	"errors"
+	"log"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/dispatch"
+	"tsimserver/models"
+	"tsimserver/siminventory"
+	"tsimserver/types"
+)
+
+// Call directions
+const (
+	DirectionIncoming = "incoming"
+	DirectionOutgoing = "outgoing"
+)
+
+// Call states
+const (
+	StatusPending   = "pending"
+	StatusDialing   = "dialing"
+	StatusRinging   = "ringing"
+	StatusAnswered  = "answered"
+	StatusCompleted = "completed"
+	StatusMissed    = "missed"
+	StatusRejected  = "rejected"
+	StatusBusy      = "busy"
+	StatusNoAnswer  = "no_answer"
+	StatusFailed    = "failed"
+)
+
+// Purposes of outbound calls
+const (
+	PurposeManual      = "manual"
+	PurposeFlashCall   = "flash_call"
+	PurposeBalanceLine = "balance_line"
+)
+
+var (
+	// ErrInvalidPurpose is returned for an unknown outbound call purpose
+	ErrInvalidPurpose = errors.New("purpose must be manual, flash_call or balance_line")
+	// ErrCallNotActive is returned when hanging up a call that already ended
+	ErrCallNotActive = errors.New("call is not in progress")
+)
+
+// Dial asks a device to call a number. maxDuration is capped by calls.max_duration;
+// zero uses the cap.
+func Dial(deviceID string, simSlot int, target, purpose string, maxDuration int, requestedBy uint) (*models.CallLog, error) {
+	if purpose == "" {
+		purpose = PurposeManual
+	}
+	if purpose != PurposeManual && purpose != PurposeFlashCall && purpose != PurposeBalanceLine {
+		return nil, ErrInvalidPurpose
+	}
+
+	limit := config.AppConfig.Calls.MaxDuration
+	if maxDuration <= 0 || (limit > 0 && maxDuration > limit) {
+		maxDuration = limit
+	}
+
+	call := models.CallLog{
+		DeviceID:    deviceID,
+		SIMCardID:   siminventory.SIMCardIDForSlot(deviceID, simSlot),
+		SimSlot:     simSlot,
+		Direction:   DirectionOutgoing,
+		Number:      target,
+		Status:      StatusPending,
+		Purpose:     purpose,
+		MaxDuration: maxDuration,
+		StartedAt:   time.Now(),
+	}
+	if requestedBy != 0 {
+		call.RequestedBy = &requestedBy
+	}
+	if err := database.DB.Create(&call).Error; err != nil {
+		return nil, err
+	}
+
+	// The call ID doubles as the internal log ID so status reports map back
+	command := types.MakeCallCommand{
+		Type:          "make_call",
+		Target:        target,
+		SimSlot:       simSlot,
+		MaxDuration:   maxDuration,
+		InternalLogID: int(call.ID),
+	}
+	if err := dispatch.ToDevice(deviceID, command); err != nil {
+		finish(&call, StatusFailed, 0, err.Error())
+		return &call, err
+	}
+
+	call.Status = StatusDialing
+	if err := database.DB.Model(&call).Update("status", StatusDialing).Error; err != nil {
+		return &call, err
+	}
+	return &call, nil
+}
+
+// Hangup asks the device to end a call it placed
+func Hangup(call *models.CallLog) error {
+	if call.Direction != DirectionOutgoing || !active(call.Status) {
+		return ErrCallNotActive
+	}
+
+	command := types.EndCallCommand{
+		Type:          "end_call",
+		InternalLogID: int(call.ID),
+	}
+	return dispatch.ToDevice(call.DeviceID, command)
+}
+
+// ApplyStatus records the progress of an outbound call reported by the device
+func ApplyStatus(deviceID string, status types.CallStatus) error {
+	var call models.CallLog
+	if err := database.DB.Where("id = ? AND device_id = ? AND direction = ?", status.InternalLogID, deviceID, DirectionOutgoing).
+		First(&call).Error; err != nil {
+		return err
+	}
+	if !active(call.Status) {
+		// Late reports after the call was closed are ignored
+		return nil
+	}
+
+	at := eventTime(status.Timestamp)
+	switch status.State {
+	case StatusDialing, StatusRinging:
+		return database.DB.Model(&call).Update("status", status.State).Error
+	case StatusAnswered:
+		return database.DB.Model(&call).Updates(map[string]interface{}{
+			"status":        StatusAnswered,
+			"answered_at":   at,
+			"ring_duration": int(at.Sub(call.StartedAt).Seconds()),
+		}).Error
+	case "ended":
+		final := StatusCompleted
+		if call.AnsweredAt == nil {
+			final = StatusNoAnswer
+		}
+		return finish(&call, final, status.Duration, "")
+	case StatusBusy:
+		return finish(&call, StatusBusy, 0, "")
+	case StatusFailed:
+		return finish(&call, StatusFailed, 0, status.ErrorMessage)
+	}
+
+	log.Printf("Unknown call state %q from device %s", status.State, deviceID)
+	return nil
+}
+
+// ApplyIncoming records an incoming call event
+func ApplyIncoming(deviceID string, event types.IncomingCall) error {
+	call, err := incomingCall(deviceID, event.CallID, event.From, event.SimSlot, event.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	at := eventTime(event.Timestamp)
+	switch event.State {
+	case StatusRinging:
+		return nil
+	case StatusAnswered:
+		return database.DB.Model(call).Updates(map[string]interface{}{
+			"status":        StatusAnswered,
+			"answered_at":   at,
+			"ring_duration": int(at.Sub(call.StartedAt).Seconds()),
+		}).Error
+	case "ended":
+		final := StatusCompleted
+		if call.AnsweredAt == nil {
+			final = StatusMissed
+		}
+		return finish(call, final, event.Duration, "")
+	case StatusRejected:
+		return finish(call, StatusRejected, 0, "")
+	}
+
+	log.Printf("Unknown incoming call state %q from device %s", event.State, deviceID)
+	return nil
+}
+
+// ApplyMissed records an incoming call that was not answered
+func ApplyMissed(deviceID string, event types.MissedCall) error {
+	call, err := incomingCall(deviceID, event.CallID, event.From, event.SimSlot, event.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return database.DB.Model(call).Updates(map[string]interface{}{
+		"status":        StatusMissed,
+		"ring_duration": event.RingDuration,
+		"ended_at":      now,
+	}).Error
+}
+
+// StartMonitor starts the background job that closes calls and verifications nobody reported back on
+func StartMonitor() {
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			expireCalls(now)
+			expireVerifications(now)
+		}
+	}()
+
+	log.Println("Call monitor started")
+}
+
+// expireCalls fails outbound calls that stopped reporting their status
+func expireCalls(now time.Time) {
+	timeout := time.Duration(config.AppConfig.Calls.StatusTimeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+
+	var stale []models.CallLog
+	if err := database.DB.Where("direction = ? AND status IN ?", DirectionOutgoing,
+		[]string{StatusPending, StatusDialing, StatusRinging, StatusAnswered}).
+		Find(&stale).Error; err != nil {
+		log.Printf("Failed to load stale calls: %v", err)
+		return
+	}
+
+	for i := range stale {
+		call := &stale[i]
+		// An answered call may run up to its maximum duration
+		deadline := call.StartedAt.Add(timeout + time.Duration(call.MaxDuration)*time.Second)
+		if now.Before(deadline) {
+			continue
+		}
+		if err := finish(call, StatusFailed, 0, "no call status from device"); err != nil {
+			log.Printf("Failed to expire call %d: %v", call.ID, err)
+		}
+	}
+}
+
+// incomingCall finds the call a device event belongs to or records a new one
+func incomingCall(deviceID, callID, from string, simSlot int, timestamp int64) (*models.CallLog, error) {
+	var call models.CallLog
+	if callID != "" {
+		result := database.DB.Where("device_id = ? AND device_call_id = ? AND direction = ?", deviceID, callID, DirectionIncoming).
+			Order("created_at DESC").Limit(1).Find(&call)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected > 0 {
+			return &call, nil
+		}
+	}
+
+	call = models.CallLog{
+		DeviceID:     deviceID,
+		SIMCardID:    siminventory.SIMCardIDForSlot(deviceID, simSlot),
+		SimSlot:      simSlot,
+		Direction:    DirectionIncoming,
+		Number:       from,
+		Status:       StatusRinging,
+		DeviceCallID: callID,
+		StartedAt:    eventTime(timestamp),
+	}
+	if err := database.DB.Create(&call).Error; err != nil {
+		return nil, err
+	}
+	return &call, nil
+}
+
+// finish closes a call
+func finish(call *models.CallLog, status string, duration int, message string) error {
+	now := time.Now()
+	call.Status = status
+	call.Duration = duration
+	call.ErrorMessage = message
+	call.EndedAt = &now
+
+	if err := database.DB.Model(call).Updates(map[string]interface{}{
+		"status":        status,
+		"duration":      duration,
+		"error_message": message,
+		"ended_at":      now,
+	}).Error; err != nil {
+		return err
+	}
+
+	if call.Purpose == PurposeFlashCall {
+		flashCallEnded(call)
+	}
+	return nil
+}
+
+// active reports whether a call has not ended yet
+func active(status string) bool {
+	switch status {
+	case StatusPending, StatusDialing, StatusRinging, StatusAnswered:
+		return true
+	}
+	return false
+}
+
+// eventTime converts a device timestamp, falling back to now
+func eventTime(timestamp int64) time.Time {
+	if timestamp <= 0 {
+		return time.Now()
+	}
+	return time.Unix(timestamp, 0)
+}
@@ -0,0 +1,210 @@
+package calls
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+
+	"gorm.io/gorm"
+)
+
+// Flash-call verification states
+const (
+	VerificationPending  = "pending"
+	VerificationVerified = "verified"
+	VerificationFailed   = "failed"
+	VerificationExpired  = "expired"
+)
+
+var (
+	// ErrNoCaller is returned when no SIM can place the flash call
+	ErrNoCaller = errors.New("no online SIM with a verified number is available to place the flash call")
+	// ErrVerificationClosed is returned when checking a code of a finished verification
+	ErrVerificationClosed = errors.New("verification is no longer pending")
+	// ErrWrongCode is returned when the code does not match the caller number
+	ErrWrongCode = errors.New("code does not match")
+)
+
+// StartFlashCall rings a number from one of our SIMs. The last digits of the calling
+// number are the code the owner of the number enters to prove it. A tenant context
+// limits the calling SIMs to the tenant's devices.
+func StartFlashCall(ctx context.Context, number string, requestedBy uint) (*models.FlashCallVerification, error) {
+	cfg := config.AppConfig.Calls
+	length := cfg.FlashCodeLength
+	if length <= 0 {
+		length = 4
+	}
+
+	number = strings.TrimSpace(number)
+	caller, err := pickCaller(ctx, number, length)
+	if err != nil {
+		return nil, err
+	}
+	if caller == nil {
+		return nil, ErrNoCaller
+	}
+
+	verification := models.FlashCallVerification{
+		Number:      number,
+		DeviceID:    caller.DeviceID,
+		SIMCardID:   caller.ID,
+		Code:        trailingDigits(caller.PhoneNumber, length),
+		CodeLength:  length,
+		Status:      VerificationPending,
+		MaxAttempts: cfg.FlashMaxAttempts,
+		ExpiresAt:   time.Now().Add(time.Duration(cfg.FlashTTL) * time.Second),
+	}
+	if requestedBy != 0 {
+		verification.RequestedBy = &requestedBy
+	}
+	if err := database.DB.Create(&verification).Error; err != nil {
+		return nil, err
+	}
+
+	slot, _ := strconv.Atoi(caller.Identifier)
+	call, err := Dial(caller.DeviceID, slot, number, PurposeFlashCall, cfg.FlashRing, requestedBy)
+	if call != nil {
+		verification.CallLogID = &call.ID
+		database.DB.Model(&verification).Update("call_log_id", call.ID)
+	}
+	if err != nil {
+		closeVerification(&verification, VerificationFailed)
+		return &verification, err
+	}
+
+	return &verification, nil
+}
+
+// CheckFlashCall compares a code with the caller number of a verification. The attempt is
+// counted before the code is compared, so concurrent requests cannot try more codes than
+// allowed.
+func CheckFlashCall(id uint, code string) (*models.FlashCallVerification, error) {
+	var verification models.FlashCallVerification
+	if err := database.DB.Where("id = ?", id).First(&verification).Error; err != nil {
+		return nil, err
+	}
+	if verification.Status != VerificationPending {
+		return &verification, ErrVerificationClosed
+	}
+	if time.Now().After(verification.ExpiresAt) {
+		closeVerification(&verification, VerificationExpired)
+		return &verification, ErrVerificationClosed
+	}
+
+	result := database.DB.Model(&models.FlashCallVerification{}).
+		Where("id = ? AND status = ? AND (max_attempts <= 0 OR attempts < max_attempts)", id, VerificationPending).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if err := database.DB.Where("id = ?", id).First(&verification).Error; err != nil {
+		return nil, err
+	}
+	if result.RowsAffected == 0 {
+		return &verification, ErrVerificationClosed
+	}
+
+	code = strings.TrimSpace(code)
+	if subtle.ConstantTimeCompare([]byte(code), []byte(verification.Code)) == 1 {
+		now := time.Now()
+		result := database.DB.Model(&models.FlashCallVerification{}).
+			Where("id = ? AND status = ?", id, VerificationPending).
+			Updates(map[string]interface{}{
+				"status":      VerificationVerified,
+				"verified_at": now,
+			})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		// A concurrent request used up the last attempt or verified it first
+		if result.RowsAffected == 0 {
+			database.DB.Where("id = ?", id).First(&verification)
+			return &verification, ErrVerificationClosed
+		}
+		verification.Status = VerificationVerified
+		verification.VerifiedAt = &now
+		return &verification, nil
+	}
+
+	if verification.MaxAttempts > 0 && verification.Attempts >= verification.MaxAttempts {
+		if err := database.DB.Model(&models.FlashCallVerification{}).
+			Where("id = ? AND status = ?", id, VerificationPending).
+			Update("status", VerificationFailed).Error; err != nil {
+			return nil, err
+		}
+		verification.Status = VerificationFailed
+	}
+	return &verification, ErrWrongCode
+}
+
+// flashCallEnded fails the verification of a flash call the device could not place
+func flashCallEnded(call *models.CallLog) {
+	if call.Status != StatusFailed {
+		return
+	}
+
+	var verification models.FlashCallVerification
+	result := database.DB.Where("call_log_id = ? AND status = ?", call.ID, VerificationPending).Limit(1).Find(&verification)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return
+	}
+	closeVerification(&verification, VerificationFailed)
+}
+
+// expireVerifications closes verifications whose code was not entered in time
+func expireVerifications(now time.Time) {
+	if err := database.DB.Model(&models.FlashCallVerification{}).
+		Where("status = ? AND expires_at < ?", VerificationPending, now).
+		Update("status", VerificationExpired).Error; err != nil {
+		log.Printf("Failed to expire flash-call verifications: %v", err)
+	}
+}
+
+// closeVerification stores the final state of a verification
+func closeVerification(verification *models.FlashCallVerification, status string) {
+	verification.Status = status
+	if err := database.DB.Model(verification).Update("status", status).Error; err != nil {
+		log.Printf("Failed to close flash-call verification %d: %v", verification.ID, err)
+	}
+}
+
+// pickCaller picks a random online SIM with a verified number long enough for the code.
+// Picking at random keeps the code from being predictable.
+func pickCaller(ctx context.Context, target string, length int) (*models.SIMCard, error) {
+	var caller models.SIMCard
+	result := database.DB.WithContext(ctx).
+		Joins("JOIN devices ON devices.device_id = sim_cards.device_id AND devices.deleted_at IS NULL").
+		Where("sim_cards.number_verified_at IS NOT NULL AND LENGTH(sim_cards.phone_number) >= ?", length).
+		Where("sim_cards.phone_number <> ?", target).
+		Where("sim_cards.is_active = ? AND sim_cards.is_enabled = ?", true, true).
+		Where("devices.operator_status = ? AND devices.is_active = ?", "online", true).
+		Order("RANDOM()").Limit(1).Find(&caller)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &caller, nil
+}
+
+// trailingDigits returns the last digits of a phone number
+func trailingDigits(number string, length int) string {
+	digits := make([]byte, 0, len(number))
+	for i := 0; i < len(number); i++ {
+		if number[i] >= '0' && number[i] <= '9' {
+			digits = append(digits, number[i])
+		}
+	}
+	if len(digits) <= length {
+		return string(digits)
+	}
+	return string(digits[len(digits)-length:])
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"tsimserver/oidc/mockidp"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+)
+
+func main() {
+	var (
+		port         = flag.Int("port", 9000, "Mock IdP port")
+		issuer       = flag.String("issuer", "http://localhost:9000", "Issuer URL, must match the mock provider enabled in config.yaml")
+		clientID     = flag.String("client-id", "tsimserver", "Accepted client ID")
+		clientSecret = flag.String("client-secret", "mock-secret", "Accepted client secret, empty for a public client")
+	)
+	flag.Parse()
+
+	// A new key on every start, tsimserver fetches it again for the unknown key ID
+	server, err := mockidp.New(*issuer, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal("Failed to generate signing key:", err)
+	}
+
+	app := fiber.New(fiber.Config{
+		ServerHeader: "TsimServer-MockIdP",
+		AppName:      "TsimCloud Mock Identity Provider",
+	})
+	app.Use(logger.New(logger.Config{
+		Format: "[${time}] ${status} - ${method} ${path} - ${latency}\n",
+	}))
+	server.Register(app)
+
+	log.Printf("Mock identity provider %s starting on port %d", *issuer, *port)
+	for _, user := range server.Users() {
+		log.Printf("User %s, groups %v", user.Username, user.Groups)
+	}
+	if err := app.Listen(fmt.Sprintf(":%d", *port)); err != nil {
+		log.Fatal("Failed to start mock identity provider:", err)
+	}
+}
@@ -7,13 +7,25 @@ import (
 	"os/signal"
 	"syscall"
 	"tsimserver/auth"
+	"tsimserver/balance"
 	"tsimserver/cache"
+	"tsimserver/calls"
 	"tsimserver/config"
 	"tsimserver/database"
+	"tsimserver/diagnostics"
 	"tsimserver/handlers"
+	"tsimserver/mailer"
+	"tsimserver/media"
 	"tsimserver/middleware"
+	"tsimserver/ota"
+	"tsimserver/passwords"
+	"tsimserver/phonenumber"
+	"tsimserver/quarantine"
 	"tsimserver/queue"
 	"tsimserver/seeders"
+	"tsimserver/simhealth"
+	"tsimserver/telemetry"
+	"tsimserver/ussdsession"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -43,30 +55,73 @@ func main() {
 		log.Printf("Warning: Failed to seed world database: %v", err)
 	}
 
-	// Initialize Casbin
-	if err := auth.InitCasbin(); err != nil {
-		log.Fatal("Failed to initialize Casbin:", err)
-	}
-
 	// Initialize Redis
 	if err := cache.Connect(); err != nil {
 		log.Fatal("Failed to connect to Redis:", err)
 	}
 	defer cache.Close()
 
+	// Initialize Casbin (after Redis, which carries policy change events)
+	if err := auth.InitCasbin(); err != nil {
+		log.Fatal("Failed to initialize Casbin:", err)
+	}
+
 	// Initialize RabbitMQ
 	if err := queue.Connect(); err != nil {
 		log.Fatal("Failed to connect to RabbitMQ:", err)
 	}
 	defer queue.Close()
 
+	// Initialize media storage
+	if err := media.Init(); err != nil {
+		log.Fatal("Failed to initialize media storage:", err)
+	}
+
+	// Load the password breach list
+	if err := passwords.Init(); err != nil {
+		log.Fatal("Failed to initialize password policy:", err)
+	}
+
+	// Initialize outgoing mail
+	if err := mailer.Init(); err != nil {
+		log.Fatal("Failed to initialize mailer:", err)
+	}
+
 	// Initialize WebSocket hub
 	handlers.InitWebSocketHub()
 
+	// Start telemetry downsampling and retention
+	telemetry.StartRollups()
+
+	// Start app update rollouts
+	ota.StartEngine()
+
+	// Start diagnostic request timeouts and artifact retention
+	diagnostics.StartMonitor()
+
+	// Start USSD session timeouts
+	ussdsession.StartMonitor()
+
+	// Start scheduled SIM balance checks
+	balance.StartScheduler()
+
+	// Start phone number discovery timeouts
+	phonenumber.StartMonitor()
+
+	// Start SIM-to-SIM loopback health tests
+	simhealth.StartScheduler()
+
+	// Start releasing quarantined SIMs after their cooldown
+	quarantine.StartMonitor()
+
+	// Start call status and flash-call verification timeouts
+	calls.StartMonitor()
+
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		ServerHeader: "TsimServer",
 		AppName:      "TsimCloud Server v1.0",
+		BodyLimit:    bodyLimit(),
 	})
 
 	// Middleware
@@ -105,10 +160,22 @@ func main() {
 	log.Println("Server exited gracefully")
 }
 
+// bodyLimit allows request bodies large enough for APK uploads
+func bodyLimit() int {
+	limit := config.AppConfig.OTA.MaxUploadMB * 1024 * 1024
+	if limit < fiber.DefaultBodyLimit {
+		return fiber.DefaultBodyLimit
+	}
+	return limit
+}
+
 func setupRoutes(app *fiber.App) {
 	// API v1 group
 	v1 := app.Group("/api/v1")
 
+	// Audit log of every change made by a user or API key
+	v1.Use(middleware.Audit())
+
 	// Health check
 	v1.Get("/health", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{
@@ -123,10 +190,31 @@ func setupRoutes(app *fiber.App) {
 	auth.Post("/login", handlers.Login)
 	auth.Post("/register", handlers.Register)
 	auth.Post("/refresh", handlers.RefreshToken)
-	auth.Post("/logout", middleware.AuthRequired(), handlers.Logout)
-	auth.Get("/profile", middleware.AuthRequired(), handlers.GetProfile)
-	auth.Put("/profile", middleware.AuthRequired(), handlers.UpdateProfile)
-	auth.Put("/change-password", middleware.AuthRequired(), handlers.ChangePassword)
+	auth.Post("/logout", middleware.AuthRequired(), middleware.UserSessionRequired(), handlers.Logout)
+	auth.Get("/profile", middleware.AuthRequired(), middleware.UserSessionRequired(), handlers.GetProfile)
+	auth.Put("/profile", middleware.AuthRequired(), middleware.UserSessionRequired(), handlers.UpdateProfile)
+	auth.Put("/change-password", middleware.AuthRequired(), middleware.UserSessionRequired(), handlers.ChangePassword)
+	auth.Post("/switch-tenant", middleware.AuthRequired(), middleware.UserSessionRequired(), middleware.SuperAdminRequired(), handlers.SwitchTenant)
+
+	// Password policy and resetting a forgotten password by email
+	auth.Get("/password-policy", handlers.GetPasswordPolicy)
+	auth.Post("/forgot-password", handlers.ForgotPassword)
+	auth.Post("/reset-password", handlers.ResetPassword)
+
+	// Two-factor authentication: the second login step, then the user's own authenticator
+	auth.Post("/mfa/challenge/enroll", handlers.EnrollMFAChallenge)
+	auth.Post("/mfa/challenge/verify", handlers.VerifyMFAChallenge)
+	mfaRoutes := auth.Group("/mfa", middleware.AuthRequired(), middleware.UserSessionRequired())
+	mfaRoutes.Get("/", handlers.GetMFAStatus)
+	mfaRoutes.Post("/enroll", handlers.EnrollMFA)
+	mfaRoutes.Post("/enable", handlers.EnableMFA)
+	mfaRoutes.Post("/disable", handlers.DisableMFA)
+	mfaRoutes.Post("/recovery-codes", handlers.RegenerateMFARecoveryCodes)
+
+	// Single sign-on through OpenID Connect identity providers
+	auth.Get("/oidc/providers", handlers.GetOIDCProviders)
+	auth.Get("/oidc/:provider/login", handlers.OIDCLogin)
+	auth.Get("/oidc/:provider/callback", handlers.OIDCCallback)
 
 	// Protected routes - Admin only
 	adminRequired := middleware.AuthRequired()
@@ -141,30 +229,70 @@ func setupRoutes(app *fiber.App) {
 	users.Post("/:id/roles", middleware.RequirePermission("users", "write"), handlers.AssignRoleToUser)
 	users.Delete("/:id/roles/:role_id", middleware.RequirePermission("users", "write"), handlers.RemoveRoleFromUser)
 	users.Get("/:id/roles", handlers.GetUserRoles)
+	users.Get("/:id/permissions", handlers.GetUserPermissions)
+	users.Delete("/:id/mfa", middleware.RequirePermission("users", "write"), handlers.ResetUserMFA)
 	users.Get("/:id/sessions", handlers.GetUserSessions)
 	users.Delete("/:id/sessions/:session_id", middleware.RequirePermission("users", "write"), handlers.RevokeUserSession)
-
-	// Role management routes (admin only)
+	users.Get("/:id/lockout", handlers.GetUserLockout)
+	users.Delete("/:id/lockout", middleware.RequirePermission("users", "write"), handlers.UnlockUser)
+
+	// Login lockouts of IP addresses span tenants (super-admin only)
+	lockouts := v1.Group("/lockouts", adminRequired, middleware.SuperAdminRequired())
+	lockouts.Delete("/ips/:ip", handlers.UnlockIP)
+
+	// Registration invitations (admin only)
+	invitationRoutes := v1.Group("/invitations", adminRequired, middleware.UserSessionRequired(), middleware.RequirePermission("users", "read"))
+	invitationRoutes.Get("/", handlers.GetInvitations)
+	invitationRoutes.Post("/", middleware.RequirePermission("users", "write"), handlers.CreateInvitation)
+	invitationRoutes.Delete("/:id", middleware.RequirePermission("users", "write"), handlers.RevokeInvitation)
+
+	// Authentication audit trail (admin only)
+	authEvents := v1.Group("/auth-events", adminRequired, middleware.RequirePermission("users", "read"))
+	authEvents.Get("/", handlers.GetAuthEvents)
+
+	// Audit log of administrative and messaging actions (admin only)
+	auditEvents := v1.Group("/audit-events", adminRequired, middleware.RequirePermission("audit", "read"))
+	auditEvents.Get("/", handlers.GetAuditEvents)
+	auditEvents.Get("/export", handlers.ExportAuditEvents)
+
+	// Role management routes (admin only). Roles and permissions are shared by all
+	// tenants, so only super-admins change them.
 	roles := v1.Group("/roles", adminRequired, middleware.RequirePermission("roles", "read"))
 	roles.Get("/", handlers.GetRoles)
 	roles.Get("/:id", handlers.GetRole)
-	roles.Post("/", middleware.RequirePermission("roles", "write"), handlers.CreateRole)
-	roles.Put("/:id", middleware.RequirePermission("roles", "write"), handlers.UpdateRole)
-	roles.Delete("/:id", middleware.RequirePermission("roles", "delete"), handlers.DeleteRole)
-	roles.Post("/:id/permissions", middleware.RequirePermission("roles", "write"), handlers.AssignPermissionToRole)
-	roles.Delete("/:id/permissions/:permission_id", middleware.RequirePermission("roles", "write"), handlers.RemovePermissionFromRole)
+	roles.Post("/", middleware.SuperAdminRequired(), middleware.RequirePermission("roles", "write"), handlers.CreateRole)
+	roles.Put("/:id", middleware.SuperAdminRequired(), middleware.RequirePermission("roles", "write"), handlers.UpdateRole)
+	roles.Delete("/:id", middleware.SuperAdminRequired(), middleware.RequirePermission("roles", "delete"), handlers.DeleteRole)
+	roles.Post("/:id/permissions", middleware.SuperAdminRequired(), middleware.RequirePermission("roles", "write"), handlers.AssignPermissionToRole)
+	roles.Delete("/:id/permissions/:permission_id", middleware.SuperAdminRequired(), middleware.RequirePermission("roles", "write"), handlers.RemovePermissionFromRole)
 	roles.Get("/:id/users", handlers.GetRoleUsers)
 
-	// Permission management routes (admin only)
+	// Permission management routes (admin only, changes by super-admins)
 	permissions := v1.Group("/permissions", adminRequired, middleware.RequirePermission("permissions", "read"))
 	permissions.Get("/", handlers.GetPermissions)
 	permissions.Get("/:id", handlers.GetPermission)
-	permissions.Post("/", middleware.RequirePermission("permissions", "write"), handlers.CreatePermission)
-	permissions.Put("/:id", middleware.RequirePermission("permissions", "write"), handlers.UpdatePermission)
-	permissions.Delete("/:id", middleware.RequirePermission("permissions", "delete"), handlers.DeletePermission)
+	permissions.Post("/", middleware.SuperAdminRequired(), middleware.RequirePermission("permissions", "write"), handlers.CreatePermission)
+	permissions.Put("/:id", middleware.SuperAdminRequired(), middleware.RequirePermission("permissions", "write"), handlers.UpdatePermission)
+	permissions.Delete("/:id", middleware.SuperAdminRequired(), middleware.RequirePermission("permissions", "delete"), handlers.DeletePermission)
 	permissions.Get("/resources", handlers.GetPermissionResources)
 	permissions.Get("/actions", handlers.GetPermissionActions)
-	permissions.Post("/bulk", middleware.RequirePermission("permissions", "write"), handlers.BulkCreatePermissions)
+	permissions.Post("/bulk", middleware.SuperAdminRequired(), middleware.RequirePermission("permissions", "write"), handlers.BulkCreatePermissions)
+
+	// API key management routes (user sessions only, keys cannot manage keys)
+	apiKeys := v1.Group("/api-keys", adminRequired, middleware.UserSessionRequired(), middleware.RequirePermission("api_keys", "read"))
+	apiKeys.Get("/", handlers.GetAPIKeys)
+	apiKeys.Get("/:id", handlers.GetAPIKey)
+	apiKeys.Post("/", middleware.RequirePermission("api_keys", "write"), handlers.CreateAPIKey)
+	apiKeys.Put("/:id", middleware.RequirePermission("api_keys", "write"), handlers.UpdateAPIKey)
+	apiKeys.Delete("/:id", middleware.RequirePermission("api_keys", "delete"), handlers.RevokeAPIKey)
+
+	// Tenant management routes (super-admin only)
+	tenants := v1.Group("/tenants", adminRequired, middleware.SuperAdminRequired())
+	tenants.Get("/", handlers.GetTenants)
+	tenants.Get("/:id", handlers.GetTenant)
+	tenants.Post("/", handlers.CreateTenant)
+	tenants.Put("/:id", handlers.UpdateTenant)
+	tenants.Delete("/:id", handlers.DeleteTenant)
 
 	// Site management routes (admin only)
 	sites := v1.Group("/sites", adminRequired, middleware.RequirePermission("sites", "read"))
@@ -174,6 +302,9 @@ func setupRoutes(app *fiber.App) {
 	sites.Put("/:id", middleware.RequirePermission("sites", "write"), handlers.UpdateSite)
 	sites.Delete("/:id", middleware.RequirePermission("sites", "delete"), handlers.DeleteSite)
 	sites.Get("/:id/stats", handlers.GetSiteStats)
+	sites.Get("/:id/geofence", handlers.GetSiteGeofence)
+	sites.Put("/:id/geofence", middleware.RequirePermission("sites", "write"), handlers.SetSiteGeofence)
+	sites.Delete("/:id/geofence", middleware.RequirePermission("sites", "write"), handlers.DeleteSiteGeofence)
 	sites.Get("/countries", handlers.GetSiteCountries)
 
 	// Device group management routes (admin only)
@@ -184,11 +315,14 @@ func setupRoutes(app *fiber.App) {
 	deviceGroups.Put("/:id", middleware.RequirePermission("device_groups", "write"), handlers.UpdateDeviceGroup)
 	deviceGroups.Delete("/:id", middleware.RequirePermission("device_groups", "delete"), handlers.DeleteDeviceGroup)
 	deviceGroups.Get("/:id/stats", handlers.GetDeviceGroupStats)
+	deviceGroups.Get("/:id/config", handlers.GetDeviceGroupConfig)
+	deviceGroups.Put("/:id/config", middleware.RequirePermission("device_groups", "write"), handlers.SetDeviceGroupConfig)
 	deviceGroups.Get("/operators", handlers.GetDeviceGroupOperators)
 
 	// Device routes (protected)
 	devices := v1.Group("/devices", middleware.AuthRequired(), middleware.RequirePermission("devices", "read"))
 	devices.Get("/", handlers.GetDevices)
+	devices.Get("/config-drift", handlers.GetConfigDrift)
 	devices.Post("/", middleware.RequirePermission("devices", "write"), handlers.CreateDevice)
 	devices.Get("/:id", handlers.GetDevice)
 	devices.Put("/:id", middleware.RequirePermission("devices", "write"), handlers.UpdateDevice)
@@ -198,8 +332,56 @@ func setupRoutes(app *fiber.App) {
 	devices.Post("/:id/sim/:simslot/disable", middleware.RequirePermission("devices", "write"), handlers.DisableSIM)
 	devices.Post("/:id/sim/:simslot/enable", middleware.RequirePermission("devices", "write"), handlers.EnableSIM)
 	devices.Get("/:id/statuses", handlers.GetDeviceStatuses)
+	devices.Get("/:id/presence", handlers.GetDevicePresence)
+	devices.Get("/:id/sim-history", handlers.GetDeviceSIMHistory)
+	devices.Get("/:id/telemetry", handlers.GetDeviceTelemetry)
+	devices.Get("/:id/config", handlers.GetDeviceConfig)
+	devices.Put("/:id/config", middleware.RequirePermission("devices", "write"), handlers.SetDeviceConfigOverrides)
+	devices.Post("/:id/config/push", middleware.RequirePermission("devices", "write"), handlers.PushDeviceConfig)
+	devices.Get("/:id/diagnostics", handlers.GetDeviceDiagnostics)
+	devices.Post("/:id/diagnostics", middleware.RequirePermission("devices", "write"), handlers.RequestDeviceDiagnostic)
 	devices.Post("/:id/alarm", middleware.RequirePermission("alarms", "write"), handlers.SendAlarmToDevice)
 
+	// SIM card inventory routes (protected)
+	simCards := v1.Group("/sim-cards", middleware.AuthRequired(), middleware.RequirePermission("devices", "read"))
+	simCards.Get("/", handlers.GetSIMCards)
+	simCards.Get("/health", handlers.GetSIMHealthOverview)
+	simCards.Get("/quarantines", handlers.GetSIMQuarantines)
+	simCards.Get("/:id", handlers.GetSIMCard)
+	simCards.Get("/:id/history", handlers.GetSIMCardHistory)
+	simCards.Get("/:id/balance", handlers.GetSIMBalanceHistory)
+	simCards.Post("/:id/balance/check", middleware.RequirePermission("ussd", "write"), handlers.CheckSIMBalance)
+	simCards.Get("/:id/phone-number/discoveries", handlers.GetSIMPhoneNumberDiscoveries)
+	simCards.Post("/:id/phone-number/discover", middleware.RequirePermission("ussd", "write"), handlers.DiscoverSIMPhoneNumber)
+	simCards.Get("/:id/health", handlers.GetSIMCardHealth)
+	simCards.Get("/:id/loopback-tests", handlers.GetSIMLoopbackTests)
+	simCards.Post("/:id/loopback-tests", middleware.RequirePermission("sms", "write"), handlers.RunSIMLoopbackTest)
+	simCards.Get("/:id/routing-score", handlers.GetSIMRoutingScore)
+	simCards.Put("/:id/daily-limit", middleware.RequirePermission("devices", "write"), handlers.UpdateSIMDailyLimit)
+	simCards.Get("/:id/quarantines", handlers.GetSIMCardQuarantines)
+	simCards.Post("/:id/release", middleware.RequirePermission("devices", "write"), handlers.ReleaseSIMQuarantine)
+
+	// Operator balance configuration routes (protected), shared by every tenant so only
+	// super-admins change them
+	balanceConfigs := v1.Group("/balance-configs", middleware.AuthRequired(), middleware.RequirePermission("ussd", "read"))
+	balanceConfigs.Get("/", handlers.GetOperatorBalanceConfigs)
+	balanceConfigs.Post("/", middleware.SuperAdminRequired(), middleware.RequirePermission("ussd", "write"), handlers.CreateOperatorBalanceConfig)
+	balanceConfigs.Post("/test", handlers.TestBalanceParser)
+	balanceConfigs.Put("/:id", middleware.SuperAdminRequired(), middleware.RequirePermission("ussd", "write"), handlers.UpdateOperatorBalanceConfig)
+	balanceConfigs.Delete("/:id", middleware.SuperAdminRequired(), middleware.RequirePermission("ussd", "delete"), handlers.DeleteOperatorBalanceConfig)
+
+	// Operator phone number configuration routes (protected), shared by every tenant
+	numberConfigs := v1.Group("/number-configs", middleware.AuthRequired(), middleware.RequirePermission("ussd", "read"))
+	numberConfigs.Get("/", handlers.GetOperatorNumberConfigs)
+	numberConfigs.Post("/", middleware.SuperAdminRequired(), middleware.RequirePermission("ussd", "write"), handlers.CreateOperatorNumberConfig)
+	numberConfigs.Put("/:id", middleware.SuperAdminRequired(), middleware.RequirePermission("ussd", "write"), handlers.UpdateOperatorNumberConfig)
+	numberConfigs.Delete("/:id", middleware.SuperAdminRequired(), middleware.RequirePermission("ussd", "delete"), handlers.DeleteOperatorNumberConfig)
+
+	// Diagnostic routes (protected)
+	diagnosticRoutes := v1.Group("/diagnostics", middleware.AuthRequired(), middleware.RequirePermission("devices", "read"))
+	diagnosticRoutes.Get("/:id", handlers.GetDiagnosticRequest)
+	diagnosticRoutes.Get("/artifacts/:id/download", handlers.DownloadDiagnosticArtifact)
+
 	// SMS routes (protected)
 	sms := v1.Group("/sms", middleware.AuthRequired(), middleware.RequirePermission("sms", "read"))
 	sms.Post("/send", middleware.RequirePermission("sms", "write"), handlers.SendSMS)
@@ -210,6 +392,16 @@ func setupRoutes(app *fiber.App) {
 	sms.Get("/:id", handlers.GetSMSMessage)
 	sms.Delete("/:id", middleware.RequirePermission("sms", "delete"), handlers.DeleteSMSMessage)
 
+	// MMS routes (protected)
+	mmsRoutes := v1.Group("/mms", middleware.AuthRequired(), middleware.RequirePermission("sms", "read"))
+	mmsRoutes.Post("/send", middleware.RequirePermission("sms", "write"), handlers.SendMMS)
+	mmsRoutes.Get("/", handlers.GetMMSMessages)
+	mmsRoutes.Get("/conversations", handlers.GetConversations)
+	mmsRoutes.Get("/conversations/:id", handlers.GetConversationMessages)
+	mmsRoutes.Get("/media/:id", handlers.GetMMSMedia)
+	mmsRoutes.Get("/:id", handlers.GetMMSMessage)
+	mmsRoutes.Delete("/:id", middleware.RequirePermission("sms", "delete"), handlers.DeleteMMSMessage)
+
 	// SMS Gateway routes (protected)
 	smsGateway := v1.Group("/sms-gateway", middleware.AuthRequired(), middleware.RequirePermission("sms", "write"))
 	smsGateway.Post("/send", handlers.SendSMSViaGateway)
@@ -217,9 +409,25 @@ func setupRoutes(app *fiber.App) {
 	smsGateway.Post("/command", middleware.RequirePermission("devices", "admin"), handlers.SendTestCommand)
 	smsGateway.Post("/dlr", handlers.ProcessDeliveryReport) // Internal endpoint for devices
 
+	// Call routes (protected)
+	callRoutes := v1.Group("/calls", middleware.AuthRequired(), middleware.RequirePermission("calls", "read"))
+	callRoutes.Get("/", handlers.GetCallLogs)
+	callRoutes.Post("/dial", middleware.RequirePermission("calls", "write"), handlers.DialCall)
+	callRoutes.Post("/flash-verifications", middleware.RequirePermission("calls", "write"), handlers.StartFlashCallVerification)
+	callRoutes.Post("/flash-verifications/:id/check", middleware.RequirePermission("calls", "write"), handlers.CheckFlashCallVerification)
+	callRoutes.Get("/:id", handlers.GetCallLog)
+	callRoutes.Post("/:id/hangup", middleware.RequirePermission("calls", "write"), handlers.HangupCall)
+
 	// USSD routes (protected)
 	ussd := v1.Group("/ussd", middleware.AuthRequired(), middleware.RequirePermission("ussd", "read"))
 	ussd.Post("/send", middleware.RequirePermission("ussd", "write"), handlers.SendUSSD)
+	ussd.Post("/check-balance", middleware.RequirePermission("ussd", "write"), handlers.CheckBalance)
+	ussd.Post("/discover-number", middleware.RequirePermission("ussd", "write"), handlers.DiscoverPhoneNumber)
+	ussd.Get("/sessions", handlers.GetUSSDSessions)
+	ussd.Post("/sessions", middleware.RequirePermission("ussd", "write"), handlers.StartUSSDSession)
+	ussd.Get("/sessions/:sessionId", handlers.GetUSSDSession)
+	ussd.Post("/sessions/:sessionId/reply", middleware.RequirePermission("ussd", "write"), handlers.ReplyUSSDSession)
+	ussd.Post("/sessions/:sessionId/cancel", middleware.RequirePermission("ussd", "write"), handlers.CancelUSSDSession)
 	ussd.Get("/device/:deviceId", handlers.GetUSSDCommands)
 	ussd.Get("/:id", handlers.GetUSSDCommand)
 	ussd.Delete("/:id", middleware.RequirePermission("ussd", "delete"), handlers.DeleteUSSDCommand)
@@ -231,6 +439,30 @@ func setupRoutes(app *fiber.App) {
 	alarms.Post("/:id/resolve", middleware.RequirePermission("alarms", "write"), handlers.ResolveAlarm)
 	alarms.Delete("/:id", middleware.RequirePermission("alarms", "delete"), handlers.DeleteAlarm)
 
+	// App release routes (protected), shared by every tenant
+	appReleases := v1.Group("/app-releases", middleware.AuthRequired(), middleware.RequirePermission("app_updates", "read"))
+	appReleases.Get("/", handlers.GetAppReleases)
+	appReleases.Post("/", middleware.SuperAdminRequired(), middleware.RequirePermission("app_updates", "write"), handlers.UploadAppRelease)
+	appReleases.Get("/:id", handlers.GetAppRelease)
+	appReleases.Delete("/:id", middleware.SuperAdminRequired(), middleware.RequirePermission("app_updates", "delete"), handlers.DeleteAppRelease)
+
+	// App rollout routes (protected)
+	appRollouts := v1.Group("/app-rollouts", middleware.AuthRequired(), middleware.RequirePermission("app_updates", "read"))
+	appRollouts.Get("/", handlers.GetAppRollouts)
+	appRollouts.Post("/", middleware.RequirePermission("app_updates", "write"), handlers.CreateAppRollout)
+	appRollouts.Get("/:id", handlers.GetAppRollout)
+	appRollouts.Get("/:id/tasks", handlers.GetAppRolloutTasks)
+	appRollouts.Post("/:id/start", middleware.RequirePermission("app_updates", "write"), handlers.StartAppRollout)
+	appRollouts.Post("/:id/pause", middleware.RequirePermission("app_updates", "write"), handlers.PauseAppRollout)
+	appRollouts.Post("/:id/resume", middleware.RequirePermission("app_updates", "write"), handlers.ResumeAppRollout)
+	appRollouts.Post("/:id/rollback", middleware.RequirePermission("app_updates", "write"), handlers.RollbackAppRollout)
+
+	// APK downloads for devices (authorized by the download token in the update_app command)
+	v1.Get("/ota/releases/:id/download", handlers.DownloadAppRelease)
+
+	// MMS media downloads for devices (authorized by the download token in the send_mms command)
+	v1.Get("/media/:id/download", handlers.DownloadMMSMedia)
+
 	// Statistics routes (protected)
 	stats := v1.Group("/stats", middleware.AuthRequired(), middleware.RequirePermission("stats", "read"))
 	stats.Get("/dashboard", handlers.GetDashboardStats)
@@ -7,14 +7,36 @@ import (
 )
 
 type Config struct {
-	Server    ServerConfig    `mapstructure:"server"`
-	Database  DatabaseConfig  `mapstructure:"database"`
-	Redis     RedisConfig     `mapstructure:"redis"`
-	RabbitMQ  RabbitMQConfig  `mapstructure:"rabbitmq"`
-	JWT       JWTConfig       `mapstructure:"jwt"`
-	Casbin    CasbinConfig    `mapstructure:"casbin"`
-	WebSocket WebSocketConfig `mapstructure:"websocket"`
-	Logging   LoggingConfig   `mapstructure:"logging"`
+	Server       ServerConfig       `mapstructure:"server"`
+	Database     DatabaseConfig     `mapstructure:"database"`
+	Redis        RedisConfig        `mapstructure:"redis"`
+	RabbitMQ     RabbitMQConfig     `mapstructure:"rabbitmq"`
+	JWT          JWTConfig          `mapstructure:"jwt"`
+	Casbin       CasbinConfig       `mapstructure:"casbin"`
+	WebSocket    WebSocketConfig    `mapstructure:"websocket"`
+	Presence     PresenceConfig     `mapstructure:"presence"`
+	Telemetry    TelemetryConfig    `mapstructure:"telemetry"`
+	Geofence     GeofenceConfig     `mapstructure:"geofence"`
+	Device       DeviceConfig       `mapstructure:"device"`
+	OTA          OTAConfig          `mapstructure:"ota"`
+	Diagnostics  DiagnosticsConfig  `mapstructure:"diagnostics"`
+	USSD         USSDConfig         `mapstructure:"ussd"`
+	Balance      BalanceConfig      `mapstructure:"balance"`
+	PhoneNumber  PhoneNumberConfig  `mapstructure:"phone_number"`
+	Loopback     LoopbackConfig     `mapstructure:"loopback"`
+	Routing      RoutingConfig      `mapstructure:"routing"`
+	Quarantine   QuarantineConfig   `mapstructure:"quarantine"`
+	Media        MediaConfig        `mapstructure:"media"`
+	Calls        CallConfig         `mapstructure:"calls"`
+	MFA          MFAConfig          `mapstructure:"mfa"`
+	OIDC         OIDCConfig         `mapstructure:"oidc"`
+	Lockout      LockoutConfig      `mapstructure:"lockout"`
+	Registration RegistrationConfig `mapstructure:"registration"`
+	Sessions     SessionsConfig     `mapstructure:"sessions"`
+	Password     PasswordConfig     `mapstructure:"password"`
+	Mail         MailConfig         `mapstructure:"mail"`
+	Audit        AuditConfig        `mapstructure:"audit"`
+	Logging      LoggingConfig      `mapstructure:"logging"`
 }
 
 type ServerConfig struct {
@@ -52,8 +74,7 @@ type JWTConfig struct {
 
 // CasbinConfig holds Casbin configuration
 type CasbinConfig struct {
-	ModelPath  string `mapstructure:"model_path"`
-	PolicyPath string `mapstructure:"policy_path"`
+	ModelPath string `mapstructure:"model_path"`
 }
 
 type WebSocketConfig struct {
@@ -62,6 +83,239 @@ type WebSocketConfig struct {
 	WriteBufferSize int    `mapstructure:"write_buffer_size"`
 }
 
+// PresenceConfig holds device presence monitoring configuration
+type PresenceConfig struct {
+	HeartbeatTimeout  int `mapstructure:"heartbeat_timeout"`   // seconds without heartbeat before offline
+	CheckInterval     int `mapstructure:"check_interval"`      // seconds between monitor passes
+	OfflineAlarmAfter int `mapstructure:"offline_alarm_after"` // seconds offline before an alarm is raised
+}
+
+// TelemetryConfig holds telemetry rollup and retention configuration
+type TelemetryConfig struct {
+	RollupInterval      int `mapstructure:"rollup_interval"`       // seconds between rollup passes
+	RawRetentionHours   int `mapstructure:"raw_retention_hours"`   // raw samples
+	MinuteRetentionDays int `mapstructure:"minute_retention_days"` // 1m rollups
+	HourRetentionDays   int `mapstructure:"hour_retention_days"`   // 1h rollups
+	StatusRetentionDays int `mapstructure:"status_retention_days"` // device_statuses rows
+}
+
+// GeofenceConfig holds location drift detection configuration
+type GeofenceConfig struct {
+	MaxSpeedKmh   float64 `mapstructure:"max_speed_kmh"`   // Faster position changes are implausible
+	MinJumpMeters float64 `mapstructure:"min_jump_meters"` // Smaller changes are treated as GPS noise
+}
+
+// DeviceConfig holds the default app settings pushed to devices
+type DeviceConfig struct {
+	HeartbeatInterval int    `mapstructure:"heartbeat_interval"` // seconds
+	StatusInterval    int    `mapstructure:"status_interval"`    // seconds
+	SendThrottle      int    `mapstructure:"send_throttle"`      // SMS per minute, 0 = unlimited
+	LogLevel          string `mapstructure:"log_level"`
+	USSDTimeout       int    `mapstructure:"ussd_timeout"` // seconds
+}
+
+// OTAConfig holds app update artifact and rollout configuration
+type OTAConfig struct {
+	StoragePath       string `mapstructure:"storage_path"` // directory for uploaded APKs
+	MaxUploadMB       int    `mapstructure:"max_upload_mb"`
+	PublicURL         string `mapstructure:"public_url"`          // base URL devices download APKs from
+	SigningCertSHA256 string `mapstructure:"signing_cert_sha256"` // trusted signing certificate, empty accepts any
+	CheckInterval     int    `mapstructure:"check_interval"`      // seconds between rollout engine passes
+	TaskTimeout       int    `mapstructure:"task_timeout"`        // seconds before an unfinished update counts as failed, or skipped when never sent
+}
+
+// DiagnosticsConfig holds remote diagnostics configuration
+type DiagnosticsConfig struct {
+	StoragePath    string `mapstructure:"storage_path"`    // directory for uploaded artifacts
+	RequestTimeout int    `mapstructure:"request_timeout"` // seconds before an unanswered request fails
+	MaxArtifactMB  int    `mapstructure:"max_artifact_mb"`
+	ChunkSize      int    `mapstructure:"chunk_size"`     // bytes per uploaded chunk requested from devices
+	RetentionDays  int    `mapstructure:"retention_days"` // artifacts older than this are deleted
+}
+
+// USSDConfig holds interactive USSD session configuration
+type USSDConfig struct {
+	SessionTimeout int `mapstructure:"session_timeout"` // seconds a session may wait for the next step
+	MaxSteps       int `mapstructure:"max_steps"`
+}
+
+// BalanceConfig holds scheduled SIM balance check configuration
+type BalanceConfig struct {
+	CheckInterval       int     `mapstructure:"check_interval"`      // minutes between checks of a SIM
+	SchedulerInterval   int     `mapstructure:"scheduler_interval"`  // seconds between scheduler passes
+	CheckTimeout        int     `mapstructure:"check_timeout"`       // seconds before an unanswered check fails
+	FailureAlarmAfter   int     `mapstructure:"failure_alarm_after"` // consecutive failures that raise an alarm
+	LowBalanceThreshold float64 `mapstructure:"low_balance_threshold"`
+}
+
+// PhoneNumberConfig holds SIM phone number discovery configuration
+type PhoneNumberConfig struct {
+	AutoDiscover     bool   `mapstructure:"auto_discover"`     // discover numbers of newly inserted SIMs
+	DiscoveryTimeout int    `mapstructure:"discovery_timeout"` // seconds before an unanswered discovery fails
+	LoopbackFallback bool   `mapstructure:"loopback_fallback"` // fall back to an SMS loop-back when USSD fails
+	LoopbackPrefix   string `mapstructure:"loopback_prefix"`   // text in front of the loop-back token
+}
+
+// LoopbackConfig holds SIM-to-SIM loopback health test configuration
+type LoopbackConfig struct {
+	Enabled           bool   `mapstructure:"enabled"`
+	TestInterval      int    `mapstructure:"test_interval"`      // minutes between tests of a SIM
+	SchedulerInterval int    `mapstructure:"scheduler_interval"` // seconds between scheduler passes
+	Timeout           int    `mapstructure:"timeout"`            // seconds before an unreceived test fails
+	Window            int    `mapstructure:"window"`             // recent tests the health score is computed from
+	UnhealthyAfter    int    `mapstructure:"unhealthy_after"`    // consecutive failures that mark a SIM unhealthy
+	SlowLatency       int    `mapstructure:"slow_latency"`       // seconds of latency that start lowering the score
+	MessagePrefix     string `mapstructure:"message_prefix"`     // text in front of the test token
+}
+
+// RoutingConfig holds SIM routing score configuration
+type RoutingConfig struct {
+	Smoothing          float64  `mapstructure:"smoothing"`            // weight of the newest event in running averages
+	SlowDLRLatency     int      `mapstructure:"slow_dlr_latency"`     // seconds of DLR latency that start lowering the score
+	ErrorPenalty       float64  `mapstructure:"error_penalty"`        // points per failed send or delivery
+	SevereErrorCodes   []string `mapstructure:"severe_error_codes"`   // DLR error codes that weigh more
+	SevereErrorPenalty float64  `mapstructure:"severe_error_penalty"` // points per severe error
+	PenaltyHalfLife    int      `mapstructure:"penalty_half_life"`    // hours for error penalties to halve
+}
+
+// QuarantineConfig holds automatic SIM quarantine configuration
+type QuarantineConfig struct {
+	Enabled             bool     `mapstructure:"enabled"`
+	ConsecutiveFailures int      `mapstructure:"consecutive_failures"` // failed sends/deliveries in a row that quarantine a SIM
+	ErrorCodes          []string `mapstructure:"error_codes"`          // DLR error codes that quarantine a SIM at once
+	Cooldown            int      `mapstructure:"cooldown"`             // minutes a SIM stays quarantined
+	AutoRelease         bool     `mapstructure:"auto_release"`         // release SIMs when the cooldown ends
+}
+
+// MediaConfig holds MMS media storage configuration
+type MediaConfig struct {
+	Storage      string        `mapstructure:"storage"`        // local or s3
+	LocalPath    string        `mapstructure:"local_path"`     // directory for media with local storage
+	MaxPartKB    int           `mapstructure:"max_part_kb"`    // largest single attachment
+	MaxMessageKB int           `mapstructure:"max_message_kb"` // all attachments of a message together
+	MaxParts     int           `mapstructure:"max_parts"`
+	AllowedTypes []string      `mapstructure:"allowed_types"` // content types accepted for MMS parts
+	PublicURL    string        `mapstructure:"public_url"`    // base URL devices download media from
+	S3           S3MediaConfig `mapstructure:"s3"`
+}
+
+// S3MediaConfig holds the S3-compatible bucket media is stored in
+type S3MediaConfig struct {
+	Endpoint  string `mapstructure:"endpoint"` // e.g. https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Region    string `mapstructure:"region"`
+	Bucket    string `mapstructure:"bucket"`
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+}
+
+// CallConfig holds voice call and flash-call verification configuration
+type CallConfig struct {
+	MaxDuration      int `mapstructure:"max_duration"`       // seconds an outbound call may last
+	StatusTimeout    int `mapstructure:"status_timeout"`     // seconds without a status before an outbound call counts as failed
+	FlashRing        int `mapstructure:"flash_ring"`         // seconds a flash call rings before the device hangs up
+	FlashCodeLength  int `mapstructure:"flash_code_length"`  // trailing caller number digits used as the code
+	FlashTTL         int `mapstructure:"flash_ttl"`          // seconds a flash-call verification stays valid
+	FlashMaxAttempts int `mapstructure:"flash_max_attempts"` // wrong codes before a verification fails
+}
+
+// MFAConfig holds two-factor authentication configuration
+type MFAConfig struct {
+	Issuer        string `mapstructure:"issuer"`         // account issuer shown in authenticator apps
+	ChallengeTTL  int    `mapstructure:"challenge_ttl"`  // seconds to enter a code after the password
+	MaxAttempts   int    `mapstructure:"max_attempts"`   // wrong codes before a challenge fails
+	Skew          int    `mapstructure:"skew"`           // 30-second steps accepted before and after the current one
+	RecoveryCodes int    `mapstructure:"recovery_codes"` // recovery codes issued per set
+}
+
+// OIDCConfig holds OpenID Connect single sign-on configuration
+type OIDCConfig struct {
+	StateTTL     int                  `mapstructure:"state_ttl"`      // seconds to finish login at the identity provider
+	HTTPTimeout  int                  `mapstructure:"http_timeout"`   // seconds for discovery, JWKS and token requests
+	JWKSCacheTTL int                  `mapstructure:"jwks_cache_ttl"` // seconds before signing keys are fetched again
+	Providers    []OIDCProviderConfig `mapstructure:"providers"`
+}
+
+// OIDCProviderConfig holds one identity provider
+type OIDCProviderConfig struct {
+	Name          string            `mapstructure:"name"` // used in the login URL
+	DisplayName   string            `mapstructure:"display_name"`
+	Issuer        string            `mapstructure:"issuer"`
+	ClientID      string            `mapstructure:"client_id"`
+	ClientSecret  string            `mapstructure:"client_secret"` // empty for public clients
+	RedirectURL   string            `mapstructure:"redirect_url"`  // callback URL registered at the provider
+	Scopes        []string          `mapstructure:"scopes"`
+	GroupsClaim   string            `mapstructure:"groups_claim"`   // ID token claim listing the user's groups
+	AutoProvision bool              `mapstructure:"auto_provision"` // create unknown users on first login
+	LinkByEmail   bool              `mapstructure:"link_by_email"`  // link existing users by verified email
+	Tenant        string            `mapstructure:"tenant"`         // slug of the tenant provisioned users join
+	DefaultRole   string            `mapstructure:"default_role"`   // role of users none of whose groups is mapped
+	RoleMappings  []OIDCRoleMapping `mapstructure:"role_mappings"`
+}
+
+// OIDCRoleMapping grants a role to members of an identity provider group
+type OIDCRoleMapping struct {
+	Group string `mapstructure:"group"`
+	Role  string `mapstructure:"role"`
+}
+
+// LockoutConfig holds login brute-force protection configuration
+type LockoutConfig struct {
+	MaxUserFailures int `mapstructure:"max_user_failures"` // failed logins of an account before it is locked
+	MaxIPFailures   int `mapstructure:"max_ip_failures"`   // failed logins from an IP address before it is locked
+	FailureWindow   int `mapstructure:"failure_window"`    // seconds failures are counted over
+	LockoutDuration int `mapstructure:"lockout_duration"`  // seconds
+	DelayAfter      int `mapstructure:"delay_after"`       // failures of an account before attempts are slowed down
+	BaseDelay       int `mapstructure:"base_delay"`        // seconds to wait after the first slowed down failure, doubling after each
+	MaxDelay        int `mapstructure:"max_delay"`         // seconds
+}
+
+// RegistrationConfig holds self-registration configuration
+type RegistrationConfig struct {
+	Mode      string `mapstructure:"mode"`       // open, invite or closed
+	InviteTTL int    `mapstructure:"invite_ttl"` // hours an invitation can be used
+}
+
+// SessionsConfig holds login session configuration
+type SessionsConfig struct {
+	CacheTTL int `mapstructure:"cache_ttl"` // seconds a validated session is trusted from Redis, 0 disables the cache
+}
+
+// PasswordConfig holds password policy and password reset configuration
+type PasswordConfig struct {
+	MinLength     int    `mapstructure:"min_length"`
+	MaxLength     int    `mapstructure:"max_length"` // bcrypt uses at most 72 bytes
+	RequireUpper  bool   `mapstructure:"require_upper"`
+	RequireLower  bool   `mapstructure:"require_lower"`
+	RequireDigit  bool   `mapstructure:"require_digit"`
+	RequireSymbol bool   `mapstructure:"require_symbol"`
+	BreachList    string `mapstructure:"breach_list"`     // file of breached passwords or their SHA-1 hashes, one per line, empty to skip
+	HistorySize   int    `mapstructure:"history_size"`    // earlier passwords that cannot be used again
+	ResetTokenTTL int    `mapstructure:"reset_token_ttl"` // minutes a reset link works
+	ResetInterval int    `mapstructure:"reset_interval"`  // seconds before another reset email is sent to an account
+	ResetURL      string `mapstructure:"reset_url"`       // page the reset email links to, with ?token=
+}
+
+// MailConfig holds outgoing email configuration
+type MailConfig struct {
+	Driver string         `mapstructure:"driver"` // smtp, or log to only log messages
+	From   string         `mapstructure:"from"`
+	SMTP   SMTPMailConfig `mapstructure:"smtp"`
+}
+
+// SMTPMailConfig holds the SMTP server email is sent through
+type SMTPMailConfig struct {
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"` // empty to send without authentication
+	Password string `mapstructure:"password"`
+	TLS      string `mapstructure:"tls"` // starttls, tls (implicit, usually port 465) or none
+}
+
+// AuditConfig holds audit log configuration
+type AuditConfig struct {
+	ExportLimit int `mapstructure:"export_limit"` // most events in one CSV or JSON export
+}
+
 type LoggingConfig struct {
 	Level string `mapstructure:"level"`
 }
@@ -125,6 +379,164 @@ func setDefaults() {
 	viper.SetDefault("websocket.read_buffer_size", 1024)
 	viper.SetDefault("websocket.write_buffer_size", 1024)
 
+	// Presence defaults
+	viper.SetDefault("presence.heartbeat_timeout", 90)
+	viper.SetDefault("presence.check_interval", 30)
+	viper.SetDefault("presence.offline_alarm_after", 600)
+
+	// Telemetry defaults
+	viper.SetDefault("telemetry.rollup_interval", 60)
+	viper.SetDefault("telemetry.raw_retention_hours", 48)
+	viper.SetDefault("telemetry.minute_retention_days", 14)
+	viper.SetDefault("telemetry.hour_retention_days", 365)
+	viper.SetDefault("telemetry.status_retention_days", 30)
+
+	// Geofence defaults
+	viper.SetDefault("geofence.max_speed_kmh", 200)
+	viper.SetDefault("geofence.min_jump_meters", 1000)
+
+	// Device app defaults
+	viper.SetDefault("device.heartbeat_interval", 30)
+	viper.SetDefault("device.status_interval", 30)
+	viper.SetDefault("device.send_throttle", 0)
+	viper.SetDefault("device.log_level", "info")
+	viper.SetDefault("device.ussd_timeout", 30)
+
+	// OTA defaults
+	viper.SetDefault("ota.storage_path", "./storage/apks")
+	viper.SetDefault("ota.max_upload_mb", 200)
+	viper.SetDefault("ota.public_url", "http://localhost:8080")
+	viper.SetDefault("ota.signing_cert_sha256", "")
+	viper.SetDefault("ota.check_interval", 30)
+	viper.SetDefault("ota.task_timeout", 1800)
+
+	// Diagnostics defaults
+	viper.SetDefault("diagnostics.storage_path", "./storage/diagnostics")
+	viper.SetDefault("diagnostics.request_timeout", 300)
+	viper.SetDefault("diagnostics.max_artifact_mb", 50)
+	viper.SetDefault("diagnostics.chunk_size", 262144)
+	viper.SetDefault("diagnostics.retention_days", 30)
+
+	// USSD session defaults
+	viper.SetDefault("ussd.session_timeout", 120)
+	viper.SetDefault("ussd.max_steps", 20)
+
+	// Balance defaults
+	viper.SetDefault("balance.check_interval", 360)
+	viper.SetDefault("balance.scheduler_interval", 60)
+	viper.SetDefault("balance.check_timeout", 120)
+	viper.SetDefault("balance.failure_alarm_after", 3)
+	viper.SetDefault("balance.low_balance_threshold", 0)
+
+	// Phone number discovery defaults
+	viper.SetDefault("phone_number.auto_discover", true)
+	viper.SetDefault("phone_number.discovery_timeout", 180)
+	viper.SetDefault("phone_number.loopback_fallback", true)
+	viper.SetDefault("phone_number.loopback_prefix", "TSIM verification code")
+
+	// Loopback health test defaults
+	viper.SetDefault("loopback.enabled", true)
+	viper.SetDefault("loopback.test_interval", 240)
+	viper.SetDefault("loopback.scheduler_interval", 60)
+	viper.SetDefault("loopback.timeout", 300)
+	viper.SetDefault("loopback.window", 10)
+	viper.SetDefault("loopback.unhealthy_after", 3)
+	viper.SetDefault("loopback.slow_latency", 30)
+	viper.SetDefault("loopback.message_prefix", "TSIM loopback")
+
+	// Routing score defaults
+	viper.SetDefault("routing.smoothing", 0.1)
+	viper.SetDefault("routing.slow_dlr_latency", 120)
+	viper.SetDefault("routing.error_penalty", 5)
+	viper.SetDefault("routing.severe_error_codes", []string{})
+	viper.SetDefault("routing.severe_error_penalty", 25)
+	viper.SetDefault("routing.penalty_half_life", 6)
+
+	// Quarantine defaults
+	viper.SetDefault("quarantine.enabled", true)
+	viper.SetDefault("quarantine.consecutive_failures", 5)
+	viper.SetDefault("quarantine.error_codes", []string{})
+	viper.SetDefault("quarantine.cooldown", 1440)
+	viper.SetDefault("quarantine.auto_release", true)
+
+	// Media defaults
+	viper.SetDefault("media.storage", "local")
+	viper.SetDefault("media.local_path", "./storage/media")
+	viper.SetDefault("media.max_part_kb", 600)
+	viper.SetDefault("media.max_message_kb", 1024)
+	viper.SetDefault("media.max_parts", 10)
+	viper.SetDefault("media.allowed_types", []string{
+		"image/jpeg", "image/png", "image/gif", "video/3gpp", "video/mp4",
+		"audio/amr", "audio/mpeg", "text/plain", "text/vcard", "text/x-vcard",
+	})
+	viper.SetDefault("media.public_url", "http://localhost:8080")
+	viper.SetDefault("media.s3.endpoint", "")
+	viper.SetDefault("media.s3.region", "us-east-1")
+	viper.SetDefault("media.s3.bucket", "")
+	viper.SetDefault("media.s3.access_key", "")
+	viper.SetDefault("media.s3.secret_key", "")
+
+	// Call defaults
+	viper.SetDefault("calls.max_duration", 120)
+	viper.SetDefault("calls.status_timeout", 60)
+	viper.SetDefault("calls.flash_ring", 5)
+	viper.SetDefault("calls.flash_code_length", 4)
+	viper.SetDefault("calls.flash_ttl", 300)
+	viper.SetDefault("calls.flash_max_attempts", 3)
+
+	// MFA defaults
+	viper.SetDefault("mfa.issuer", "TsimCloud")
+	viper.SetDefault("mfa.challenge_ttl", 300)
+	viper.SetDefault("mfa.max_attempts", 5)
+	viper.SetDefault("mfa.skew", 1)
+	viper.SetDefault("mfa.recovery_codes", 10)
+
+	// OIDC defaults
+	viper.SetDefault("oidc.state_ttl", 600)
+	viper.SetDefault("oidc.http_timeout", 10)
+	viper.SetDefault("oidc.jwks_cache_ttl", 3600)
+
+	// Lockout defaults
+	viper.SetDefault("lockout.max_user_failures", 5)
+	viper.SetDefault("lockout.max_ip_failures", 50)
+	viper.SetDefault("lockout.failure_window", 900)
+	viper.SetDefault("lockout.lockout_duration", 900)
+	viper.SetDefault("lockout.delay_after", 3)
+	viper.SetDefault("lockout.base_delay", 1)
+	viper.SetDefault("lockout.max_delay", 30)
+
+	// Registration defaults
+	viper.SetDefault("registration.mode", "invite")
+	viper.SetDefault("registration.invite_ttl", 72)
+
+	// Sessions defaults
+	viper.SetDefault("sessions.cache_ttl", 300)
+
+	// Password defaults
+	viper.SetDefault("password.min_length", 10)
+	viper.SetDefault("password.max_length", 72)
+	viper.SetDefault("password.require_upper", true)
+	viper.SetDefault("password.require_lower", true)
+	viper.SetDefault("password.require_digit", true)
+	viper.SetDefault("password.require_symbol", false)
+	viper.SetDefault("password.breach_list", "")
+	viper.SetDefault("password.history_size", 5)
+	viper.SetDefault("password.reset_token_ttl", 30)
+	viper.SetDefault("password.reset_interval", 60)
+	viper.SetDefault("password.reset_url", "http://localhost:3000/reset-password")
+
+	// Mail defaults
+	viper.SetDefault("mail.driver", "log")
+	viper.SetDefault("mail.from", "TsimServer <noreply@tsimserver.local>")
+	viper.SetDefault("mail.smtp.host", "localhost")
+	viper.SetDefault("mail.smtp.port", 587)
+	viper.SetDefault("mail.smtp.username", "")
+	viper.SetDefault("mail.smtp.password", "")
+	viper.SetDefault("mail.smtp.tls", "starttls")
+
+	// Audit defaults
+	viper.SetDefault("audit.export_limit", 10000)
+
 	// Logging defaults
 	viper.SetDefault("logging.level", "info")
 }
@@ -5,6 +5,7 @@ import (
 	"log"
 	"tsimserver/config"
 	"tsimserver/models"
+	"tsimserver/tenancy"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -29,32 +30,79 @@ func Connect() error {
 		return fmt.Errorf("failed to connect to database: %v", err)
 	}
 
+	// Scope queries of tenant users to their organization
+	if err := tenancy.Register(DB); err != nil {
+		return fmt.Errorf("failed to register tenant scoping: %v", err)
+	}
+
 	log.Println("Database connection established successfully")
 	return nil
 }
 
 // Migrate runs database migrations
 func Migrate() error {
+	if err := uniqueSIMICCIDs(); err != nil {
+		return fmt.Errorf("failed to prepare SIM card ICCID index: %v", err)
+	}
+
 	err := DB.AutoMigrate(
 		// First create core authentication models
+		&models.Tenant{},
 		&models.User{},
 		&models.Role{},
 		&models.Permission{},
 		&models.Session{},
+		&models.APIKey{},
+		&models.APIKeyUsage{},
+		&models.UserMFA{},
+		&models.MFARecoveryCode{},
+		&models.MFAChallenge{},
+		&models.UserIdentity{},
+		&models.AuthEvent{},
+		&models.AuditEvent{},
+		&models.PasswordHistory{},
+		&models.PasswordReset{},
 		&models.UserRole{},
 		&models.RolePermission{},
+		&models.Invitation{},
 
 		// Then create site and device management models
 		&models.Site{},
+		&models.Geofence{},
 		&models.DeviceGroup{},
 		&models.Device{},
+		&models.DeviceFenceState{},
+		&models.DeviceGroupConfig{},
+		&models.DeviceConfigState{},
 		&models.SIMCard{},
+		&models.SIMCardEvent{},
+		&models.OperatorBalanceConfig{},
+		&models.SIMBalanceCheck{},
+		&models.OperatorNumberConfig{},
+		&models.PhoneNumberDiscovery{},
+		&models.SIMLoopbackTest{},
+		&models.SIMRoutingStats{},
+		&models.SIMQuarantine{},
+		&models.Conversation{},
+		&models.MMSMessage{},
+		&models.MMSMedia{},
+		&models.CallLog{},
+		&models.FlashCallVerification{},
 		&models.DeviceStatus{},
 
 		// Then create dependent models
 		&models.SMSMessage{},
 		&models.USSDCommand{},
+		&models.USSDSession{},
+		&models.USSDSessionStep{},
 		&models.Alarm{},
+		&models.TelemetrySample{},
+		&models.TelemetryRollup{},
+		&models.AppRelease{},
+		&models.AppRollout{},
+		&models.AppUpdateTask{},
+		&models.DiagnosticRequest{},
+		&models.DiagnosticArtifact{},
 
 		// Finally create world data models
 		&models.Region{},
@@ -68,10 +116,56 @@ func Migrate() error {
 		return fmt.Errorf("failed to migrate database: %v", err)
 	}
 
+	if err := protectAuditLog(); err != nil {
+		return fmt.Errorf("failed to protect audit log: %v", err)
+	}
+
 	log.Println("Database migration completed successfully")
 	return nil
 }
 
+// uniqueSIMICCIDs prepares inventories from before the unique ICCID index: it drops the
+// plain index and clears the ICCID of all but the latest record of a card recorded twice
+func uniqueSIMICCIDs() error {
+	if !DB.Migrator().HasColumn(&models.SIMCard{}, "iccid") {
+		return nil
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`DROP INDEX IF EXISTS idx_sim_cards_iccid`).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`UPDATE sim_cards SET iccid = '' WHERE iccid <> '' AND id NOT IN (
+	SELECT DISTINCT ON (iccid) id FROM sim_cards WHERE iccid <> '' ORDER BY iccid, updated_at DESC, id DESC)`).Error
+	})
+}
+
+// protectAuditLog makes the audit_events table append-only in the database itself, so raw
+// SQL and unscoped deletes cannot change or remove events either
+func protectAuditLog() error {
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events`,
+		`CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+	FOR EACH ROW EXECUTE FUNCTION audit_events_append_only()`,
+		`DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events`,
+		`CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+	FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only()`,
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Close closes database connection
 func Close() error {
 	if DB != nil {
@@ -95,27 +189,64 @@ func Reset() error {
 		return fmt.Errorf("database connection is not initialized")
 	}
 
-	// Drop all tables (in reverse dependency order)
+	// Drop all tables (in reverse dependency order). The audit log is kept.
 	err := DB.Migrator().DropTable(
 		&models.City{},
 		&models.State{},
 		&models.Country{},
 		&models.Subregion{},
 		&models.Region{},
+		&models.DiagnosticArtifact{},
+		&models.DiagnosticRequest{},
+		&models.AppUpdateTask{},
+		&models.AppRollout{},
+		&models.AppRelease{},
+		&models.TelemetryRollup{},
+		&models.TelemetrySample{},
 		&models.Alarm{},
+		&models.USSDSessionStep{},
+		&models.USSDSession{},
 		&models.USSDCommand{},
 		&models.SMSMessage{},
 		&models.DeviceStatus{},
+		&models.FlashCallVerification{},
+		&models.CallLog{},
+		&models.MMSMedia{},
+		&models.MMSMessage{},
+		&models.Conversation{},
+		&models.SIMQuarantine{},
+		&models.SIMRoutingStats{},
+		&models.SIMLoopbackTest{},
+		&models.PhoneNumberDiscovery{},
+		&models.OperatorNumberConfig{},
+		&models.SIMBalanceCheck{},
+		&models.OperatorBalanceConfig{},
+		&models.SIMCardEvent{},
 		&models.SIMCard{},
+		&models.DeviceConfigState{},
+		&models.DeviceGroupConfig{},
+		&models.DeviceFenceState{},
 		&models.Device{},
 		&models.DeviceGroup{},
+		&models.Geofence{},
 		&models.Site{},
+		&models.Invitation{},
 		&models.RolePermission{},
 		&models.UserRole{},
 		&models.Permission{},
 		&models.Role{},
+		&models.PasswordReset{},
+		&models.PasswordHistory{},
+		&models.AuthEvent{},
+		&models.UserIdentity{},
+		&models.MFAChallenge{},
+		&models.MFARecoveryCode{},
+		&models.UserMFA{},
+		&models.APIKeyUsage{},
+		&models.APIKey{},
 		&models.Session{},
 		&models.User{},
+		&models.Tenant{},
 	)
 	if err != nil {
 		return fmt.Errorf("failed to drop tables: %v", err)
@@ -0,0 +1,242 @@
+package deviceconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/dispatch"
+	"tsimserver/models"
+	"tsimserver/types"
+
+	"gorm.io/gorm"
+)
+
+// validLogLevels are the log levels understood by the Android client
+var validLogLevels = map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
+
+// Defaults returns the server-wide default settings from configuration
+func Defaults() models.DeviceSettings {
+	cfg := config.AppConfig.Device
+	heartbeat := cfg.HeartbeatInterval
+	status := cfg.StatusInterval
+	throttle := cfg.SendThrottle
+	logLevel := cfg.LogLevel
+	ussdTimeout := cfg.USSDTimeout
+
+	return models.DeviceSettings{
+		HeartbeatInterval: &heartbeat,
+		StatusInterval:    &status,
+		SendThrottle:      &throttle,
+		LogLevel:          &logLevel,
+		USSDTimeout:       &ussdTimeout,
+	}
+}
+
+// Merge overlays the fields set in override onto base
+func Merge(base, override models.DeviceSettings) models.DeviceSettings {
+	merged := base
+	if override.HeartbeatInterval != nil {
+		merged.HeartbeatInterval = override.HeartbeatInterval
+	}
+	if override.StatusInterval != nil {
+		merged.StatusInterval = override.StatusInterval
+	}
+	if override.SendThrottle != nil {
+		merged.SendThrottle = override.SendThrottle
+	}
+	if override.EnabledSIMSlots != nil {
+		merged.EnabledSIMSlots = override.EnabledSIMSlots
+	}
+	if override.LogLevel != nil {
+		merged.LogLevel = override.LogLevel
+	}
+	if override.USSDTimeout != nil {
+		merged.USSDTimeout = override.USSDTimeout
+	}
+	return merged
+}
+
+// Validate rejects settings the client cannot apply
+func Validate(settings models.DeviceSettings) error {
+	if settings.HeartbeatInterval != nil && *settings.HeartbeatInterval < 5 {
+		return errors.New("heartbeat_interval must be at least 5 seconds")
+	}
+	if settings.StatusInterval != nil && *settings.StatusInterval < 5 {
+		return errors.New("status_interval must be at least 5 seconds")
+	}
+	if settings.SendThrottle != nil && *settings.SendThrottle < 0 {
+		return errors.New("send_throttle cannot be negative")
+	}
+	if settings.USSDTimeout != nil && *settings.USSDTimeout <= 0 {
+		return errors.New("ussd_timeout must be positive")
+	}
+	if settings.LogLevel != nil && !validLogLevels[*settings.LogLevel] {
+		return errors.New("log_level must be one of debug, info, warn, error")
+	}
+	for _, slot := range settings.EnabledSIMSlots {
+		if slot < 0 {
+			return errors.New("enabled_sim_slots cannot contain negative slots")
+		}
+	}
+	return nil
+}
+
+// Drift returns the names of settings whose reported value differs from the desired one
+func Drift(desired, reported models.DeviceSettings) []string {
+	want := toMap(desired)
+	got := toMap(reported)
+
+	var drift []string
+	for key, value := range want {
+		if !reflect.DeepEqual(value, got[key]) {
+			drift = append(drift, key)
+		}
+	}
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			drift = append(drift, key)
+		}
+	}
+
+	sort.Strings(drift)
+	return drift
+}
+
+// State returns the configuration state of a device, creating it if needed
+func State(deviceID string) (*models.DeviceConfigState, error) {
+	var state models.DeviceConfigState
+	err := database.DB.Where("device_id = ?", deviceID).First(&state).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		state = models.DeviceConfigState{DeviceID: deviceID}
+		if err := database.DB.Create(&state).Error; err != nil {
+			return nil, err
+		}
+		return &state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// GroupSettings returns the settings defined for a device group
+func GroupSettings(groupID uint) (models.DeviceSettings, error) {
+	var groupConfig models.DeviceGroupConfig
+	result := database.DB.Where("device_group_id = ?", groupID).Limit(1).Find(&groupConfig)
+	return groupConfig.Settings, result.Error
+}
+
+// Reconcile recomputes the desired settings of a device from defaults, its
+// group and its overrides, bumping the version when they changed
+func Reconcile(deviceID string) (*models.DeviceConfigState, error) {
+	var device models.Device
+	if err := database.DB.Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return nil, err
+	}
+
+	state, err := State(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := Defaults()
+	if device.DeviceGroupID != nil {
+		groupSettings, err := GroupSettings(*device.DeviceGroupID)
+		if err != nil {
+			return nil, err
+		}
+		desired = Merge(desired, groupSettings)
+	}
+	desired = Merge(desired, state.Overrides)
+
+	if state.DesiredVersion == 0 || len(Drift(desired, state.Desired)) > 0 {
+		state.Desired = desired
+		state.DesiredVersion++
+	}
+	state.InSync = state.ReportedVersion == state.DesiredVersion && len(Drift(state.Desired, state.Reported)) == 0
+
+	if err := database.DB.Save(state).Error; err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Push sends the desired configuration of a device as a config_update command
+func Push(state *models.DeviceConfigState) error {
+	command := types.ConfigUpdateCommand{
+		Type:     "config_update",
+		Version:  state.DesiredVersion,
+		Settings: state.Desired,
+	}
+
+	if err := dispatch.ToDevice(state.DeviceID, command); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	state.PushedAt = &now
+	return database.DB.Model(state).Update("pushed_at", now).Error
+}
+
+// ReconcileAndPush reconciles a device and pushes its configuration when it is not in sync
+func ReconcileAndPush(deviceID string) (*models.DeviceConfigState, error) {
+	state, err := Reconcile(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if state.InSync {
+		return state, nil
+	}
+	return state, Push(state)
+}
+
+// ReconcileGroup reconciles and pushes every device of a group
+func ReconcileGroup(groupID uint) (int, error) {
+	var deviceIDs []string
+	if err := database.DB.Model(&models.Device{}).Where("device_group_id = ?", groupID).
+		Pluck("device_id", &deviceIDs).Error; err != nil {
+		return 0, err
+	}
+
+	for _, deviceID := range deviceIDs {
+		if _, err := ReconcileAndPush(deviceID); err != nil {
+			return 0, err
+		}
+	}
+	return len(deviceIDs), nil
+}
+
+// ApplyReport stores the configuration a device reports as applied
+func ApplyReport(deviceID string, report types.ConfigReport) error {
+	var reported models.DeviceSettings
+	if len(report.Settings) > 0 {
+		if err := json.Unmarshal(report.Settings, &reported); err != nil {
+			return err
+		}
+	}
+
+	state, err := State(deviceID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	state.Reported = reported
+	state.ReportedVersion = report.Version
+	state.ReportedAt = &now
+	state.InSync = state.ReportedVersion == state.DesiredVersion && len(Drift(state.Desired, state.Reported)) == 0
+
+	return database.DB.Save(state).Error
+}
+
+// toMap flattens settings to comparable JSON values
+func toMap(settings models.DeviceSettings) map[string]interface{} {
+	data, _ := json.Marshal(settings)
+	values := make(map[string]interface{})
+	json.Unmarshal(data, &values)
+	return values
+}
@@ -0,0 +1,136 @@
+package diagnostics
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/types"
+)
+
+// unsafeFileChars are replaced in device supplied file names
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// storeChunk writes one chunk and returns how many chunks and bytes are stored for the request
+func storeChunk(requestID uint, chunk types.DiagnosticChunk) (int, int64, error) {
+	data, err := base64.StdEncoding.DecodeString(chunk.Data)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid chunk data: %v", err)
+	}
+
+	dir := chunkDir(requestID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, 0, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, chunkName(chunk.Index)), data, 0644); err != nil {
+		return 0, 0, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return 0, 0, err
+		}
+		size += info.Size()
+	}
+	return len(entries), size, nil
+}
+
+// assemble concatenates the chunks of a request into an artifact file and records it
+func assemble(request *models.DiagnosticRequest, chunk types.DiagnosticChunk) (*models.DiagnosticArtifact, error) {
+	dir := chunkDir(request.ID)
+	artifactDir := filepath.Join(config.AppConfig.Diagnostics.StoragePath, "artifacts")
+	if err := os.MkdirAll(artifactDir, 0755); err != nil {
+		return nil, err
+	}
+
+	fileName := sanitizeFileName(chunk.FileName, request.Command)
+	path := filepath.Join(artifactDir, fmt.Sprintf("%d-%s", request.ID, fileName))
+
+	out, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	writer := io.MultiWriter(out, hasher)
+	var size int64
+	for i := 0; i < chunk.Total; i++ {
+		part, err := os.Open(filepath.Join(dir, chunkName(i)))
+		if err != nil {
+			out.Close()
+			os.Remove(path)
+			return nil, fmt.Errorf("missing chunk %d", i)
+		}
+		n, err := io.Copy(writer, part)
+		part.Close()
+		if err != nil {
+			out.Close()
+			os.Remove(path)
+			return nil, err
+		}
+		size += n
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if chunk.SHA256 != "" && !strings.EqualFold(chunk.SHA256, checksum) {
+		os.Remove(path)
+		return nil, fmt.Errorf("checksum mismatch: expected %s, got %s", chunk.SHA256, checksum)
+	}
+
+	contentType := chunk.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	artifact := models.DiagnosticArtifact{
+		DiagnosticRequestID: request.ID,
+		DeviceID:            request.DeviceID,
+		Kind:                request.Command,
+		FileName:            fileName,
+		FilePath:            path,
+		ContentType:         contentType,
+		Size:                size,
+		SHA256:              checksum,
+	}
+	if err := database.DB.Create(&artifact).Error; err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	removeChunks(request.ID)
+	return &artifact, nil
+}
+
+// chunkName returns the file name of a stored chunk
+func chunkName(index int) string {
+	return strconv.Itoa(index) + ".part"
+}
+
+// sanitizeFileName keeps device supplied names inside the artifact directory
+func sanitizeFileName(name, fallback string) string {
+	name = unsafeFileChars.ReplaceAllString(filepath.Base(name), "_")
+	if name == "" || name == "." || name == ".." || name == "_" {
+		return fallback
+	}
+	return name
+}
@@ -0,0 +1,312 @@
+package diagnostics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/dispatch"
+	"tsimserver/models"
+	"tsimserver/types"
+)
+
+// Diagnostic commands understood by the Android client
+const (
+	CommandLogs         = "logs"
+	CommandScreenshot   = "screenshot"
+	CommandPing         = "ping"
+	CommandConnectivity = "connectivity"
+	CommandReboot       = "reboot"
+	CommandRestartApp   = "restart_app"
+)
+
+// Request states
+const (
+	StatusPending   = "pending"
+	StatusSent      = "sent"
+	StatusReceiving = "receiving"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusTimeout   = "timeout"
+)
+
+// artifactCommands are answered with a chunked file upload
+var artifactCommands = map[string]bool{
+	CommandLogs:       true,
+	CommandScreenshot: true,
+}
+
+// validCommands lists every supported diagnostic command
+var validCommands = map[string]bool{
+	CommandLogs:         true,
+	CommandScreenshot:   true,
+	CommandPing:         true,
+	CommandConnectivity: true,
+	CommandReboot:       true,
+	CommandRestartApp:   true,
+}
+
+// ErrDeviceOffline is returned when a diagnostic is requested from a disconnected device
+var ErrDeviceOffline = errors.New("device is not online")
+
+// IsValidCommand reports whether a diagnostic command is supported
+func IsValidCommand(command string) bool {
+	return validCommands[command]
+}
+
+// Request creates a diagnostic request and sends it to the device
+func Request(deviceID, command string, params json.RawMessage, requestedBy uint) (*models.DiagnosticRequest, error) {
+	if !IsValidCommand(command) {
+		return nil, fmt.Errorf("unknown diagnostic command %q", command)
+	}
+	if len(params) > 0 && !json.Valid(params) {
+		return nil, errors.New("params must be valid JSON")
+	}
+
+	var device models.Device
+	if err := database.DB.Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return nil, err
+	}
+	if device.OperatorStatus != "online" {
+		return nil, ErrDeviceOffline
+	}
+
+	request := models.DiagnosticRequest{
+		DeviceID:    deviceID,
+		Command:     command,
+		Params:      string(params),
+		Status:      StatusPending,
+		RequestedBy: requestedBy,
+	}
+	if err := database.DB.Create(&request).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	message := types.DiagnosticCommand{
+		Type:      "diagnostic_request",
+		RequestID: request.ID,
+		Command:   command,
+		Params:    params,
+		SentAt:    now.UnixMilli(),
+	}
+	if artifactCommands[command] {
+		message.ChunkSize = config.AppConfig.Diagnostics.ChunkSize
+	}
+
+	if err := dispatch.ToDevice(deviceID, message); err != nil {
+		fail(&request, StatusFailed, err.Error())
+		return &request, err
+	}
+
+	request.Status = StatusSent
+	request.SentAt = &now
+	if err := database.DB.Model(&request).Updates(map[string]interface{}{
+		"status":  StatusSent,
+		"sent_at": now,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// ApplyResult records the answer of a device to a diagnostic request
+func ApplyResult(deviceID string, result types.DiagnosticResult) error {
+	request, err := openRequest(deviceID, result.RequestID)
+	if err != nil || request == nil {
+		return err
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"result": string(result.Result),
+	}
+	if request.SentAt != nil && request.LatencyMs == 0 {
+		updates["latency_ms"] = now.Sub(*request.SentAt).Milliseconds()
+	}
+
+	switch {
+	case !result.Success:
+		updates["status"] = StatusFailed
+		updates["error_message"] = result.ErrorMessage
+		updates["completed_at"] = now
+		removeChunks(request.ID)
+	case artifactCommands[request.Command]:
+		// The device accepted the request, the file follows as chunks
+		if request.Status == StatusSent {
+			updates["status"] = StatusReceiving
+		}
+	default:
+		updates["status"] = StatusCompleted
+		updates["completed_at"] = now
+	}
+
+	return database.DB.Model(request).Updates(updates).Error
+}
+
+// ApplyChunk stores one uploaded chunk and assembles the artifact once all chunks arrived
+func ApplyChunk(deviceID string, chunk types.DiagnosticChunk) error {
+	request, err := openRequest(deviceID, chunk.RequestID)
+	if err != nil || request == nil {
+		return err
+	}
+
+	if !artifactCommands[request.Command] {
+		return fmt.Errorf("diagnostic request %d does not accept uploads", request.ID)
+	}
+	if chunk.Total <= 0 || chunk.Index < 0 || chunk.Index >= chunk.Total {
+		return fmt.Errorf("invalid chunk %d of %d for diagnostic request %d", chunk.Index, chunk.Total, request.ID)
+	}
+	if request.ChunksTotal != 0 && request.ChunksTotal != chunk.Total {
+		return fmt.Errorf("chunk count changed from %d to %d for diagnostic request %d", request.ChunksTotal, chunk.Total, request.ID)
+	}
+
+	// Chunks are written as separate files so duplicates and reordering are harmless
+	received, size, err := storeChunk(request.ID, chunk)
+	if err != nil {
+		return err
+	}
+
+	maxSize := int64(config.AppConfig.Diagnostics.MaxArtifactMB) * 1024 * 1024
+	if maxSize > 0 && size > maxSize {
+		removeChunks(request.ID)
+		return fail(request, StatusFailed, fmt.Sprintf("upload exceeds the %d MB artifact limit", config.AppConfig.Diagnostics.MaxArtifactMB))
+	}
+
+	if received < chunk.Total {
+		return database.DB.Model(request).Updates(map[string]interface{}{
+			"status":          StatusReceiving,
+			"chunks_total":    chunk.Total,
+			"chunks_received": received,
+		}).Error
+	}
+
+	artifact, err := assemble(request, chunk)
+	if err != nil {
+		removeChunks(request.ID)
+		return fail(request, StatusFailed, err.Error())
+	}
+
+	now := time.Now()
+	return database.DB.Model(request).Updates(map[string]interface{}{
+		"status":          StatusCompleted,
+		"chunks_total":    chunk.Total,
+		"chunks_received": received,
+		"completed_at":    now,
+		"error_message":   "",
+		"result":          fmt.Sprintf(`{"artifact_id":%d}`, artifact.ID),
+	}).Error
+}
+
+// StartMonitor starts the background job that times out requests and applies artifact retention
+func StartMonitor() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		lastCleanup := time.Time{}
+		for now := range ticker.C {
+			expireRequests(now)
+
+			if now.Sub(lastCleanup) >= time.Hour {
+				if err := ApplyRetention(now); err != nil {
+					log.Printf("Diagnostics retention failed: %v", err)
+				}
+				lastCleanup = now
+			}
+		}
+	}()
+
+	log.Println("Diagnostics monitor started")
+}
+
+// ApplyRetention deletes artifacts past their retention together with their files
+func ApplyRetention(now time.Time) error {
+	days := config.AppConfig.Diagnostics.RetentionDays
+	if days <= 0 {
+		return nil
+	}
+
+	var artifacts []models.DiagnosticArtifact
+	if err := database.DB.Where("created_at < ?", now.AddDate(0, 0, -days)).Find(&artifacts).Error; err != nil {
+		return err
+	}
+
+	for _, artifact := range artifacts {
+		if err := os.Remove(artifact.FilePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove diagnostic artifact %s: %v", artifact.FilePath, err)
+			continue
+		}
+		database.DB.Delete(&artifact)
+	}
+	return nil
+}
+
+// expireRequests fails requests the device stopped answering
+func expireRequests(now time.Time) {
+	timeout := time.Duration(config.AppConfig.Diagnostics.RequestTimeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+
+	var requests []models.DiagnosticRequest
+	if err := database.DB.Where("status IN ? AND updated_at < ?",
+		[]string{StatusPending, StatusSent, StatusReceiving}, now.Add(-timeout)).
+		Find(&requests).Error; err != nil {
+		log.Printf("Failed to load stale diagnostic requests: %v", err)
+		return
+	}
+
+	for i := range requests {
+		removeChunks(requests[i].ID)
+		if err := fail(&requests[i], StatusTimeout, "device did not answer in time"); err != nil {
+			log.Printf("Failed to expire diagnostic request %d: %v", requests[i].ID, err)
+		}
+	}
+}
+
+// openRequest returns an unfinished request of the device, or nil for late answers
+func openRequest(deviceID string, requestID uint) (*models.DiagnosticRequest, error) {
+	var request models.DiagnosticRequest
+	if err := database.DB.Where("id = ? AND device_id = ?", requestID, deviceID).First(&request).Error; err != nil {
+		return nil, fmt.Errorf("diagnostic request %d not found for device %s", requestID, deviceID)
+	}
+
+	switch request.Status {
+	case StatusCompleted, StatusFailed, StatusTimeout:
+		return nil, nil
+	}
+	return &request, nil
+}
+
+// fail moves a request to a final error state
+func fail(request *models.DiagnosticRequest, status, message string) error {
+	now := time.Now()
+	request.Status = status
+	request.ErrorMessage = message
+	request.CompletedAt = &now
+	return database.DB.Model(request).Updates(map[string]interface{}{
+		"status":        status,
+		"error_message": message,
+		"completed_at":  now,
+	}).Error
+}
+
+// chunkDir is where the chunks of a request are kept until assembly
+func chunkDir(requestID uint) string {
+	return filepath.Join(config.AppConfig.Diagnostics.StoragePath, "chunks", strconv.FormatUint(uint64(requestID), 10))
+}
+
+// removeChunks deletes the stored chunks of a request
+func removeChunks(requestID uint) {
+	if err := os.RemoveAll(chunkDir(requestID)); err != nil {
+		log.Printf("Failed to remove chunks of diagnostic request %d: %v", requestID, err)
+	}
+}
@@ -0,0 +1,23 @@
+package dispatch
+
+import "errors"
+
+// Sender delivers a message to a connected device. The WebSocket hub implements it.
+type Sender interface {
+	SendMessageToDevice(deviceID string, message interface{}) error
+}
+
+var sender Sender
+
+// SetSender registers the sender used to reach devices
+func SetSender(s Sender) {
+	sender = s
+}
+
+// ToDevice sends a command to a device through the registered sender
+func ToDevice(deviceID string, message interface{}) error {
+	if sender == nil {
+		return errors.New("WebSocket hub not initialized")
+	}
+	return sender.SendMessageToDevice(deviceID, message)
+}
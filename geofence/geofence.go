@@ -0,0 +1,222 @@
+package geofence
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+	"tsimserver/alarms"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+
+	"gorm.io/gorm"
+)
+
+// Fence types
+const (
+	TypeRadius  = "radius"
+	TypePolygon = "polygon"
+)
+
+// Alarm types raised by geofencing
+const (
+	AlarmFenceExit    = "geofence_exit"
+	AlarmLocationJump = "location_jump"
+)
+
+const earthRadiusMeters = 6371000.0
+
+// ParsePolygon decodes a polygon stored as a JSON array of [latitude, longitude] pairs
+func ParsePolygon(raw string) ([][2]float64, error) {
+	var points [][2]float64
+	if err := json.Unmarshal([]byte(raw), &points); err != nil {
+		return nil, fmt.Errorf("invalid polygon: %v", err)
+	}
+	if len(points) < 3 {
+		return nil, errors.New("polygon needs at least 3 points")
+	}
+	return points, nil
+}
+
+// Validate checks that a fence definition is usable
+func Validate(fence *models.Geofence) error {
+	switch fence.FenceType {
+	case TypeRadius:
+		if fence.RadiusMeters <= 0 {
+			return errors.New("radius_meters must be positive")
+		}
+	case TypePolygon:
+		if _, err := ParsePolygon(fence.Polygon); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown fence type %q", fence.FenceType)
+	}
+	return nil
+}
+
+// Contains reports whether a point lies inside the fence of a site
+func Contains(fence *models.Geofence, site *models.Site, latitude, longitude float64) (bool, error) {
+	switch fence.FenceType {
+	case TypeRadius:
+		return Distance(site.Latitude, site.Longitude, latitude, longitude) <= fence.RadiusMeters, nil
+	case TypePolygon:
+		points, err := ParsePolygon(fence.Polygon)
+		if err != nil {
+			return false, err
+		}
+		return pointInPolygon(points, latitude, longitude), nil
+	}
+	return false, fmt.Errorf("unknown fence type %q", fence.FenceType)
+}
+
+// Distance returns the great-circle distance in meters between two coordinates
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// pointInPolygon uses ray casting; fences are small enough to treat coordinates as planar
+func pointInPolygon(points [][2]float64, latitude, longitude float64) bool {
+	inside := false
+	for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+		latI, lonI := points[i][0], points[i][1]
+		latJ, lonJ := points[j][0], points[j][1]
+
+		if (lonI > longitude) != (lonJ > longitude) &&
+			latitude < (latJ-latI)*(longitude-lonI)/(lonJ-lonI)+latI {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Check evaluates a reported device position against its site fence and its
+// previous position, updates the fence state and raises alarms
+func Check(deviceID string, latitude, longitude float64, at time.Time) error {
+	// 0,0 means the device has no location fix
+	if latitude == 0 && longitude == 0 {
+		return nil
+	}
+
+	var state models.DeviceFenceState
+	result := database.DB.Where("device_id = ?", deviceID).Limit(1).Find(&state)
+	if result.Error != nil {
+		return result.Error
+	}
+	hasPrevious := result.RowsAffected > 0
+
+	if hasPrevious {
+		checkJump(deviceID, &state, latitude, longitude, at)
+	}
+
+	state.DeviceID = deviceID
+	state.Latitude = latitude
+	state.Longitude = longitude
+	state.CheckedAt = at
+
+	site, fence, err := siteFence(deviceID)
+	if err != nil {
+		return err
+	}
+
+	if site != nil {
+		state.SiteID = site.ID
+		state.DistanceMeters = Distance(site.Latitude, site.Longitude, latitude, longitude)
+	}
+
+	if fence != nil {
+		inside, err := Contains(fence, site, latitude, longitude)
+		if err != nil {
+			return err
+		}
+
+		wasInside := !hasPrevious || state.Inside
+		state.Inside = inside
+
+		switch {
+		case wasInside && !inside:
+			state.ExitedAt = &at
+			message := fmt.Sprintf("Device %s left the geofence of site %s (%.0f m from site center)",
+				deviceID, site.Name, state.DistanceMeters)
+			if _, _, err := alarms.RaiseOnce(deviceID, AlarmFenceExit, "Device left geofence", message, "high"); err != nil {
+				log.Printf("Failed to raise geofence alarm for device %s: %v", deviceID, err)
+			}
+		case !wasInside && inside:
+			state.ExitedAt = nil
+			if err := alarms.Resolve(deviceID, AlarmFenceExit); err != nil {
+				log.Printf("Failed to resolve geofence alarm for device %s: %v", deviceID, err)
+			}
+		}
+	} else {
+		// No fence configured, nothing to be outside of
+		state.Inside = true
+		state.ExitedAt = nil
+	}
+
+	return database.DB.Save(&state).Error
+}
+
+// checkJump raises an alarm when the position changed faster than a device can move
+func checkJump(deviceID string, previous *models.DeviceFenceState, latitude, longitude float64, at time.Time) {
+	cfg := config.AppConfig.Geofence
+	if cfg.MaxSpeedKmh <= 0 {
+		return
+	}
+
+	distance := Distance(previous.Latitude, previous.Longitude, latitude, longitude)
+	if distance < cfg.MinJumpMeters {
+		previous.LastJumpKmh = 0
+		return
+	}
+
+	elapsed := at.Sub(previous.CheckedAt).Hours()
+	if elapsed <= 0 {
+		elapsed = 1.0 / 3600 // Same-second reports count as one second apart
+	}
+
+	speed := distance / 1000 / elapsed
+	previous.LastJumpKmh = speed
+	if speed <= cfg.MaxSpeedKmh {
+		return
+	}
+
+	message := fmt.Sprintf("Device %s position jumped %.0f m in %s (%.0f km/h)",
+		deviceID, distance, at.Sub(previous.CheckedAt).Round(time.Second), speed)
+	if _, err := alarms.Raise(deviceID, AlarmLocationJump, "Implausible location change", message, "medium"); err != nil {
+		log.Printf("Failed to raise location jump alarm for device %s: %v", deviceID, err)
+	}
+}
+
+// siteFence resolves the site of a device through its group and the site's active fence
+func siteFence(deviceID string) (*models.Site, *models.Geofence, error) {
+	var device models.Device
+	if err := database.DB.Preload("DeviceGroup.Site").Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return nil, nil, err
+	}
+
+	if device.DeviceGroup == nil {
+		return nil, nil, nil
+	}
+	site := &device.DeviceGroup.Site
+
+	var fence models.Geofence
+	err := database.DB.Where("site_id = ? AND is_active = ?", site.ID, true).First(&fence).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return site, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return site, &fence, nil
+}
@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"strconv"
-	"tsimserver/database"
 	"tsimserver/models"
 
 	"github.com/gofiber/fiber/v2"
@@ -15,7 +14,7 @@ func GetAlarms(c *fiber.Ctx) error {
 	severity := c.Query("severity")
 	limit := c.QueryInt("limit", 100)
 
-	query := database.DB.Model(&models.Alarm{})
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.Alarm{}), "alarms")
 
 	if deviceID != "" {
 		query = query.Where("device_id = ?", deviceID)
@@ -55,7 +54,7 @@ func GetAlarm(c *fiber.Ctx) error {
 	}
 
 	var alarm models.Alarm
-	if err := database.DB.Where("id = ?", alarmID).First(&alarm).Error; err != nil {
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "alarms").Where("id = ?", alarmID).First(&alarm).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Alarm not found",
 		})
@@ -75,14 +74,14 @@ func ResolveAlarm(c *fiber.Ctx) error {
 	}
 
 	var alarm models.Alarm
-	if err := database.DB.Where("id = ?", alarmID).First(&alarm).Error; err != nil {
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "alarms").Where("id = ?", alarmID).First(&alarm).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Alarm not found",
 		})
 	}
 
 	alarm.Resolved = true
-	if err := database.DB.Save(&alarm).Error; err != nil {
+	if err := tenantDB(c).Save(&alarm).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to resolve alarm",
 		})
@@ -104,7 +103,7 @@ func DeleteAlarm(c *fiber.Ctx) error {
 		})
 	}
 
-	if err := database.DB.Delete(&models.Alarm{}, alarmID).Error; err != nil {
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "alarms").Delete(&models.Alarm{}, alarmID).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to delete alarm",
 		})
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"tsimserver/apikeys"
+	"tsimserver/audit"
+	"tsimserver/database"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiKeyRequest is the body of API key create and update requests
+type apiKeyRequest struct {
+	Name           *string    `json:"name"`
+	Description    *string    `json:"description"`
+	Permissions    []string   `json:"permissions"`      // resource:action pairs, resource:* for every action
+	SiteIDs        []uint     `json:"site_ids"`         // empty for all sites
+	DeviceGroupIDs []uint     `json:"device_group_ids"` // empty for all device groups
+	AllowedIPs     []string   `json:"allowed_ips"`      // IPs or CIDR ranges, empty for any
+	RateLimit      *int       `json:"rate_limit"`       // requests per minute, 0 is unlimited
+	ExpiresAt      *time.Time `json:"expires_at"`
+	IsActive       *bool      `json:"is_active"`
+}
+
+// GetAPIKeys returns API keys with pagination
+func GetAPIKeys(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	userID := c.QueryInt("user_id", 0)
+
+	offset := (page - 1) * limit
+
+	query := tenantDB(c).Model(&models.APIKey{})
+	if userID > 0 {
+		query = query.Where("user_id = ?", userID)
+	}
+	if c.Query("active") == "true" {
+		query = query.Where("is_active = ?", true)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get keys with pagination
+	var keys []models.APIKey
+	result := query.Preload("User").Order("created_at DESC").Offset(offset).Limit(limit).Find(&keys)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch API keys",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"api_keys": keys,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetAPIKey returns a specific API key with its usage over the last 30 days
+func GetAPIKey(c *fiber.Ctx) error {
+	keyIDStr := c.Params("id")
+	keyID, err := strconv.ParseUint(keyIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid API key ID",
+		})
+	}
+
+	var key models.APIKey
+	if err := tenantDB(c).Preload("User").Where("id = ?", uint(keyID)).First(&key).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "API key not found",
+		})
+	}
+
+	var usage []models.APIKeyUsage
+	since := time.Now().AddDate(0, 0, -30).Format("2006-01-02")
+	tenantDB(c).Where("api_key_id = ? AND day >= ?", key.ID, since).Order("day DESC").Find(&usage)
+
+	return c.JSON(fiber.Map{
+		"api_key": key,
+		"usage":   usage,
+	})
+}
+
+// CreateAPIKey creates an API key owned by the current user. The key itself is only
+// returned in this response.
+func CreateAPIKey(c *fiber.Ctx) error {
+	var req apiKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Name == nil || strings.TrimSpace(*req.Name) == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "name is required",
+		})
+	}
+	if len(req.Permissions) == 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "At least one permission is required",
+		})
+	}
+
+	key := models.APIKey{
+		Name:     strings.TrimSpace(*req.Name),
+		IsActive: true,
+	}
+	if userID, ok := c.Locals("user_id").(uint); ok {
+		key.UserID = userID
+	}
+	if msg := applyAPIKeyRequest(c, &key, &req); msg != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	plain, err := apikeys.Generate(&key)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to generate API key",
+		})
+	}
+	if err := tenantDB(c).Create(&key).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to create API key",
+		})
+	}
+	audit.Change(c, "api_keys", strconv.FormatUint(uint64(key.ID), 10), nil, &key)
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "API key created. Store the key now, it cannot be shown again",
+		"key":     plain,
+		"api_key": key,
+	})
+}
+
+// UpdateAPIKey updates the name, scopes and limits of an API key
+func UpdateAPIKey(c *fiber.Ctx) error {
+	keyIDStr := c.Params("id")
+	keyID, err := strconv.ParseUint(keyIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid API key ID",
+		})
+	}
+
+	var key models.APIKey
+	if err := tenantDB(c).Where("id = ?", uint(keyID)).First(&key).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "API key not found",
+		})
+	}
+	if key.RevokedAt != nil {
+		return c.Status(409).JSON(fiber.Map{
+			"error": "API key is revoked",
+		})
+	}
+	before := key
+
+	var req apiKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Name != nil && strings.TrimSpace(*req.Name) != "" {
+		key.Name = strings.TrimSpace(*req.Name)
+	}
+	if msg := applyAPIKeyRequest(c, &key, &req); msg != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	if err := tenantDB(c).Save(&key).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to update API key",
+		})
+	}
+	audit.Change(c, "api_keys", keyIDStr, &before, &key)
+
+	return c.JSON(key)
+}
+
+// RevokeAPIKey permanently disables an API key
+func RevokeAPIKey(c *fiber.Ctx) error {
+	keyIDStr := c.Params("id")
+	keyID, err := strconv.ParseUint(keyIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid API key ID",
+		})
+	}
+
+	var key models.APIKey
+	if err := tenantDB(c).Where("id = ?", uint(keyID)).First(&key).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "API key not found",
+		})
+	}
+
+	before := key
+	now := time.Now()
+	if err := tenantDB(c).Model(&key).Updates(map[string]interface{}{
+		"is_active":  false,
+		"revoked_at": now,
+	}).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to revoke API key",
+		})
+	}
+	key.IsActive = false
+	key.RevokedAt = &now
+	audit.Change(c, "api_keys", keyIDStr, &before, &key)
+
+	return c.JSON(fiber.Map{
+		"message": "API key revoked successfully",
+	})
+}
+
+// applyAPIKeyRequest validates a create or update request and copies it onto a key.
+// It returns a message describing the first invalid field.
+func applyAPIKeyRequest(c *fiber.Ctx, key *models.APIKey, req *apiKeyRequest) string {
+	if req.Permissions != nil {
+		for _, permission := range req.Permissions {
+			if !knownPermission(permission) {
+				return "Unknown permission: " + permission
+			}
+		}
+		key.Permissions = req.Permissions
+	}
+	if req.SiteIDs != nil {
+		var count int64
+		tenantDB(c).Model(&models.Site{}).Where("id IN ?", req.SiteIDs).Count(&count)
+		if len(req.SiteIDs) > 0 && int(count) != len(req.SiteIDs) {
+			return "One or more sites not found"
+		}
+		key.SiteIDs = req.SiteIDs
+	}
+	if req.DeviceGroupIDs != nil {
+		var count int64
+		tenantDB(c).Model(&models.DeviceGroup{}).Where("id IN ?", req.DeviceGroupIDs).Count(&count)
+		if len(req.DeviceGroupIDs) > 0 && int(count) != len(req.DeviceGroupIDs) {
+			return "One or more device groups not found"
+		}
+		key.DeviceGroupIDs = req.DeviceGroupIDs
+	}
+	if req.AllowedIPs != nil {
+		for _, rule := range req.AllowedIPs {
+			if !apikeys.ValidIPRule(rule) {
+				return "Invalid IP address or CIDR range: " + rule
+			}
+		}
+		key.AllowedIPs = req.AllowedIPs
+	}
+	if req.RateLimit != nil {
+		if *req.RateLimit < 0 {
+			return "rate_limit cannot be negative"
+		}
+		key.RateLimit = *req.RateLimit
+	}
+	if req.ExpiresAt != nil {
+		if req.ExpiresAt.Before(time.Now()) {
+			return "expires_at must be in the future"
+		}
+		key.ExpiresAt = req.ExpiresAt
+	}
+	if req.Description != nil {
+		key.Description = *req.Description
+	}
+	if req.IsActive != nil {
+		key.IsActive = *req.IsActive
+	}
+	return ""
+}
+
+// knownPermission reports whether a resource:action pair names an existing permission
+func knownPermission(permission string) bool {
+	resource, action, ok := strings.Cut(permission, ":")
+	if !ok || resource == "" || action == "" {
+		return false
+	}
+
+	query := database.DB.Model(&models.Permission{}).Where("resource = ? AND is_active = ?", resource, true)
+	if action != "*" {
+		query = query.Where("action = ?", action)
+	}
+	var count int64
+	query.Count(&count)
+	return count > 0
+}
@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"tsimserver/audit"
+	"tsimserver/models"
+	"tsimserver/ota"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// CreateAppRolloutRequest represents the request body for creating a rollout
+type CreateAppRolloutRequest struct {
+	AppReleaseID      uint     `json:"app_release_id" validate:"required"`
+	DeviceGroupID     uint     `json:"device_group_id" validate:"required"`
+	PreviousReleaseID *uint    `json:"previous_release_id"`
+	Steps             []int    `json:"steps"`
+	StepInterval      *int     `json:"step_interval"`
+	MaxErrorRate      *float64 `json:"max_error_rate"`
+	MinSampleSize     *int     `json:"min_sample_size"`
+}
+
+// UploadAppRelease stores a new APK as an app release
+func UploadAppRelease(c *fiber.Ctx) error {
+	versionName := c.FormValue("version_name")
+	versionCode, err := strconv.Atoi(c.FormValue("version_code"))
+	if versionName == "" || err != nil || versionCode <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "version_name and a positive version_code are required",
+		})
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "APK file is required",
+		})
+	}
+
+	var existing int64
+	tenantDB(c).Unscoped().Model(&models.AppRelease{}).Where("version_code = ?", versionCode).Count(&existing)
+	if existing > 0 {
+		return c.Status(409).JSON(fiber.Map{
+			"error": "A release with this version code already exists",
+		})
+	}
+
+	release := models.AppRelease{
+		VersionName:  versionName,
+		VersionCode:  versionCode,
+		ReleaseNotes: c.FormValue("release_notes"),
+	}
+	if userID, ok := c.Locals("user_id").(uint); ok {
+		release.UploadedBy = userID
+	}
+
+	if err := ota.SaveRelease(file, &release, c.FormValue("sha256")); err != nil {
+		status := 400
+		if errors.Is(err, ota.ErrUntrustedSigner) {
+			status = 422
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"error":   "Failed to store APK",
+			"details": err.Error(),
+		})
+	}
+	audit.Change(c, "app_releases", strconv.FormatUint(uint64(release.ID), 10), nil, &release)
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "App release uploaded successfully",
+		"release": release,
+	})
+}
+
+// GetAppReleases returns all app releases, newest first
+func GetAppReleases(c *fiber.Ctx) error {
+	var releases []models.AppRelease
+	if err := tenantDB(c).Order("version_code DESC").Find(&releases).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch app releases",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"releases": releases,
+	})
+}
+
+// GetAppRelease returns a specific app release
+func GetAppRelease(c *fiber.Ctx) error {
+	releaseIDStr := c.Params("id")
+	releaseID, err := strconv.ParseUint(releaseIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid app release ID",
+		})
+	}
+
+	var release models.AppRelease
+	if err := tenantDB(c).Where("id = ?", uint(releaseID)).First(&release).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "App release not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"release": release,
+	})
+}
+
+// DeleteAppRelease deletes an app release that is not used by any rollout
+func DeleteAppRelease(c *fiber.Ctx) error {
+	releaseIDStr := c.Params("id")
+	releaseID, err := strconv.ParseUint(releaseIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid app release ID",
+		})
+	}
+
+	var release models.AppRelease
+	if err := tenantDB(c).Where("id = ?", uint(releaseID)).First(&release).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "App release not found",
+		})
+	}
+
+	var rollouts int64
+	tenantDB(c).Model(&models.AppRollout{}).
+		Where("app_release_id = ? OR previous_release_id = ?", release.ID, release.ID).
+		Count(&rollouts)
+	if rollouts > 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Cannot delete a release used by rollouts",
+		})
+	}
+
+	if err := tenantDB(c).Delete(&release).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to delete app release",
+		})
+	}
+	audit.Change(c, "app_releases", releaseIDStr, &release, nil)
+
+	return c.JSON(fiber.Map{
+		"message": "App release deleted successfully",
+	})
+}
+
+// DownloadAppRelease serves an APK to devices holding the release download token
+func DownloadAppRelease(c *fiber.Ctx) error {
+	releaseIDStr := c.Params("id")
+	releaseID, err := strconv.ParseUint(releaseIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid app release ID",
+		})
+	}
+
+	if !ota.VerifyDownloadToken(uint(releaseID), c.Query("token")) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Invalid download token",
+		})
+	}
+
+	var release models.AppRelease
+	if err := tenantDB(c).Where("id = ?", uint(releaseID)).First(&release).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "App release not found",
+		})
+	}
+
+	c.Set("X-Checksum-SHA256", release.SHA256)
+	return c.Download(release.FilePath, release.FileName)
+}
+
+// CreateAppRollout creates a pending staged rollout of a release to a device group
+func CreateAppRollout(c *fiber.Ctx) error {
+	var req CreateAppRolloutRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var group models.DeviceGroup
+	if err := tenantDB(c).Where("id = ?", req.DeviceGroupID).First(&group).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device group not found",
+		})
+	}
+
+	rollout := models.AppRollout{
+		AppReleaseID:      req.AppReleaseID,
+		DeviceGroupID:     req.DeviceGroupID,
+		PreviousReleaseID: req.PreviousReleaseID,
+		Steps:             req.Steps,
+		StepInterval:      3600,
+		MaxErrorRate:      0.1,
+		MinSampleSize:     5,
+	}
+	if len(rollout.Steps) == 0 {
+		rollout.Steps = []int{5, 25, 50, 100}
+	}
+	if req.StepInterval != nil {
+		rollout.StepInterval = *req.StepInterval
+	}
+	if req.MaxErrorRate != nil {
+		rollout.MaxErrorRate = *req.MaxErrorRate
+	}
+	if req.MinSampleSize != nil {
+		rollout.MinSampleSize = *req.MinSampleSize
+	}
+	if userID, ok := c.Locals("user_id").(uint); ok {
+		rollout.CreatedBy = userID
+	}
+
+	if err := ota.Create(&rollout); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	audit.Change(c, "app_rollouts", strconv.FormatUint(uint64(rollout.ID), 10), nil, &rollout)
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "Rollout created successfully",
+		"rollout": rollout,
+	})
+}
+
+// GetAppRollouts returns rollouts with pagination
+func GetAppRollouts(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	status := c.Query("status", "")
+	deviceGroupID := c.QueryInt("device_group_id", 0)
+
+	offset := (page - 1) * limit
+
+	query := tenantDB(c).Model(&models.AppRollout{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if deviceGroupID > 0 {
+		query = query.Where("device_group_id = ?", deviceGroupID)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get rollouts with pagination
+	var rollouts []models.AppRollout
+	result := query.Preload("AppRelease").Preload("DeviceGroup").
+		Order("created_at DESC").Offset(offset).Limit(limit).Find(&rollouts)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch rollouts",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"rollouts": rollouts,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetAppRollout returns a rollout with its update and rollback progress
+func GetAppRollout(c *fiber.Ctx) error {
+	rolloutIDStr := c.Params("id")
+	rolloutID, err := strconv.ParseUint(rolloutIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid rollout ID",
+		})
+	}
+
+	var rollout models.AppRollout
+	if err := tenantDB(c).Preload("AppRelease").Preload("PreviousRelease").Preload("DeviceGroup").
+		Where("id = ?", uint(rolloutID)).First(&rollout).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Rollout not found",
+		})
+	}
+
+	updates, err := ota.Summarize(rollout.ID, false)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to summarize rollout",
+		})
+	}
+	rollbacks, err := ota.Summarize(rollout.ID, true)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to summarize rollout",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"rollout":   rollout,
+		"updates":   updates,
+		"rollbacks": rollbacks,
+	})
+}
+
+// GetAppRolloutTasks returns the per-device update tasks of a rollout
+func GetAppRolloutTasks(c *fiber.Ctx) error {
+	rolloutIDStr := c.Params("id")
+	rolloutID, err := strconv.ParseUint(rolloutIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid rollout ID",
+		})
+	}
+
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+	status := c.Query("status", "")
+
+	offset := (page - 1) * limit
+
+	query := tenantDB(c).Model(&models.AppUpdateTask{}).Where("app_rollout_id = ?", uint(rolloutID))
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get tasks with pagination
+	var tasks []models.AppUpdateTask
+	result := query.Order("is_rollback, step, device_id").Offset(offset).Limit(limit).Find(&tasks)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch rollout tasks",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"tasks": tasks,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// StartAppRollout starts a pending rollout
+func StartAppRollout(c *fiber.Ctx) error {
+	return changeAppRollout(c, ota.Start, "Rollout started successfully")
+}
+
+// PauseAppRollout pauses a running rollout
+func PauseAppRollout(c *fiber.Ctx) error {
+	return changeAppRollout(c, ota.Pause, "Rollout paused successfully")
+}
+
+// ResumeAppRollout resumes a paused or halted rollout
+func ResumeAppRollout(c *fiber.Ctx) error {
+	return changeAppRollout(c, ota.Resume, "Rollout resumed successfully")
+}
+
+// RollbackAppRollout rolls devices of a rollout back to the previous release
+func RollbackAppRollout(c *fiber.Ctx) error {
+	return changeAppRollout(c, ota.Rollback, "Rollback started successfully")
+}
+
+// changeAppRollout applies a state transition to the rollout in the route
+func changeAppRollout(c *fiber.Ctx, action func(uint) (*models.AppRollout, error), message string) error {
+	rolloutIDStr := c.Params("id")
+	rolloutID, err := strconv.ParseUint(rolloutIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid rollout ID",
+		})
+	}
+
+	var before models.AppRollout
+	if err := tenantDB(c).Where("id = ?", uint(rolloutID)).First(&before).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Rollout not found",
+		})
+	}
+
+	rollout, err := action(uint(rolloutID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Rollout not found",
+			})
+		}
+		if errors.Is(err, ota.ErrInvalidState) {
+			return c.Status(409).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	audit.Change(c, "app_rollouts", rolloutIDStr, &before, rollout)
+
+	return c.JSON(fiber.Map{
+		"message": message,
+		"rollout": rollout,
+	})
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"tsimserver/config"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// GetAuditEvents returns the audit log with filtering and pagination
+func GetAuditEvents(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+
+	offset := (page - 1) * limit
+
+	query, err := auditEventQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get events with pagination
+	var events []models.AuditEvent
+	result := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&events)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch audit events",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"events": events,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// ExportAuditEvents downloads the filtered audit log as CSV or JSON, the newest
+// audit.export_limit events at most
+func ExportAuditEvents(c *fiber.Ctx) error {
+	format := c.Query("format", "csv")
+	if format != "csv" && format != "json" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "format must be csv or json",
+		})
+	}
+
+	query, err := auditEventQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var events []models.AuditEvent
+	result := query.Order("created_at DESC").Limit(config.AppConfig.Audit.ExportLimit).Find(&events)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch audit events",
+		})
+	}
+
+	filename := "audit-events-" + time.Now().UTC().Format("20060102-150405")
+	if format == "json" {
+		c.Attachment(filename + ".json")
+		return c.JSON(events)
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"id", "created_at", "actor_id", "actor_name", "api_key_id", "tenant_id", "ip_address",
+		"user_agent", "action", "target_type", "target_id", "status", "before", "after", "diff"})
+	for _, event := range events {
+		w.Write([]string{
+			strconv.FormatUint(uint64(event.ID), 10),
+			event.CreatedAt.UTC().Format(time.RFC3339),
+			optionalID(event.ActorID),
+			csvText(event.ActorName),
+			optionalID(event.APIKeyID),
+			optionalID(event.TenantID),
+			csvText(event.IPAddress),
+			csvText(event.UserAgent),
+			csvText(event.Action),
+			csvText(event.TargetType),
+			csvText(event.TargetID),
+			strconv.Itoa(event.Status),
+			csvText(jsonColumn(event.Before)),
+			csvText(jsonColumn(event.After)),
+			csvText(jsonColumn(event.Diff)),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to export audit events",
+		})
+	}
+
+	c.Attachment(filename + ".csv")
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	return c.Send(buf.Bytes())
+}
+
+// auditEventQuery applies the audit log filters of a request
+func auditEventQuery(c *fiber.Ctx) (*gorm.DB, error) {
+	query := tenantDB(c).Model(&models.AuditEvent{})
+	for _, filter := range []string{"action", "target_type", "target_id", "ip_address"} {
+		if value := c.Query(filter); value != "" {
+			query = query.Where(filter+" = ?", value)
+		}
+	}
+	for _, filter := range []string{"actor_id", "api_key_id", "status"} {
+		if value := c.QueryInt(filter, -1); value >= 0 {
+			query = query.Where(filter+" = ?", value)
+		}
+	}
+	if method := c.Query("method"); method != "" {
+		query = query.Where("action LIKE ?", method+" %")
+	}
+	if fromStr := c.Query("from"); fromStr != "" {
+		from, err := time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			return nil, errors.New("Invalid 'from' timestamp, expected RFC3339")
+		}
+		query = query.Where("created_at >= ?", from)
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		to, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			return nil, errors.New("Invalid 'to' timestamp, expected RFC3339")
+		}
+		query = query.Where("created_at < ?", to)
+	}
+	return query, nil
+}
+
+// optionalID formats a nullable ID for CSV, empty for nil
+func optionalID(id *uint) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*id), 10)
+}
+
+// csvText makes a value that comes from users safe for spreadsheets: text starting like a
+// formula is prefixed with a quote so it is shown rather than evaluated
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// jsonColumn formats a before, after or diff value for CSV, empty when missing
+func jsonColumn(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil || string(data) == "null" {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"strconv"
+	"testing"
+	"tsimserver/database"
+	"tsimserver/middleware"
+	"tsimserver/models"
+	"tsimserver/testutil"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSiteChangesRecordTargetState(t *testing.T) {
+	testutil.LoadConfig(t)
+	testutil.OpenDatabase(t, &models.Site{}, &models.DeviceGroup{}, &models.AuditEvent{})
+
+	f := &scopeFixture{app: fiber.New()}
+	f.app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user_id", uint(1))
+		return c.Next()
+	}, middleware.Audit())
+	f.app.Post("/api/v1/sites", CreateSite)
+	f.app.Put("/api/v1/sites/:id", UpdateSite)
+	f.app.Delete("/api/v1/sites/:id", DeleteSite)
+
+	status, body := f.request(t, "POST", "/api/v1/sites", `{"name":"Istanbul","country":"TR","phone_code":"+90","is_active":true}`)
+	if status != 201 {
+		t.Fatalf("creating site = %d %v", status, body)
+	}
+	path := "/api/v1/sites/" + strconv.Itoa(int(body["id"].(float64)))
+	if status, body := f.request(t, "PUT", path, `{"name":"Ankara","is_active":true}`); status != 200 {
+		t.Fatalf("updating site = %d %v", status, body)
+	}
+	if status, body := f.request(t, "DELETE", path, ""); status != 200 {
+		t.Fatalf("deleting site = %d %v", status, body)
+	}
+
+	var events []models.AuditEvent
+	database.DB.Order("id").Find(&events)
+	if len(events) != 3 {
+		t.Fatalf("%d audit events, want 3", len(events))
+	}
+	for _, event := range events {
+		if event.TargetType != "sites" {
+			t.Errorf("%s targets %s, want sites", event.Action, event.TargetType)
+		}
+	}
+	if events[0].Before != nil || events[0].After["name"] != "Istanbul" {
+		t.Errorf("create recorded before %v and after %v, want only the new site", events[0].Before, events[0].After)
+	}
+	if change, ok := events[1].Diff["name"]; !ok || change.Before != "Istanbul" || change.After != "Ankara" {
+		t.Errorf("update recorded diff %v, want the name change", events[1].Diff)
+	}
+	if events[2].Before["name"] != "Ankara" || events[2].After != nil {
+		t.Errorf("delete recorded before %v and after %v, want only the deleted site", events[2].Before, events[2].After)
+	}
+}
@@ -1,12 +1,22 @@
 package handlers
 
 import (
+	"errors"
+	"strconv"
 	"time"
+	"tsimserver/auth"
+	"tsimserver/authaudit"
 	"tsimserver/database"
+	"tsimserver/invitations"
+	"tsimserver/lockout"
+	"tsimserver/mfa"
 	"tsimserver/models"
+	"tsimserver/passwords"
+	"tsimserver/sessions"
 	"tsimserver/utils"
 
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 // LoginRequest represents login request body
@@ -17,11 +27,12 @@ type LoginRequest struct {
 
 // RegisterRequest represents register request body
 type RegisterRequest struct {
-	Username  string `json:"username" validate:"required,min=3,max=50"`
-	Email     string `json:"email" validate:"required,email"`
-	Password  string `json:"password" validate:"required,min=6"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
+	Username    string `json:"username" validate:"required,min=3,max=50"`
+	Email       string `json:"email" validate:"required,email"`
+	Password    string `json:"password" validate:"required"`
+	FirstName   string `json:"first_name"`
+	LastName    string `json:"last_name"`
+	InviteToken string `json:"invite_token"` // required when registration.mode is invite
 }
 
 // RefreshTokenRequest represents refresh token request
@@ -31,10 +42,11 @@ type RefreshTokenRequest struct {
 
 // AuthResponse represents authentication response
 type AuthResponse struct {
-	User         *models.User `json:"user"`
-	AccessToken  string       `json:"access_token"`
-	RefreshToken string       `json:"refresh_token"`
-	ExpiresAt    time.Time    `json:"expires_at"`
+	User          *models.User `json:"user"`
+	AccessToken   string       `json:"access_token"`
+	RefreshToken  string       `json:"refresh_token"`
+	ExpiresAt     time.Time    `json:"expires_at"`
+	RecoveryCodes []string     `json:"recovery_codes,omitempty"` // Set when MFA was enabled while logging in
 }
 
 // Login authenticates a user
@@ -49,7 +61,22 @@ func Login(c *fiber.Ctx) error {
 	// Find user by username or email
 	var user models.User
 	result := database.DB.Where("username = ? OR email = ?", req.Username, req.Username).First(&user)
-	if result.Error != nil {
+	found := result.Error == nil
+
+	// Failures are counted per user, or per login name when it matches no user, and per IP
+	account := lockout.NameAccount(req.Username)
+	var known *models.User
+	if found {
+		account = lockout.UserAccount(user.ID)
+		known = &user
+	}
+	if block := lockout.Attempt(account, c.IP()); block != nil {
+		recordAuthEvent(c, authaudit.EventLoginBlocked, known, req.Username, block.Reason)
+		return loginBlocked(c, block)
+	}
+
+	if !found {
+		loginFailed(c, account, nil, req.Username, "unknown user")
 		return c.Status(401).JSON(fiber.Map{
 			"error": "Invalid credentials",
 		})
@@ -57,6 +84,7 @@ func Login(c *fiber.Ctx) error {
 
 	// Check if user is active
 	if !user.IsActive {
+		loginFailed(c, account, &user, req.Username, "account deactivated")
 		return c.Status(401).JSON(fiber.Map{
 			"error": "Account is deactivated",
 		})
@@ -64,62 +92,95 @@ func Login(c *fiber.Ctx) error {
 
 	// Verify password
 	if !user.CheckPassword(req.Password) {
+		loginFailed(c, account, &user, req.Username, "wrong password")
 		return c.Status(401).JSON(fiber.Map{
 			"error": "Invalid credentials",
 		})
 	}
 
-	// Generate tokens
-	accessToken, err := utils.GenerateAccessToken(user.ID, user.Username, user.Email)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Error generating access token",
-		})
+	return completeLogin(c, &user, account)
+}
+
+// loginFailed records a failed login and counts it towards lockouts
+func loginFailed(c *fiber.Ctx, account string, user *models.User, username, reason string) {
+	recordAuthEvent(c, authaudit.EventLoginFailure, user, username, reason)
+	countFailure(c, account, user, username)
+}
+
+// countFailure settles a failed login attempt and records the lock it caused
+func countFailure(c *fiber.Ctx, account string, user *models.User, username string) {
+	if block := lockout.Fail(account, c.IP()); block != nil {
+		event := authaudit.EventAccountLocked
+		if block.Reason == lockout.ReasonIPLocked {
+			event = authaudit.EventIPLocked
+		}
+		recordAuthEvent(c, event, user, username, "")
 	}
+}
 
-	refreshToken, err := utils.GenerateRefreshToken(user.ID, user.Username)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Error generating refresh token",
+// completeLogin finishes the first login step of a user: users with an authenticator, or a
+// role that requires one, get an MFA challenge, everyone else a session. The attempt on a
+// lockout account, if any, succeeds once the session is created. With MFA the password
+// attempt is taken back instead and only the code step counts, as its own attempt.
+func completeLogin(c *fiber.Ctx, user *models.User, account string) error {
+	if enabled := mfa.Enabled(user.ID); enabled || mfa.Required(user.ID) {
+		if account != "" {
+			lockout.Release(account, c.IP())
+		}
+
+		token, challenge, err := mfa.NewChallenge(user.ID, !enabled, c.IP())
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Error creating MFA challenge",
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"mfa_required":        true,
+			"enrollment_required": !enabled,
+			"mfa_token":           token,
+			"expires_at":          challenge.ExpiresAt,
 		})
 	}
 
-	// Create session
-	session := models.Session{
-		UserID:           user.ID,
-		AccessToken:      accessToken,
-		RefreshToken:     refreshToken,
-		ExpiresAt:        time.Now().Add(15 * time.Minute),   // 15 minutes
-		RefreshExpiresAt: time.Now().Add(7 * 24 * time.Hour), // 7 days
-		IPAddress:        c.IP(),
-		UserAgent:        c.Get("User-Agent"),
-		IsActive:         true,
+	if account != "" {
+		lockout.Succeed(account, c.IP())
 	}
-
-	if err := database.DB.Create(&session).Error; err != nil {
+	response, err := startSession(c, user)
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Error creating session",
 		})
 	}
 
+	return c.JSON(response)
+}
+
+// startSession creates a session with access and refresh tokens for a user who completed login
+func startSession(c *fiber.Ctx, user *models.User) (*AuthResponse, error) {
+	session, err := sessions.Create(user, c.IP(), c.Get("User-Agent"))
+	if err != nil {
+		return nil, err
+	}
+
 	// Update last login
 	now := time.Now()
 	user.LastLogin = &now
-	database.DB.Save(&user)
+	database.DB.Model(user).Update("last_login", now)
+	recordAuthEvent(c, authaudit.EventLoginSuccess, user, "", "")
 
 	// Prepare response
 	user.Password = "" // Don't return password
-	response := AuthResponse{
-		User:         &user,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
+	return &AuthResponse{
+		User:         user,
+		AccessToken:  session.AccessToken,
+		RefreshToken: session.RefreshToken,
 		ExpiresAt:    session.ExpiresAt,
-	}
-
-	return c.JSON(response)
+	}, nil
 }
 
-// Register creates a new user account
+// Register creates a new user account. Depending on registration.mode it is open to anyone,
+// needs an invitation token or is closed.
 func Register(c *fiber.Ctx) error {
 	var req RegisterRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -128,6 +189,26 @@ func Register(c *fiber.Ctx) error {
 		})
 	}
 
+	mode := invitations.Mode()
+	if mode == invitations.ModeClosed {
+		recordAuthEvent(c, authaudit.EventRegisterRejected, nil, req.Username, "registration closed")
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Registration is disabled",
+		})
+	}
+
+	var invitation *models.Invitation
+	if req.InviteToken != "" || mode == invitations.ModeInvite {
+		var err error
+		invitation, err = invitations.Find(req.InviteToken, req.Email)
+		if err != nil {
+			recordAuthEvent(c, authaudit.EventRegisterRejected, nil, req.Username, err.Error())
+			return c.Status(403).JSON(fiber.Map{
+				"error": "A valid invitation is required to register",
+			})
+		}
+	}
+
 	// Check if username already exists
 	var existingUser models.User
 	if result := database.DB.Where("username = ?", req.Username).First(&existingUser); result.Error == nil {
@@ -153,6 +234,11 @@ func Register(c *fiber.Ctx) error {
 		IsActive:  true,
 	}
 
+	// Check the password policy
+	if err := passwords.Check(req.Password); err != nil {
+		return passwordError(c, err)
+	}
+
 	// Hash password
 	if err := user.HashPassword(); err != nil {
 		return c.Status(500).JSON(fiber.Map{
@@ -160,69 +246,69 @@ func Register(c *fiber.Ctx) error {
 		})
 	}
 
-	// Save user
-	if err := database.DB.Create(&user).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Error creating user",
-		})
+	// Invited users join the invitation's tenant with its role, everyone else gets viewer
+	var role models.Role
+	roleQuery := database.DB.Where("name = ?", "viewer")
+	if invitation != nil {
+		user.TenantID = invitation.TenantID
+		if invitation.RoleID != nil {
+			roleQuery = database.DB.Where("id = ?", *invitation.RoleID)
+		}
 	}
+	hasRole := roleQuery.First(&role).Error == nil
 
-	// Assign default role (viewer)
-	var defaultRole models.Role
-	if err := database.DB.Where("name = ?", "viewer").First(&defaultRole).Error; err == nil {
-		userRole := models.UserRole{
-			UserID: user.ID,
-			RoleID: defaultRole.ID,
+	// Save user, use the invitation and assign the role together
+	err := auth.UpdatePolicies(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		if err := passwords.Remember(tx, user.ID, user.Password); err != nil {
+			return err
+		}
+		if invitation != nil {
+			if err := invitations.Accept(tx, invitation, user.ID); err != nil {
+				return err
+			}
 		}
-		database.DB.Create(&userRole)
+		if !hasRole {
+			return nil
+		}
+		return tx.Create(&models.UserRole{UserID: user.ID, RoleID: role.ID}).Error
+	})
+	if errors.Is(err, invitations.ErrInvalid) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "A valid invitation is required to register",
+		})
 	}
-
-	// Generate tokens
-	accessToken, err := utils.GenerateAccessToken(user.ID, user.Username, user.Email)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
-			"error": "Error generating access token",
+			"error": "Error creating user",
 		})
 	}
 
-	refreshToken, err := utils.GenerateRefreshToken(user.ID, user.Username)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Error generating refresh token",
-		})
+	details := ""
+	if invitation != nil {
+		details = "invitation " + strconv.FormatUint(uint64(invitation.ID), 10)
 	}
+	recordAuthEvent(c, authaudit.EventRegister, &user, "", details)
 
-	// Create session
-	session := models.Session{
-		UserID:           user.ID,
-		AccessToken:      accessToken,
-		RefreshToken:     refreshToken,
-		ExpiresAt:        time.Now().Add(15 * time.Minute),
-		RefreshExpiresAt: time.Now().Add(7 * 24 * time.Hour),
-		IPAddress:        c.IP(),
-		UserAgent:        c.Get("User-Agent"),
-		IsActive:         true,
+	// Roles that require MFA enroll before the first session
+	if mfa.Required(user.ID) {
+		return completeLogin(c, &user, "")
 	}
 
-	if err := database.DB.Create(&session).Error; err != nil {
+	response, err := startSession(c, &user)
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Error creating session",
 		})
 	}
 
-	// Prepare response
-	user.Password = "" // Don't return password
-	response := AuthResponse{
-		User:         &user,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresAt:    session.ExpiresAt,
-	}
-
 	return c.Status(201).JSON(response)
 }
 
-// RefreshToken refreshes access token using refresh token
+// RefreshToken exchanges a refresh token for new access and refresh tokens. Every refresh
+// token works once, reusing one revokes all sessions descending from the same login.
 func RefreshToken(c *fiber.Ctx) error {
 	var req RefreshTokenRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -239,52 +325,39 @@ func RefreshToken(c *fiber.Ctx) error {
 		})
 	}
 
-	// Find session
-	var session models.Session
-	if err := database.DB.Where("refresh_token = ? AND is_active = ?", req.RefreshToken, true).First(&session).Error; err != nil {
+	session, err := sessions.Refresh(req.RefreshToken, c.IP(), c.Get("User-Agent"))
+	switch {
+	case errors.Is(err, sessions.ErrReused):
+		var user models.User
+		database.DB.Unscoped().Where("id = ?", session.UserID).First(&user)
+		recordAuthEvent(c, authaudit.EventRefreshTokenReused, &user, "", "family "+session.FamilyID)
 		return c.Status(401).JSON(fiber.Map{
-			"error": "Session not found or expired",
+			"error": "Refresh token was already used, its sessions are revoked",
 		})
-	}
-
-	// Check if refresh token is expired
-	if time.Now().After(session.RefreshExpiresAt) {
-		// Deactivate session
-		session.IsActive = false
-		database.DB.Save(&session)
-
+	case errors.Is(err, sessions.ErrExpired):
 		return c.Status(401).JSON(fiber.Map{
 			"error": "Refresh token expired",
 		})
-	}
-
-	// Get user
-	var user models.User
-	if err := database.DB.Where("id = ? AND is_active = ?", session.UserID, true).First(&user).Error; err != nil {
+	case errors.Is(err, sessions.ErrInactiveUser):
 		return c.Status(401).JSON(fiber.Map{
 			"error": "User not found or inactive",
 		})
-	}
-
-	// Generate new access token
-	newAccessToken, err := utils.GenerateAccessToken(user.ID, user.Username, user.Email)
-	if err != nil {
+	case errors.Is(err, sessions.ErrInvalid):
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Session not found or expired",
+		})
+	case err != nil:
 		return c.Status(500).JSON(fiber.Map{
-			"error": "Error generating access token",
+			"error": "Error refreshing session",
 		})
 	}
 
-	// Update session
-	session.AccessToken = newAccessToken
-	session.ExpiresAt = time.Now().Add(15 * time.Minute)
-	database.DB.Save(&session)
-
 	// Prepare response
-	user.Password = "" // Don't return password
+	session.User.Password = "" // Don't return password
 	response := AuthResponse{
-		User:         &user,
-		AccessToken:  newAccessToken,
-		RefreshToken: req.RefreshToken,
+		User:         session.User,
+		AccessToken:  session.AccessToken,
+		RefreshToken: session.RefreshToken,
 		ExpiresAt:    session.ExpiresAt,
 	}
 
@@ -309,9 +382,14 @@ func Logout(c *fiber.Ctx) error {
 	}
 
 	// Deactivate session
-	database.DB.Model(&models.Session{}).
-		Where("access_token = ?", token).
-		Update("is_active", false)
+	if err := sessions.RevokeAccessToken(token); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error logging out",
+		})
+	}
+
+	user, _ := c.Locals("user").(*models.User)
+	recordAuthEvent(c, authaudit.EventLogout, user, "", "")
 
 	return c.JSON(fiber.Map{
 		"message": "Logged out successfully",
@@ -336,8 +414,9 @@ func GetProfile(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(fiber.Map{
-		"user":  user,
-		"roles": roles,
+		"user":             user,
+		"roles":            roles,
+		"active_tenant_id": c.Locals("tenant_id"),
 	})
 }
 
@@ -376,12 +455,13 @@ func UpdateProfile(c *fiber.Ctx) error {
 		user.LastName = updateData.LastName
 	}
 
-	// Save user
-	if err := database.DB.Save(user).Error; err != nil {
+	// Save user, the user of the session cache has no password hash to save
+	if err := database.DB.Model(user).Select("email", "first_name", "last_name").Updates(user).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Error updating profile",
 		})
 	}
+	sessions.Invalidate(user.ID)
 
 	// Don't return password
 	user.Password = ""
@@ -398,7 +478,7 @@ func ChangePassword(c *fiber.Ctx) error {
 
 	var req struct {
 		CurrentPassword string `json:"current_password" validate:"required"`
-		NewPassword     string `json:"new_password" validate:"required,min=6"`
+		NewPassword     string `json:"new_password" validate:"required"`
 	}
 
 	if err := c.BodyParser(&req); err != nil {
@@ -408,34 +488,36 @@ func ChangePassword(c *fiber.Ctx) error {
 	}
 
 	// Verify current password
-	if !user.CheckPassword(req.CurrentPassword) {
+	if !checkCurrentPassword(user, req.CurrentPassword) {
 		return c.Status(400).JSON(fiber.Map{
 			"error": "Current password is incorrect",
 		})
 	}
 
-	// Update password
-	user.Password = req.NewPassword
-	if err := user.HashPassword(); err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Error hashing password",
-		})
-	}
-
-	// Save user
-	if err := database.DB.Save(user).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Error updating password",
-		})
+	// Update password, checked against the password policy and earlier passwords
+	if err := passwords.Change(user, req.NewPassword); err != nil {
+		return passwordError(c, err)
 	}
 
 	// Invalidate all sessions except current one
-	currentToken := utils.ExtractTokenFromHeader(c.Get("Authorization"))
+	sessionID, _ := c.Locals("session_id").(uint)
 	database.DB.Model(&models.Session{}).
-		Where("user_id = ? AND access_token != ?", user.ID, currentToken).
+		Where("user_id = ? AND id != ?", user.ID, sessionID).
 		Update("is_active", false)
+	sessions.Invalidate(user.ID)
+	recordAuthEvent(c, authaudit.EventPasswordChanged, user, "", "")
 
 	return c.JSON(fiber.Map{
 		"message": "Password changed successfully",
 	})
 }
+
+// checkCurrentPassword checks the password of the authenticated user. Users from the
+// session cache carry no password hash, so it is read from the database.
+func checkCurrentPassword(user *models.User, password string) bool {
+	var stored models.User
+	if err := database.DB.Select("id", "password").Where("id = ?", user.ID).First(&stored).Error; err != nil {
+		return false
+	}
+	return stored.CheckPassword(password)
+}
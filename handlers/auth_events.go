@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"time"
+	"tsimserver/authaudit"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetAuthEvents returns the authentication audit trail with filtering and pagination
+func GetAuthEvents(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+
+	offset := (page - 1) * limit
+
+	query := tenantDB(c).Model(&models.AuthEvent{})
+	for _, filter := range []string{"event", "username", "ip_address"} {
+		if value := c.Query(filter); value != "" {
+			query = query.Where(filter+" = ?", value)
+		}
+	}
+	if userID := c.QueryInt("user_id", -1); userID >= 0 {
+		query = query.Where("user_id = ?", userID)
+	}
+	if fromStr := c.Query("from"); fromStr != "" {
+		from, err := time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid 'from' timestamp, expected RFC3339",
+			})
+		}
+		query = query.Where("created_at >= ?", from)
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		to, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid 'to' timestamp, expected RFC3339",
+			})
+		}
+		query = query.Where("created_at < ?", to)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get events with pagination
+	var events []models.AuthEvent
+	result := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&events)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch auth events",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"events": events,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// recordAuthEvent appends an event about a user, or a login name matching no user, to the
+// authentication audit trail
+func recordAuthEvent(c *fiber.Ctx, event string, user *models.User, username, details string) {
+	entry := models.AuthEvent{
+		Event:     event,
+		Username:  username,
+		IPAddress: c.IP(),
+		UserAgent: c.Get("User-Agent"),
+		Details:   details,
+	}
+	if user != nil {
+		entry.UserID = &user.ID
+		entry.Username = user.Username
+	}
+	if actorID, ok := c.Locals("user_id").(uint); ok {
+		entry.ActorID = &actorID
+	}
+
+	authaudit.Record(&entry)
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"tsimserver/audit"
+	"tsimserver/balance"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CheckSIMBalance sends a balance check to a SIM card
+func CheckSIMBalance(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	var req struct {
+		USSDCode string `json:"ussd_code"`
+	}
+	c.BodyParser(&req)
+
+	var simCard models.SIMCard
+	if err := tenantDB(c).Where("id = ?", uint(simID)).First(&simCard).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, simCard.DeviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	check, err := balance.Check(&simCard, req.USSDCode, false)
+	if err != nil {
+		if errors.Is(err, balance.ErrNoUSSDCode) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to send balance check command",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "Balance check sent successfully",
+		"check":   check,
+	})
+}
+
+// GetSIMBalanceHistory returns the balance checks of a SIM card with pagination
+func GetSIMBalanceHistory(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+	status := c.Query("status", "")
+
+	offset := (page - 1) * limit
+
+	var simCard models.SIMCard
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Unscoped(), "sim_cards").Where("id = ?", uint(simID)).First(&simCard).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	query := tenantDB(c).Model(&models.SIMBalanceCheck{}).Where("sim_card_id = ?", simCard.ID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get checks with pagination
+	var checks []models.SIMBalanceCheck
+	result := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&checks)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch balance history",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"sim_card_id":        simCard.ID,
+		"balance":            simCard.Balance,
+		"balance_currency":   simCard.BalanceCurrency,
+		"balance_checked_at": simCard.BalanceCheckedAt,
+		"checks":             checks,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetOperatorBalanceConfigs returns all operator balance configurations
+func GetOperatorBalanceConfigs(c *fiber.Ctx) error {
+	var configs []models.OperatorBalanceConfig
+	if err := tenantDB(c).Order("name").Find(&configs).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch balance configurations",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"configs": configs,
+	})
+}
+
+// CreateOperatorBalanceConfig creates an operator balance configuration
+func CreateOperatorBalanceConfig(c *fiber.Ctx) error {
+	var cfg models.OperatorBalanceConfig
+	if err := c.BodyParser(&cfg); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validateOperatorBalanceConfig(&cfg); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	cfg.ID = 0
+	if err := tenantDB(c).Create(&cfg).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to create balance configuration",
+		})
+	}
+	audit.Change(c, "operator_balance_configs", strconv.FormatUint(uint64(cfg.ID), 10), nil, &cfg)
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "Balance configuration created successfully",
+		"config":  cfg,
+	})
+}
+
+// UpdateOperatorBalanceConfig replaces an operator balance configuration
+func UpdateOperatorBalanceConfig(c *fiber.Ctx) error {
+	cfgIDStr := c.Params("id")
+	cfgID, err := strconv.ParseUint(cfgIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid balance configuration ID",
+		})
+	}
+
+	var cfg models.OperatorBalanceConfig
+	if err := tenantDB(c).Where("id = ?", uint(cfgID)).First(&cfg).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Balance configuration not found",
+		})
+	}
+	before := cfg
+
+	if err := c.BodyParser(&cfg); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	cfg.ID = uint(cfgID)
+
+	if err := validateOperatorBalanceConfig(&cfg); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err := tenantDB(c).Save(&cfg).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to update balance configuration",
+		})
+	}
+	audit.Change(c, "operator_balance_configs", cfgIDStr, &before, &cfg)
+
+	return c.JSON(fiber.Map{
+		"message": "Balance configuration updated successfully",
+		"config":  cfg,
+	})
+}
+
+// DeleteOperatorBalanceConfig deletes an operator balance configuration
+func DeleteOperatorBalanceConfig(c *fiber.Ctx) error {
+	cfgIDStr := c.Params("id")
+	cfgID, err := strconv.ParseUint(cfgIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid balance configuration ID",
+		})
+	}
+
+	var cfg models.OperatorBalanceConfig
+	tenantDB(c).Where("id = ?", uint(cfgID)).First(&cfg)
+
+	if err := tenantDB(c).Delete(&models.OperatorBalanceConfig{}, uint(cfgID)).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to delete balance configuration",
+		})
+	}
+	if cfg.ID != 0 {
+		audit.Change(c, "operator_balance_configs", cfgIDStr, &cfg, nil)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Balance configuration deleted successfully",
+	})
+}
+
+// TestBalanceParser runs a parser definition against a sample USSD response
+func TestBalanceParser(c *fiber.Ctx) error {
+	var req struct {
+		ParserType string `json:"parser_type"`
+		Pattern    string `json:"pattern"`
+		Currency   string `json:"currency"`
+		Response   string `json:"response"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	cfg := models.OperatorBalanceConfig{ParserType: req.ParserType, Pattern: req.Pattern, Currency: req.Currency}
+	result, err := balance.Parse(&cfg, req.Response)
+	if err != nil {
+		return c.Status(422).JSON(fiber.Map{
+			"matched": false,
+			"error":   err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"matched":  true,
+		"amount":   result.Amount,
+		"currency": result.Currency,
+	})
+}
+
+// validateOperatorBalanceConfig checks the operator match and parser of a configuration
+func validateOperatorBalanceConfig(cfg *models.OperatorBalanceConfig) error {
+	if cfg.Name == "" {
+		return errors.New("name is required")
+	}
+	if cfg.MCC == "" && cfg.Operator == "" {
+		return errors.New("either mcc/mnc or operator is required")
+	}
+	if cfg.ParserType == "" {
+		cfg.ParserType = balance.ParserTemplate
+	}
+	if cfg.Pattern != "" {
+		if _, err := balance.Compile(cfg.ParserType, cfg.Pattern); err != nil {
+			return err
+		}
+	}
+	if cfg.LowBalanceThreshold < 0 || cfg.CheckInterval < 0 {
+		return errors.New("low_balance_threshold and check_interval cannot be negative")
+	}
+	return nil
+}
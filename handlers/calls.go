@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+	"tsimserver/calls"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// GetCallLogs returns call logs with filtering and pagination
+func GetCallLogs(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+
+	offset := (page - 1) * limit
+
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.CallLog{}), "call_logs")
+	for _, filter := range []string{"device_id", "direction", "status", "purpose", "number"} {
+		if value := c.Query(filter); value != "" {
+			query = query.Where(filter+" = ?", value)
+		}
+	}
+	if simCardID := c.QueryInt("sim_card_id", -1); simCardID >= 0 {
+		query = query.Where("sim_card_id = ?", simCardID)
+	}
+	if fromStr := c.Query("from"); fromStr != "" {
+		from, err := time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid 'from' timestamp, expected RFC3339",
+			})
+		}
+		query = query.Where("started_at >= ?", from)
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		to, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid 'to' timestamp, expected RFC3339",
+			})
+		}
+		query = query.Where("started_at < ?", to)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get calls with pagination
+	var callLogs []models.CallLog
+	result := query.Order("started_at DESC").Offset(offset).Limit(limit).Find(&callLogs)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch call logs",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"calls": callLogs,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetCallLog returns a specific call log
+func GetCallLog(c *fiber.Ctx) error {
+	callIDStr := c.Params("id")
+	callID, err := strconv.ParseUint(callIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid call ID",
+		})
+	}
+
+	var callLog models.CallLog
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "call_logs").Preload("SIMCard").Where("id = ?", uint(callID)).First(&callLog).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Call not found",
+		})
+	}
+
+	return c.JSON(callLog)
+}
+
+// DialCall asks a device to place a voice call
+func DialCall(c *fiber.Ctx) error {
+	var req struct {
+		DeviceID    string `json:"device_id"`
+		SimSlot     int    `json:"sim_slot"`
+		Target      string `json:"target"`
+		Purpose     string `json:"purpose"`      // manual, flash_call, balance_line
+		MaxDuration int    `json:"max_duration"` // seconds, capped by calls.max_duration
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.DeviceID == "" || req.Target == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "device_id and target are required",
+		})
+	}
+
+	if !deviceInTenant(c, req.DeviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, req.DeviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	var requestedBy uint
+	if userID, ok := c.Locals("user_id").(uint); ok {
+		requestedBy = userID
+	}
+
+	call, err := calls.Dial(req.DeviceID, req.SimSlot, req.Target, req.Purpose, req.MaxDuration, requestedBy)
+	if err != nil {
+		if errors.Is(err, calls.ErrInvalidPurpose) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to send call command",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "Call command sent",
+		"call":    call,
+	})
+}
+
+// HangupCall asks the device to end a call it placed
+func HangupCall(c *fiber.Ctx) error {
+	callIDStr := c.Params("id")
+	callID, err := strconv.ParseUint(callIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid call ID",
+		})
+	}
+
+	var callLog models.CallLog
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "call_logs").Where("id = ?", uint(callID)).First(&callLog).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Call not found",
+		})
+	}
+
+	if err := calls.Hangup(&callLog); err != nil {
+		if errors.Is(err, calls.ErrCallNotActive) {
+			return c.Status(409).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to send hang up command",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Hang up command sent",
+	})
+}
+
+// StartFlashCallVerification rings a number so its owner can verify it with the caller ID
+func StartFlashCallVerification(c *fiber.Ctx) error {
+	var req struct {
+		Number string `json:"number"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Number == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "number is required",
+		})
+	}
+	if !isValidPhoneNumber(req.Number) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid phone number",
+		})
+	}
+
+	var requestedBy uint
+	if userID, ok := c.Locals("user_id").(uint); ok {
+		requestedBy = userID
+	}
+
+	verification, err := calls.StartFlashCall(c.UserContext(), req.Number, requestedBy)
+	if err != nil {
+		if errors.Is(err, calls.ErrNoCaller) {
+			return c.Status(409).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to start flash-call verification",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message":      "Flash call placed",
+		"verification": verification,
+	})
+}
+
+// CheckFlashCallVerification checks the code entered for a flash-call verification
+func CheckFlashCallVerification(c *fiber.Ctx) error {
+	verificationIDStr := c.Params("id")
+	verificationID, err := strconv.ParseUint(verificationIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid verification ID",
+		})
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Code == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "code is required",
+		})
+	}
+
+	var count int64
+	tenantDB(c).Model(&models.FlashCallVerification{}).Where("id = ?", uint(verificationID)).Count(&count)
+	if count == 0 {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Verification not found",
+		})
+	}
+
+	verification, err := calls.CheckFlashCall(uint(verificationID), req.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Verification not found",
+			})
+		case errors.Is(err, calls.ErrWrongCode):
+			return c.Status(422).JSON(fiber.Map{
+				"error":        err.Error(),
+				"verified":     false,
+				"verification": verification,
+			})
+		case errors.Is(err, calls.ErrVerificationClosed):
+			return c.Status(409).JSON(fiber.Map{
+				"error":        err.Error(),
+				"verified":     false,
+				"verification": verification,
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to check code",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"verified":     true,
+		"verification": verification,
+	})
+}
@@ -3,7 +3,8 @@ package handlers
 import (
 	"strconv"
 	"time"
-	"tsimserver/database"
+	"tsimserver/audit"
+	"tsimserver/cache"
 	"tsimserver/models"
 	"tsimserver/queue"
 	"tsimserver/types"
@@ -15,7 +16,7 @@ import (
 func GetDevices(c *fiber.Ctx) error {
 	var devices []models.Device
 
-	result := database.DB.Preload("SIMCards").Find(&devices)
+	result := permissionScope(c).ScopeDevices(tenantDB(c)).Preload("SIMCards").Find(&devices)
 	if result.Error != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to fetch devices",
@@ -33,7 +34,7 @@ func GetDevice(c *fiber.Ctx) error {
 	deviceID := c.Params("id")
 
 	var device models.Device
-	result := database.DB.Preload("SIMCards").Preload("DeviceStatuses").Where("device_id = ?", deviceID).First(&device)
+	result := permissionScope(c).ScopeDevices(tenantDB(c)).Preload("SIMCards").Preload("DeviceStatuses").Preload("FenceState").Where("device_id = ?", deviceID).First(&device)
 	if result.Error != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Device not found",
@@ -53,11 +54,23 @@ func CreateDevice(c *fiber.Ctx) error {
 		})
 	}
 
+	// Devices belong to a tenant through their group
+	if device.DeviceGroupID != nil && !deviceGroupInTenant(c, *device.DeviceGroupID) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Device group not found",
+		})
+	}
+	if !deviceGroupInPermissionScope(c, device.DeviceGroupID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device group",
+		})
+	}
+
 	device.CreatedAt = time.Now()
 	device.UpdatedAt = time.Now()
 	device.IsActive = true
 
-	if err := database.DB.Create(&device).Error; err != nil {
+	if err := tenantDB(c).Create(&device).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to create device",
 		})
@@ -71,7 +84,7 @@ func UpdateDevice(c *fiber.Ctx) error {
 	deviceID := c.Params("id")
 
 	var device models.Device
-	if err := database.DB.Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+	if err := permissionScope(c).ScopeDevices(tenantDB(c)).Where("device_id = ?", deviceID).First(&device).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Device not found",
 		})
@@ -84,17 +97,32 @@ func UpdateDevice(c *fiber.Ctx) error {
 		})
 	}
 
+	before := device
 	device.DeviceName = updateData.DeviceName
 	device.SiteName = updateData.SiteName
 	device.GroupName = updateData.GroupName
 	device.IsActive = updateData.IsActive
 	device.UpdatedAt = time.Now()
+	if updateData.DeviceGroupID != nil {
+		if !deviceGroupInTenant(c, *updateData.DeviceGroupID) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Device group not found",
+			})
+		}
+		if !deviceGroupInPermissionScope(c, updateData.DeviceGroupID) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Insufficient permissions for this device group",
+			})
+		}
+		device.DeviceGroupID = updateData.DeviceGroupID
+	}
 
-	if err := database.DB.Save(&device).Error; err != nil {
+	if err := tenantDB(c).Save(&device).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to update device",
 		})
 	}
+	audit.Change(c, "devices", deviceID, &before, &device)
 
 	return c.JSON(device)
 }
@@ -103,11 +131,18 @@ func UpdateDevice(c *fiber.Ctx) error {
 func DeleteDevice(c *fiber.Ctx) error {
 	deviceID := c.Params("id")
 
-	if err := database.DB.Where("device_id = ?", deviceID).Delete(&models.Device{}).Error; err != nil {
+	var device models.Device
+	permissionScope(c).ScopeDevices(tenantDB(c)).Where("device_id = ?", deviceID).First(&device)
+
+	query := permissionScope(c).ScopeDevices(tenantDB(c))
+	if err := query.Where("device_id = ?", deviceID).Delete(&models.Device{}).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to delete device",
 		})
 	}
+	if device.ID != 0 {
+		audit.Change(c, "devices", deviceID, &device, nil)
+	}
 
 	return c.JSON(fiber.Map{
 		"message": "Device deleted successfully",
@@ -118,12 +153,27 @@ func DeleteDevice(c *fiber.Ctx) error {
 func DisableDevice(c *fiber.Ctx) error {
 	deviceID := c.Params("id")
 
+	if !deviceInTenant(c, deviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
 	// Update device status in database
-	if err := database.DB.Model(&models.Device{}).Where("device_id = ?", deviceID).Update("is_active", false).Error; err != nil {
+	var device models.Device
+	tenantDB(c).Where("device_id = ?", deviceID).First(&device)
+	if err := tenantDB(c).Model(&models.Device{}).Where("device_id = ?", deviceID).Update("is_active", false).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to disable device",
 		})
 	}
+	audit.Change(c, "devices", deviceID, fiber.Map{"is_active": device.IsActive}, fiber.Map{"is_active": false})
 
 	// Send disable command to device
 	disableCmd := types.DisableDeviceCommand{
@@ -146,12 +196,27 @@ func DisableDevice(c *fiber.Ctx) error {
 func EnableDevice(c *fiber.Ctx) error {
 	deviceID := c.Params("id")
 
+	if !deviceInTenant(c, deviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
 	// Update device status in database
-	if err := database.DB.Model(&models.Device{}).Where("device_id = ?", deviceID).Update("is_active", true).Error; err != nil {
+	var device models.Device
+	tenantDB(c).Where("device_id = ?", deviceID).First(&device)
+	if err := tenantDB(c).Model(&models.Device{}).Where("device_id = ?", deviceID).Update("is_active", true).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to enable device",
 		})
 	}
+	audit.Change(c, "devices", deviceID, fiber.Map{"is_active": device.IsActive}, fiber.Map{"is_active": true})
 
 	// Send enable command to device
 	enableCmd := types.EnableDeviceCommand{
@@ -173,6 +238,18 @@ func EnableDevice(c *fiber.Ctx) error {
 // DisableSIM disables a SIM card
 func DisableSIM(c *fiber.Ctx) error {
 	deviceID := c.Params("id")
+
+	if !deviceInTenant(c, deviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
 	simSlotStr := c.Params("simslot")
 
 	simSlot, err := strconv.Atoi(simSlotStr)
@@ -183,11 +260,16 @@ func DisableSIM(c *fiber.Ctx) error {
 	}
 
 	// Update SIM status in database
-	if err := database.DB.Model(&models.SIMCard{}).Where("device_id = ? AND identifier = ?", deviceID, simSlot).Update("is_enabled", false).Error; err != nil {
+	var simCard models.SIMCard
+	tenantDB(c).Where("device_id = ? AND identifier = ?", deviceID, simSlot).First(&simCard)
+	if err := tenantDB(c).Model(&models.SIMCard{}).Where("device_id = ? AND identifier = ?", deviceID, simSlot).Update("is_enabled", false).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to disable SIM",
 		})
 	}
+	audit.Change(c, "sim_cards", strconv.FormatUint(uint64(simCard.ID), 10),
+		fiber.Map{"device_id": deviceID, "sim_slot": simSlot, "is_enabled": simCard.IsEnabled},
+		fiber.Map{"device_id": deviceID, "sim_slot": simSlot, "is_enabled": false})
 
 	// Send disable SIM command to device
 	disableCmd := types.DisableSIMCommand{
@@ -210,6 +292,18 @@ func DisableSIM(c *fiber.Ctx) error {
 // EnableSIM enables a SIM card
 func EnableSIM(c *fiber.Ctx) error {
 	deviceID := c.Params("id")
+
+	if !deviceInTenant(c, deviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
 	simSlotStr := c.Params("simslot")
 
 	simSlot, err := strconv.Atoi(simSlotStr)
@@ -219,12 +313,26 @@ func EnableSIM(c *fiber.Ctx) error {
 		})
 	}
 
+	// Quarantined SIMs go back into routing through the release endpoint only
+	var quarantined int64
+	tenantDB(c).Model(&models.SIMCard{}).Where("device_id = ? AND identifier = ? AND is_quarantined = ?", deviceID, simSlot, true).Count(&quarantined)
+	if quarantined > 0 {
+		return c.Status(409).JSON(fiber.Map{
+			"error": "SIM is quarantined, release it from quarantine instead",
+		})
+	}
+
 	// Update SIM status in database
-	if err := database.DB.Model(&models.SIMCard{}).Where("device_id = ? AND identifier = ?", deviceID, simSlot).Update("is_enabled", true).Error; err != nil {
+	var simCard models.SIMCard
+	tenantDB(c).Where("device_id = ? AND identifier = ?", deviceID, simSlot).First(&simCard)
+	if err := tenantDB(c).Model(&models.SIMCard{}).Where("device_id = ? AND identifier = ?", deviceID, simSlot).Update("is_enabled", true).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to enable SIM",
 		})
 	}
+	audit.Change(c, "sim_cards", strconv.FormatUint(uint64(simCard.ID), 10),
+		fiber.Map{"device_id": deviceID, "sim_slot": simSlot, "is_enabled": simCard.IsEnabled},
+		fiber.Map{"device_id": deviceID, "sim_slot": simSlot, "is_enabled": true})
 
 	// Send enable SIM command to device
 	enableCmd := types.EnableSIMCommand{
@@ -249,7 +357,8 @@ func GetDeviceStatuses(c *fiber.Ctx) error {
 	deviceID := c.Params("id")
 
 	var statuses []models.DeviceStatus
-	result := database.DB.Where("device_id = ?", deviceID).Order("created_at DESC").Limit(100).Find(&statuses)
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "device_statuses")
+	result := query.Where("device_id = ?", deviceID).Order("created_at DESC").Limit(100).Find(&statuses)
 	if result.Error != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to fetch device statuses",
@@ -262,10 +371,50 @@ func GetDeviceStatuses(c *fiber.Ctx) error {
 	})
 }
 
+// GetDevicePresence returns the live presence state of a device
+func GetDevicePresence(c *fiber.Ctx) error {
+	deviceID := c.Params("id")
+
+	var device models.Device
+	if err := permissionScope(c).ScopeDevices(tenantDB(c)).Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	response := fiber.Map{
+		"device_id":       device.DeviceID,
+		"operator_status": device.OperatorStatus,
+		"is_available":    device.IsAvailable,
+		"battery_level":   device.BatteryLevel,
+		"signal_strength": device.SignalStrength,
+		"last_seen":       device.LastSeen,
+		"offline_since":   device.OfflineSince,
+	}
+
+	if heartbeat, err := cache.GetDeviceHeartbeat(deviceID); err == nil {
+		response["last_heartbeat"] = heartbeat
+	}
+
+	return c.JSON(response)
+}
+
 // SendAlarmToDevice sends an alarm to a specific device
 func SendAlarmToDevice(c *fiber.Ctx) error {
 	deviceID := c.Params("id")
 
+	if !deviceInTenant(c, deviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
 	var alarmReq struct {
 		Title   string `json:"title"`
 		Message string `json:"message"`
@@ -302,7 +451,7 @@ func SendAlarmToDevice(c *fiber.Ctx) error {
 		Timestamp: time.Now().Unix(),
 	}
 
-	if err := database.DB.Create(&dbAlarm).Error; err != nil {
+	if err := tenantDB(c).Create(&dbAlarm).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to save alarm",
 		})
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"strconv"
+	"tsimserver/audit"
+	"tsimserver/deviceconfig"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetDeviceGroupConfig returns the settings of a device group
+func GetDeviceGroupConfig(c *fiber.Ctx) error {
+	groupIDStr := c.Params("id")
+	groupID, err := strconv.ParseUint(groupIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid device group ID",
+		})
+	}
+
+	var group models.DeviceGroup
+	if err := tenantDB(c).Where("id = ?", uint(groupID)).First(&group).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device group not found",
+		})
+	}
+
+	settings, err := deviceconfig.GroupSettings(uint(groupID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch device group config",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"device_group_id": uint(groupID),
+		"settings":        settings,
+		"defaults":        deviceconfig.Defaults(),
+	})
+}
+
+// SetDeviceGroupConfig replaces the settings of a device group and pushes them to its devices
+func SetDeviceGroupConfig(c *fiber.Ctx) error {
+	groupIDStr := c.Params("id")
+	groupID, err := strconv.ParseUint(groupIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid device group ID",
+		})
+	}
+
+	var group models.DeviceGroup
+	if err := tenantDB(c).Where("id = ?", uint(groupID)).First(&group).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device group not found",
+		})
+	}
+
+	var settings models.DeviceSettings
+	if err := c.BodyParser(&settings); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := deviceconfig.Validate(settings); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var groupConfig models.DeviceGroupConfig
+	tenantDB(c).Where("device_group_id = ?", group.ID).Limit(1).Find(&groupConfig)
+	before := groupConfig.Settings
+	groupConfig.DeviceGroupID = group.ID
+	groupConfig.Settings = settings
+
+	if err := tenantDB(c).Save(&groupConfig).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to save device group config",
+		})
+	}
+	audit.Change(c, "device_groups", groupIDStr, fiber.Map{"config": before}, fiber.Map{"config": settings})
+
+	pushed, err := deviceconfig.ReconcileGroup(group.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Config saved but failed to push to devices",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "Device group config updated successfully",
+		"config":         groupConfig,
+		"devices_synced": pushed,
+	})
+}
+
+// GetDeviceConfig returns desired, reported and override settings of a device with its drift
+func GetDeviceConfig(c *fiber.Ctx) error {
+	deviceID := c.Params("id")
+
+	if !deviceInTenant(c, deviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	state, err := deviceconfig.Reconcile(deviceID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"state": state,
+		"drift": deviceconfig.Drift(state.Desired, state.Reported),
+	})
+}
+
+// SetDeviceConfigOverrides replaces the per-device overrides and pushes the result
+func SetDeviceConfigOverrides(c *fiber.Ctx) error {
+	deviceID := c.Params("id")
+
+	var overrides models.DeviceSettings
+	if err := c.BodyParser(&overrides); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := deviceconfig.Validate(overrides); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var device models.Device
+	if err := tenantDB(c).Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	state, err := deviceconfig.State(deviceID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to load device config",
+		})
+	}
+
+	before := state.Overrides
+	state.Overrides = overrides
+	if err := tenantDB(c).Save(state).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to save device config overrides",
+		})
+	}
+	audit.Change(c, "devices", deviceID, fiber.Map{"config_overrides": before}, fiber.Map{"config_overrides": overrides})
+
+	state, err = deviceconfig.ReconcileAndPush(deviceID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Overrides saved but failed to push config",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Device config updated successfully",
+		"state":   state,
+	})
+}
+
+// PushDeviceConfig re-sends the desired configuration to a device
+func PushDeviceConfig(c *fiber.Ctx) error {
+	deviceID := c.Params("id")
+
+	if !deviceInTenant(c, deviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	state, err := deviceconfig.Reconcile(deviceID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if err := deviceconfig.Push(state); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to push config",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Config pushed successfully",
+		"version": state.DesiredVersion,
+	})
+}
+
+// GetConfigDrift lists devices whose reported configuration differs from the desired one
+func GetConfigDrift(c *fiber.Ctx) error {
+	var states []models.DeviceConfigState
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "device_config_states").Where("in_sync = ?", false).Order("updated_at DESC").Find(&states).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch config drift",
+		})
+	}
+
+	drifted := make([]fiber.Map, 0, len(states))
+	for _, state := range states {
+		drifted = append(drifted, fiber.Map{
+			"device_id":        state.DeviceID,
+			"desired_version":  state.DesiredVersion,
+			"reported_version": state.ReportedVersion,
+			"pushed_at":        state.PushedAt,
+			"reported_at":      state.ReportedAt,
+			"drift":            deviceconfig.Drift(state.Desired, state.Reported),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"devices": drifted,
+		"count":   len(drifted),
+	})
+}
@@ -2,7 +2,7 @@ package handlers
 
 import (
 	"strconv"
-	"tsimserver/database"
+	"tsimserver/audit"
 	"tsimserver/models"
 
 	"github.com/gofiber/fiber/v2"
@@ -19,7 +19,7 @@ func GetDeviceGroups(c *fiber.Ctx) error {
 
 	offset := (page - 1) * limit
 
-	query := database.DB.Model(&models.DeviceGroup{})
+	query := tenantDB(c).Model(&models.DeviceGroup{})
 
 	// Search functionality
 	if search != "" {
@@ -80,7 +80,7 @@ func GetDeviceGroup(c *fiber.Ctx) error {
 	}
 
 	var deviceGroup models.DeviceGroup
-	result := database.DB.Preload("Site").
+	result := tenantDB(c).Preload("Site").
 		Preload("Devices.SIMCards").
 		Where("id = ?", uint(groupID)).
 		First(&deviceGroup)
@@ -113,7 +113,7 @@ func CreateDeviceGroup(c *fiber.Ctx) error {
 
 	// Check if site exists
 	var site models.Site
-	if err := database.DB.Where("id = ?", deviceGroup.SiteID).First(&site).Error; err != nil {
+	if err := tenantDB(c).Where("id = ?", deviceGroup.SiteID).First(&site).Error; err != nil {
 		return c.Status(400).JSON(fiber.Map{
 			"error": "Site not found",
 		})
@@ -121,21 +121,23 @@ func CreateDeviceGroup(c *fiber.Ctx) error {
 
 	// Check if group name is unique within the site
 	var existingGroup models.DeviceGroup
-	if result := database.DB.Where("site_id = ? AND name = ?", deviceGroup.SiteID, deviceGroup.Name).First(&existingGroup); result.Error == nil {
+	if result := tenantDB(c).Where("site_id = ? AND name = ?", deviceGroup.SiteID, deviceGroup.Name).First(&existingGroup); result.Error == nil {
 		return c.Status(409).JSON(fiber.Map{
 			"error": "Device group name already exists in this site",
 		})
 	}
 
 	// Create device group
-	if err := database.DB.Create(&deviceGroup).Error; err != nil {
+	if err := tenantDB(c).Create(&deviceGroup).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to create device group",
 		})
 	}
+	// A copy, the site loaded below is not part of the change
+	audit.Change(c, "device_groups", strconv.FormatUint(uint64(deviceGroup.ID), 10), nil, deviceGroup)
 
 	// Load relations for response
-	database.DB.Preload("Site").First(&deviceGroup, deviceGroup.ID)
+	tenantDB(c).Preload("Site").First(&deviceGroup, deviceGroup.ID)
 
 	return c.Status(201).JSON(deviceGroup)
 }
@@ -151,11 +153,12 @@ func UpdateDeviceGroup(c *fiber.Ctx) error {
 	}
 
 	var deviceGroup models.DeviceGroup
-	if err := database.DB.Where("id = ?", uint(groupID)).First(&deviceGroup).Error; err != nil {
+	if err := tenantDB(c).Where("id = ?", uint(groupID)).First(&deviceGroup).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Device group not found",
 		})
 	}
+	before := deviceGroup
 
 	var updateData models.DeviceGroup
 	if err := c.BodyParser(&updateData); err != nil {
@@ -167,7 +170,7 @@ func UpdateDeviceGroup(c *fiber.Ctx) error {
 	// Check if name is unique within the site (if name is being updated)
 	if updateData.Name != "" && updateData.Name != deviceGroup.Name {
 		var existingGroup models.DeviceGroup
-		if result := database.DB.Where("site_id = ? AND name = ? AND id != ?",
+		if result := tenantDB(c).Where("site_id = ? AND name = ? AND id != ?",
 			deviceGroup.SiteID, updateData.Name, deviceGroup.ID).First(&existingGroup); result.Error == nil {
 			return c.Status(409).JSON(fiber.Map{
 				"error": "Device group name already exists in this site",
@@ -188,14 +191,15 @@ func UpdateDeviceGroup(c *fiber.Ctx) error {
 	}
 	deviceGroup.IsActive = updateData.IsActive
 
-	if err := database.DB.Save(&deviceGroup).Error; err != nil {
+	if err := tenantDB(c).Save(&deviceGroup).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to update device group",
 		})
 	}
+	audit.Change(c, "device_groups", groupIDStr, before, deviceGroup)
 
 	// Load relations for response
-	database.DB.Preload("Site").First(&deviceGroup, deviceGroup.ID)
+	tenantDB(c).Preload("Site").First(&deviceGroup, deviceGroup.ID)
 
 	return c.JSON(deviceGroup)
 }
@@ -212,7 +216,7 @@ func DeleteDeviceGroup(c *fiber.Ctx) error {
 
 	// Check if device group has devices
 	var deviceCount int64
-	database.DB.Model(&models.Device{}).Where("device_group_id = ?", uint(groupID)).Count(&deviceCount)
+	tenantDB(c).Model(&models.Device{}).Where("device_group_id = ?", uint(groupID)).Count(&deviceCount)
 
 	if deviceCount > 0 {
 		return c.Status(400).JSON(fiber.Map{
@@ -221,12 +225,18 @@ func DeleteDeviceGroup(c *fiber.Ctx) error {
 		})
 	}
 
+	var deviceGroup models.DeviceGroup
+	tenantDB(c).Where("id = ?", uint(groupID)).First(&deviceGroup)
+
 	// Delete device group
-	if err := database.DB.Delete(&models.DeviceGroup{}, uint(groupID)).Error; err != nil {
+	if err := tenantDB(c).Delete(&models.DeviceGroup{}, uint(groupID)).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to delete device group",
 		})
 	}
+	if deviceGroup.ID != 0 {
+		audit.Change(c, "device_groups", groupIDStr, &deviceGroup, nil)
+	}
 
 	return c.JSON(fiber.Map{
 		"message": "Device group deleted successfully",
@@ -243,23 +253,31 @@ func GetDeviceGroupStats(c *fiber.Ctx) error {
 		})
 	}
 
+	// Check if device group exists
+	var deviceGroup models.DeviceGroup
+	if err := tenantDB(c).Where("id = ?", uint(groupID)).First(&deviceGroup).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device group not found",
+		})
+	}
+
 	// Count devices by status
 	var totalDevices, activeDevices, onlineDevices, availableDevices int64
 
-	database.DB.Model(&models.Device{}).Where("device_group_id = ?", uint(groupID)).Count(&totalDevices)
-	database.DB.Model(&models.Device{}).Where("device_group_id = ? AND is_active = ?", uint(groupID), true).Count(&activeDevices)
-	database.DB.Model(&models.Device{}).Where("device_group_id = ? AND operator_status = ?", uint(groupID), "online").Count(&onlineDevices)
-	database.DB.Model(&models.Device{}).Where("device_group_id = ? AND is_available = ?", uint(groupID), true).Count(&availableDevices)
+	tenantDB(c).Model(&models.Device{}).Where("device_group_id = ?", uint(groupID)).Count(&totalDevices)
+	tenantDB(c).Model(&models.Device{}).Where("device_group_id = ? AND is_active = ?", uint(groupID), true).Count(&activeDevices)
+	tenantDB(c).Model(&models.Device{}).Where("device_group_id = ? AND operator_status = ?", uint(groupID), "online").Count(&onlineDevices)
+	tenantDB(c).Model(&models.Device{}).Where("device_group_id = ? AND is_available = ?", uint(groupID), true).Count(&availableDevices)
 
 	// Count SIM cards
 	var totalSIMCards, activeSIMCards int64
-	database.DB.Raw(`
+	tenantDB(c).Raw(`
 		SELECT COUNT(*) FROM sim_cards s
 		JOIN devices d ON s.device_id = d.device_id
 		WHERE d.device_group_id = ?
 	`, uint(groupID)).Scan(&totalSIMCards)
 
-	database.DB.Raw(`
+	tenantDB(c).Raw(`
 		SELECT COUNT(*) FROM sim_cards s
 		JOIN devices d ON s.device_id = d.device_id
 		WHERE d.device_group_id = ? AND s.is_active = true
@@ -267,25 +285,25 @@ func GetDeviceGroupStats(c *fiber.Ctx) error {
 
 	// Count SMS messages today
 	var smsToday, smsPending, smsDelivered, smsFailed int64
-	database.DB.Raw(`
+	tenantDB(c).Raw(`
 		SELECT COUNT(*) FROM sms_messages s
 		JOIN devices d ON s.device_id = d.device_id
 		WHERE d.device_group_id = ? AND DATE(s.created_at) = CURRENT_DATE
 	`, uint(groupID)).Scan(&smsToday)
 
-	database.DB.Raw(`
+	tenantDB(c).Raw(`
 		SELECT COUNT(*) FROM sms_messages s
 		JOIN devices d ON s.device_id = d.device_id
 		WHERE d.device_group_id = ? AND s.status = 'pending'
 	`, uint(groupID)).Scan(&smsPending)
 
-	database.DB.Raw(`
+	tenantDB(c).Raw(`
 		SELECT COUNT(*) FROM sms_messages s
 		JOIN devices d ON s.device_id = d.device_id
 		WHERE d.device_group_id = ? AND s.status = 'delivered'
 	`, uint(groupID)).Scan(&smsDelivered)
 
-	database.DB.Raw(`
+	tenantDB(c).Raw(`
 		SELECT COUNT(*) FROM sms_messages s
 		JOIN devices d ON s.device_id = d.device_id
 		WHERE d.device_group_id = ? AND s.status = 'failed'
@@ -319,7 +337,7 @@ func GetDeviceGroupOperators(c *fiber.Ctx) error {
 		Count    int64  `json:"group_count"`
 	}
 
-	result := database.DB.Model(&models.DeviceGroup{}).
+	result := tenantDB(c).Model(&models.DeviceGroup{}).
 		Select("operator, COUNT(*) as count").
 		Where("operator IS NOT NULL AND operator != ''").
 		Group("operator").
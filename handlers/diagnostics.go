@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"tsimserver/diagnostics"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// DiagnosticRequestBody represents the request body for a device diagnostic
+type DiagnosticRequestBody struct {
+	Command string          `json:"command" validate:"required"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// RequestDeviceDiagnostic sends a diagnostic command to a device
+func RequestDeviceDiagnostic(c *fiber.Ctx) error {
+	deviceID := c.Params("id")
+
+	if !deviceInTenant(c, deviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	var req DiagnosticRequestBody
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if !diagnostics.IsValidCommand(req.Command) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "command must be one of logs, screenshot, ping, connectivity, reboot, restart_app",
+		})
+	}
+
+	var requestedBy uint
+	if userID, ok := c.Locals("user_id").(uint); ok {
+		requestedBy = userID
+	}
+
+	request, err := diagnostics.Request(deviceID, req.Command, req.Params, requestedBy)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Device not found",
+			})
+		case errors.Is(err, diagnostics.ErrDeviceOffline):
+			return c.Status(409).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to send diagnostic request",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(202).JSON(fiber.Map{
+		"message": "Diagnostic request sent",
+		"request": request,
+	})
+}
+
+// GetDeviceDiagnostics returns the diagnostic requests of a device with pagination
+func GetDeviceDiagnostics(c *fiber.Ctx) error {
+	deviceID := c.Params("id")
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	command := c.Query("command", "")
+
+	offset := (page - 1) * limit
+
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.DiagnosticRequest{}), "diagnostic_requests").
+		Where("device_id = ?", deviceID)
+	if command != "" {
+		query = query.Where("command = ?", command)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get requests with pagination
+	var requests []models.DiagnosticRequest
+	result := query.Preload("Artifacts").Order("created_at DESC").Offset(offset).Limit(limit).Find(&requests)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch diagnostic requests",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"requests": requests,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetDiagnosticRequest returns a diagnostic request with its artifacts
+func GetDiagnosticRequest(c *fiber.Ctx) error {
+	requestIDStr := c.Params("id")
+	requestID, err := strconv.ParseUint(requestIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid diagnostic request ID",
+		})
+	}
+
+	var request models.DiagnosticRequest
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "diagnostic_requests").Preload("Artifacts").Where("id = ?", uint(requestID)).First(&request).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Diagnostic request not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"request": request,
+	})
+}
+
+// DownloadDiagnosticArtifact serves a file uploaded by a device
+func DownloadDiagnosticArtifact(c *fiber.Ctx) error {
+	artifactIDStr := c.Params("id")
+	artifactID, err := strconv.ParseUint(artifactIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid artifact ID",
+		})
+	}
+
+	var artifact models.DiagnosticArtifact
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "diagnostic_artifacts").Where("id = ?", uint(artifactID)).First(&artifact).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Artifact not found",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, artifact.ContentType)
+	return c.Download(artifact.FilePath, artifact.FileName)
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strconv"
+	"tsimserver/audit"
+	"tsimserver/geofence"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetSiteGeofence returns the geofence of a site
+func GetSiteGeofence(c *fiber.Ctx) error {
+	siteIDStr := c.Params("id")
+	siteID, err := strconv.ParseUint(siteIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid site ID",
+		})
+	}
+
+	var fence models.Geofence
+	if err := tenantDB(c).Where("site_id = ?", uint(siteID)).First(&fence).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Geofence not found",
+		})
+	}
+
+	return c.JSON(fence)
+}
+
+// SetSiteGeofence creates or replaces the geofence of a site
+func SetSiteGeofence(c *fiber.Ctx) error {
+	siteIDStr := c.Params("id")
+	siteID, err := strconv.ParseUint(siteIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid site ID",
+		})
+	}
+
+	var site models.Site
+	if err := tenantDB(c).Where("id = ?", uint(siteID)).First(&site).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Site not found",
+		})
+	}
+
+	var req struct {
+		FenceType    string       `json:"fence_type"`
+		RadiusMeters float64      `json:"radius_meters"`
+		Polygon      [][2]float64 `json:"polygon"`
+		IsActive     *bool        `json:"is_active"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var fence models.Geofence
+	tenantDB(c).Where("site_id = ?", site.ID).Limit(1).Find(&fence)
+	var before *models.Geofence
+	if fence.ID != 0 {
+		previous := fence
+		before = &previous
+	}
+
+	fence.SiteID = site.ID
+	fence.FenceType = req.FenceType
+	fence.RadiusMeters = req.RadiusMeters
+	fence.Polygon = ""
+	fence.IsActive = true
+	if req.IsActive != nil {
+		fence.IsActive = *req.IsActive
+	}
+
+	if req.FenceType == geofence.TypePolygon {
+		polygon, _ := json.Marshal(req.Polygon)
+		fence.Polygon = string(polygon)
+	}
+
+	if req.FenceType == geofence.TypeRadius && site.Latitude == 0 && site.Longitude == 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Site has no coordinates for a radius fence",
+		})
+	}
+
+	if err := geofence.Validate(&fence); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err := tenantDB(c).Save(&fence).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to save geofence",
+		})
+	}
+	audit.Change(c, "geofences", strconv.FormatUint(uint64(fence.ID), 10), before, &fence)
+
+	return c.JSON(fence)
+}
+
+// DeleteSiteGeofence removes the geofence of a site
+func DeleteSiteGeofence(c *fiber.Ctx) error {
+	siteIDStr := c.Params("id")
+	siteID, err := strconv.ParseUint(siteIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid site ID",
+		})
+	}
+
+	var fence models.Geofence
+	tenantDB(c).Where("site_id = ?", uint(siteID)).Limit(1).Find(&fence)
+
+	if err := tenantDB(c).Where("site_id = ?", uint(siteID)).Delete(&models.Geofence{}).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to delete geofence",
+		})
+	}
+	if fence.ID != 0 {
+		audit.Change(c, "geofences", strconv.FormatUint(uint64(fence.ID), 10), &fence, nil)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Geofence deleted successfully",
+	})
+}
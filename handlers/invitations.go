@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"net/mail"
+	"strconv"
+	"time"
+	"tsimserver/authaudit"
+	"tsimserver/database"
+	"tsimserver/invitations"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetInvitations returns registration invitations with pagination
+func GetInvitations(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+
+	offset := (page - 1) * limit
+
+	query := tenantDB(c).Model(&models.Invitation{})
+	switch c.Query("status") {
+	case "open":
+		query = query.Where("used_at IS NULL AND revoked_at IS NULL AND expires_at > ?", time.Now())
+	case "used":
+		query = query.Where("used_at IS NOT NULL")
+	case "revoked":
+		query = query.Where("revoked_at IS NOT NULL")
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	var invitationList []models.Invitation
+	result := query.Preload("Role").Order("created_at DESC").Offset(offset).Limit(limit).Find(&invitationList)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch invitations",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"invitations": invitationList,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// CreateInvitation creates an invitation token to register with
+func CreateInvitation(c *fiber.Ctx) error {
+	var req struct {
+		Email          string `json:"email"`            // optional, limits the invitation to one email
+		RoleID         *uint  `json:"role_id"`          // optional, viewer by default
+		TenantID       *uint  `json:"tenant_id"`        // super-admins only, others invite into their tenant
+		ExpiresInHours int    `json:"expires_in_hours"` // optional, registration.invite_ttl by default
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if _, err := mail.ParseAddress(req.Email); req.Email != "" && err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid email",
+		})
+	}
+
+	invitation := models.Invitation{
+		Email:  req.Email,
+		RoleID: req.RoleID,
+	}
+	if userID, ok := c.Locals("user_id").(uint); ok {
+		invitation.CreatedBy = userID
+	}
+	if req.ExpiresInHours > 0 {
+		invitation.ExpiresAt = time.Now().Add(time.Duration(req.ExpiresInHours) * time.Hour)
+	}
+
+	if req.RoleID != nil {
+		var count int64
+		database.DB.Model(&models.Role{}).Where("id = ? AND is_active = ?", *req.RoleID, true).Count(&count)
+		if count == 0 {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Role not found",
+			})
+		}
+		if !canGrantRole(c, *req.RoleID, nil, nil) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Cannot grant a role with permissions you do not hold",
+			})
+		}
+	}
+	if req.TenantID != nil {
+		if !tenantExists(*req.TenantID) {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Tenant not found",
+			})
+		}
+		invitation.TenantID = req.TenantID // replaced by the caller's tenant unless a super-admin
+	}
+
+	token, err := invitations.Create(tenantDB(c), &invitation)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to create invitation",
+		})
+	}
+	recordAuthEvent(c, authaudit.EventInvitationCreated, nil, invitation.Email, "invitation "+strconv.FormatUint(uint64(invitation.ID), 10))
+
+	return c.Status(201).JSON(fiber.Map{
+		"message":    "Invitation created. Send the token now, it cannot be shown again",
+		"token":      token,
+		"invitation": invitation,
+	})
+}
+
+// RevokeInvitation revokes an unused invitation
+func RevokeInvitation(c *fiber.Ctx) error {
+	invitationIDStr := c.Params("id")
+	invitationID, err := strconv.ParseUint(invitationIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid invitation ID",
+		})
+	}
+
+	var invitation models.Invitation
+	if err := tenantDB(c).Where("id = ?", uint(invitationID)).First(&invitation).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Invitation not found",
+		})
+	}
+	if invitation.UsedAt != nil || invitation.RevokedAt != nil {
+		return c.Status(409).JSON(fiber.Map{
+			"error": "Invitation is already used or revoked",
+		})
+	}
+
+	if err := tenantDB(c).Model(&invitation).Update("revoked_at", time.Now()).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to revoke invitation",
+		})
+	}
+	recordAuthEvent(c, authaudit.EventInvitationRevoked, nil, invitation.Email, "invitation "+invitationIDStr)
+
+	return c.JSON(fiber.Map{
+		"message": "Invitation revoked successfully",
+	})
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"tsimserver/authaudit"
+	"tsimserver/lockout"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetUserLockout returns the failed logins and lock of a user
+func GetUserLockout(c *fiber.Ctx) error {
+	userIDStr := c.Params("id")
+	userID, err := strconv.ParseUint(userIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var user models.User
+	if err := tenantDB(c).Where("id = ?", uint(userID)).First(&user).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	status, err := lockout.AccountStatus(lockout.UserAccount(user.ID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch lockout status",
+		})
+	}
+
+	return c.JSON(status)
+}
+
+// UnlockUser lifts the lock of a user after too many failed logins
+func UnlockUser(c *fiber.Ctx) error {
+	userIDStr := c.Params("id")
+	userID, err := strconv.ParseUint(userIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var user models.User
+	if err := tenantDB(c).Where("id = ?", uint(userID)).First(&user).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if err := lockout.Unlock(lockout.UserAccount(user.ID)); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to unlock user",
+		})
+	}
+	recordAuthEvent(c, authaudit.EventAccountUnlocked, &user, "", "")
+
+	return c.JSON(fiber.Map{
+		"message": "User unlocked successfully",
+	})
+}
+
+// UnlockIP lifts the lock of an IP address after too many failed logins
+func UnlockIP(c *fiber.Ctx) error {
+	ip := net.ParseIP(c.Params("ip"))
+	if ip == nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid IP address",
+		})
+	}
+
+	if err := lockout.UnlockIP(ip.String()); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to unlock IP address",
+		})
+	}
+	recordAuthEvent(c, authaudit.EventIPUnlocked, nil, "", ip.String())
+
+	return c.JSON(fiber.Map{
+		"message": "IP address unlocked successfully",
+	})
+}
+
+// loginBlocked responds to a login attempt refused by a lockout or wait
+func loginBlocked(c *fiber.Ctx, block *lockout.Block) error {
+	retryAfter := int(math.Ceil(block.RetryAfter.Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+
+	message := "Too many failed logins, try again later"
+	if block.Reason == lockout.ReasonAccountLocked {
+		message = "Account is temporarily locked after too many failed logins"
+	}
+	return c.Status(429).JSON(fiber.Map{
+		"error":       message,
+		"reason":      block.Reason,
+		"retry_after": retryAfter,
+	})
+}
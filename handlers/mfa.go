@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"tsimserver/authaudit"
+	"tsimserver/database"
+	"tsimserver/lockout"
+	"tsimserver/mfa"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// mfaChallengeRequest is the body of the second login step
+type mfaChallengeRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"` // TOTP or recovery code
+}
+
+// GetMFAStatus returns the two-factor authentication state of the current user
+func GetMFAStatus(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	return c.JSON(fiber.Map{
+		"enabled":                  mfa.Enabled(user.ID),
+		"required":                 mfa.Required(user.ID),
+		"remaining_recovery_codes": mfa.RemainingRecoveryCodes(user.ID),
+	})
+}
+
+// EnrollMFA starts setting up an authenticator for the current user
+func EnrollMFA(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+	return mfaEnrollment(c, user)
+}
+
+// EnableMFA confirms the pending authenticator of the current user with a first code
+func EnableMFA(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Code == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "code is required",
+		})
+	}
+
+	codes, err := mfa.Enable(user.ID, req.Code)
+	if err != nil {
+		return mfaError(c, err)
+	}
+	recordAuthEvent(c, authaudit.EventMFAEnabled, user, "", "")
+
+	return c.JSON(fiber.Map{
+		"message":        "Two-factor authentication enabled. Store the recovery codes now, they cannot be shown again",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableMFA removes the authenticator of the current user
+func DisableMFA(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if mfa.Required(user.ID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Two-factor authentication is required for your role",
+		})
+	}
+	if !checkCurrentPassword(user, req.Password) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Password is incorrect",
+		})
+	}
+	if err := mfa.Verify(user.ID, req.Code); err != nil {
+		return mfaError(c, err)
+	}
+
+	if err := mfa.Disable(user.ID); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to disable two-factor authentication",
+		})
+	}
+	recordAuthEvent(c, authaudit.EventMFADisabled, user, "", "")
+
+	return c.JSON(fiber.Map{
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// RegenerateMFARecoveryCodes replaces the recovery codes of the current user
+func RegenerateMFARecoveryCodes(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Code == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "code is required",
+		})
+	}
+
+	if err := mfa.Verify(user.ID, req.Code); err != nil {
+		return mfaError(c, err)
+	}
+
+	codes, err := mfa.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+	recordAuthEvent(c, authaudit.EventRecoveryCodes, user, "", "")
+
+	return c.JSON(fiber.Map{
+		"message":        "Recovery codes replaced. Store them now, they cannot be shown again",
+		"recovery_codes": codes,
+	})
+}
+
+// EnrollMFAChallenge starts setting up an authenticator during login, for users whose role
+// requires MFA before they have one
+func EnrollMFAChallenge(c *fiber.Ctx) error {
+	var req mfaChallengeRequest
+	if err := c.BodyParser(&req); err != nil || req.MFAToken == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "mfa_token is required",
+		})
+	}
+
+	challenge, user, err := openMFAChallenge(req.MFAToken)
+	if err != nil {
+		return mfaError(c, err)
+	}
+	if !challenge.Enrollment {
+		return c.Status(409).JSON(fiber.Map{
+			"error": mfa.ErrAlreadyEnabled.Error(),
+		})
+	}
+
+	return mfaEnrollment(c, user)
+}
+
+// VerifyMFAChallenge completes login with a TOTP or recovery code and creates the session.
+// For enrollment challenges the code confirms the new authenticator.
+func VerifyMFAChallenge(c *fiber.Ctx) error {
+	var req mfaChallengeRequest
+	if err := c.BodyParser(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "mfa_token and code are required",
+		})
+	}
+
+	challenge, user, err := openMFAChallenge(req.MFAToken)
+	if err != nil {
+		return mfaError(c, err)
+	}
+
+	// Codes are guessed against the account lockout too, not only the challenge. The
+	// password step was settled, so this attempt is the only one the login counts.
+	account := lockout.UserAccount(user.ID)
+	if block := lockout.Attempt(account, c.IP()); block != nil {
+		recordAuthEvent(c, authaudit.EventLoginBlocked, user, "", block.Reason)
+		return loginBlocked(c, block)
+	}
+	if err := mfa.ClaimAttempt(challenge); err != nil {
+		return mfaError(c, err)
+	}
+
+	var recoveryCodes []string
+	if challenge.Enrollment {
+		recoveryCodes, err = mfa.Enable(user.ID, req.Code)
+	} else {
+		err = mfa.Verify(user.ID, req.Code)
+	}
+	if err != nil {
+		if errors.Is(err, mfa.ErrInvalidCode) {
+			recordAuthEvent(c, authaudit.EventMFAFailure, user, "", "")
+			countFailure(c, account, user, "")
+		}
+		return mfaError(c, err)
+	}
+
+	if !mfa.CompleteChallenge(challenge) {
+		return mfaError(c, mfa.ErrInvalidChallenge)
+	}
+	if challenge.Enrollment {
+		recordAuthEvent(c, authaudit.EventMFAEnabled, user, "", "enrolled during login")
+	}
+	lockout.Succeed(account, c.IP())
+
+	response, err := startSession(c, user)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Error creating session",
+		})
+	}
+	response.RecoveryCodes = recoveryCodes
+
+	return c.JSON(response)
+}
+
+// ResetUserMFA removes the authenticator of a user who lost it. Users whose role requires
+// MFA enroll again on their next login.
+func ResetUserMFA(c *fiber.Ctx) error {
+	userIDStr := c.Params("id")
+	userID, err := strconv.ParseUint(userIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	// Check if user exists
+	var user models.User
+	if err := tenantDB(c).Where("id = ?", uint(userID)).First(&user).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if err := mfa.Disable(user.ID); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to reset two-factor authentication",
+		})
+	}
+	recordAuthEvent(c, authaudit.EventMFAReset, &user, "", "")
+
+	return c.JSON(fiber.Map{
+		"message": "Two-factor authentication reset successfully",
+	})
+}
+
+// openMFAChallenge returns the open challenge of a token and its active user
+func openMFAChallenge(token string) (*models.MFAChallenge, *models.User, error) {
+	challenge, err := mfa.FindChallenge(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var user models.User
+	if err := database.DB.Where("id = ? AND is_active = ?", challenge.UserID, true).First(&user).Error; err != nil {
+		return nil, nil, mfa.ErrInvalidChallenge
+	}
+	return challenge, &user, nil
+}
+
+// mfaEnrollment creates a pending authenticator and returns what the user's app needs
+func mfaEnrollment(c *fiber.Ctx, user *models.User) error {
+	secret, uri, err := mfa.BeginEnrollment(user)
+	if err != nil {
+		return mfaError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"secret":           secret,
+		"provisioning_uri": uri,
+		"message":          "Add the account to an authenticator app, then confirm it with a code",
+	})
+}
+
+// mfaError maps MFA errors to HTTP responses
+func mfaError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, mfa.ErrInvalidChallenge):
+		return c.Status(401).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, mfa.ErrInvalidCode):
+		return c.Status(422).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, mfa.ErrTooManyAttempts):
+		return c.Status(429).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, mfa.ErrNotEnrolled):
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, mfa.ErrAlreadyEnabled):
+		return c.Status(409).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(500).JSON(fiber.Map{
+		"error": "Two-factor authentication failed",
+	})
+}
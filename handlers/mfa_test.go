@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"tsimserver/cache"
+	"tsimserver/mfa"
+	"tsimserver/models"
+	"tsimserver/testutil"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// handleLockoutScripts runs the lockout package's attempt and release scripts in Go
+func handleLockoutScripts(redis *testutil.Redis) {
+	redis.HandleScript("local reasons = {ARGV[1], ARGV[2], ARGV[3]}",
+		func(call func(args ...string) interface{}, keys, argv []string) interface{} {
+			for i := 0; i < 3; i++ {
+				if ttl, _ := call("PTTL", keys[i]).(int64); ttl > 0 {
+					return []interface{}{argv[i], ttl}
+				}
+			}
+			accountFailures, _ := call("INCR", keys[3]).(int64)
+			call("PEXPIRE", keys[3], argv[3])
+			ipFailures, _ := call("INCR", keys[4]).(int64)
+			call("PEXPIRE", keys[4], argv[3])
+			maxUser, _ := strconv.ParseInt(argv[4], 10, 64)
+			maxIP, _ := strconv.ParseInt(argv[5], 10, 64)
+			if (maxUser > 0 && accountFailures > maxUser) || (maxIP > 0 && ipFailures > maxIP) {
+				call("DECR", keys[3])
+				call("DECR", keys[4])
+				return []interface{}{argv[2], int64(1000)}
+			}
+			return []interface{}{"", int64(0)}
+		})
+	redis.HandleScript("for _, key in ipairs(KEYS)",
+		func(call func(args ...string) interface{}, keys, argv []string) interface{} {
+			for _, key := range keys {
+				value, _ := call("GET", key).(string)
+				if failures, _ := strconv.Atoi(value); failures > 0 {
+					call("DECR", key)
+				}
+			}
+			return int64(0)
+		})
+}
+
+func TestMFALoginsLeaveNoIPFailures(t *testing.T) {
+	testutil.LoadConfig(t)
+	testutil.OpenDatabase(t, &models.User{}, &models.UserMFA{}, &models.MFAChallenge{},
+		&models.MFARecoveryCode{}, &models.Session{}, &models.AuthEvent{}, &models.Role{}, &models.UserRole{})
+	handleLockoutScripts(testutil.StartRedis(t))
+
+	user := models.User{Username: "alice", Email: "alice@example.com", Password: "Initial-Pass-1", IsActive: true}
+	if err := user.HashPassword(); err != nil {
+		t.Fatalf("hashing password: %v", err)
+	}
+	mustCreate(t, &user)
+	mustCreate(t, &models.UserMFA{UserID: user.ID, Secret: "JBSWY3DPEHPK3PXP", Enabled: true})
+	codes, err := mfa.RegenerateRecoveryCodes(user.ID)
+	if err != nil || len(codes) < 2 {
+		t.Fatalf("creating recovery codes: %v, %d codes", err, len(codes))
+	}
+
+	f := &scopeFixture{app: fiber.New()}
+	f.app.Post("/auth/login", Login)
+	f.app.Post("/auth/mfa/verify", VerifyMFAChallenge)
+	for _, code := range codes[:2] {
+		status, body := f.request(t, "POST", "/auth/login", `{"username":"alice","password":"Initial-Pass-1"}`)
+		token, _ := body["mfa_token"].(string)
+		if status != 200 || token == "" {
+			t.Fatalf("login = %d %v, want an MFA challenge", status, body)
+		}
+		status, body = f.request(t, "POST", "/auth/mfa/verify", `{"mfa_token":"`+token+`","code":"`+code+`"}`)
+		if status != 200 || body["access_token"] == nil {
+			t.Fatalf("MFA verification = %d %v, want a session", status, body)
+		}
+	}
+
+	for _, key := range []string{"ip:0.0.0.0", "account:user:" + strconv.Itoa(int(user.ID))} {
+		failures, _ := cache.RedisClient.Get(context.Background(), "tsimserver:lockout:failures:"+key).Int()
+		if failures != 0 {
+			t.Errorf("%s has %d failures after two MFA logins, want 0", key, failures)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"strconv"
+	"tsimserver/media"
+	"tsimserver/mms"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SendMMS sends an MMS with media attachments (multipart form, files under "media")
+func SendMMS(c *fiber.Ctx) error {
+	deviceID := c.FormValue("device_id")
+	target := c.FormValue("target")
+	simSlot, err := strconv.Atoi(c.FormValue("sim_slot", "0"))
+	if deviceID == "" || target == "" || err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "device_id, target and a numeric sim_slot are required",
+		})
+	}
+
+	if !deviceInTenant(c, deviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	var files []*multipart.FileHeader
+	if form, err := c.MultipartForm(); err == nil {
+		files = form.File["media"]
+	}
+
+	out := mms.Outgoing{
+		DeviceID: deviceID,
+		SimSlot:  simSlot,
+		Target:   target,
+		Subject:  c.FormValue("subject"),
+		Text:     c.FormValue("text"),
+	}
+	if userID, ok := c.Locals("user_id").(uint); ok {
+		out.SentBy = userID
+	}
+
+	for _, file := range files {
+		src, err := file.Open()
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to read %s", file.Filename),
+			})
+		}
+		defer src.Close()
+
+		out.Parts = append(out.Parts, media.Part{
+			FileName:    file.Filename,
+			ContentType: file.Header.Get("Content-Type"),
+			Size:        file.Size,
+			Data:        src,
+		})
+	}
+
+	message, err := mms.Send(out)
+	if err != nil {
+		return mmsError(c, message, err)
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "MMS sent successfully",
+		"mms":     message,
+	})
+}
+
+// GetMMSMessages returns MMS messages with pagination
+func GetMMSMessages(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+	deviceID := c.Query("device_id", "")
+	msgType := c.Query("type", "")
+
+	offset := (page - 1) * limit
+
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.MMSMessage{}), "mms_messages")
+	if deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	if msgType != "" {
+		query = query.Where("type = ?", msgType)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get messages with pagination
+	var messages []models.MMSMessage
+	result := query.Preload("Parts").Order("created_at DESC").Offset(offset).Limit(limit).Find(&messages)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch MMS messages",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"messages": messages,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetMMSMessage returns a specific MMS message with its parts
+func GetMMSMessage(c *fiber.Ctx) error {
+	messageIDStr := c.Params("id")
+	messageID, err := strconv.ParseUint(messageIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid MMS ID",
+		})
+	}
+
+	var message models.MMSMessage
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "mms_messages").Preload("Parts").Preload("Conversation").Where("id = ?", uint(messageID)).First(&message).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "MMS message not found",
+		})
+	}
+
+	return c.JSON(message)
+}
+
+// DeleteMMSMessage deletes an MMS message and its stored media
+func DeleteMMSMessage(c *fiber.Ctx) error {
+	messageIDStr := c.Params("id")
+	messageID, err := strconv.ParseUint(messageIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid MMS ID",
+		})
+	}
+
+	var message models.MMSMessage
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "mms_messages").Where("id = ?", uint(messageID)).First(&message).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "MMS message not found",
+		})
+	}
+
+	if err := mms.Delete(&message); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to delete MMS message",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "MMS message deleted successfully",
+	})
+}
+
+// GetConversations returns conversations with pagination, most recent first
+func GetConversations(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+	deviceID := c.Query("device_id", "")
+	peerNumber := c.Query("peer_number", "")
+
+	offset := (page - 1) * limit
+
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.Conversation{}), "conversations")
+	if deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	if peerNumber != "" {
+		query = query.Where("peer_number = ?", peerNumber)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get conversations with pagination
+	var conversations []models.Conversation
+	result := query.Order("last_message_at DESC NULLS LAST").Offset(offset).Limit(limit).Find(&conversations)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch conversations",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"conversations": conversations,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetConversationMessages returns the MMS messages of a conversation with pagination, newest first
+func GetConversationMessages(c *fiber.Ctx) error {
+	conversationIDStr := c.Params("id")
+	conversationID, err := strconv.ParseUint(conversationIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid conversation ID",
+		})
+	}
+
+	var conversation models.Conversation
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "conversations").Where("id = ?", uint(conversationID)).First(&conversation).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Conversation not found",
+		})
+	}
+
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+	offset := (page - 1) * limit
+
+	query := tenantDB(c).Model(&models.MMSMessage{}).Where("conversation_id = ?", conversation.ID)
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get messages with pagination
+	var messages []models.MMSMessage
+	result := query.Preload("Parts").Order("created_at DESC").Offset(offset).Limit(limit).Find(&messages)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch MMS messages",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"conversation": conversation,
+		"messages":     messages,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetMMSMedia serves a stored MMS part to API users
+func GetMMSMedia(c *fiber.Ctx) error {
+	mediaIDStr := c.Params("id")
+	mediaID, err := strconv.ParseUint(mediaIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid media ID",
+		})
+	}
+
+	return sendMMSMedia(c, uint(mediaID))
+}
+
+// DownloadMMSMedia serves a stored MMS part to devices holding its download token
+func DownloadMMSMedia(c *fiber.Ctx) error {
+	mediaIDStr := c.Params("id")
+	mediaID, err := strconv.ParseUint(mediaIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid media ID",
+		})
+	}
+
+	if !media.VerifyDownloadToken(uint(mediaID), c.Query("token")) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Invalid download token",
+		})
+	}
+
+	return sendMMSMedia(c, uint(mediaID))
+}
+
+// sendMMSMedia streams a stored MMS part from the media store
+func sendMMSMedia(c *fiber.Ctx, mediaID uint) error {
+	var record models.MMSMedia
+	if err := tenantDB(c).Where("id = ?", mediaID).First(&record).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Media not found",
+		})
+	}
+
+	content, err := media.Open(&record)
+	if err != nil {
+		if errors.Is(err, media.ErrNotFound) {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Media content not found",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to read media",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, record.ContentType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", record.FileName))
+	c.Set("X-Checksum-SHA256", record.SHA256)
+	return c.SendStream(content, int(record.Size))
+}
+
+// mmsError maps MMS send errors to HTTP responses
+func mmsError(c *fiber.Ctx, message *models.MMSMessage, err error) error {
+	switch {
+	case errors.Is(err, mms.ErrEmptyMessage),
+		errors.Is(err, media.ErrTooManyParts):
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, media.ErrUnsupportedType):
+		return c.Status(415).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, media.ErrPartTooLarge),
+		errors.Is(err, media.ErrMessageTooLarge):
+		return c.Status(413).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	response := fiber.Map{
+		"error":   "Failed to send MMS",
+		"details": err.Error(),
+	}
+	if message != nil {
+		response["mms_id"] = message.ID
+	}
+	return c.Status(500).JSON(response)
+}
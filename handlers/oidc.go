@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"time"
+	"tsimserver/authaudit"
+	"tsimserver/config"
+	"tsimserver/oidc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// oidcBindingCookie keeps the binding of a login in the browser that started it
+const oidcBindingCookie = "tsim_oidc_login"
+
+// GetOIDCProviders lists the identity providers users can log in with
+func GetOIDCProviders(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"providers": oidc.Providers(),
+	})
+}
+
+// OIDCLogin redirects to an identity provider to log in
+func OIDCLogin(c *fiber.Ctx) error {
+	authURL, binding, err := oidc.BeginLogin(c.UserContext(), c.Params("provider"))
+	if err != nil {
+		return oidcError(c, err)
+	}
+
+	setOIDCBinding(c, binding, time.Now().Add(time.Duration(config.AppConfig.OIDC.StateTTL)*time.Second))
+	return c.Redirect(authURL)
+}
+
+// OIDCCallback completes a login at an identity provider. The user then continues like
+// after a password login, with an MFA challenge or a session.
+func OIDCCallback(c *fiber.Ctx) error {
+	if providerError := c.Query("error"); providerError != "" {
+		return c.Status(401).JSON(fiber.Map{
+			"error":   "Login was rejected by the identity provider",
+			"details": providerError + " " + c.Query("error_description"),
+		})
+	}
+
+	code := c.Query("code")
+	state := c.Query("state")
+	if code == "" || state == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "code and state are required",
+		})
+	}
+
+	// The binding is only good for one callback
+	binding := c.Cookies(oidcBindingCookie)
+	setOIDCBinding(c, "", time.Unix(0, 0))
+
+	user, err := oidc.FinishLogin(c.UserContext(), c.Params("provider"), code, state, binding)
+	if err != nil {
+		recordAuthEvent(c, authaudit.EventSSOFailure, nil, "", c.Params("provider")+": "+err.Error())
+		return oidcError(c, err)
+	}
+	recordAuthEvent(c, authaudit.EventSSOLogin, user, "", c.Params("provider"))
+
+	return completeLogin(c, user, "")
+}
+
+// setOIDCBinding sets the login binding cookie for the provider's callback route, or
+// removes it with an expiry in the past. Lax cookies are sent on the provider's redirect back.
+func setOIDCBinding(c *fiber.Ctx, binding string, expires time.Time) {
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcBindingCookie,
+		Value:    binding,
+		Path:     "/api/v1/auth/oidc/" + c.Params("provider"),
+		Expires:  expires,
+		Secure:   c.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+// oidcError maps OIDC errors to HTTP responses
+func oidcError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, oidc.ErrUnknownProvider):
+		return c.Status(404).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, oidc.ErrInvalidState), errors.Is(err, oidc.ErrInvalidIDToken):
+		return c.Status(401).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, oidc.ErrNotProvisioned), errors.Is(err, oidc.ErrInactiveUser):
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, oidc.ErrEmailInUse), errors.Is(err, oidc.ErrMissingEmail):
+		return c.Status(409).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, oidc.ErrProvider):
+		log.Printf("OIDC provider error: %v", err)
+		return c.Status(502).JSON(fiber.Map{
+			"error": "Identity provider request failed",
+		})
+	}
+
+	log.Printf("OIDC login failed: %v", err)
+	return c.Status(500).JSON(fiber.Map{
+		"error": "Single sign-on failed",
+	})
+}
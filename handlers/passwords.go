@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"tsimserver/authaudit"
+	"tsimserver/passwords"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetPasswordPolicy returns the rules new passwords must meet
+func GetPasswordPolicy(c *fiber.Ctx) error {
+	return c.JSON(passwords.CurrentPolicy())
+}
+
+// ForgotPassword emails a password reset link. It answers the same whether or not the
+// email belongs to an account.
+func ForgotPassword(c *fiber.Ctx) error {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Email == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "email is required",
+		})
+	}
+
+	user, err := passwords.RequestReset(req.Email, c.IP())
+	if err != nil {
+		log.Printf("Password reset for %s failed: %v", req.Email, err)
+	}
+	if user != nil {
+		recordAuthEvent(c, authaudit.EventPasswordResetSent, user, "", "")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "If the email belongs to an account, a password reset link was sent to it",
+	})
+}
+
+// ResetPassword sets a new password with the token from a reset email and logs the user
+// out everywhere
+func ResetPassword(c *fiber.Ctx) error {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Token == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "token and password are required",
+		})
+	}
+
+	user, err := passwords.Reset(req.Token, req.Password)
+	if errors.Is(err, passwords.ErrInvalidToken) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid or expired reset token",
+		})
+	}
+	if err != nil {
+		return passwordError(c, err)
+	}
+	recordAuthEvent(c, authaudit.EventPasswordReset, user, "", "")
+
+	return c.JSON(fiber.Map{
+		"message": "Password reset successfully, log in with the new password",
+	})
+}
+
+// passwordError maps errors of setting a password to HTTP responses
+func passwordError(c *fiber.Ctx, err error) error {
+	var policyErr *passwords.PolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		return c.Status(400).JSON(fiber.Map{
+			"error":      "Password does not meet the password policy",
+			"violations": policyErr.Violations,
+		})
+	case errors.Is(err, passwords.ErrReused):
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Password was used before, choose another one",
+		})
+	}
+
+	return c.Status(500).JSON(fiber.Map{
+		"error": "Error updating password",
+	})
+}
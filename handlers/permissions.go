@@ -7,6 +7,7 @@ import (
 	"tsimserver/models"
 
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 // GetPermissions returns all permissions with pagination
@@ -179,15 +180,15 @@ func UpdatePermission(c *fiber.Ctx) error {
 	}
 	permission.IsActive = updateData.IsActive
 
-	if err := database.DB.Save(&permission).Error; err != nil {
+	// Save the permission and sync Casbin policies
+	if err := auth.UpdatePolicies(func(tx *gorm.DB) error {
+		return tx.Save(&permission).Error
+	}); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to update permission",
 		})
 	}
 
-	// Sync Casbin policies
-	auth.SyncPoliciesFromDatabase()
-
 	return c.JSON(permission)
 }
 
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"tsimserver/audit"
+	"tsimserver/models"
+	"tsimserver/phonenumber"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// DiscoverSIMPhoneNumber starts a phone number discovery for a SIM card
+func DiscoverSIMPhoneNumber(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	var req struct {
+		Method   string `json:"method"`
+		USSDCode string `json:"ussd_code"`
+	}
+	c.BodyParser(&req)
+
+	var simCard models.SIMCard
+	if err := tenantDB(c).Where("id = ?", uint(simID)).First(&simCard).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, simCard.DeviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	discovery, err := phonenumber.Discover(&simCard, req.Method, req.USSDCode, false)
+	if err != nil {
+		return phoneNumberDiscoveryError(c, err)
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message":   "Phone number discovery started",
+		"discovery": discovery,
+	})
+}
+
+// GetSIMPhoneNumberDiscoveries returns the phone number discoveries of a SIM card with pagination
+func GetSIMPhoneNumberDiscoveries(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+
+	offset := (page - 1) * limit
+
+	var simCard models.SIMCard
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Unscoped(), "sim_cards").Where("id = ?", uint(simID)).First(&simCard).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	query := tenantDB(c).Model(&models.PhoneNumberDiscovery{}).Where("sim_card_id = ?", simCard.ID)
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get discoveries with pagination
+	var discoveries []models.PhoneNumberDiscovery
+	result := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&discoveries)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch phone number discoveries",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"sim_card_id":        simCard.ID,
+		"phone_number":       simCard.PhoneNumber,
+		"number_verified_at": simCard.NumberVerifiedAt,
+		"number_method":      simCard.NumberMethod,
+		"discoveries":        discoveries,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetOperatorNumberConfigs returns all operator number configurations
+func GetOperatorNumberConfigs(c *fiber.Ctx) error {
+	var configs []models.OperatorNumberConfig
+	if err := tenantDB(c).Order("name").Find(&configs).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch number configurations",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"configs": configs,
+	})
+}
+
+// CreateOperatorNumberConfig creates an operator number configuration
+func CreateOperatorNumberConfig(c *fiber.Ctx) error {
+	var cfg models.OperatorNumberConfig
+	if err := c.BodyParser(&cfg); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := validateOperatorNumberConfig(&cfg); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	cfg.ID = 0
+	if err := tenantDB(c).Create(&cfg).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to create number configuration",
+		})
+	}
+	audit.Change(c, "operator_number_configs", strconv.FormatUint(uint64(cfg.ID), 10), nil, &cfg)
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "Number configuration created successfully",
+		"config":  cfg,
+	})
+}
+
+// UpdateOperatorNumberConfig replaces an operator number configuration
+func UpdateOperatorNumberConfig(c *fiber.Ctx) error {
+	cfgIDStr := c.Params("id")
+	cfgID, err := strconv.ParseUint(cfgIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid number configuration ID",
+		})
+	}
+
+	var cfg models.OperatorNumberConfig
+	if err := tenantDB(c).Where("id = ?", uint(cfgID)).First(&cfg).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Number configuration not found",
+		})
+	}
+	before := cfg
+
+	if err := c.BodyParser(&cfg); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	cfg.ID = uint(cfgID)
+
+	if err := validateOperatorNumberConfig(&cfg); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err := tenantDB(c).Save(&cfg).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to update number configuration",
+		})
+	}
+	audit.Change(c, "operator_number_configs", cfgIDStr, &before, &cfg)
+
+	return c.JSON(fiber.Map{
+		"message": "Number configuration updated successfully",
+		"config":  cfg,
+	})
+}
+
+// DeleteOperatorNumberConfig deletes an operator number configuration
+func DeleteOperatorNumberConfig(c *fiber.Ctx) error {
+	cfgIDStr := c.Params("id")
+	cfgID, err := strconv.ParseUint(cfgIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid number configuration ID",
+		})
+	}
+
+	var cfg models.OperatorNumberConfig
+	tenantDB(c).Where("id = ?", uint(cfgID)).First(&cfg)
+
+	if err := tenantDB(c).Delete(&models.OperatorNumberConfig{}, uint(cfgID)).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to delete number configuration",
+		})
+	}
+	if cfg.ID != 0 {
+		audit.Change(c, "operator_number_configs", cfgIDStr, &cfg, nil)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Number configuration deleted successfully",
+	})
+}
+
+// validateOperatorNumberConfig checks the operator match and pattern of a configuration
+func validateOperatorNumberConfig(cfg *models.OperatorNumberConfig) error {
+	if cfg.Name == "" {
+		return errors.New("name is required")
+	}
+	if cfg.MCC == "" && cfg.Operator == "" {
+		return errors.New("either mcc/mnc or operator is required")
+	}
+	if cfg.USSDCode == "" {
+		return errors.New("ussd_code is required")
+	}
+	if cfg.Pattern != "" {
+		if _, err := phonenumber.CompilePattern(cfg.Pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// phoneNumberDiscoveryError maps phone number discovery errors to responses
+func phoneNumberDiscoveryError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, phonenumber.ErrInvalidMethod), errors.Is(err, phonenumber.ErrNoUSSDCode):
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, phonenumber.ErrInProgress), errors.Is(err, phonenumber.ErrNoPeer):
+		return c.Status(409).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(500).JSON(fiber.Map{
+		"error":   "Failed to start phone number discovery",
+		"details": err.Error(),
+	})
+}
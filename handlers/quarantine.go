@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"tsimserver/audit"
+	"tsimserver/models"
+	"tsimserver/quarantine"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// GetSIMQuarantines returns SIM quarantines with pagination, active ones by default
+func GetSIMQuarantines(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+	status := c.Query("status", quarantine.StatusActive)
+	deviceID := c.Query("device_id", "")
+
+	offset := (page - 1) * limit
+
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.SIMQuarantine{}), "sim_quarantines")
+	if status != "all" {
+		query = query.Where("status = ?", status)
+	}
+	if deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get quarantines with pagination
+	var quarantines []models.SIMQuarantine
+	result := query.Preload("SIMCard").Order("created_at DESC").Offset(offset).Limit(limit).Find(&quarantines)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch quarantines",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"quarantines": quarantines,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetSIMCardQuarantines returns the quarantine history of a SIM card
+func GetSIMCardQuarantines(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	if !simCardInPermissionScope(c, uint(simID)) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	var quarantines []models.SIMQuarantine
+	result := tenantDB(c).Where("sim_card_id = ?", uint(simID)).Preload("ReleasedByUser").
+		Order("created_at DESC").Limit(100).Find(&quarantines)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch quarantines",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"quarantines": quarantines,
+	})
+}
+
+// ReleaseSIMQuarantine puts a quarantined SIM card back into routing
+func ReleaseSIMQuarantine(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	var simCard models.SIMCard
+	if err := tenantDB(c).Where("id = ?", uint(simID)).First(&simCard).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, simCard.DeviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	var req struct {
+		Note string `json:"note"`
+	}
+	c.BodyParser(&req)
+
+	var releasedBy uint
+	if userID, ok := c.Locals("user_id").(uint); ok {
+		releasedBy = userID
+	}
+
+	entry, err := quarantine.Release(uint(simID), releasedBy, req.Note)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return c.Status(404).JSON(fiber.Map{
+				"error": "SIM card not found",
+			})
+		case errors.Is(err, quarantine.ErrNotQuarantined):
+			return c.Status(409).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to release SIM from quarantine",
+		})
+	}
+	audit.Change(c, "sim_cards", simIDStr, fiber.Map{"is_quarantined": simCard.IsQuarantined},
+		fiber.Map{"is_quarantined": false, "quarantine": entry})
+
+	return c.JSON(fiber.Map{
+		"message":    "SIM released from quarantine",
+		"quarantine": entry,
+	})
+}
@@ -2,11 +2,13 @@ package handlers
 
 import (
 	"strconv"
+	"tsimserver/audit"
 	"tsimserver/auth"
 	"tsimserver/database"
 	"tsimserver/models"
 
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 // GetRoles returns all roles with pagination
@@ -17,7 +19,7 @@ func GetRoles(c *fiber.Ctx) error {
 
 	offset := (page - 1) * limit
 
-	query := database.DB.Model(&models.Role{})
+	query := tenantDB(c).Model(&models.Role{})
 
 	// Search functionality
 	if search != "" {
@@ -63,7 +65,7 @@ func GetRole(c *fiber.Ctx) error {
 	}
 
 	var role models.Role
-	result := database.DB.Preload("UserRoles").
+	result := tenantDB(c).Preload("UserRoles").
 		Preload("RolePermissions.Permission").
 		Where("id = ?", uint(roleID)).
 		First(&role)
@@ -96,18 +98,19 @@ func CreateRole(c *fiber.Ctx) error {
 
 	// Check if role name already exists
 	var existingRole models.Role
-	if result := database.DB.Where("name = ?", role.Name).First(&existingRole); result.Error == nil {
+	if result := tenantDB(c).Where("name = ?", role.Name).First(&existingRole); result.Error == nil {
 		return c.Status(409).JSON(fiber.Map{
 			"error": "Role name already exists",
 		})
 	}
 
 	// Create role
-	if err := database.DB.Create(&role).Error; err != nil {
+	if err := tenantDB(c).Create(&role).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to create role",
 		})
 	}
+	audit.Change(c, "roles", strconv.FormatUint(uint64(role.ID), 10), nil, &role)
 
 	return c.Status(201).JSON(role)
 }
@@ -123,7 +126,7 @@ func UpdateRole(c *fiber.Ctx) error {
 	}
 
 	var role models.Role
-	if err := database.DB.Where("id = ?", uint(roleID)).First(&role).Error; err != nil {
+	if err := tenantDB(c).Where("id = ?", uint(roleID)).First(&role).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Role not found",
 		})
@@ -136,10 +139,12 @@ func UpdateRole(c *fiber.Ctx) error {
 		})
 	}
 
+	before := role
+
 	// Check if role name already exists (for other roles)
 	if updateData.Name != "" && updateData.Name != role.Name {
 		var existingRole models.Role
-		if result := database.DB.Where("name = ? AND id != ?", updateData.Name, role.ID).First(&existingRole); result.Error == nil {
+		if result := tenantDB(c).Where("name = ? AND id != ?", updateData.Name, role.ID).First(&existingRole); result.Error == nil {
 			return c.Status(409).JSON(fiber.Map{
 				"error": "Role name already exists",
 			})
@@ -155,12 +160,17 @@ func UpdateRole(c *fiber.Ctx) error {
 		role.Description = updateData.Description
 	}
 	role.IsActive = updateData.IsActive
+	role.MFARequired = updateData.MFARequired
 
-	if err := database.DB.Save(&role).Error; err != nil {
+	// Renaming or deactivating a role changes its Casbin policies
+	if err := auth.UpdatePolicies(func(tx *gorm.DB) error {
+		return tx.Save(&role).Error
+	}); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to update role",
 		})
 	}
+	audit.Change(c, "roles", roleIDStr, &before, &role)
 
 	return c.JSON(role)
 }
@@ -175,7 +185,7 @@ func DeleteRole(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if role has users
+	// Check if role has users in any tenant, roles are shared by all of them
 	var userCount int64
 	database.DB.Model(&models.UserRole{}).Where("role_id = ?", uint(roleID)).Count(&userCount)
 
@@ -185,18 +195,23 @@ func DeleteRole(c *fiber.Ctx) error {
 		})
 	}
 
-	// Delete role permissions first
-	database.DB.Where("role_id = ?", uint(roleID)).Delete(&models.RolePermission{})
+	var role models.Role
+	tenantDB(c).Where("id = ?", uint(roleID)).First(&role)
 
-	// Delete role
-	if err := database.DB.Delete(&models.Role{}, uint(roleID)).Error; err != nil {
+	// Delete role permissions first, then the role, and sync Casbin policies
+	if err := auth.UpdatePolicies(func(tx *gorm.DB) error {
+		if err := tx.Where("role_id = ?", uint(roleID)).Delete(&models.RolePermission{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.Role{}, uint(roleID)).Error
+	}); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to delete role",
 		})
 	}
-
-	// Sync Casbin policies
-	auth.SyncPoliciesFromDatabase()
+	if role.ID != 0 {
+		audit.Change(c, "roles", roleIDStr, &role, nil)
+	}
 
 	return c.JSON(fiber.Map{
 		"message": "Role deleted successfully",
@@ -225,7 +240,7 @@ func AssignPermissionToRole(c *fiber.Ctx) error {
 
 	// Check if role exists
 	var role models.Role
-	if err := database.DB.Where("id = ?", uint(roleID)).First(&role).Error; err != nil {
+	if err := tenantDB(c).Where("id = ?", uint(roleID)).First(&role).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Role not found",
 		})
@@ -233,7 +248,7 @@ func AssignPermissionToRole(c *fiber.Ctx) error {
 
 	// Check if permission exists
 	var permission models.Permission
-	if err := database.DB.Where("id = ?", req.PermissionID).First(&permission).Error; err != nil {
+	if err := tenantDB(c).Where("id = ?", req.PermissionID).First(&permission).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Permission not found",
 		})
@@ -241,7 +256,7 @@ func AssignPermissionToRole(c *fiber.Ctx) error {
 
 	// Check if assignment already exists
 	var existingAssignment models.RolePermission
-	result := database.DB.Where("role_id = ? AND permission_id = ?", uint(roleID), req.PermissionID).First(&existingAssignment)
+	result := tenantDB(c).Where("role_id = ? AND permission_id = ?", uint(roleID), req.PermissionID).First(&existingAssignment)
 	if result.Error == nil {
 		return c.Status(409).JSON(fiber.Map{
 			"error": "Permission already assigned to role",
@@ -254,14 +269,18 @@ func AssignPermissionToRole(c *fiber.Ctx) error {
 		PermissionID: req.PermissionID,
 	}
 
-	if err := database.DB.Create(&assignment).Error; err != nil {
+	// Create the assignment and sync Casbin policies
+	if err := auth.UpdatePolicies(func(tx *gorm.DB) error {
+		return tx.Create(&assignment).Error
+	}); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to assign permission to role",
 		})
 	}
-
-	// Sync Casbin policies
-	auth.SyncPoliciesFromDatabase()
+	audit.Change(c, "roles", roleIDStr, nil, fiber.Map{
+		"role":             role.Name,
+		"permission_added": permission.Name,
+	})
 
 	return c.Status(201).JSON(fiber.Map{
 		"message": "Permission assigned to role successfully",
@@ -286,15 +305,15 @@ func RemovePermissionFromRole(c *fiber.Ctx) error {
 		})
 	}
 
-	// Remove assignment
-	if err := database.DB.Where("role_id = ? AND permission_id = ?", uint(roleID), uint(permissionID)).Delete(&models.RolePermission{}).Error; err != nil {
+	// Remove assignment and sync Casbin policies
+	if err := auth.UpdatePolicies(func(tx *gorm.DB) error {
+		return tx.Where("role_id = ? AND permission_id = ?", uint(roleID), uint(permissionID)).Delete(&models.RolePermission{}).Error
+	}); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to remove permission from role",
 		})
 	}
-
-	// Sync Casbin policies
-	auth.SyncPoliciesFromDatabase()
+	audit.Change(c, "roles", roleIDStr, fiber.Map{"permission_removed": uint(permissionID)}, nil)
 
 	return c.JSON(fiber.Map{
 		"message": "Permission removed from role successfully",
@@ -312,7 +331,7 @@ func GetRoleUsers(c *fiber.Ctx) error {
 	}
 
 	var users []models.User
-	result := database.DB.Table("users").
+	result := tenantDB(c).Table("users").
 		Joins("JOIN user_roles ON users.id = user_roles.user_id").
 		Where("user_roles.role_id = ? AND users.is_active = ?", uint(roleID), true).
 		Find(&users)
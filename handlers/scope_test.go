@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"tsimserver/auth"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/testutil"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// scopeFixture holds the records of a site inside and a site outside the permission scope
+type scopeFixture struct {
+	app        *fiber.App
+	inSIM      models.SIMCard
+	outSIM     models.SIMCard
+	outRequest models.DiagnosticRequest
+	outFile    models.DiagnosticArtifact
+}
+
+// setupScope creates a device with a SIM card on each of two sites and serves the SIM card,
+// device and diagnostic routes to a user whose permission covers only the first site. The
+// routes get the scope the way RequirePermission sets it; scoped is false to leave it unset.
+func setupScope(t *testing.T, scoped bool) *scopeFixture {
+	t.Helper()
+
+	testutil.LoadConfig(t)
+	testutil.OpenDatabase(t, &models.Site{}, &models.DeviceGroup{}, &models.Device{}, &models.SIMCard{},
+		&models.SIMCardEvent{}, &models.SIMQuarantine{}, &models.SIMLoopbackTest{}, &models.SIMBalanceCheck{},
+		&models.PhoneNumberDiscovery{}, &models.DiagnosticRequest{}, &models.DiagnosticArtifact{},
+		&models.DeviceConfigState{})
+
+	f := &scopeFixture{}
+	var siteIDs []uint
+	for i, deviceID := range []string{"device-in", "device-out"} {
+		site := models.Site{Name: deviceID, Country: "TR", PhoneCode: "+90"}
+		mustCreate(t, &site)
+		group := models.DeviceGroup{SiteID: site.ID, Name: deviceID}
+		mustCreate(t, &group)
+		mustCreate(t, &models.Device{DeviceID: deviceID, DeviceName: deviceID, ConnectKey: deviceID, DeviceGroupID: &group.ID})
+
+		sim := models.SIMCard{DeviceID: deviceID, Identifier: "1", ICCID: "8990" + strconv.Itoa(i), IsActive: true}
+		mustCreate(t, &sim)
+		mustCreate(t, &models.SIMCardEvent{SIMCardID: sim.ID, DeviceID: deviceID, EventType: "inserted"})
+		mustCreate(t, &models.SIMQuarantine{SIMCardID: sim.ID, DeviceID: deviceID, Status: "active"})
+		mustCreate(t, &models.DeviceConfigState{DeviceID: deviceID, InSync: false})
+		request := models.DiagnosticRequest{DeviceID: deviceID, Command: "logs"}
+		mustCreate(t, &request)
+		artifact := models.DiagnosticArtifact{DiagnosticRequestID: request.ID, DeviceID: deviceID, FileName: "logs.txt"}
+		mustCreate(t, &artifact)
+
+		siteIDs = append(siteIDs, site.ID)
+		if i == 0 {
+			f.inSIM = sim
+		} else {
+			f.outSIM, f.outRequest, f.outFile = sim, request, artifact
+		}
+	}
+
+	f.app = fiber.New()
+	f.app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user_id", uint(1))
+		if scoped {
+			c.Locals("permission_scope", auth.Scope{SiteIDs: siteIDs[:1]})
+		}
+		return c.Next()
+	})
+	f.app.Get("/sim-cards", GetSIMCards)
+	f.app.Get("/sim-cards/health", GetSIMHealthOverview)
+	f.app.Get("/sim-cards/quarantines", GetSIMQuarantines)
+	f.app.Get("/sim-cards/:id", GetSIMCard)
+	f.app.Get("/sim-cards/:id/history", GetSIMCardHistory)
+	f.app.Get("/sim-cards/:id/balance", GetSIMBalanceHistory)
+	f.app.Post("/sim-cards/:id/balance/check", CheckSIMBalance)
+	f.app.Get("/sim-cards/:id/phone-number/discoveries", GetSIMPhoneNumberDiscoveries)
+	f.app.Post("/sim-cards/:id/phone-number/discover", DiscoverSIMPhoneNumber)
+	f.app.Get("/sim-cards/:id/health", GetSIMCardHealth)
+	f.app.Get("/sim-cards/:id/loopback-tests", GetSIMLoopbackTests)
+	f.app.Post("/sim-cards/:id/loopback-tests", RunSIMLoopbackTest)
+	f.app.Get("/sim-cards/:id/routing-score", GetSIMRoutingScore)
+	f.app.Put("/sim-cards/:id/daily-limit", UpdateSIMDailyLimit)
+	f.app.Get("/sim-cards/:id/quarantines", GetSIMCardQuarantines)
+	f.app.Post("/sim-cards/:id/release", ReleaseSIMQuarantine)
+	f.app.Get("/devices/config-drift", GetConfigDrift)
+	f.app.Get("/devices/:id/sim-history", GetDeviceSIMHistory)
+	f.app.Put("/devices/:id/config", SetDeviceConfigOverrides)
+	f.app.Get("/devices/:id/diagnostics", GetDeviceDiagnostics)
+	f.app.Get("/diagnostics/:id", GetDiagnosticRequest)
+	f.app.Get("/diagnostics/artifacts/:id/download", DownloadDiagnosticArtifact)
+	return f
+}
+
+// mustCreate inserts a record or fails the test
+func mustCreate(t *testing.T, value interface{}) {
+	t.Helper()
+
+	if err := database.DB.Create(value).Error; err != nil {
+		t.Fatalf("creating %T: %v", value, err)
+	}
+}
+
+// request sends a request to the app and returns the status and decoded JSON body
+func (f *scopeFixture) request(t *testing.T, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	var decoded map[string]interface{}
+	json.Unmarshal(data, &decoded)
+	return resp.StatusCode, decoded
+}
+
+// listDevices returns the device_id of each entry in a list field of a response
+func listDevices(t *testing.T, body map[string]interface{}, field string) []string {
+	t.Helper()
+
+	entries, ok := body[field].([]interface{})
+	if !ok {
+		t.Fatalf("response has no %s list: %v", field, body)
+	}
+	var deviceIDs []string
+	for _, entry := range entries {
+		deviceIDs = append(deviceIDs, entry.(map[string]interface{})["device_id"].(string))
+	}
+	return deviceIDs
+}
+
+func TestSIMCardRoutesListOnlyScopedSIMs(t *testing.T) {
+	f := setupScope(t, true)
+
+	for _, path := range []string{"/sim-cards", "/sim-cards/health", "/sim-cards/quarantines"} {
+		status, body := f.request(t, "GET", path, "")
+		field := "sim_cards"
+		if strings.HasSuffix(path, "quarantines") {
+			field = "quarantines"
+		}
+		if got := listDevices(t, body, field); status != 200 || len(got) != 1 || got[0] != "device-in" {
+			t.Errorf("GET %s = %d %v, want only device-in", path, status, got)
+		}
+	}
+}
+
+func TestSIMCardRoutesHideSIMsOutsideScope(t *testing.T) {
+	f := setupScope(t, true)
+
+	in, out := strconv.Itoa(int(f.inSIM.ID)), strconv.Itoa(int(f.outSIM.ID))
+	for _, suffix := range []string{"", "/history", "/balance", "/phone-number/discoveries",
+		"/health", "/loopback-tests", "/routing-score", "/quarantines"} {
+		if status, _ := f.request(t, "GET", "/sim-cards/"+out+suffix, ""); status != 404 {
+			t.Errorf("GET /sim-cards/<out of scope>%s = %d, want 404", suffix, status)
+		}
+	}
+	if status, _ := f.request(t, "GET", "/sim-cards/"+in, ""); status != 200 {
+		t.Errorf("GET /sim-cards/<in scope> = %d, want 200", status)
+	}
+}
+
+func TestSIMCardActionsRefuseSIMsOutsideScope(t *testing.T) {
+	f := setupScope(t, true)
+
+	out := strconv.Itoa(int(f.outSIM.ID))
+	actions := []struct {
+		method, path, body string
+	}{
+		{"POST", "/sim-cards/" + out + "/balance/check", `{"ussd_code":"*123#"}`},
+		{"POST", "/sim-cards/" + out + "/phone-number/discover", `{"method":"ussd","ussd_code":"*135#"}`},
+		{"POST", "/sim-cards/" + out + "/loopback-tests", `{}`},
+		{"POST", "/sim-cards/" + strconv.Itoa(int(f.inSIM.ID)) + "/loopback-tests", `{"receiver_sim_card_id":` + out + `}`},
+		{"PUT", "/sim-cards/" + out + "/daily-limit", `{"daily_sms_limit":5}`},
+		{"POST", "/sim-cards/" + out + "/release", `{"note":"test"}`},
+	}
+	for _, action := range actions {
+		if status, _ := f.request(t, action.method, action.path, action.body); status != 403 {
+			t.Errorf("%s %s = %d, want 403", action.method, action.path, status)
+		}
+	}
+
+	var sim models.SIMCard
+	database.DB.First(&sim, f.outSIM.ID)
+	if sim.DailySMSLimit != 0 {
+		t.Errorf("daily limit of a SIM outside the scope changed to %d", sim.DailySMSLimit)
+	}
+	var released int64
+	database.DB.Model(&models.SIMQuarantine{}).Where("sim_card_id = ? AND status <> ?", f.outSIM.ID, "active").Count(&released)
+	if released != 0 {
+		t.Error("quarantine of a SIM outside the scope was released")
+	}
+}
+
+func TestDeviceRoutesRefuseDevicesOutsideScope(t *testing.T) {
+	f := setupScope(t, true)
+
+	if status, _ := f.request(t, "GET", "/devices/device-out/sim-history", ""); status != 403 {
+		t.Errorf("GET sim-history of a device outside the scope = %d, want 403", status)
+	}
+	if status, _ := f.request(t, "PUT", "/devices/device-out/config", `{}`); status != 403 {
+		t.Errorf("PUT config of a device outside the scope = %d, want 403", status)
+	}
+	status, body := f.request(t, "GET", "/devices/config-drift", "")
+	if got := listDevices(t, body, "devices"); status != 200 || len(got) != 1 || got[0] != "device-in" {
+		t.Errorf("GET /devices/config-drift = %d %v, want only device-in", status, got)
+	}
+}
+
+func TestDiagnosticRoutesHideRequestsOutsideScope(t *testing.T) {
+	f := setupScope(t, true)
+
+	status, body := f.request(t, "GET", "/devices/device-out/diagnostics", "")
+	if got := listDevices(t, body, "requests"); status != 200 || len(got) != 0 {
+		t.Errorf("GET diagnostics of a device outside the scope = %d %v, want none", status, got)
+	}
+	if status, _ := f.request(t, "GET", "/diagnostics/"+strconv.Itoa(int(f.outRequest.ID)), ""); status != 404 {
+		t.Errorf("GET a diagnostic request outside the scope = %d, want 404", status)
+	}
+	if status, _ := f.request(t, "GET", "/diagnostics/artifacts/"+strconv.Itoa(int(f.outFile.ID))+"/download", ""); status != 404 {
+		t.Errorf("downloading an artifact outside the scope = %d, want 404", status)
+	}
+}
+
+func TestMissingPermissionScopeGrantsNothing(t *testing.T) {
+	f := setupScope(t, false)
+
+	status, body := f.request(t, "GET", "/sim-cards", "")
+	if got := listDevices(t, body, "sim_cards"); status != 200 || len(got) != 0 {
+		t.Errorf("GET /sim-cards without a scope = %d %v, want none", status, got)
+	}
+	if status, _ := f.request(t, "PUT", "/sim-cards/"+strconv.Itoa(int(f.inSIM.ID))+"/daily-limit", `{"daily_sms_limit":5}`); status != http.StatusForbidden {
+		t.Errorf("PUT daily-limit without a scope = %d, want 403", status)
+	}
+}
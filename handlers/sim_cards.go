@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"strconv"
+	"tsimserver/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetSIMCards returns the SIM card inventory with pagination
+func GetSIMCards(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+	deviceID := c.Query("device_id", "")
+	operator := c.Query("operator", "")
+	includeRemoved := c.QueryBool("include_removed", false)
+
+	offset := (page - 1) * limit
+
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.SIMCard{}), "sim_cards")
+	if includeRemoved {
+		query = query.Unscoped()
+	}
+
+	if deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+
+	if operator != "" {
+		query = query.Where("operator = ?", operator)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get SIM cards with pagination
+	var simCards []models.SIMCard
+	result := query.Order("device_id, identifier").Offset(offset).Limit(limit).Find(&simCards)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch SIM cards",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"sim_cards": simCards,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetSIMCard returns a specific SIM card, including removed ones
+func GetSIMCard(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	var simCard models.SIMCard
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Unscoped(), "sim_cards").Where("id = ?", uint(simID)).First(&simCard).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"sim_card": simCard,
+		"removed":  simCard.DeletedAt.Valid,
+	})
+}
+
+// GetSIMCardHistory returns insertion, removal and move history of a SIM card
+func GetSIMCardHistory(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	if !simCardInPermissionScope(c, uint(simID)) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	var events []models.SIMCardEvent
+	result := tenantDB(c).Where("sim_card_id = ?", uint(simID)).Order("created_at DESC").Find(&events)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch SIM card history",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"events": events,
+		"count":  len(events),
+	})
+}
+
+// GetDeviceSIMHistory returns SIM card events that happened on a device
+func GetDeviceSIMHistory(c *fiber.Ctx) error {
+	deviceID := c.Params("id")
+	limit := c.QueryInt("limit", 100)
+
+	if !deviceInTenant(c, deviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	var events []models.SIMCardEvent
+	result := tenantDB(c).Where("device_id = ? OR previous_device_id = ?", deviceID, deviceID).
+		Order("created_at DESC").Limit(limit).Find(&events)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch SIM card history",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"events": events,
+		"count":  len(events),
+	})
+}
+
+// simCardInPermissionScope reports whether a SIM card, including a removed one, is in the
+// tenant and sits in a device where the user holds the route's permission
+func simCardInPermissionScope(c *fiber.Ctx, simCardID uint) bool {
+	var count int64
+	permissionScope(c).ScopeDeviceRecords(tenantDB(c).Unscoped().Model(&models.SIMCard{}), "sim_cards").
+		Where("id = ?", simCardID).Count(&count)
+	return count > 0
+}
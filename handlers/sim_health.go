@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"tsimserver/audit"
+	"tsimserver/models"
+	"tsimserver/simhealth"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// GetSIMHealthOverview returns the health and routing score of SIM cards, lowest score first
+func GetSIMHealthOverview(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+	status := c.Query("status", "")
+	deviceID := c.Query("device_id", "")
+
+	offset := (page - 1) * limit
+
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.SIMCard{}), "sim_cards")
+	if status != "" {
+		query = query.Where("health_status = ?", status)
+	}
+	if deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get SIM cards with pagination
+	var simCards []models.SIMCard
+	result := query.Order("health_score ASC NULLS LAST, device_id, identifier").Offset(offset).Limit(limit).Find(&simCards)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch SIM health",
+		})
+	}
+
+	health := make([]fiber.Map, 0, len(simCards))
+	for _, sim := range simCards {
+		health = append(health, fiber.Map{
+			"sim_card_id":       sim.ID,
+			"device_id":         sim.DeviceID,
+			"identifier":        sim.Identifier,
+			"operator":          sim.Operator,
+			"phone_number":      sim.PhoneNumber,
+			"health_score":      sim.HealthScore,
+			"health_status":     sim.HealthStatus,
+			"health_checked_at": sim.HealthCheckedAt,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"sim_cards": health,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// GetSIMCardHealth returns how the loopback health of a SIM card is made up
+func GetSIMCardHealth(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	var simCard models.SIMCard
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Unscoped(), "sim_cards").Where("id = ?", uint(simID)).First(&simCard).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	report, err := simhealth.Assess(simCard.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to assess SIM health",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"health":            report,
+		"health_checked_at": simCard.HealthCheckedAt,
+	})
+}
+
+// GetSIMLoopbackTests returns the loopback tests a SIM card took part in with pagination
+func GetSIMLoopbackTests(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 50)
+	status := c.Query("status", "")
+
+	offset := (page - 1) * limit
+
+	if !simCardInPermissionScope(c, uint(simID)) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	query := tenantDB(c).Model(&models.SIMLoopbackTest{}).
+		Where("sender_sim_card_id = ? OR receiver_sim_card_id = ?", uint(simID), uint(simID))
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get tests with pagination
+	var tests []models.SIMLoopbackTest
+	result := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&tests)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch loopback tests",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"tests": tests,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// RunSIMLoopbackTest sends a loopback test SMS from a SIM card now
+func RunSIMLoopbackTest(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	var req struct {
+		ReceiverSIMCardID uint `json:"receiver_sim_card_id"` // Optional, picked automatically otherwise
+	}
+	c.BodyParser(&req)
+
+	var simCard models.SIMCard
+	if err := tenantDB(c).Where("id = ?", uint(simID)).First(&simCard).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, simCard.DeviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	// A chosen receiver must be in the scope too, it receives the test SMS
+	if req.ReceiverSIMCardID != 0 {
+		var receiver models.SIMCard
+		if err := tenantDB(c).Where("id = ?", req.ReceiverSIMCardID).First(&receiver).Error; err != nil {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Receiver SIM card not found",
+			})
+		}
+		if !deviceInPermissionScope(c, receiver.DeviceID) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Insufficient permissions for the receiver device",
+			})
+		}
+	}
+
+	test, err := simhealth.RunTest(&simCard, req.ReceiverSIMCardID, false)
+	if err != nil {
+		switch {
+		case errors.Is(err, simhealth.ErrNoReceiver),
+			errors.Is(err, simhealth.ErrSenderUnavailable),
+			errors.Is(err, simhealth.ErrTestRunning):
+			return c.Status(409).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "Failed to send loopback test",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"message": "Loopback test sent",
+		"test":    test,
+	})
+}
+
+// GetSIMRoutingScore explains the routing score of a SIM card and where it ranks
+func GetSIMRoutingScore(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	var count int64
+	permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.SIMCard{}), "sim_cards").Where("id = ?", uint(simID)).Count(&count)
+	if count == 0 {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	explanation, err := simhealth.Explain(uint(simID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "SIM card not found",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to explain routing score",
+		})
+	}
+
+	return c.JSON(explanation)
+}
+
+// UpdateSIMDailyLimit sets how many SMS a SIM card may send per day
+func UpdateSIMDailyLimit(c *fiber.Ctx) error {
+	simIDStr := c.Params("id")
+	simID, err := strconv.ParseUint(simIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid SIM card ID",
+		})
+	}
+
+	var req struct {
+		DailySMSLimit int `json:"daily_sms_limit"` // 0 removes the limit
+	}
+	if err := c.BodyParser(&req); err != nil || req.DailySMSLimit < 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "daily_sms_limit must be zero or a positive number",
+		})
+	}
+
+	var simCard models.SIMCard
+	if err := tenantDB(c).Where("id = ?", uint(simID)).First(&simCard).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, simCard.DeviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	before := simCard.DailySMSLimit
+	if err := tenantDB(c).Model(&simCard).Update("daily_sms_limit", req.DailySMSLimit).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to update daily SMS limit",
+		})
+	}
+	audit.Change(c, "sim_cards", simIDStr, fiber.Map{"daily_sms_limit": before},
+		fiber.Map{"daily_sms_limit": req.DailySMSLimit})
+
+	return c.JSON(fiber.Map{
+		"message":  "Daily SMS limit updated successfully",
+		"sim_card": simCard,
+	})
+}
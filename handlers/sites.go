@@ -2,7 +2,7 @@ package handlers
 
 import (
 	"strconv"
-	"tsimserver/database"
+	"tsimserver/audit"
 	"tsimserver/models"
 
 	"github.com/gofiber/fiber/v2"
@@ -17,7 +17,7 @@ func GetSites(c *fiber.Ctx) error {
 
 	offset := (page - 1) * limit
 
-	query := database.DB.Model(&models.Site{})
+	query := tenantDB(c).Model(&models.Site{})
 
 	// Search functionality
 	if search != "" {
@@ -68,7 +68,7 @@ func GetSite(c *fiber.Ctx) error {
 	}
 
 	var site models.Site
-	result := database.DB.Preload("DeviceGroups.Devices.SIMCards").
+	result := tenantDB(c).Preload("DeviceGroups.Devices.SIMCards").
 		Where("id = ?", uint(siteID)).
 		First(&site)
 
@@ -98,12 +98,20 @@ func CreateSite(c *fiber.Ctx) error {
 		})
 	}
 
+	// Tenant users always create sites in their own tenant
+	if site.TenantID != nil && !tenantExists(*site.TenantID) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Tenant not found",
+		})
+	}
+
 	// Create site
-	if err := database.DB.Create(&site).Error; err != nil {
+	if err := tenantDB(c).Create(&site).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to create site",
 		})
 	}
+	audit.Change(c, "sites", strconv.FormatUint(uint64(site.ID), 10), nil, &site)
 
 	return c.Status(201).JSON(site)
 }
@@ -119,11 +127,12 @@ func UpdateSite(c *fiber.Ctx) error {
 	}
 
 	var site models.Site
-	if err := database.DB.Where("id = ?", uint(siteID)).First(&site).Error; err != nil {
+	if err := tenantDB(c).Where("id = ?", uint(siteID)).First(&site).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Site not found",
 		})
 	}
+	before := site
 
 	var updateData models.Site
 	if err := c.BodyParser(&updateData); err != nil {
@@ -164,12 +173,21 @@ func UpdateSite(c *fiber.Ctx) error {
 		site.ContactInfo = updateData.ContactInfo
 	}
 	site.IsActive = updateData.IsActive
+	if updateData.TenantID != nil && isSuperAdmin(c) {
+		if !tenantExists(*updateData.TenantID) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Tenant not found",
+			})
+		}
+		site.TenantID = updateData.TenantID
+	}
 
-	if err := database.DB.Save(&site).Error; err != nil {
+	if err := tenantDB(c).Save(&site).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to update site",
 		})
 	}
+	audit.Change(c, "sites", siteIDStr, &before, &site)
 
 	return c.JSON(site)
 }
@@ -186,7 +204,7 @@ func DeleteSite(c *fiber.Ctx) error {
 
 	// Check if site has device groups
 	var groupCount int64
-	database.DB.Model(&models.DeviceGroup{}).Where("site_id = ?", uint(siteID)).Count(&groupCount)
+	tenantDB(c).Model(&models.DeviceGroup{}).Where("site_id = ?", uint(siteID)).Count(&groupCount)
 
 	if groupCount > 0 {
 		return c.Status(400).JSON(fiber.Map{
@@ -195,12 +213,18 @@ func DeleteSite(c *fiber.Ctx) error {
 		})
 	}
 
+	var site models.Site
+	tenantDB(c).Where("id = ?", uint(siteID)).First(&site)
+
 	// Delete site
-	if err := database.DB.Delete(&models.Site{}, uint(siteID)).Error; err != nil {
+	if err := tenantDB(c).Delete(&models.Site{}, uint(siteID)).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to delete site",
 		})
 	}
+	if site.ID != 0 {
+		audit.Change(c, "sites", siteIDStr, &site, nil)
+	}
 
 	return c.JSON(fiber.Map{
 		"message": "Site deleted successfully",
@@ -219,7 +243,7 @@ func GetSiteStats(c *fiber.Ctx) error {
 
 	// Get site device groups
 	var deviceGroups []models.DeviceGroup
-	database.DB.Where("site_id = ?", uint(siteID)).Find(&deviceGroups)
+	tenantDB(c).Where("site_id = ?", uint(siteID)).Find(&deviceGroups)
 
 	var deviceGroupIDs []uint
 	for _, dg := range deviceGroups {
@@ -230,14 +254,14 @@ func GetSiteStats(c *fiber.Ctx) error {
 	var totalDevices, activeDevices, onlineDevices int64
 
 	if len(deviceGroupIDs) > 0 {
-		database.DB.Model(&models.Device{}).Where("device_group_id IN ?", deviceGroupIDs).Count(&totalDevices)
-		database.DB.Model(&models.Device{}).Where("device_group_id IN ? AND is_active = ?", deviceGroupIDs, true).Count(&activeDevices)
-		database.DB.Model(&models.Device{}).Where("device_group_id IN ? AND operator_status = ?", deviceGroupIDs, "online").Count(&onlineDevices)
+		tenantDB(c).Model(&models.Device{}).Where("device_group_id IN ?", deviceGroupIDs).Count(&totalDevices)
+		tenantDB(c).Model(&models.Device{}).Where("device_group_id IN ? AND is_active = ?", deviceGroupIDs, true).Count(&activeDevices)
+		tenantDB(c).Model(&models.Device{}).Where("device_group_id IN ? AND operator_status = ?", deviceGroupIDs, "online").Count(&onlineDevices)
 	}
 
 	// Count SMS messages today
 	var smsToday int64
-	database.DB.Raw(`
+	tenantDB(c).Raw(`
 		SELECT COUNT(*) FROM sms_messages s
 		JOIN devices d ON s.device_id = d.device_id
 		WHERE d.device_group_id IN ? AND DATE(s.created_at) = CURRENT_DATE
@@ -262,7 +286,7 @@ func GetSiteCountries(c *fiber.Ctx) error {
 		Count       int64  `json:"site_count"`
 	}
 
-	result := database.DB.Model(&models.Site{}).
+	result := tenantDB(c).Model(&models.Site{}).
 		Select("country, country_name, phone_code, COUNT(*) as count").
 		Group("country, country_name, phone_code").
 		Find(&countries)
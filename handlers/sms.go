@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"log"
 	"math/rand"
 	"strconv"
 	"time"
-	"tsimserver/database"
+	"tsimserver/auth"
 	"tsimserver/models"
 	"tsimserver/queue"
+	"tsimserver/simhealth"
+	"tsimserver/siminventory"
 	"tsimserver/types"
 
 	"github.com/gofiber/fiber/v2"
@@ -27,6 +30,18 @@ func SendSMS(c *fiber.Ctx) error {
 		})
 	}
 
+	if !deviceInTenant(c, smsReq.DeviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, smsReq.DeviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
 	// Generate internal log ID
 	internalLogID := rand.Intn(999999) + 100000
 
@@ -37,12 +52,13 @@ func SendSMS(c *fiber.Ctx) error {
 		Target:        smsReq.Target,
 		Message:       smsReq.Message,
 		SimSlot:       smsReq.SimSlot,
+		SIMCardID:     siminventory.SIMCardIDForSlot(smsReq.DeviceID, smsReq.SimSlot),
 		InternalLogID: internalLogID,
 		Status:        "pending",
 		Timestamp:     time.Now().Unix(),
 	}
 
-	if err := database.DB.Create(&sms).Error; err != nil {
+	if err := tenantDB(c).Create(&sms).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to save SMS",
 		})
@@ -57,11 +73,13 @@ func SendSMS(c *fiber.Ctx) error {
 		InternalLogID: internalLogID,
 	}
 
-	if err := Hub.SendMessageToDevice(smsReq.DeviceID, smsCmd); err != nil {
+	err := Hub.SendMessageToDevice(smsReq.DeviceID, smsCmd)
+	recordSMSSend(sms.SIMCardID, err)
+	if err != nil {
 		// Update SMS status to failed
 		sms.Status = "failed"
 		sms.ErrorMessage = err.Error()
-		database.DB.Save(&sms)
+		tenantDB(c).Save(&sms)
 
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to send SMS command",
@@ -82,8 +100,10 @@ func SendSMS(c *fiber.Ctx) error {
 func GetSMSMessages(c *fiber.Ctx) error {
 	deviceID := c.Params("deviceId")
 
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "sms_messages")
+
 	var messages []models.SMSMessage
-	result := database.DB.Where("device_id = ?", deviceID).Order("created_at DESC").Limit(100).Find(&messages)
+	result := query.Where("device_id = ?", deviceID).Order("created_at DESC").Limit(100).Find(&messages)
 	if result.Error != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to fetch SMS messages",
@@ -106,8 +126,10 @@ func GetSMSMessage(c *fiber.Ctx) error {
 		})
 	}
 
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "sms_messages")
+
 	var sms models.SMSMessage
-	if err := database.DB.Where("id = ?", smsID).First(&sms).Error; err != nil {
+	if err := query.Where("id = ?", smsID).First(&sms).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "SMS message not found",
 		})
@@ -121,7 +143,7 @@ func GetIncomingSMS(c *fiber.Ctx) error {
 	deviceID := c.Query("device_id")
 	limit := c.QueryInt("limit", 50)
 
-	query := database.DB.Where("type = ?", "incoming")
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "sms_messages").Where("type = ?", "incoming")
 	if deviceID != "" {
 		query = query.Where("device_id = ?", deviceID)
 	}
@@ -145,7 +167,7 @@ func GetOutgoingSMS(c *fiber.Ctx) error {
 	deviceID := c.Query("device_id")
 	limit := c.QueryInt("limit", 50)
 
-	query := database.DB.Where("type = ?", "outgoing")
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "sms_messages").Where("type = ?", "outgoing")
 	if deviceID != "" {
 		query = query.Where("device_id = ?", deviceID)
 	}
@@ -175,7 +197,7 @@ func GetSMSStats(c *fiber.Ctx) error {
 		TotalFailed    int64 `json:"total_failed"`
 	}
 
-	baseQuery := database.DB.Model(&models.SMSMessage{})
+	baseQuery := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.SMSMessage{}), "sms_messages")
 	if deviceID != "" {
 		baseQuery = baseQuery.Where("device_id = ?", deviceID)
 	}
@@ -205,7 +227,8 @@ func DeleteSMSMessage(c *fiber.Ctx) error {
 		})
 	}
 
-	if err := database.DB.Delete(&models.SMSMessage{}, smsID).Error; err != nil {
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "sms_messages")
+	if err := query.Delete(&models.SMSMessage{}, smsID).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to delete SMS message",
 		})
@@ -215,3 +238,35 @@ func DeleteSMSMessage(c *fiber.Ctx) error {
 		"message": "SMS message deleted successfully",
 	})
 }
+
+// recordSMSSend feeds a send attempt into the routing score of the sending SIM
+func recordSMSSend(simCardID *uint, sendErr error) {
+	if simCardID == nil {
+		return
+	}
+	if err := simhealth.RecordSend(*simCardID, sendErr); err != nil {
+		log.Printf("Failed to update routing stats of SIM %d: %v", *simCardID, err)
+	}
+}
+
+// permissionScope returns the sites and device groups where the user holds the
+// permission the route requires, or nothing when no middleware set it
+func permissionScope(c *fiber.Ctx) auth.Scope {
+	scope, _ := c.Locals("permission_scope").(auth.Scope)
+	return scope
+}
+
+// deviceInPermissionScope reports whether the user holds the route's permission for a device
+func deviceInPermissionScope(c *fiber.Ctx, deviceID string) bool {
+	return permissionScope(c).AllowsDevice(deviceID)
+}
+
+// deviceGroupInPermissionScope reports whether the user holds the route's permission for
+// a device group. Only users holding it everywhere may use devices without a group.
+func deviceGroupInPermissionScope(c *fiber.Ctx, groupID *uint) bool {
+	scope := permissionScope(c)
+	if groupID == nil {
+		return scope.All
+	}
+	return scope.AllowsDeviceGroup(*groupID)
+}
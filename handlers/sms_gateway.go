@@ -3,11 +3,15 @@ package handlers
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
-	"tsimserver/database"
+	"tsimserver/audit"
 	"tsimserver/models"
 	"tsimserver/queue"
+	"tsimserver/simhealth"
+	"tsimserver/siminventory"
 	"tsimserver/websocket"
 
 	"github.com/gofiber/fiber/v2"
@@ -72,7 +76,7 @@ func SendSMSViaGateway(c *fiber.Ctx) error {
 	}
 
 	// Find best device and SIM for sending SMS
-	device, simCard, err := findBestDeviceForSMS(req.Target, req.Country, req.Operator)
+	device, simCard, err := findBestDeviceForSMS(c, req.Target, req.Country, req.Operator)
 	if err != nil {
 		return c.Status(503).JSON(fiber.Map{
 			"error":   "No available device found",
@@ -80,6 +84,8 @@ func SendSMSViaGateway(c *fiber.Ctx) error {
 		})
 	}
 
+	simSlot, _ := strconv.Atoi(simCard.Identifier)
+
 	// Parse scheduled time if provided
 	var scheduledAt *time.Time
 	if req.ScheduledAt != "" {
@@ -94,7 +100,8 @@ func SendSMSViaGateway(c *fiber.Ctx) error {
 		Type:          "outgoing",
 		Target:        req.Target,
 		Message:       req.Message,
-		SimSlot:       int(simCard.ID), // Use SIMCard ID as slot reference
+		SimSlot:       simSlot,
+		SIMCardID:     &simCard.ID,
 		Status:        "pending",
 		Priority:      req.Priority,
 		ScheduledAt:   scheduledAt,
@@ -103,18 +110,25 @@ func SendSMSViaGateway(c *fiber.Ctx) error {
 		Timestamp:     time.Now().Unix(),
 	}
 
-	if err := database.DB.Create(&smsMessage).Error; err != nil {
+	if err := tenantDB(c).Create(&smsMessage).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to create SMS record",
 		})
 	}
+	// Recorded once the handler returns, with the final status of the message
+	audit.Change(c, "sms_messages", strconv.FormatUint(uint64(smsMessage.ID), 10), nil, &smsMessage)
+
+	// The message ID doubles as the internal log ID so delivery reports map back
+	smsMessage.InternalLogID = int(smsMessage.ID)
 
 	// Send SMS to device via WebSocket
-	if err := sendSMSToDevice(device.DeviceID, smsMessage); err != nil {
+	err = sendSMSToDevice(device.DeviceID, smsMessage)
+	recordSMSSend(smsMessage.SIMCardID, err)
+	if err != nil {
 		// Update SMS status to failed
 		smsMessage.Status = "failed"
 		smsMessage.ErrorMessage = err.Error()
-		database.DB.Save(&smsMessage)
+		tenantDB(c).Save(&smsMessage)
 
 		return c.Status(500).JSON(fiber.Map{
 			"error":   "Failed to send SMS to device",
@@ -124,13 +138,13 @@ func SendSMSViaGateway(c *fiber.Ctx) error {
 
 	// Update SMS status to sent
 	smsMessage.Status = "sent"
-	database.DB.Save(&smsMessage)
+	tenantDB(c).Save(&smsMessage)
 
 	return c.JSON(SMSGatewayResponse{
 		Success:       true,
 		MessageID:     smsMessage.ID,
 		DeviceID:      device.DeviceID,
-		SimSlot:       int(simCard.ID),
+		SimSlot:       simSlot,
 		EstimatedCost: calculateSMSCost(req.Target, len(req.Message)),
 		Message:       "SMS sent successfully",
 	})
@@ -161,7 +175,7 @@ func SendTestSMS(c *fiber.Ctx) error {
 
 	// Check if device exists and is available
 	var device models.Device
-	if err := database.DB.Where("device_id = ?", req.DeviceID).First(&device).Error; err != nil {
+	if err := permissionScope(c).ScopeDevices(tenantDB(c)).Where("device_id = ?", req.DeviceID).First(&device).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Device not found",
 		})
@@ -182,6 +196,7 @@ func SendTestSMS(c *fiber.Ctx) error {
 		Target:        req.Target,
 		Message:       fmt.Sprintf("[TEST] %s", req.Message),
 		SimSlot:       req.SimSlot,
+		SIMCardID:     siminventory.SIMCardIDForSlot(device.DeviceID, req.SimSlot),
 		Status:        "pending",
 		Priority:      5, // Highest priority for test messages
 		IsTestMessage: true,
@@ -189,17 +204,24 @@ func SendTestSMS(c *fiber.Ctx) error {
 		Timestamp:     time.Now().Unix(),
 	}
 
-	if err := database.DB.Create(&testMessage).Error; err != nil {
+	if err := tenantDB(c).Create(&testMessage).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to create test SMS record",
 		})
 	}
+	// Recorded once the handler returns, with the final status of the message
+	audit.Change(c, "sms_messages", strconv.FormatUint(uint64(testMessage.ID), 10), nil, &testMessage)
+
+	// The message ID doubles as the internal log ID so delivery reports map back
+	testMessage.InternalLogID = int(testMessage.ID)
 
 	// Send test SMS to device
-	if err := sendSMSToDevice(device.DeviceID, testMessage); err != nil {
+	err := sendSMSToDevice(device.DeviceID, testMessage)
+	recordSMSSend(testMessage.SIMCardID, err)
+	if err != nil {
 		testMessage.Status = "failed"
 		testMessage.ErrorMessage = err.Error()
-		database.DB.Save(&testMessage)
+		tenantDB(c).Save(&testMessage)
 
 		return c.Status(500).JSON(fiber.Map{
 			"error":   "Failed to send test SMS",
@@ -208,7 +230,7 @@ func SendTestSMS(c *fiber.Ctx) error {
 	}
 
 	testMessage.Status = "sent"
-	database.DB.Save(&testMessage)
+	tenantDB(c).Save(&testMessage)
 
 	return c.JSON(fiber.Map{
 		"success":    true,
@@ -233,7 +255,7 @@ func SendTestCommand(c *fiber.Ctx) error {
 
 	// Check if device exists
 	var device models.Device
-	if err := database.DB.Where("device_id = ?", req.DeviceID).First(&device).Error; err != nil {
+	if err := permissionScope(c).ScopeDevices(tenantDB(c)).Where("device_id = ?", req.DeviceID).First(&device).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Device not found",
 		})
@@ -319,7 +341,7 @@ func ProcessDeliveryReport(c *fiber.Ctx) error {
 
 	// Find SMS message by device ID and internal log ID
 	var smsMessage models.SMSMessage
-	result := database.DB.Where("device_id = ? AND internal_log_id = ?", dlr.DeviceID, dlr.InternalLogID).
+	result := tenantDB(c).Where("device_id = ? AND internal_log_id = ?", dlr.DeviceID, dlr.InternalLogID).
 		First(&smsMessage)
 
 	if result.Error != nil {
@@ -330,6 +352,7 @@ func ProcessDeliveryReport(c *fiber.Ctx) error {
 	}
 
 	// Update SMS message status
+	previousStatus := smsMessage.Status
 	smsMessage.Status = dlr.Status
 	smsMessage.DeliveryReport = dlr.DeliveryReport
 	smsMessage.ErrorMessage = dlr.ErrorMessage
@@ -339,13 +362,18 @@ func ProcessDeliveryReport(c *fiber.Ctx) error {
 		smsMessage.DeliveredAt = &now
 	}
 
-	if err := database.DB.Save(&smsMessage).Error; err != nil {
+	if err := tenantDB(c).Save(&smsMessage).Error; err != nil {
 		log.Printf("Failed to update SMS message: %v", err)
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to update SMS status",
 		})
 	}
 
+	// Delivery outcomes feed the routing score of the sending SIM
+	if err := simhealth.RecordDelivery(&smsMessage, previousStatus, dlr.ErrorMessage); err != nil {
+		log.Printf("Failed to update routing stats for SMS %d: %v", smsMessage.ID, err)
+	}
+
 	// Send delivery report to RabbitMQ queue
 	go func() {
 		dlrData := map[string]interface{}{
@@ -375,15 +403,17 @@ func ProcessDeliveryReport(c *fiber.Ctx) error {
 
 // Helper functions
 
-// findBestDeviceForSMS finds the best available device and SIM for sending SMS
-func findBestDeviceForSMS(targetNumber, country, operator string) (*models.Device, *models.SIMCard, error) {
+// findBestDeviceForSMS finds the best available device and SIM for sending SMS. The search
+// is limited to the request's tenant, to the sites and device groups of its API key and to
+// those where the user may send SMS.
+func findBestDeviceForSMS(c *fiber.Ctx, targetNumber, country, operator string) (*models.Device, *models.SIMCard, error) {
 	// Determine target country from phone number if not provided
 	if country == "" {
 		country = getCountryFromPhoneNumber(targetNumber)
 	}
 
 	// Build query for finding suitable devices
-	query := database.DB.Joins("JOIN device_groups ON devices.device_group_id = device_groups.id").
+	query := tenantDB(c).Joins("JOIN device_groups ON devices.device_group_id = device_groups.id").
 		Joins("JOIN sites ON device_groups.site_id = sites.id").
 		Where("devices.is_active = ? AND devices.is_available = ? AND devices.operator_status = ? AND devices.battery_level >= ?",
 			true, true, "online", 10)
@@ -398,6 +428,8 @@ func findBestDeviceForSMS(targetNumber, country, operator string) (*models.Devic
 		query = query.Where("device_groups.operator = ?", operator)
 	}
 
+	query = permissionScope(c).ScopeDevices(query)
+
 	// Order by priority: battery level desc, signal strength desc, last seen desc
 	query = query.Order("devices.battery_level DESC, devices.signal_strength DESC, devices.last_seen DESC")
 
@@ -406,15 +438,31 @@ func findBestDeviceForSMS(targetNumber, country, operator string) (*models.Devic
 		return nil, nil, fmt.Errorf("failed to query devices: %v", err)
 	}
 
-	// Find device with available SIM card
-	for _, device := range devices {
-		for _, simCard := range device.SIMCards {
-			if simCard.IsActive && simCard.IsEnabled && simCard.SignalStrength > 0 {
-				return &device, &simCard, nil
+	// Collect usable SIMs; unhealthy, blocked and over-quota SIMs take no traffic
+	type candidate struct {
+		device *models.Device
+		sim    *models.SIMCard
+	}
+	var candidates []candidate
+	for i := range devices {
+		device := &devices[i]
+		for j := range device.SIMCards {
+			simCard := &device.SIMCards[j]
+			if simCard.SignalStrength > 0 && simhealth.Routable(simCard) {
+				candidates = append(candidates, candidate{device: device, sim: simCard})
 			}
 		}
 	}
 
+	// Highest routing score wins; the device order above breaks ties
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return simhealth.RankScore(candidates[a].sim) > simhealth.RankScore(candidates[b].sim)
+	})
+
+	if len(candidates) > 0 {
+		return candidates[0].device, candidates[0].sim, nil
+	}
+
 	return nil, nil, fmt.Errorf("no available device with active SIM card found")
 }
 
@@ -1,8 +1,8 @@
 package handlers
 
 import (
-	"tsimserver/database"
 	"tsimserver/models"
+	"tsimserver/presence"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -22,23 +22,23 @@ func GetDashboardStats(c *fiber.Ctx) error {
 	}
 
 	// Get device counts
-	database.DB.Model(&models.Device{}).Count(&stats.TotalDevices)
-	database.DB.Model(&models.Device{}).Where("is_active = ?", true).Count(&stats.OnlineDevices)
+	tenantDB(c).Model(&models.Device{}).Count(&stats.TotalDevices)
+	tenantDB(c).Model(&models.Device{}).Where("operator_status = ?", presence.StatusOnline).Count(&stats.OnlineDevices)
 	stats.OfflineDevices = stats.TotalDevices - stats.OnlineDevices
 
 	// Get SIM card counts
-	database.DB.Model(&models.SIMCard{}).Count(&stats.TotalSIMCards)
-	database.DB.Model(&models.SIMCard{}).Where("is_active = ? AND is_enabled = ?", true, true).Count(&stats.ActiveSIMCards)
+	tenantDB(c).Model(&models.SIMCard{}).Count(&stats.TotalSIMCards)
+	tenantDB(c).Model(&models.SIMCard{}).Where("is_active = ? AND is_enabled = ?", true, true).Count(&stats.ActiveSIMCards)
 
 	// Get today's SMS count
-	database.DB.Model(&models.SMSMessage{}).Where("DATE(created_at) = CURRENT_DATE").Count(&stats.TotalSMSToday)
+	tenantDB(c).Model(&models.SMSMessage{}).Where("DATE(created_at) = CURRENT_DATE").Count(&stats.TotalSMSToday)
 
 	// Get today's USSD count
-	database.DB.Model(&models.USSDCommand{}).Where("DATE(created_at) = CURRENT_DATE").Count(&stats.TotalUSSDToday)
+	tenantDB(c).Model(&models.USSDCommand{}).Where("DATE(created_at) = CURRENT_DATE").Count(&stats.TotalUSSDToday)
 
 	// Get alarm counts
-	database.DB.Model(&models.Alarm{}).Where("resolved = ?", false).Count(&stats.UnresolvedAlarms)
-	database.DB.Model(&models.Alarm{}).Where("resolved = ? AND severity = ?", false, "critical").Count(&stats.CriticalAlarms)
+	tenantDB(c).Model(&models.Alarm{}).Where("resolved = ?", false).Count(&stats.UnresolvedAlarms)
+	tenantDB(c).Model(&models.Alarm{}).Where("resolved = ? AND severity = ?", false, "critical").Count(&stats.CriticalAlarms)
 
 	return c.JSON(stats)
 }
@@ -51,6 +51,7 @@ func GetDeviceStats(c *fiber.Ctx) error {
 		SiteName   string `json:"site_name"`
 		GroupName  string `json:"group_name"`
 		IsActive   bool   `json:"is_active"`
+		Status     string `json:"operator_status"`
 		SMSCount   int64  `json:"sms_count"`
 		USSDCount  int64  `json:"ussd_count"`
 		AlarmCount int64  `json:"alarm_count"`
@@ -59,7 +60,7 @@ func GetDeviceStats(c *fiber.Ctx) error {
 
 	// Get all devices
 	var devices []models.Device
-	database.DB.Find(&devices)
+	tenantDB(c).Find(&devices)
 
 	for _, device := range devices {
 		var stat struct {
@@ -68,6 +69,7 @@ func GetDeviceStats(c *fiber.Ctx) error {
 			SiteName   string `json:"site_name"`
 			GroupName  string `json:"group_name"`
 			IsActive   bool   `json:"is_active"`
+			Status     string `json:"operator_status"`
 			SMSCount   int64  `json:"sms_count"`
 			USSDCount  int64  `json:"ussd_count"`
 			AlarmCount int64  `json:"alarm_count"`
@@ -79,12 +81,13 @@ func GetDeviceStats(c *fiber.Ctx) error {
 		stat.SiteName = device.SiteName
 		stat.GroupName = device.GroupName
 		stat.IsActive = device.IsActive
+		stat.Status = device.OperatorStatus
 
 		// Get counts for this device
-		database.DB.Model(&models.SMSMessage{}).Where("device_id = ?", device.DeviceID).Count(&stat.SMSCount)
-		database.DB.Model(&models.USSDCommand{}).Where("device_id = ?", device.DeviceID).Count(&stat.USSDCount)
-		database.DB.Model(&models.Alarm{}).Where("device_id = ?", device.DeviceID).Count(&stat.AlarmCount)
-		database.DB.Model(&models.SIMCard{}).Where("device_id = ?", device.DeviceID).Count(&stat.SIMCount)
+		tenantDB(c).Model(&models.SMSMessage{}).Where("device_id = ?", device.DeviceID).Count(&stat.SMSCount)
+		tenantDB(c).Model(&models.USSDCommand{}).Where("device_id = ?", device.DeviceID).Count(&stat.USSDCount)
+		tenantDB(c).Model(&models.Alarm{}).Where("device_id = ?", device.DeviceID).Count(&stat.AlarmCount)
+		tenantDB(c).Model(&models.SIMCard{}).Where("device_id = ?", device.DeviceID).Count(&stat.SIMCount)
 
 		deviceStats = append(deviceStats, stat)
 	}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"time"
+	"tsimserver/telemetry"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetDeviceTelemetry returns telemetry series of a device over a time range
+func GetDeviceTelemetry(c *fiber.Ctx) error {
+	deviceID := c.Params("id")
+	metric := c.Query("metric", telemetry.MetricBatteryLevel)
+	resolution := c.Query("resolution", "")
+
+	if !deviceInTenant(c, deviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, deviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	// Default range is the last 24 hours
+	to := time.Now()
+	if toStr := c.Query("to"); toStr != "" {
+		parsed, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid 'to' timestamp, expected RFC3339",
+			})
+		}
+		to = parsed
+	}
+
+	from := to.Add(-24 * time.Hour)
+	if fromStr := c.Query("from"); fromStr != "" {
+		parsed, err := time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid 'from' timestamp, expected RFC3339",
+			})
+		}
+		from = parsed
+	}
+
+	query := telemetry.Query{
+		DeviceID:   deviceID,
+		Metric:     metric,
+		From:       from,
+		To:         to,
+		Resolution: resolution,
+	}
+
+	if simCardID := c.QueryInt("sim_card_id", -1); simCardID >= 0 {
+		id := uint(simCardID)
+		query.SIMCardID = &id
+	}
+
+	series, err := telemetry.QuerySeries(query)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"device_id": deviceID,
+		"metric":    metric,
+		"from":      from,
+		"to":        to,
+		"series":    series,
+	})
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"regexp"
+	"strconv"
+	"tsimserver/audit"
+	"tsimserver/authaudit"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/sessions"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var tenantSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}$`)
+
+// tenantDB returns the database handle for a request, scoped to the tenant of the
+// authenticated user
+func tenantDB(c *fiber.Ctx) *gorm.DB {
+	return database.DB.WithContext(c.UserContext())
+}
+
+// GetTenants returns all tenants
+func GetTenants(c *fiber.Ctx) error {
+	var tenants []models.Tenant
+	if err := database.DB.Order("name").Find(&tenants).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch tenants",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"tenants": tenants,
+		"count":   len(tenants),
+	})
+}
+
+// GetTenant returns a specific tenant with its site and user counts
+func GetTenant(c *fiber.Ctx) error {
+	tenantIDStr := c.Params("id")
+	tenantID, err := strconv.ParseUint(tenantIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid tenant ID",
+		})
+	}
+
+	var tenant models.Tenant
+	if err := database.DB.Where("id = ?", uint(tenantID)).First(&tenant).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Tenant not found",
+		})
+	}
+
+	var sites, users int64
+	database.DB.Model(&models.Site{}).Where("tenant_id = ?", tenant.ID).Count(&sites)
+	database.DB.Model(&models.User{}).Where("tenant_id = ?", tenant.ID).Count(&users)
+
+	return c.JSON(fiber.Map{
+		"tenant": tenant,
+		"sites":  sites,
+		"users":  users,
+	})
+}
+
+// CreateTenant creates a new tenant
+func CreateTenant(c *fiber.Ctx) error {
+	var tenant models.Tenant
+	if err := c.BodyParser(&tenant); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if tenant.Name == "" || !tenantSlugPattern.MatchString(tenant.Slug) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Name and a lowercase slug (letters, digits and dashes) are required",
+		})
+	}
+
+	var existing models.Tenant
+	if err := database.DB.Unscoped().Where("slug = ?", tenant.Slug).First(&existing).Error; err == nil {
+		return c.Status(409).JSON(fiber.Map{
+			"error": "Tenant slug already exists",
+		})
+	}
+
+	tenant.ID = 0
+	tenant.IsActive = true
+	if err := database.DB.Create(&tenant).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to create tenant",
+		})
+	}
+	audit.Change(c, "tenants", strconv.FormatUint(uint64(tenant.ID), 10), nil, &tenant)
+
+	return c.Status(201).JSON(tenant)
+}
+
+// UpdateTenant updates an existing tenant
+func UpdateTenant(c *fiber.Ctx) error {
+	tenantIDStr := c.Params("id")
+	tenantID, err := strconv.ParseUint(tenantIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid tenant ID",
+		})
+	}
+
+	var tenant models.Tenant
+	if err := database.DB.Where("id = ?", uint(tenantID)).First(&tenant).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Tenant not found",
+		})
+	}
+
+	var updateData struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		ContactInfo string `json:"contact_info"`
+		IsActive    *bool  `json:"is_active"`
+	}
+	if err := c.BodyParser(&updateData); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	before := tenant
+	if updateData.Name != "" {
+		tenant.Name = updateData.Name
+	}
+	if updateData.Description != "" {
+		tenant.Description = updateData.Description
+	}
+	if updateData.ContactInfo != "" {
+		tenant.ContactInfo = updateData.ContactInfo
+	}
+	if updateData.IsActive != nil {
+		tenant.IsActive = *updateData.IsActive
+	}
+
+	if err := database.DB.Save(&tenant).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to update tenant",
+		})
+	}
+	// Cached sessions carry the tenant, deactivating it locks its users out right away
+	sessions.InvalidateTenant(tenant.ID)
+	audit.Change(c, "tenants", tenantIDStr, &before, &tenant)
+
+	return c.JSON(tenant)
+}
+
+// DeleteTenant deletes a tenant that no longer owns sites or users
+func DeleteTenant(c *fiber.Ctx) error {
+	tenantIDStr := c.Params("id")
+	tenantID, err := strconv.ParseUint(tenantIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid tenant ID",
+		})
+	}
+
+	var sites, users int64
+	database.DB.Model(&models.Site{}).Where("tenant_id = ?", uint(tenantID)).Count(&sites)
+	database.DB.Model(&models.User{}).Where("tenant_id = ?", uint(tenantID)).Count(&users)
+	if sites > 0 || users > 0 {
+		return c.Status(409).JSON(fiber.Map{
+			"error": "Cannot delete tenant with sites or users",
+			"sites": sites,
+			"users": users,
+		})
+	}
+
+	var tenant models.Tenant
+	database.DB.Where("id = ?", uint(tenantID)).First(&tenant)
+
+	if err := database.DB.Delete(&models.Tenant{}, uint(tenantID)).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to delete tenant",
+		})
+	}
+	if tenant.ID != 0 {
+		audit.Change(c, "tenants", tenantIDStr, &tenant, nil)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Tenant deleted successfully",
+	})
+}
+
+// SwitchTenant limits the current super-admin session to one tenant, or back to all
+// tenants with a null tenant_id
+func SwitchTenant(c *fiber.Ctx) error {
+	var req struct {
+		TenantID *uint `json:"tenant_id"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var tenant *models.Tenant
+	if req.TenantID != nil {
+		tenant = &models.Tenant{}
+		if err := database.DB.Where("id = ?", *req.TenantID).First(tenant).Error; err != nil {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Tenant not found",
+			})
+		}
+	}
+
+	sessionID, _ := c.Locals("session_id").(uint)
+	if err := database.DB.Model(&models.Session{}).Where("id = ?", sessionID).
+		Update("tenant_id", req.TenantID).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to switch tenant",
+		})
+	}
+
+	user, _ := c.Locals("user").(*models.User)
+	sessions.Invalidate(user.ID)
+
+	details := "all tenants"
+	if tenant != nil {
+		details = "tenant " + tenant.Slug
+	}
+	recordAuthEvent(c, authaudit.EventTenantSwitched, user, "", details)
+
+	return c.JSON(fiber.Map{
+		"message": "Tenant switched successfully",
+		"tenant":  tenant,
+	})
+}
+
+// isSuperAdmin reports whether the authenticated user is a super-admin
+func isSuperAdmin(c *fiber.Ctx) bool {
+	user, ok := c.Locals("user").(*models.User)
+	return ok && user.IsSuperAdmin
+}
+
+// tenantExists reports whether a tenant exists
+func tenantExists(tenantID uint) bool {
+	var count int64
+	database.DB.Model(&models.Tenant{}).Where("id = ?", tenantID).Count(&count)
+	return count > 0
+}
+
+// deviceInTenant reports whether a device belongs to the tenant of the request
+func deviceInTenant(c *fiber.Ctx, deviceID string) bool {
+	if _, ok := c.Locals("tenant_id").(uint); !ok {
+		return true
+	}
+
+	var count int64
+	tenantDB(c).Model(&models.Device{}).Where("device_id = ?", deviceID).Count(&count)
+	return count > 0
+}
+
+// deviceGroupInTenant reports whether a device group belongs to the tenant of the request
+func deviceGroupInTenant(c *fiber.Ctx, groupID uint) bool {
+	var count int64
+	tenantDB(c).Model(&models.DeviceGroup{}).Where("id = ?", groupID).Count(&count)
+	return count > 0
+}
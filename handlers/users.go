@@ -2,11 +2,17 @@ package handlers
 
 import (
 	"strconv"
+	"tsimserver/apikeys"
+	"tsimserver/audit"
 	"tsimserver/auth"
+	"tsimserver/authaudit"
 	"tsimserver/database"
 	"tsimserver/models"
+	"tsimserver/passwords"
+	"tsimserver/sessions"
 
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 // GetUsers returns all users with pagination and roles
@@ -19,7 +25,7 @@ func GetUsers(c *fiber.Ctx) error {
 
 	offset := (page - 1) * limit
 
-	query := database.DB.Model(&models.User{})
+	query := tenantDB(c).Model(&models.User{})
 
 	// Search functionality
 	if search != "" {
@@ -86,7 +92,7 @@ func GetUser(c *fiber.Ctx) error {
 	}
 
 	var user models.User
-	result := database.DB.Preload("UserRoles.Role").
+	result := tenantDB(c).Preload("UserRoles.Role").
 		Where("id = ?", uint(userID)).
 		First(&user)
 
@@ -107,11 +113,12 @@ func CreateUser(c *fiber.Ctx) error {
 	var req struct {
 		Username  string `json:"username" validate:"required,min=3,max=50"`
 		Email     string `json:"email" validate:"required,email"`
-		Password  string `json:"password" validate:"required,min=6"`
+		Password  string `json:"password" validate:"required"`
 		FirstName string `json:"first_name"`
 		LastName  string `json:"last_name"`
 		IsActive  bool   `json:"is_active"`
 		RoleIDs   []uint `json:"role_ids"`
+		TenantID  *uint  `json:"tenant_id"` // super-admins only, others create users in their own tenant
 	}
 
 	if err := c.BodyParser(&req); err != nil {
@@ -135,6 +142,34 @@ func CreateUser(c *fiber.Ctx) error {
 		})
 	}
 
+	if req.TenantID != nil && !tenantExists(*req.TenantID) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Tenant not found",
+		})
+	}
+
+	// Check the roles exist and may be granted
+	var roles []models.Role
+	if len(req.RoleIDs) > 0 {
+		if err := database.DB.Where("id IN ? AND is_active = ?", req.RoleIDs, true).Find(&roles).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Error checking roles",
+			})
+		}
+	}
+	for _, roleID := range req.RoleIDs {
+		if !containsRole(roles, roleID) {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Role not found",
+			})
+		}
+		if !canGrantRole(c, roleID, nil, nil) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Cannot grant a role with permissions you do not hold",
+			})
+		}
+	}
+
 	// Create new user
 	user := models.User{
 		Username:  req.Username,
@@ -142,9 +177,15 @@ func CreateUser(c *fiber.Ctx) error {
 		Password:  req.Password,
 		FirstName: req.FirstName,
 		LastName:  req.LastName,
+		TenantID:  req.TenantID,
 		IsActive:  req.IsActive,
 	}
 
+	// Check the password policy
+	if err := passwords.Check(req.Password); err != nil {
+		return passwordError(c, err)
+	}
+
 	// Hash password
 	if err := user.HashPassword(); err != nil {
 		return c.Status(500).JSON(fiber.Map{
@@ -152,21 +193,27 @@ func CreateUser(c *fiber.Ctx) error {
 		})
 	}
 
-	// Save user
-	if err := database.DB.Create(&user).Error; err != nil {
+	// Save user and assign its roles together, and sync Casbin policies
+	err := auth.UpdatePolicies(func(tx *gorm.DB) error {
+		if err := tx.WithContext(c.UserContext()).Create(&user).Error; err != nil {
+			return err
+		}
+		if err := passwords.Remember(tx, user.ID, user.Password); err != nil {
+			return err
+		}
+		for _, role := range roles {
+			if err := tx.Create(&models.UserRole{UserID: user.ID, RoleID: role.ID}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Error creating user",
 		})
 	}
-
-	// Assign roles
-	for _, roleID := range req.RoleIDs {
-		userRole := models.UserRole{
-			UserID: user.ID,
-			RoleID: roleID,
-		}
-		database.DB.Create(&userRole)
-	}
+	audit.Change(c, "users", strconv.FormatUint(uint64(user.ID), 10), nil, &user)
 
 	// Don't return password
 	user.Password = ""
@@ -185,7 +232,7 @@ func UpdateUser(c *fiber.Ctx) error {
 	}
 
 	var user models.User
-	if err := database.DB.Where("id = ?", uint(userID)).First(&user).Error; err != nil {
+	if err := tenantDB(c).Where("id = ?", uint(userID)).First(&user).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "User not found",
 		})
@@ -196,6 +243,7 @@ func UpdateUser(c *fiber.Ctx) error {
 		LastName  string `json:"last_name"`
 		Email     string `json:"email"`
 		IsActive  *bool  `json:"is_active"`
+		TenantID  *uint  `json:"tenant_id"` // super-admins only
 	}
 
 	if err := c.BodyParser(&updateData); err != nil {
@@ -204,6 +252,8 @@ func UpdateUser(c *fiber.Ctx) error {
 		})
 	}
 
+	before := user
+
 	// Check if email already exists (for other users)
 	if updateData.Email != "" && updateData.Email != user.Email {
 		var existingUser models.User
@@ -225,13 +275,29 @@ func UpdateUser(c *fiber.Ctx) error {
 	if updateData.IsActive != nil {
 		user.IsActive = *updateData.IsActive
 	}
+	if updateData.TenantID != nil {
+		if !isSuperAdmin(c) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Only super-admins can move users between tenants",
+			})
+		}
+		if !tenantExists(*updateData.TenantID) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Tenant not found",
+			})
+		}
+		user.TenantID = updateData.TenantID
+	}
 
 	// Save user
-	if err := database.DB.Save(&user).Error; err != nil {
+	if err := tenantDB(c).Save(&user).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Error updating user",
 		})
 	}
+	// A deactivated user is logged out on the next request
+	sessions.Invalidate(user.ID)
+	audit.Change(c, "users", userIDStr, &before, &user)
 
 	// Don't return password
 	user.Password = ""
@@ -257,18 +323,31 @@ func DeleteUser(c *fiber.Ctx) error {
 		})
 	}
 
-	// Soft delete user roles first
-	database.DB.Where("user_id = ?", uint(userID)).Delete(&models.UserRole{})
+	var user models.User
+	tenantDB(c).Where("id = ?", uint(userID)).First(&user)
+
+	// Soft delete user roles first and sync Casbin policies
+	if err := auth.UpdatePolicies(func(tx *gorm.DB) error {
+		return tx.WithContext(c.UserContext()).Where("user_id = ?", uint(userID)).Delete(&models.UserRole{}).Error
+	}); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to remove user roles",
+		})
+	}
 
 	// Deactivate sessions
-	database.DB.Model(&models.Session{}).Where("user_id = ?", uint(userID)).Update("is_active", false)
+	tenantDB(c).Model(&models.Session{}).Where("user_id = ?", uint(userID)).Update("is_active", false)
+	sessions.Invalidate(uint(userID))
 
 	// Soft delete user
-	if err := database.DB.Delete(&models.User{}, uint(userID)).Error; err != nil {
+	if err := tenantDB(c).Delete(&models.User{}, uint(userID)).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to delete user",
 		})
 	}
+	if user.ID != 0 {
+		audit.Change(c, "users", userIDStr, &user, nil)
+	}
 
 	return c.JSON(fiber.Map{
 		"message": "User deleted successfully",
@@ -286,7 +365,9 @@ func AssignRoleToUser(c *fiber.Ctx) error {
 	}
 
 	var req struct {
-		RoleID uint `json:"role_id" validate:"required"`
+		RoleID        uint  `json:"role_id" validate:"required"`
+		SiteID        *uint `json:"site_id"`         // limit the role to one site
+		DeviceGroupID *uint `json:"device_group_id"` // limit the role to one device group
 	}
 
 	if err := c.BodyParser(&req); err != nil {
@@ -297,7 +378,7 @@ func AssignRoleToUser(c *fiber.Ctx) error {
 
 	// Check if user exists
 	var user models.User
-	if err := database.DB.Where("id = ?", uint(userID)).First(&user).Error; err != nil {
+	if err := tenantDB(c).Where("id = ?", uint(userID)).First(&user).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "User not found",
 		})
@@ -305,18 +386,50 @@ func AssignRoleToUser(c *fiber.Ctx) error {
 
 	// Check if role exists
 	var role models.Role
-	if err := database.DB.Where("id = ?", req.RoleID).First(&role).Error; err != nil {
+	if err := tenantDB(c).Where("id = ?", req.RoleID).First(&role).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Role not found",
 		})
 	}
 
+	if req.SiteID != nil && req.DeviceGroupID != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Set either site_id or device_group_id, not both",
+		})
+	}
+	if req.SiteID != nil {
+		var count int64
+		tenantDB(c).Model(&models.Site{}).Where("id = ?", *req.SiteID).Count(&count)
+		if count == 0 {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Site not found",
+			})
+		}
+	}
+	if req.DeviceGroupID != nil && !deviceGroupInTenant(c, *req.DeviceGroupID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device group not found",
+		})
+	}
+
+	// Admins cannot grant what they do not hold themselves
+	if !canGrantRole(c, role.ID, req.SiteID, req.DeviceGroupID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Cannot grant a role with permissions you do not hold there",
+		})
+	}
+
 	// Use auth package to assign role
-	if err := auth.AddRoleForUser(uint(userID), req.RoleID); err != nil {
+	if err := auth.AddRoleForUser(uint(userID), req.RoleID, req.SiteID, req.DeviceGroupID); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to assign role to user",
 		})
 	}
+	audit.Change(c, "users", userIDStr, nil, fiber.Map{
+		"role_added":      role.Name,
+		"site_id":         req.SiteID,
+		"device_group_id": req.DeviceGroupID,
+	})
 
 	return c.JSON(fiber.Map{
 		"message": "Role assigned to user successfully",
@@ -341,12 +454,37 @@ func RemoveRoleFromUser(c *fiber.Ctx) error {
 		})
 	}
 
+	// Check if user exists
+	var user models.User
+	if err := tenantDB(c).Where("id = ?", uint(userID)).First(&user).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	// The role is removed from every domain it is assigned in, each of which the current
+	// user must be able to grant it in
+	var assignments []models.UserRole
+	if err := database.DB.Where("user_id = ? AND role_id = ?", uint(userID), uint(roleID)).Find(&assignments).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch role assignments",
+		})
+	}
+	for _, assignment := range assignments {
+		if !canGrantRole(c, uint(roleID), assignment.SiteID, assignment.DeviceGroupID) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Cannot remove a role with permissions you do not hold there",
+			})
+		}
+	}
+
 	// Use auth package to remove role
 	if err := auth.RemoveRoleForUser(uint(userID), uint(roleID)); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to remove role from user",
 		})
 	}
+	audit.Change(c, "users", userIDStr, fiber.Map{"role_removed": uint(roleID)}, nil)
 
 	return c.JSON(fiber.Map{
 		"message": "Role removed from user successfully",
@@ -363,6 +501,14 @@ func GetUserRoles(c *fiber.Ctx) error {
 		})
 	}
 
+	// Check if user exists
+	var user models.User
+	if err := tenantDB(c).Where("id = ?", uint(userID)).First(&user).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
 	roles, err := auth.GetUserRoles(uint(userID))
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
@@ -370,9 +516,47 @@ func GetUserRoles(c *fiber.Ctx) error {
 		})
 	}
 
+	// Role assignments with the site or device group each is limited to
+	var assignments []models.UserRole
+	tenantDB(c).Preload("Role").Preload("Site").Preload("DeviceGroup").
+		Where("user_id = ?", uint(userID)).Find(&assignments)
+
 	return c.JSON(fiber.Map{
-		"roles": roles,
-		"count": len(roles),
+		"roles":       roles,
+		"assignments": assignments,
+		"count":       len(roles),
+	})
+}
+
+// GetUserPermissions returns the permissions a user effectively holds, with the roles
+// granting each and the sites and device groups it applies to
+func GetUserPermissions(c *fiber.Ctx) error {
+	userIDStr := c.Params("id")
+	userID, err := strconv.ParseUint(userIDStr, 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	// Check if user exists
+	var user models.User
+	if err := tenantDB(c).Where("id = ?", uint(userID)).First(&user).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	permissions, err := auth.EffectivePermissions(uint(userID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch user permissions",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"permissions": permissions,
+		"count":       len(permissions),
 	})
 }
 
@@ -386,10 +570,10 @@ func GetUserSessions(c *fiber.Ctx) error {
 		})
 	}
 
-	var sessions []models.Session
-	result := database.DB.Where("user_id = ? AND is_active = ?", uint(userID), true).
+	var sessionList []models.Session
+	result := tenantDB(c).Where("user_id = ? AND is_active = ?", uint(userID), true).
 		Order("created_at DESC").
-		Find(&sessions)
+		Find(&sessionList)
 
 	if result.Error != nil {
 		return c.Status(500).JSON(fiber.Map{
@@ -398,14 +582,14 @@ func GetUserSessions(c *fiber.Ctx) error {
 	}
 
 	// Don't return tokens
-	for i := range sessions {
-		sessions[i].AccessToken = ""
-		sessions[i].RefreshToken = ""
+	for i := range sessionList {
+		sessionList[i].AccessToken = ""
+		sessionList[i].RefreshToken = ""
 	}
 
 	return c.JSON(fiber.Map{
-		"sessions": sessions,
-		"count":    len(sessions),
+		"sessions": sessionList,
+		"count":    len(sessionList),
 	})
 }
 
@@ -428,7 +612,7 @@ func RevokeUserSession(c *fiber.Ctx) error {
 	}
 
 	// Deactivate session
-	result := database.DB.Model(&models.Session{}).
+	result := tenantDB(c).Model(&models.Session{}).
 		Where("id = ? AND user_id = ?", uint(sessionID), uint(userID)).
 		Update("is_active", false)
 
@@ -443,8 +627,52 @@ func RevokeUserSession(c *fiber.Ctx) error {
 			"error": "Session not found",
 		})
 	}
+	sessions.Invalidate(uint(userID))
+
+	var user models.User
+	tenantDB(c).Where("id = ?", uint(userID)).First(&user)
+	recordAuthEvent(c, authaudit.EventSessionRevoked, &user, "", "session "+sessionIDStr)
 
 	return c.JSON(fiber.Map{
 		"message": "Session revoked successfully",
 	})
 }
+
+// canGrantRole reports whether the current user may assign a role in a domain: they must
+// hold each of its permissions there themselves, and through their API key when they use
+// one. Super-admins may grant any role.
+func canGrantRole(c *fiber.Ctx, roleID uint, siteID, deviceGroupID *uint) bool {
+	if isSuperAdmin(c) {
+		return true
+	}
+	userID, ok := c.Locals("user_id").(uint)
+	if !ok {
+		return false
+	}
+
+	permissions, err := auth.GetRolePermissions(roleID)
+	if err != nil {
+		return false
+	}
+	key, _ := c.Locals("api_key").(*models.APIKey)
+	for _, permission := range permissions {
+		if key != nil && !apikeys.Allows(key, permission.Resource, permission.Action) {
+			return false
+		}
+		scope, err := auth.PermissionScope(userID, permission.Resource, permission.Action)
+		if err != nil || !scope.Covers(siteID, deviceGroupID) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsRole reports whether roles contains the role with roleID
+func containsRole(roles []models.Role, roleID uint) bool {
+	for _, role := range roles {
+		if role.ID == roleID {
+			return true
+		}
+	}
+	return false
+}
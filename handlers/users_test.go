@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"tsimserver/auth"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/testutil"
+
+	gormadapter "github.com/casbin/gorm-adapter/v3"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRemoveRoleFromUserNeedsPermissionsInItsDomains(t *testing.T) {
+	testutil.LoadConfig(t)
+	testutil.OpenDatabase(t, &models.User{}, &models.Role{}, &models.Permission{}, &models.RolePermission{},
+		&models.Site{}, &models.DeviceGroup{}, &models.UserRole{}, &gormadapter.CasbinRule{})
+	previousEnforcer := auth.Enforcer
+	t.Cleanup(func() {
+		auth.Enforcer = previousEnforcer
+	})
+	if err := auth.InitEnforcer(testutil.RepoPath("casbin", "model.conf")); err != nil {
+		t.Fatalf("creating enforcer: %v", err)
+	}
+
+	// The admin manages users everywhere but uses devices on the first site only
+	admin := models.User{Username: "admin", Email: "admin@example.com", IsActive: true}
+	target := models.User{Username: "target", Email: "target@example.com", IsActive: true}
+	mustCreate(t, &admin)
+	mustCreate(t, &target)
+	var sites []uint
+	for _, name := range []string{"first", "second"} {
+		site := models.Site{Name: name, Country: "TR", PhoneCode: "+90"}
+		mustCreate(t, &site)
+		sites = append(sites, site.ID)
+	}
+	usersWrite := models.Permission{Name: "users:write", Resource: "users", Action: "write", IsActive: true}
+	devicesWrite := models.Permission{Name: "devices:write", Resource: "devices", Action: "write", IsActive: true}
+	mustCreate(t, &usersWrite)
+	mustCreate(t, &devicesWrite)
+	userAdmin := models.Role{Name: "user-admin", IsActive: true}
+	operator := models.Role{Name: "operator", IsActive: true}
+	mustCreate(t, &userAdmin)
+	mustCreate(t, &operator)
+	mustCreate(t, &models.RolePermission{RoleID: userAdmin.ID, PermissionID: usersWrite.ID})
+	mustCreate(t, &models.RolePermission{RoleID: operator.ID, PermissionID: devicesWrite.ID})
+	for _, assignment := range []struct {
+		userID, roleID uint
+		siteID         *uint
+	}{
+		{admin.ID, userAdmin.ID, nil},
+		{admin.ID, operator.ID, &sites[0]},
+		{target.ID, operator.ID, &sites[1]},
+	} {
+		if err := auth.AddRoleForUser(assignment.userID, assignment.roleID, assignment.siteID, nil); err != nil {
+			t.Fatalf("assigning role: %v", err)
+		}
+	}
+
+	app := fiber.New()
+	app.Delete("/users/:id/roles/:role_id", func(c *fiber.Ctx) error {
+		c.Locals("user_id", admin.ID)
+		c.Locals("user", &admin)
+		return c.Next()
+	}, RemoveRoleFromUser)
+	remove := func() int {
+		path := "/users/" + strconv.Itoa(int(target.ID)) + "/roles/" + strconv.Itoa(int(operator.ID))
+		resp, err := app.Test(httptest.NewRequest("DELETE", path, nil), -1)
+		if err != nil {
+			t.Fatalf("DELETE %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assigned := func() int64 {
+		var count int64
+		database.DB.Model(&models.UserRole{}).Where("user_id = ? AND role_id = ?", target.ID, operator.ID).Count(&count)
+		return count
+	}
+
+	if status := remove(); status != 403 || assigned() != 1 {
+		t.Errorf("removing a role on a site outside the admin's permissions = %d, %d assignments left, want 403 and 1",
+			status, assigned())
+	}
+
+	database.DB.Model(&models.UserRole{}).Where("user_id = ? AND role_id = ?", target.ID, operator.ID).
+		Update("site_id", sites[0])
+	if err := auth.SyncPoliciesFromDatabase(); err != nil {
+		t.Fatalf("syncing policies: %v", err)
+	}
+	if status := remove(); status != 200 || assigned() != 0 {
+		t.Errorf("removing a role on the admin's site = %d, %d assignments left, want 200 and 0", status, assigned())
+	}
+}
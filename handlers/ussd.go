@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"errors"
 	"math/rand"
 	"strconv"
 	"time"
-	"tsimserver/database"
+	"tsimserver/balance"
 	"tsimserver/models"
+	"tsimserver/phonenumber"
 	"tsimserver/queue"
 	"tsimserver/types"
 
@@ -26,6 +28,18 @@ func SendUSSD(c *fiber.Ctx) error {
 		})
 	}
 
+	if !deviceInTenant(c, ussdReq.DeviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, ussdReq.DeviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
 	// Generate internal log ID
 	internalLogID := rand.Intn(999999) + 100000
 
@@ -39,7 +53,7 @@ func SendUSSD(c *fiber.Ctx) error {
 		Timestamp:     time.Now().Unix(),
 	}
 
-	if err := database.DB.Create(&ussd).Error; err != nil {
+	if err := tenantDB(c).Create(&ussd).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to save USSD command",
 		})
@@ -57,7 +71,7 @@ func SendUSSD(c *fiber.Ctx) error {
 		// Update USSD status to failed
 		ussd.Status = "failed"
 		ussd.ErrorMessage = err.Error()
-		database.DB.Save(&ussd)
+		tenantDB(c).Save(&ussd)
 
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to send USSD command",
@@ -79,7 +93,7 @@ func GetUSSDCommands(c *fiber.Ctx) error {
 	deviceID := c.Params("deviceId")
 
 	var commands []models.USSDCommand
-	result := database.DB.Where("device_id = ?", deviceID).Order("created_at DESC").Limit(100).Find(&commands)
+	result := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "ussd_commands").Where("device_id = ?", deviceID).Order("created_at DESC").Limit(100).Find(&commands)
 	if result.Error != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to fetch USSD commands",
@@ -103,7 +117,7 @@ func GetUSSDCommand(c *fiber.Ctx) error {
 	}
 
 	var ussd models.USSDCommand
-	if err := database.DB.Where("id = ?", ussdID).First(&ussd).Error; err != nil {
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "ussd_commands").Where("id = ?", ussdID).First(&ussd).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "USSD command not found",
 		})
@@ -122,7 +136,7 @@ func DeleteUSSDCommand(c *fiber.Ctx) error {
 		})
 	}
 
-	if err := database.DB.Delete(&models.USSDCommand{}, ussdID).Error; err != nil {
+	if err := permissionScope(c).ScopeDeviceRecords(tenantDB(c), "ussd_commands").Delete(&models.USSDCommand{}, ussdID).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to delete USSD command",
 		})
@@ -138,7 +152,7 @@ func CheckBalance(c *fiber.Ctx) error {
 	var balanceReq struct {
 		DeviceID string `json:"device_id"`
 		SimSlot  int    `json:"sim_slot"`
-		USSDCode string `json:"ussd_code"`
+		USSDCode string `json:"ussd_code"` // Optional, defaults to the operator's balance code
 	}
 
 	if err := c.BodyParser(&balanceReq); err != nil {
@@ -147,18 +161,21 @@ func CheckBalance(c *fiber.Ctx) error {
 		})
 	}
 
-	// Generate internal log ID
-	internalLogID := rand.Intn(999999) + 100000
-
-	// Send balance check command to device
-	balanceCmd := types.CheckBalanceCommand{
-		Type:          "check_balance",
-		SimSlot:       balanceReq.SimSlot,
-		USSDCode:      balanceReq.USSDCode,
-		InternalLogID: internalLogID,
+	var simCard models.SIMCard
+	if err := tenantDB(c).Where("device_id = ? AND identifier = ?", balanceReq.DeviceID, strconv.Itoa(balanceReq.SimSlot)).
+		First(&simCard).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
 	}
 
-	if err := Hub.SendMessageToDevice(balanceReq.DeviceID, balanceCmd); err != nil {
+	check, err := balance.Check(&simCard, balanceReq.USSDCode, false)
+	if err != nil {
+		if errors.Is(err, balance.ErrNoUSSDCode) {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to send balance check command",
 		})
@@ -166,16 +183,18 @@ func CheckBalance(c *fiber.Ctx) error {
 
 	return c.Status(201).JSON(fiber.Map{
 		"message":         "Balance check sent successfully",
-		"internal_log_id": internalLogID,
+		"internal_log_id": check.ID,
+		"check":           check,
 	})
 }
 
-// DiscoverPhoneNumber sends phone number discovery USSD command
+// DiscoverPhoneNumber starts a phone number discovery for the SIM in a device slot
 func DiscoverPhoneNumber(c *fiber.Ctx) error {
 	var phoneReq struct {
 		DeviceID string `json:"device_id"`
 		SimSlot  int    `json:"sim_slot"`
-		USSDCode string `json:"ussd_code"`
+		Method   string `json:"method"`    // Optional: ussd or sms_loopback
+		USSDCode string `json:"ussd_code"` // Optional, defaults to the operator's number code
 	}
 
 	if err := c.BodyParser(&phoneReq); err != nil {
@@ -184,25 +203,22 @@ func DiscoverPhoneNumber(c *fiber.Ctx) error {
 		})
 	}
 
-	// Generate internal log ID
-	internalLogID := rand.Intn(999999) + 100000
-
-	// Send phone number discovery command to device
-	phoneCmd := types.DiscoverPhoneNumberCommand{
-		Type:          "discover_phone_number",
-		SimSlot:       phoneReq.SimSlot,
-		USSDCode:      phoneReq.USSDCode,
-		InternalLogID: internalLogID,
+	var simCard models.SIMCard
+	if err := tenantDB(c).Where("device_id = ? AND identifier = ?", phoneReq.DeviceID, strconv.Itoa(phoneReq.SimSlot)).
+		First(&simCard).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "SIM card not found",
+		})
 	}
 
-	if err := Hub.SendMessageToDevice(phoneReq.DeviceID, phoneCmd); err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Failed to send phone number discovery command",
-		})
+	discovery, err := phonenumber.Discover(&simCard, phoneReq.Method, phoneReq.USSDCode, false)
+	if err != nil {
+		return phoneNumberDiscoveryError(c, err)
 	}
 
 	return c.Status(201).JSON(fiber.Map{
 		"message":         "Phone number discovery sent successfully",
-		"internal_log_id": internalLogID,
+		"internal_log_id": discovery.ID,
+		"discovery":       discovery,
 	})
 }
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+	"tsimserver/models"
+	"tsimserver/ussdsession"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// maxSessionWait caps how long a request may wait for a menu response
+const maxSessionWait = 30
+
+// StartUSSDSession opens an interactive USSD session on a device
+func StartUSSDSession(c *fiber.Ctx) error {
+	var req struct {
+		DeviceID string `json:"device_id"`
+		SimSlot  int    `json:"sim_slot"`
+		USSDCode string `json:"ussd_code"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if !deviceInTenant(c, req.DeviceID) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	if !deviceInPermissionScope(c, req.DeviceID) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Insufficient permissions for this device",
+		})
+	}
+
+	var startedBy uint
+	if userID, ok := c.Locals("user_id").(uint); ok {
+		startedBy = userID
+	}
+
+	session, err := ussdsession.Start(req.DeviceID, req.SimSlot, req.USSDCode, startedBy)
+	if err != nil {
+		return ussdSessionError(c, err)
+	}
+
+	session = waitForUSSDResponse(c, session)
+	return c.Status(201).JSON(fiber.Map{
+		"message": "USSD session started",
+		"session": session,
+	})
+}
+
+// ReplyUSSDSession sends the next menu input to an open USSD session
+func ReplyUSSDSession(c *fiber.Ctx) error {
+	var req struct {
+		Input string `json:"input"`
+	}
+
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if !ussdSessionInTenant(c, c.Params("sessionId")) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "USSD session not found",
+		})
+	}
+
+	session, err := ussdsession.Reply(c.Params("sessionId"), req.Input)
+	if err != nil {
+		return ussdSessionError(c, err)
+	}
+
+	session = waitForUSSDResponse(c, session)
+	return c.JSON(fiber.Map{
+		"message": "USSD reply sent",
+		"session": session,
+	})
+}
+
+// CancelUSSDSession cancels an active USSD session
+func CancelUSSDSession(c *fiber.Ctx) error {
+	if !ussdSessionInTenant(c, c.Params("sessionId")) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "USSD session not found",
+		})
+	}
+
+	session, err := ussdsession.Cancel(c.Params("sessionId"))
+	if err != nil {
+		return ussdSessionError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "USSD session cancelled",
+		"session": session,
+	})
+}
+
+// GetUSSDSession returns a USSD session with its menu steps
+func GetUSSDSession(c *fiber.Ctx) error {
+	if !ussdSessionInTenant(c, c.Params("sessionId")) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "USSD session not found",
+		})
+	}
+
+	session, err := ussdsession.Get(c.Params("sessionId"))
+	if err != nil {
+		return ussdSessionError(c, err)
+	}
+
+	session = waitForUSSDResponse(c, session)
+	return c.JSON(fiber.Map{
+		"session": session,
+	})
+}
+
+// GetUSSDSessions returns USSD sessions with pagination
+func GetUSSDSessions(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	deviceID := c.Query("device_id", "")
+	status := c.Query("status", "")
+
+	offset := (page - 1) * limit
+
+	query := permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.USSDSession{}), "ussd_sessions")
+	if deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	// Get total count
+	var total int64
+	query.Count(&total)
+
+	// Get sessions with pagination
+	var sessions []models.USSDSession
+	result := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&sessions)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to fetch USSD sessions",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"sessions": sessions,
+		"pagination": fiber.Map{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (total + int64(limit) - 1) / int64(limit),
+		},
+	})
+}
+
+// ussdSessionInTenant reports whether a USSD session belongs to the tenant of the request
+// and to a device the user holds the route's permission for
+func ussdSessionInTenant(c *fiber.Ctx, sessionID string) bool {
+	var count int64
+	permissionScope(c).ScopeDeviceRecords(tenantDB(c).Model(&models.USSDSession{}), "ussd_sessions").Where("session_id = ?", sessionID).Count(&count)
+	return count > 0
+}
+
+// waitForUSSDResponse long-polls for the pending step when the request asks to wait
+func waitForUSSDResponse(c *fiber.Ctx, session *models.USSDSession) *models.USSDSession {
+	wait := c.QueryInt("wait", 0)
+	if wait <= 0 {
+		return session
+	}
+	if wait > maxSessionWait {
+		wait = maxSessionWait
+	}
+
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+	for session.IsActive() && hasPendingStep(session) && time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+		refreshed, err := ussdsession.Get(session.SessionID)
+		if err != nil {
+			break
+		}
+		session = refreshed
+	}
+	return session
+}
+
+// hasPendingStep reports whether the latest step still waits for the device
+func hasPendingStep(session *models.USSDSession) bool {
+	if len(session.Steps) == 0 {
+		return false
+	}
+	return session.Steps[len(session.Steps)-1].Status == ussdsession.StepPending
+}
+
+// ussdSessionError maps USSD session errors to responses
+func ussdSessionError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(404).JSON(fiber.Map{
+			"error": "USSD session or device not found",
+		})
+	case errors.Is(err, ussdsession.ErrInvalidInput):
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, ussdsession.ErrSessionBusy),
+		errors.Is(err, ussdsession.ErrNotActive),
+		errors.Is(err, ussdsession.ErrAwaitingResponse):
+		return c.Status(409).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(500).JSON(fiber.Map{
+		"error":   "USSD session request failed",
+		"details": err.Error(),
+	})
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"log"
+	"tsimserver/dispatch"
+	"tsimserver/presence"
 	"tsimserver/websocket"
 
 	"github.com/gofiber/fiber/v2"
@@ -15,6 +17,13 @@ func InitWebSocketHub() {
 	Hub = websocket.NewHub()
 	go Hub.Run()
 	log.Println("WebSocket hub started")
+
+	// Let the SMS gateway and background jobs reach devices through the hub
+	InitializeWebSocketHub(Hub)
+	dispatch.SetSender(Hub)
+
+	// The hub owns device connections, so it also drives presence
+	presence.StartMonitor()
 }
 
 // WebSocketHandler handles WebSocket connections
@@ -0,0 +1,99 @@
+package invitations
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+
+	"gorm.io/gorm"
+)
+
+// TokenPrefix starts every invitation token
+const TokenPrefix = "inv_"
+
+// Registration modes
+const (
+	ModeOpen   = "open"   // anyone can register
+	ModeInvite = "invite" // registration needs an invitation token
+	ModeClosed = "closed" // users are only created by admins and single sign-on
+)
+
+var (
+	// ErrInvalid is returned for an unknown, used, revoked or expired invitation
+	ErrInvalid = errors.New("invalid or expired invitation")
+	// ErrEmailMismatch is returned when registering with another email than the invited one
+	ErrEmailMismatch = errors.New("invitation is for another email")
+)
+
+// Mode returns the registration mode. Unknown modes require an invitation.
+func Mode() string {
+	switch mode := strings.ToLower(config.AppConfig.Registration.Mode); mode {
+	case ModeOpen, ModeClosed:
+		return mode
+	}
+	return ModeInvite
+}
+
+// Create stores a new invitation and returns its token, which is not stored. Without an
+// expiry the invitation is valid for registration.invite_ttl hours.
+func Create(db *gorm.DB, invitation *models.Invitation) (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := TokenPrefix + hex.EncodeToString(buf)
+
+	invitation.TokenHash = hash(token)
+	invitation.Email = strings.ToLower(strings.TrimSpace(invitation.Email))
+	if invitation.ExpiresAt.IsZero() {
+		invitation.ExpiresAt = time.Now().Add(time.Duration(config.AppConfig.Registration.InviteTTL) * time.Hour)
+	}
+	if err := db.Create(invitation).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Find returns the open invitation of a token for registering with an email
+func Find(token, email string) (*models.Invitation, error) {
+	var invitation models.Invitation
+	err := database.DB.Where("token_hash = ? AND used_at IS NULL AND revoked_at IS NULL", hash(token)).
+		First(&invitation).Error
+	if err != nil || time.Now().After(invitation.ExpiresAt) {
+		return nil, ErrInvalid
+	}
+	if invitation.Email != "" && invitation.Email != strings.ToLower(strings.TrimSpace(email)) {
+		return nil, ErrEmailMismatch
+	}
+	return &invitation, nil
+}
+
+// Accept marks an invitation as used by a new user. It fails when a concurrent registration
+// used it first.
+func Accept(tx *gorm.DB, invitation *models.Invitation, userID uint) error {
+	result := tx.Model(&models.Invitation{}).
+		Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", invitation.ID).
+		Updates(map[string]interface{}{
+			"used_at":    time.Now(),
+			"used_by_id": userID,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// hash returns the stored form of a token
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
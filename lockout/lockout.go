@@ -0,0 +1,245 @@
+package lockout
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"tsimserver/cache"
+	"tsimserver/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyPrefix starts the Redis keys of failure counters, waits and locks
+const keyPrefix = "tsimserver:lockout:"
+
+// Block reasons
+const (
+	ReasonAccountLocked = "account_locked"
+	ReasonIPLocked      = "ip_locked"
+	ReasonDelay         = "delay" // too soon after the last failure
+)
+
+// Block tells why and for how long login attempts are refused
+type Block struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+// Status is the failure state of an account
+type Status struct {
+	Failures    int64      `json:"failures"`
+	Locked      bool       `json:"locked"`
+	LockedUntil *time.Time `json:"locked_until"`
+}
+
+// UserAccount names an existing user for failure tracking
+func UserAccount(userID uint) string {
+	return "user:" + strconv.FormatUint(uint64(userID), 10)
+}
+
+// NameAccount names a login that matches no user, so guessing usernames is throttled too
+func NameAccount(login string) string {
+	return "name:" + strings.ToLower(strings.TrimSpace(login))
+}
+
+// attemptScript refuses an attempt while the account or IP address is locked or has to wait,
+// and otherwise counts it as a failure up front. Counting before the credentials are checked
+// keeps concurrent attempts from all passing the check before any failure is counted; an
+// attempt over the limits is refused and not counted.
+var attemptScript = redis.NewScript(`
+local reasons = {ARGV[1], ARGV[2], ARGV[3]}
+for i = 1, 3 do
+	local ttl = redis.call("PTTL", KEYS[i])
+	if ttl > 0 then
+		return {reasons[i], ttl}
+	end
+end
+local accountFailures = redis.call("INCR", KEYS[4])
+redis.call("PEXPIRE", KEYS[4], ARGV[4])
+local ipFailures = redis.call("INCR", KEYS[5])
+redis.call("PEXPIRE", KEYS[5], ARGV[4])
+local maxUser, maxIP = tonumber(ARGV[5]), tonumber(ARGV[6])
+if (maxUser > 0 and accountFailures > maxUser) or (maxIP > 0 and ipFailures > maxIP) then
+	redis.call("DECR", KEYS[4])
+	redis.call("DECR", KEYS[5])
+	return {ARGV[3], 1000}
+end
+return {"", 0}
+`)
+
+// releaseScript takes back the failure an attempt counted for each key, if the count did
+// not expire meanwhile
+var releaseScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	local failures = tonumber(redis.call("GET", key))
+	if failures and failures > 0 then
+		redis.call("DECR", key)
+	end
+end
+return 0
+`)
+
+// Attempt returns the block on login attempts for an account from an IP address, or nil
+// when the attempt may go ahead. An allowed attempt counts as a failure until Succeed is
+// called. Attempts are allowed while Redis is unavailable.
+func Attempt(account, ip string) *Block {
+	cfg := config.AppConfig.Lockout
+	ctx := context.Background()
+	window := time.Duration(cfg.FailureWindow) * time.Second
+
+	result, err := attemptScript.Run(ctx, cache.RedisClient,
+		[]string{
+			lockKey("account", account), lockKey("ip", ip), delayKey(account),
+			failuresKey("account", account), failuresKey("ip", ip),
+		},
+		ReasonAccountLocked, ReasonIPLocked, ReasonDelay,
+		window.Milliseconds(), cfg.MaxUserFailures, cfg.MaxIPFailures,
+	).Slice()
+	if err != nil || len(result) != 2 {
+		log.Printf("Failed to check login lockout: %v", err)
+		return nil
+	}
+
+	reason, _ := result[0].(string)
+	ttl, _ := result[1].(int64)
+	if reason == "" {
+		return nil
+	}
+	return &Block{Reason: reason, RetryAfter: time.Duration(ttl) * time.Millisecond}
+}
+
+// Fail settles a failed attempt of an account from an IP address, already counted by
+// Attempt. It returns the block it caused when the account or address is now locked, or nil.
+func Fail(account, ip string) *Block {
+	cfg := config.AppConfig.Lockout
+	ctx := context.Background()
+
+	counts, err := cache.RedisClient.MGet(ctx, failuresKey("account", account), failuresKey("ip", ip)).Result()
+	if err != nil {
+		log.Printf("Failed to count failed login: %v", err)
+		return nil
+	}
+	accountFailures, ipFailures := parseCount(counts[0]), parseCount(counts[1])
+
+	lockDuration := time.Duration(cfg.LockoutDuration) * time.Second
+	if cfg.MaxUserFailures > 0 && lockDuration > 0 && accountFailures >= int64(cfg.MaxUserFailures) {
+		lock(ctx, lockKey("account", account), failuresKey("account", account), lockDuration)
+		return &Block{Reason: ReasonAccountLocked, RetryAfter: lockDuration}
+	}
+	if cfg.MaxIPFailures > 0 && lockDuration > 0 && ipFailures >= int64(cfg.MaxIPFailures) {
+		lock(ctx, lockKey("ip", ip), failuresKey("ip", ip), lockDuration)
+		return &Block{Reason: ReasonIPLocked, RetryAfter: lockDuration}
+	}
+
+	// Each further failure doubles the wait before the next attempt
+	excess := accountFailures - int64(cfg.DelayAfter)
+	if cfg.DelayAfter > 0 && excess >= 0 && cfg.BaseDelay > 0 && cfg.MaxDelay > 0 {
+		delay := time.Duration(cfg.BaseDelay) * time.Second
+		maxDelay := time.Duration(cfg.MaxDelay) * time.Second
+		for i := int64(0); i < excess && delay < maxDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		if err := cache.RedisClient.Set(ctx, delayKey(account), 1, delay).Err(); err != nil {
+			log.Printf("Failed to delay next login: %v", err)
+		}
+	}
+	return nil
+}
+
+// Succeed clears the failures of an account after a successful login, including the
+// attempt itself. Earlier failures of the IP address are kept so logging into one account
+// does not reset guessing at others.
+func Succeed(account, ip string) {
+	ctx := context.Background()
+	if err := cache.RedisClient.Del(ctx, failuresKey("account", account), delayKey(account)).Err(); err != nil {
+		log.Printf("Failed to clear failed logins: %v", err)
+	}
+	if err := releaseScript.Run(ctx, cache.RedisClient, []string{failuresKey("ip", ip)}).Err(); err != nil {
+		log.Printf("Failed to clear failed logins: %v", err)
+	}
+}
+
+// Release takes back the failure an allowed attempt counted, for a step that succeeded
+// without ending the login, such as the right password before the MFA code. Earlier
+// failures of the account and IP address are kept, so a right password does not reset
+// guessing at the code.
+func Release(account, ip string) {
+	ctx := context.Background()
+	keys := []string{failuresKey("account", account), failuresKey("ip", ip)}
+	if err := releaseScript.Run(ctx, cache.RedisClient, keys).Err(); err != nil {
+		log.Printf("Failed to release login attempt: %v", err)
+	}
+}
+
+// Unlock lifts the lock of an account and clears its failures
+func Unlock(account string) error {
+	return cache.RedisClient.Del(context.Background(),
+		lockKey("account", account), failuresKey("account", account), delayKey(account)).Err()
+}
+
+// UnlockIP lifts the lock of an IP address and clears its failures
+func UnlockIP(ip string) error {
+	return cache.RedisClient.Del(context.Background(), lockKey("ip", ip), failuresKey("ip", ip)).Err()
+}
+
+// AccountStatus returns the failures and lock of an account
+func AccountStatus(account string) (*Status, error) {
+	ctx := context.Background()
+	failures, err := cache.RedisClient.Get(ctx, failuresKey("account", account)).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	ttl, err := cache.RedisClient.PTTL(ctx, lockKey("account", account)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{Failures: failures}
+	if ttl > 0 {
+		until := time.Now().Add(ttl)
+		status.Locked = true
+		status.LockedUntil = &until
+	}
+	return status, nil
+}
+
+// parseCount reads a failure counter, zero when it is not set
+func parseCount(value interface{}) int64 {
+	s, _ := value.(string)
+	count, _ := strconv.ParseInt(s, 10, 64)
+	return count
+}
+
+// lock sets a lock and restarts the failure count for when it expires
+func lock(ctx context.Context, lockKey, failuresKey string, duration time.Duration) {
+	_, err := cache.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, lockKey, time.Now().Unix(), duration)
+		pipe.Del(ctx, failuresKey)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to lock logins: %v", err)
+	}
+}
+
+// failuresKey returns the key counting failures of an account or IP address
+func failuresKey(kind, name string) string {
+	return fmt.Sprintf("%sfailures:%s:%s", keyPrefix, kind, name)
+}
+
+// lockKey returns the key locking an account or IP address
+func lockKey(kind, name string) string {
+	return fmt.Sprintf("%slock:%s:%s", keyPrefix, kind, name)
+}
+
+// delayKey returns the key making an account wait before its next attempt
+func delayKey(account string) string {
+	return keyPrefix + "delay:" + account
+}
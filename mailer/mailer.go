@@ -0,0 +1,94 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"tsimserver/config"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email. SMTP and a log-only fake implement it.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// maxKept limits the messages a LogMailer keeps
+const maxKept = 100
+
+var mailer Mailer
+
+// Init creates the mailer configured under mail.driver
+func Init() error {
+	cfg := config.AppConfig.Mail
+	switch strings.ToLower(cfg.Driver) {
+	case "", "log":
+		mailer = &LogMailer{}
+	case "smtp":
+		smtp, err := NewSMTPMailer(cfg.SMTP, cfg.From)
+		if err != nil {
+			return err
+		}
+		mailer = smtp
+	default:
+		return fmt.Errorf("unknown mail driver %q", cfg.Driver)
+	}
+	return nil
+}
+
+// Default returns the configured mailer
+func Default() (Mailer, error) {
+	if mailer == nil {
+		return nil, errors.New("mailer not initialized")
+	}
+	return mailer, nil
+}
+
+// SetDefault replaces the configured mailer, for tests and tools
+func SetDefault(m Mailer) {
+	mailer = m
+}
+
+// Send sends a message with the configured mailer
+func Send(msg Message) error {
+	m, err := Default()
+	if err != nil {
+		return err
+	}
+	return m.Send(msg)
+}
+
+// LogMailer only logs messages and keeps the latest for inspection. Use it in development
+// and tests, it prints reset links and other secrets to the log.
+type LogMailer struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+// Send implements Mailer
+func (m *LogMailer) Send(msg Message) error {
+	m.mu.Lock()
+	m.sent = append(m.sent, msg)
+	if len(m.sent) > maxKept {
+		m.sent = m.sent[len(m.sent)-maxKept:]
+	}
+	m.mu.Unlock()
+
+	log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// Sent returns the latest messages sent
+func (m *LogMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.sent...)
+}
@@ -0,0 +1,175 @@
+package media
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+)
+
+var (
+	// ErrUnsupportedType is returned for a content type that is not allowed
+	ErrUnsupportedType = errors.New("media content type is not allowed")
+	// ErrPartTooLarge is returned when one attachment exceeds the part limit
+	ErrPartTooLarge = errors.New("media part exceeds the size limit")
+	// ErrMessageTooLarge is returned when all attachments together exceed the message limit
+	ErrMessageTooLarge = errors.New("media parts exceed the message size limit")
+	// ErrTooManyParts is returned when a message has more parts than allowed
+	ErrTooManyParts = errors.New("too many media parts")
+)
+
+// unsafeNameChars are replaced in client supplied file names
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// Part is an attachment waiting to be stored
+type Part struct {
+	FileName    string
+	ContentType string
+	Size        int64
+	Data        io.Reader
+}
+
+// ContentType normalizes a content type, dropping parameters such as charset
+func ContentType(value string) string {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(value))
+	}
+	return mediaType
+}
+
+// CheckPart validates the content type and size of a single part
+func CheckPart(part Part) error {
+	if !allowedType(ContentType(part.ContentType)) {
+		return fmt.Errorf("%w: %s", ErrUnsupportedType, part.ContentType)
+	}
+	if maxPart := int64(config.AppConfig.Media.MaxPartKB) * 1024; maxPart > 0 && part.Size > maxPart {
+		return fmt.Errorf("%w of %d KB: %s", ErrPartTooLarge, config.AppConfig.Media.MaxPartKB, part.FileName)
+	}
+	return nil
+}
+
+// Validate checks the parts of a message against the configured limits
+func Validate(parts []Part) error {
+	cfg := config.AppConfig.Media
+	if cfg.MaxParts > 0 && len(parts) > cfg.MaxParts {
+		return fmt.Errorf("%w: %d allowed", ErrTooManyParts, cfg.MaxParts)
+	}
+
+	var total int64
+	for _, part := range parts {
+		if err := CheckPart(part); err != nil {
+			return err
+		}
+		total += part.Size
+	}
+	if maxMessage := int64(cfg.MaxMessageKB) * 1024; maxMessage > 0 && total > maxMessage {
+		return fmt.Errorf("%w of %d KB", ErrMessageTooLarge, cfg.MaxMessageKB)
+	}
+	return nil
+}
+
+// Save stores a part of an MMS and records it
+func Save(message *models.MMSMessage, seq int, part Part) (*models.MMSMedia, error) {
+	store, err := Default()
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := ContentType(part.ContentType)
+	fileName := sanitizeFileName(part.FileName, seq, contentType)
+	key := fmt.Sprintf("mms/%d/%d-%d-%s", message.ConversationID, message.ID, seq, fileName)
+
+	hasher := sha256.New()
+	if err := store.Put(key, io.TeeReader(part.Data, hasher), part.Size, contentType); err != nil {
+		return nil, err
+	}
+
+	record := models.MMSMedia{
+		MMSMessageID:   message.ID,
+		ConversationID: message.ConversationID,
+		Seq:            seq,
+		ContentType:    contentType,
+		FileName:       fileName,
+		Size:           part.Size,
+		SHA256:         hex.EncodeToString(hasher.Sum(nil)),
+		Storage:        store.Name(),
+		StorageKey:     key,
+	}
+	if err := database.DB.Create(&record).Error; err != nil {
+		store.Delete(key)
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Open returns the content of a stored part
+func Open(record *models.MMSMedia) (io.ReadCloser, error) {
+	store, err := Default()
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(record.StorageKey)
+}
+
+// Delete removes the stored content of a part
+func Delete(record *models.MMSMedia) error {
+	store, err := Default()
+	if err != nil {
+		return err
+	}
+	return store.Delete(record.StorageKey)
+}
+
+// DownloadToken returns the token devices present to download a part
+func DownloadToken(mediaID uint) string {
+	mac := hmac.New(sha256.New, []byte(config.AppConfig.JWT.Secret))
+	fmt.Fprintf(mac, "mms_media:%d", mediaID)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyDownloadToken checks a download token for a part
+func VerifyDownloadToken(mediaID uint, token string) bool {
+	return hmac.Equal([]byte(DownloadToken(mediaID)), []byte(token))
+}
+
+// DownloadURL returns the URL a device downloads a part from
+func DownloadURL(record *models.MMSMedia) string {
+	base := strings.TrimRight(config.AppConfig.Media.PublicURL, "/")
+	return fmt.Sprintf("%s/api/v1/media/%d/download?token=%s", base, record.ID, DownloadToken(record.ID))
+}
+
+// allowedType reports whether a normalized content type may be stored
+func allowedType(contentType string) bool {
+	for _, allowed := range config.AppConfig.Media.AllowedTypes {
+		if strings.EqualFold(allowed, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeFileName makes a client supplied file name safe for storage keys
+func sanitizeFileName(name string, seq int, contentType string) string {
+	name = unsafeNameChars.ReplaceAllString(filepath.Base(name), "_")
+	name = strings.Trim(name, "._")
+	if name == "" {
+		name = fmt.Sprintf("part%d", seq)
+		if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+	return name
+}
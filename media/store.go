@@ -0,0 +1,127 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"tsimserver/config"
+)
+
+// ErrNotFound is returned when a stored object does not exist
+var ErrNotFound = errors.New("media object not found")
+
+// Store keeps media objects under keys. Local disk and S3-compatible storage implement it.
+type Store interface {
+	// Name identifies the store in media records
+	Name() string
+	// Put stores size bytes read from r under key
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Get opens a stored object
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes an object, succeeding when it does not exist
+	Delete(key string) error
+}
+
+var store Store
+
+// Init creates the store configured under media.storage
+func Init() error {
+	cfg := config.AppConfig.Media
+	switch cfg.Storage {
+	case "", "local":
+		if err := os.MkdirAll(cfg.LocalPath, 0755); err != nil {
+			return err
+		}
+		store = &LocalStore{Root: cfg.LocalPath}
+	case "s3":
+		s3, err := NewS3Store(cfg.S3)
+		if err != nil {
+			return err
+		}
+		store = s3
+	default:
+		return fmt.Errorf("unknown media storage %q", cfg.Storage)
+	}
+	return nil
+}
+
+// Default returns the configured store
+func Default() (Store, error) {
+	if store == nil {
+		return nil, errors.New("media storage not initialized")
+	}
+	return store, nil
+}
+
+// LocalStore keeps media as files below a root directory
+type LocalStore struct {
+	Root string
+}
+
+// Name implements Store
+func (s *LocalStore) Name() string {
+	return "local"
+}
+
+// Put implements Store
+func (s *LocalStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, io.LimitReader(r, size)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get implements Store
+func (s *LocalStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+// Delete implements Store
+func (s *LocalStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// path maps a key to a file below the root, rejecting keys that escape it
+func (s *LocalStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid media key %q", key)
+	}
+	return filepath.Join(s.Root, clean), nil
+}
@@ -0,0 +1,320 @@
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// period is the TOTP time step in seconds
+	period = 30
+	// digits is the length of TOTP codes
+	digits = 6
+	// challengePrefix starts every challenge token so it can be told apart from a JWT
+	challengePrefix = "mfa_"
+)
+
+var (
+	// ErrInvalidCode is returned for a wrong, expired or reused code
+	ErrInvalidCode = errors.New("invalid two-factor code")
+	// ErrNotEnrolled is returned when the user has no authenticator to check codes against
+	ErrNotEnrolled = errors.New("two-factor authentication is not set up")
+	// ErrAlreadyEnabled is returned when enrolling a user whose authenticator is already confirmed
+	ErrAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrInvalidChallenge is returned for an unknown, used or expired challenge token
+	ErrInvalidChallenge = errors.New("invalid or expired MFA token")
+	// ErrTooManyAttempts is returned once a challenge had too many wrong codes
+	ErrTooManyAttempts = errors.New("too many wrong codes, log in again")
+)
+
+// base32NoPadding encodes secrets the way authenticator apps expect them
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Required reports whether any active role of a user requires two-factor authentication
+func Required(userID uint) bool {
+	var count int64
+	database.DB.Model(&models.UserRole{}).
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Where("user_roles.user_id = ? AND roles.is_active = ? AND roles.mfa_required = ?", userID, true, true).
+		Count(&count)
+	return count > 0
+}
+
+// Enabled reports whether a user has a confirmed authenticator
+func Enabled(userID uint) bool {
+	var count int64
+	database.DB.Model(&models.UserMFA{}).Where("user_id = ? AND enabled = ?", userID, true).Count(&count)
+	return count > 0
+}
+
+// BeginEnrollment creates a new pending authenticator for a user, replacing any pending one,
+// and returns its secret and otpauth:// provisioning URI for a QR code
+func BeginEnrollment(user *models.User) (string, string, error) {
+	var existing models.UserMFA
+	err := database.DB.Where("user_id = ?", user.ID).First(&existing).Error
+	if err == nil && existing.Enabled {
+		return "", "", ErrAlreadyEnabled
+	}
+
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	secret := base32NoPadding.EncodeToString(buf)
+
+	record := models.UserMFA{UserID: user.ID, Secret: secret}
+	if err == nil {
+		record.ID = existing.ID
+		record.CreatedAt = existing.CreatedAt
+	}
+	if err := database.DB.Save(&record).Error; err != nil {
+		return "", "", err
+	}
+
+	return secret, ProvisioningURI(secret, user.Username), nil
+}
+
+// ProvisioningURI returns the otpauth:// URI authenticator apps scan to add an account
+func ProvisioningURI(secret, account string) string {
+	issuer := config.AppConfig.MFA.Issuer
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(digits))
+	params.Set("period", fmt.Sprint(period))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Enable confirms a pending authenticator with a first code and returns a new set of
+// recovery codes
+func Enable(userID uint, code string) ([]string, error) {
+	var record models.UserMFA
+	if err := database.DB.Where("user_id = ?", userID).First(&record).Error; err != nil {
+		return nil, ErrNotEnrolled
+	}
+	if record.Enabled {
+		return nil, ErrAlreadyEnabled
+	}
+	if err := acceptCode(&record, code); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := database.DB.Model(&record).Updates(map[string]interface{}{
+		"enabled":    true,
+		"enabled_at": now,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	return RegenerateRecoveryCodes(userID)
+}
+
+// Verify checks a TOTP code, or a recovery code, of a user with a confirmed authenticator.
+// A recovery code can only be used once.
+func Verify(userID uint, code string) error {
+	var record models.UserMFA
+	if err := database.DB.Where("user_id = ? AND enabled = ?", userID, true).First(&record).Error; err != nil {
+		return ErrNotEnrolled
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) == digits {
+		return acceptCode(&record, code)
+	}
+	return useRecoveryCode(userID, code)
+}
+
+// Disable removes a user's authenticator and recovery codes
+func Disable(userID uint) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.UserMFA{}).Error
+	})
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes. Only hashes are stored, so the
+// returned codes cannot be shown again.
+func RegenerateRecoveryCodes(userID uint) ([]string, error) {
+	count := config.AppConfig.MFA.RecoveryCodes
+	codes := make([]string, 0, count)
+	records := make([]models.MFARecoveryCode, 0, count)
+	for i := 0; i < count; i++ {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(buf)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		records = append(records, models.MFARecoveryCode{UserID: userID, CodeHash: hash(code)})
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RemainingRecoveryCodes returns how many unused recovery codes a user has
+func RemainingRecoveryCodes(userID uint) int64 {
+	var count int64
+	database.DB.Model(&models.MFARecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count)
+	return count
+}
+
+// NewChallenge starts the second login step for a user and returns its token. Enrollment
+// challenges let a user who must use MFA but has not set it up enroll before logging in.
+func NewChallenge(userID uint, enrollment bool, ip string) (string, *models.MFAChallenge, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	token := challengePrefix + hex.EncodeToString(buf)
+
+	challenge := models.MFAChallenge{
+		UserID:     userID,
+		TokenHash:  hash(token),
+		Enrollment: enrollment,
+		IPAddress:  ip,
+		ExpiresAt:  time.Now().Add(time.Duration(config.AppConfig.MFA.ChallengeTTL) * time.Second),
+	}
+	if err := database.DB.Create(&challenge).Error; err != nil {
+		return "", nil, err
+	}
+	return token, &challenge, nil
+}
+
+// FindChallenge returns the open challenge of a token
+func FindChallenge(token string) (*models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+	if err := database.DB.Where("token_hash = ? AND used_at IS NULL", hash(token)).First(&challenge).Error; err != nil {
+		return nil, ErrInvalidChallenge
+	}
+	if time.Now().After(challenge.ExpiresAt) {
+		return nil, ErrInvalidChallenge
+	}
+	if challenge.Attempts >= config.AppConfig.MFA.MaxAttempts {
+		return nil, ErrTooManyAttempts
+	}
+	return &challenge, nil
+}
+
+// ClaimAttempt counts an attempt against a challenge before its code is checked, so
+// concurrent requests cannot try more codes than allowed. It returns ErrTooManyAttempts
+// once the attempts are used up.
+func ClaimAttempt(challenge *models.MFAChallenge) error {
+	result := database.DB.Model(&models.MFAChallenge{}).
+		Where("id = ? AND used_at IS NULL AND attempts < ?", challenge.ID, config.AppConfig.MFA.MaxAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTooManyAttempts
+	}
+	challenge.Attempts++
+	return nil
+}
+
+// CompleteChallenge closes a challenge so its token cannot be used again. It reports false
+// when a concurrent request completed it first.
+func CompleteChallenge(challenge *models.MFAChallenge) bool {
+	result := database.DB.Model(&models.MFAChallenge{}).
+		Where("id = ? AND used_at IS NULL", challenge.ID).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// acceptCode checks a TOTP code against an authenticator and records its time step so the
+// same code cannot be used twice
+func acceptCode(record *models.UserMFA, code string) error {
+	secret, err := base32NoPadding.DecodeString(record.Secret)
+	if err != nil {
+		return err
+	}
+
+	current := time.Now().Unix() / period
+	skew := int64(config.AppConfig.MFA.Skew)
+	for step := current - skew; step <= current+skew; step++ {
+		if step <= record.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(generate(secret, step)), []byte(code)) != 1 {
+			continue
+		}
+
+		// Only one request may use a step
+		result := database.DB.Model(&models.UserMFA{}).
+			Where("id = ? AND last_step < ?", record.ID, step).
+			Update("last_step", step)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return ErrInvalidCode
+		}
+		record.LastStep = step
+		return nil
+	}
+	return ErrInvalidCode
+}
+
+// useRecoveryCode marks an unused recovery code of a user as used
+func useRecoveryCode(userID uint, code string) error {
+	code = strings.ToLower(strings.TrimSpace(code))
+	result := database.DB.Model(&models.MFARecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// generate returns the TOTP code of a time step (RFC 6238 with HMAC-SHA1)
+func generate(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%1000000)
+}
+
+// hash returns the stored form of a token or recovery code
+func hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"tsimserver/audit"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Audit middleware records requests that change something in the audit log, after the
+// handler ran so the authenticated actor and the handler's reported change are known.
+// Requests without a user, such as logins and device callbacks, are left to the
+// authentication audit trail and device records.
+func Audit() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		switch c.Method() {
+		case fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete:
+		default:
+			return c.Next()
+		}
+
+		err := c.Next()
+		if _, ok := c.Locals("user_id").(uint); !ok {
+			return err
+		}
+
+		// Errors returned by handlers become responses after the middleware returns
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			}
+		}
+		audit.RecordRequest(c, status)
+
+		return err
+	}
+}
@@ -1,10 +1,14 @@
 package middleware
 
 import (
+	"errors"
 	"strings"
+	"tsimserver/apikeys"
 	"tsimserver/auth"
 	"tsimserver/database"
 	"tsimserver/models"
+	"tsimserver/sessions"
+	"tsimserver/tenancy"
 	"tsimserver/utils"
 
 	"github.com/gofiber/fiber/v2"
@@ -13,6 +17,11 @@ import (
 // AuthRequired middleware checks if user is authenticated
 func AuthRequired() fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		// Machine clients authenticate with an API key instead of a user session
+		if key := apiKeyFromRequest(c); key != "" {
+			return authenticateAPIKey(c, key)
+		}
+
 		// Extract token from header
 		authHeader := c.Get("Authorization")
 		if authHeader == "" {
@@ -36,26 +45,30 @@ func AuthRequired() fiber.Handler {
 			})
 		}
 
-		// Check if user exists and is active
-		var user models.User
-		if err := database.DB.Where("id = ? AND is_active = ?", claims.UserID, true).First(&user).Error; err != nil {
+		// Check if the session and its user are active, from the session cache when possible
+		session, user, err := sessions.Validate(token, claims.UserID)
+		if errors.Is(err, sessions.ErrInactiveUser) {
 			return c.Status(401).JSON(fiber.Map{
 				"error": "User not found or inactive",
 			})
 		}
-
-		// Check if session exists and is active
-		var session models.Session
-		if err := database.DB.Where("access_token = ? AND is_active = ? AND user_id = ?", token, true, claims.UserID).First(&session).Error; err != nil {
+		if err != nil {
 			return c.Status(401).JSON(fiber.Map{
 				"error": "Session not found or expired",
 			})
 		}
 
+		if !scopeToTenant(c, user, session.TenantID) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Organization is inactive",
+			})
+		}
+
 		// Store user info in context
-		c.Locals("user", &user)
+		c.Locals("user", user)
 		c.Locals("user_id", claims.UserID)
 		c.Locals("username", claims.Username)
+		c.Locals("session_id", session.ID)
 
 		return c.Next()
 	}
@@ -72,20 +85,81 @@ func RequirePermission(resource, action string) fiber.Handler {
 			})
 		}
 
+		// An API key only grants the permissions it was scoped to, on top of its owner's
+		if key, ok := c.Locals("api_key").(*models.APIKey); ok && !apikeys.Allows(key, resource, action) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "API key does not grant this permission",
+			})
+		}
+
 		// Check permission
-		allowed, err := auth.CheckPermission(userID.(uint), resource, action)
+		scope, err := auth.PermissionScope(userID.(uint), resource, action)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error": "Error checking permissions",
 			})
 		}
 
-		if !allowed {
+		// Only device permissions may be limited to sites and device groups, the rest
+		// would act on the whole tenant
+		if scope.Empty() || (!scope.All && !auth.DeviceScoped(resource)) {
 			return c.Status(403).JSON(fiber.Map{
 				"error": "Insufficient permissions",
 			})
 		}
 
+		// A key limited to sites and device groups only uses devices there, even where its
+		// owner holds the permission
+		if key, ok := c.Locals("api_key").(*models.APIKey); ok && auth.DeviceScoped(resource) {
+			scope = scope.Intersect(apikeys.Scope(key))
+			if scope.Empty() {
+				return c.Status(403).JSON(fiber.Map{
+					"error": "API key does not grant this permission for any device",
+				})
+			}
+		}
+
+		// Handlers limit devices and their records to the sites and device groups
+		// where the user, and the API key if any, hold the permission
+		c.Locals("permission_scope", scope)
+
+		return c.Next()
+	}
+}
+
+// UserSessionRequired middleware rejects requests authenticated with an API key, for
+// routes that manage the account or its keys
+func UserSessionRequired() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Locals("api_key") != nil {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "API keys cannot be used for this endpoint",
+			})
+		}
+
+		return c.Next()
+	}
+}
+
+// SuperAdminRequired middleware checks if user is a super-admin
+func SuperAdminRequired() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(*models.User)
+		if !ok {
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Authentication required",
+			})
+		}
+
+		if !user.IsSuperAdmin {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Super-admin access required",
+			})
+		}
+
+		// Super-admins act on every site and device group
+		c.Locals("permission_scope", auth.Scope{All: true})
+
 		return c.Next()
 	}
 }
@@ -148,17 +222,108 @@ func OptionalAuth() fiber.Handler {
 			return c.Next()
 		}
 
-		// Check if user exists and is active
-		var user models.User
-		if err := database.DB.Where("id = ? AND is_active = ?", claims.UserID, true).First(&user).Error; err != nil {
+		// Revoked sessions count as anonymous
+		session, user, err := sessions.Validate(token, claims.UserID)
+		if err != nil {
 			return c.Next()
 		}
 
 		// Store user info in context
-		c.Locals("user", &user)
+		c.Locals("user", user)
 		c.Locals("user_id", claims.UserID)
 		c.Locals("username", claims.Username)
+		c.Locals("session_id", session.ID)
 
 		return c.Next()
 	}
 }
+
+// apiKeyFromRequest returns an API key sent in the X-API-Key header or as a bearer token
+func apiKeyFromRequest(c *fiber.Ctx) string {
+	if key := c.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token := utils.ExtractTokenFromHeader(c.Get("Authorization")); apikeys.IsKey(token) {
+		return token
+	}
+	return ""
+}
+
+// authenticateAPIKey authenticates a request with an API key, acting as the key's owner,
+// and records the outcome in the key's usage figures
+func authenticateAPIKey(c *fiber.Ctx, plain string) error {
+	key, err := apikeys.Authenticate(plain, c.IP())
+	if err != nil {
+		status := 401
+		switch {
+		case errors.Is(err, apikeys.ErrIPNotAllowed):
+			status = 403
+		case errors.Is(err, apikeys.ErrRateLimited):
+			c.Set(fiber.HeaderRetryAfter, "60")
+			return c.Status(429).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if key != nil {
+			apikeys.RecordUsage(key, c.IP(), status, false)
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Check if the owner exists and is active
+	var user models.User
+	if err := database.DB.Preload("Tenant").Where("id = ? AND is_active = ?", key.UserID, true).First(&user).Error; err != nil {
+		apikeys.RecordUsage(key, c.IP(), 401, false)
+		return c.Status(401).JSON(fiber.Map{
+			"error": "API key owner not found or inactive",
+		})
+	}
+	if !scopeToTenant(c, &user, nil) {
+		apikeys.RecordUsage(key, c.IP(), 403, false)
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Organization is inactive",
+		})
+	}
+
+	// Store user info in context
+	c.Locals("user", &user)
+	c.Locals("user_id", user.ID)
+	c.Locals("username", user.Username)
+	c.Locals("api_key", key)
+
+	err = c.Next()
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = fiber.StatusInternalServerError
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			status = fiberErr.Code
+		}
+	}
+	apikeys.RecordUsage(key, c.IP(), status, false)
+	return err
+}
+
+// scopeToTenant limits the queries of a request to the user's tenant. Super-admins see
+// every tenant unless they switched to one. It returns false when the tenant is inactive.
+func scopeToTenant(c *fiber.Ctx, user *models.User, switched *uint) bool {
+	var tenantID uint
+	switch {
+	case user.IsSuperAdmin && switched == nil:
+		return true
+	case user.IsSuperAdmin:
+		tenantID = *switched
+	case user.TenantID != nil:
+		if user.Tenant != nil && !user.Tenant.IsActive {
+			return false
+		}
+		tenantID = *user.TenantID
+	}
+
+	// Users without a tenant are scoped to tenant 0 and see nothing
+	c.Locals("tenant_id", tenantID)
+	c.SetUserContext(tenancy.WithTenant(c.UserContext(), tenantID))
+	return true
+}
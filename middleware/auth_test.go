@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"tsimserver/auth"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/testutil"
+
+	gormadapter "github.com/casbin/gorm-adapter/v3"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRequirePermissionLimitsScopeToAPIKey(t *testing.T) {
+	testutil.LoadConfig(t)
+	testutil.OpenDatabase(t, &models.User{}, &models.Role{}, &models.Permission{}, &models.RolePermission{},
+		&models.Site{}, &models.DeviceGroup{}, &models.UserRole{}, &gormadapter.CasbinRule{})
+	previousEnforcer := auth.Enforcer
+	t.Cleanup(func() {
+		auth.Enforcer = previousEnforcer
+	})
+	if err := auth.InitEnforcer(testutil.RepoPath("casbin", "model.conf")); err != nil {
+		t.Fatalf("creating enforcer: %v", err)
+	}
+
+	create := func(value interface{}) {
+		t.Helper()
+		if err := database.DB.Create(value).Error; err != nil {
+			t.Fatalf("creating %T: %v", value, err)
+		}
+	}
+
+	// The owner reads devices on both sites, each with one device group
+	owner := models.User{Username: "owner", Email: "owner@example.com", IsActive: true}
+	create(&owner)
+	var sites, groups []uint
+	for _, name := range []string{"first", "second"} {
+		site := models.Site{Name: name, Country: "TR", PhoneCode: "+90"}
+		create(&site)
+		group := models.DeviceGroup{SiteID: site.ID, Name: name}
+		create(&group)
+		sites = append(sites, site.ID)
+		groups = append(groups, group.ID)
+	}
+	devicesRead := models.Permission{Name: "devices:read", Resource: "devices", Action: "read", IsActive: true}
+	create(&devicesRead)
+	viewer := models.Role{Name: "viewer", IsActive: true}
+	create(&viewer)
+	create(&models.RolePermission{RoleID: viewer.ID, PermissionID: devicesRead.ID})
+	for i := range sites {
+		if err := auth.AddRoleForUser(owner.ID, viewer.ID, &sites[i], nil); err != nil {
+			t.Fatalf("assigning role: %v", err)
+		}
+	}
+
+	request := func(key *models.APIKey) (int, auth.Scope) {
+		t.Helper()
+
+		app := fiber.New()
+		app.Get("/devices", func(c *fiber.Ctx) error {
+			c.Locals("user_id", owner.ID)
+			if key != nil {
+				c.Locals("api_key", key)
+			}
+			return c.Next()
+		}, RequirePermission("devices", "read"), func(c *fiber.Ctx) error {
+			return c.JSON(c.Locals("permission_scope"))
+		})
+		resp, err := app.Test(httptest.NewRequest("GET", "/devices", nil), -1)
+		if err != nil {
+			t.Fatalf("GET /devices: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var scope auth.Scope
+		data, _ := io.ReadAll(resp.Body)
+		json.Unmarshal(data, &scope)
+		return resp.StatusCode, scope
+	}
+	permissions := []string{"devices:read"}
+
+	if status, scope := request(nil); status != 200 || len(scope.SiteIDs) != 2 {
+		t.Errorf("user session = %d %+v, want both sites", status, scope)
+	}
+	if status, scope := request(&models.APIKey{Permissions: permissions}); status != 200 || len(scope.SiteIDs) != 2 {
+		t.Errorf("unlimited key = %d %+v, want both sites", status, scope)
+	}
+
+	siteKey := &models.APIKey{Permissions: permissions, SiteIDs: sites[1:]}
+	if status, scope := request(siteKey); status != 200 || !reflect.DeepEqual(scope.SiteIDs, sites[1:]) ||
+		len(scope.DeviceGroupIDs) != 0 {
+		t.Errorf("key limited to the second site = %d %+v, want only that site", status, scope)
+	}
+
+	groupKey := &models.APIKey{Permissions: permissions, SiteIDs: sites[:1], DeviceGroupIDs: groups}
+	if status, scope := request(groupKey); status != 200 || len(scope.SiteIDs) != 0 ||
+		!reflect.DeepEqual(scope.DeviceGroupIDs, groups[:1]) {
+		t.Errorf("key limited to the groups of the first site = %d %+v, want only its group", status, scope)
+	}
+
+	disjointKey := &models.APIKey{Permissions: permissions, SiteIDs: sites[:1], DeviceGroupIDs: groups[1:]}
+	if status, _ := request(disjointKey); status != 403 {
+		t.Errorf("key limited to a group on another site = %d, want 403", status)
+	}
+}
@@ -0,0 +1,262 @@
+package mms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/dispatch"
+	"tsimserver/media"
+	"tsimserver/models"
+	"tsimserver/siminventory"
+	"tsimserver/types"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MMS states
+const (
+	StatusPending  = "pending"
+	StatusSent     = "sent"
+	StatusFailed   = "failed"
+	StatusReceived = "received"
+)
+
+// ErrEmptyMessage is returned for an MMS without text and attachments
+var ErrEmptyMessage = errors.New("MMS needs text or at least one media part")
+
+// Outgoing describes an MMS to send
+type Outgoing struct {
+	DeviceID string
+	SimSlot  int
+	Target   string
+	Subject  string
+	Text     string
+	Parts    []media.Part
+	SentBy   uint
+}
+
+// Send stores the media of an MMS and asks the device to send it. The message is returned
+// with its parts even when the device could not be reached.
+func Send(out Outgoing) (*models.MMSMessage, error) {
+	if strings.TrimSpace(out.Text) == "" && len(out.Parts) == 0 {
+		return nil, ErrEmptyMessage
+	}
+	if err := media.Validate(out.Parts); err != nil {
+		return nil, err
+	}
+
+	conversation, err := Conversation(out.DeviceID, out.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	message := models.MMSMessage{
+		ConversationID: conversation.ID,
+		DeviceID:       out.DeviceID,
+		Type:           "outgoing",
+		Target:         out.Target,
+		Subject:        out.Subject,
+		Text:           out.Text,
+		SimSlot:        out.SimSlot,
+		SIMCardID:      siminventory.SIMCardIDForSlot(out.DeviceID, out.SimSlot),
+		Status:         StatusPending,
+		Timestamp:      time.Now().Unix(),
+	}
+	if out.SentBy != 0 {
+		message.SentBy = &out.SentBy
+	}
+	if err := database.DB.Create(&message).Error; err != nil {
+		return nil, err
+	}
+
+	command := types.SendMMSCommand{
+		Type:          "send_mms",
+		Target:        out.Target,
+		SimSlot:       out.SimSlot,
+		Subject:       out.Subject,
+		Text:          out.Text,
+		Parts:         []types.MMSPart{},
+		InternalLogID: int(message.ID),
+	}
+	for i, part := range out.Parts {
+		record, err := media.Save(&message, i, part)
+		if err != nil {
+			fail(&message, fmt.Sprintf("failed to store part %d: %v", i, err))
+			return &message, err
+		}
+		message.Parts = append(message.Parts, *record)
+		message.TotalSize += record.Size
+		command.Parts = append(command.Parts, types.MMSPart{
+			Seq:         record.Seq,
+			ContentType: record.ContentType,
+			FileName:    record.FileName,
+			Size:        record.Size,
+			SHA256:      record.SHA256,
+			URL:         media.DownloadURL(record),
+		})
+	}
+	touch(conversation.ID, message.CreatedAt)
+
+	if err := dispatch.ToDevice(out.DeviceID, command); err != nil {
+		fail(&message, err.Error())
+		return &message, err
+	}
+
+	now := time.Now()
+	message.Status = StatusSent
+	message.SentAt = &now
+	if err := database.DB.Model(&message).Updates(map[string]interface{}{
+		"status":     StatusSent,
+		"sent_at":    now,
+		"total_size": message.TotalSize,
+	}).Error; err != nil {
+		return &message, err
+	}
+	return &message, nil
+}
+
+// Receive stores an MMS reported by a device. Parts that break the media limits are
+// dropped and noted on the message instead of rejecting it.
+func Receive(deviceID string, in types.IncomingMMS) (*models.MMSMessage, error) {
+	conversation, err := Conversation(deviceID, in.From)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := in.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().Unix()
+	}
+	message := models.MMSMessage{
+		ConversationID: conversation.ID,
+		DeviceID:       deviceID,
+		Type:           "incoming",
+		From:           in.From,
+		Subject:        in.Subject,
+		Text:           in.Text,
+		SimSlot:        in.SimSlot,
+		SIMCardID:      siminventory.SIMCardIDForSlot(deviceID, in.SimSlot),
+		Status:         StatusReceived,
+		Timestamp:      timestamp,
+	}
+	if err := database.DB.Create(&message).Error; err != nil {
+		return nil, err
+	}
+	touch(conversation.ID, message.CreatedAt)
+
+	var problems []string
+	remaining := messageLimit()
+	for i, part := range in.Parts {
+		data, err := base64.StdEncoding.DecodeString(part.Data)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("part %d: invalid data", i))
+			continue
+		}
+
+		upload := media.Part{
+			FileName:    part.FileName,
+			ContentType: part.ContentType,
+			Size:        int64(len(data)),
+			Data:        bytes.NewReader(data),
+		}
+		if err := media.CheckPart(upload); err != nil {
+			problems = append(problems, fmt.Sprintf("part %d: %v", i, err))
+			continue
+		}
+		if remaining >= 0 && upload.Size > remaining {
+			problems = append(problems, fmt.Sprintf("part %d: %v", i, media.ErrMessageTooLarge))
+			continue
+		}
+
+		record, err := media.Save(&message, i, upload)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("part %d: %v", i, err))
+			continue
+		}
+		message.Parts = append(message.Parts, *record)
+		message.TotalSize += record.Size
+		if remaining >= 0 {
+			remaining -= record.Size
+		}
+	}
+
+	message.ErrorMessage = strings.Join(problems, "; ")
+	if err := database.DB.Model(&message).Updates(map[string]interface{}{
+		"total_size":    message.TotalSize,
+		"error_message": message.ErrorMessage,
+	}).Error; err != nil {
+		return &message, err
+	}
+	return &message, nil
+}
+
+// Delete removes an MMS with its stored media
+func Delete(message *models.MMSMessage) error {
+	var parts []models.MMSMedia
+	if err := database.DB.Where("mms_message_id = ?", message.ID).Find(&parts).Error; err != nil {
+		return err
+	}
+	for i := range parts {
+		if err := media.Delete(&parts[i]); err != nil {
+			log.Printf("Failed to delete media %d of MMS %d: %v", parts[i].ID, message.ID, err)
+		}
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("mms_message_id = ?", message.ID).Delete(&models.MMSMedia{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(message).Error
+	})
+}
+
+// Conversation returns the conversation between a device and a remote number, creating it when needed
+func Conversation(deviceID, peerNumber string) (*models.Conversation, error) {
+	conversation := models.Conversation{DeviceID: deviceID, PeerNumber: strings.TrimSpace(peerNumber)}
+	if err := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&conversation).Error; err != nil {
+		return nil, err
+	}
+	if conversation.ID != 0 {
+		return &conversation, nil
+	}
+
+	if err := database.DB.Where("device_id = ? AND peer_number = ?", conversation.DeviceID, conversation.PeerNumber).
+		First(&conversation).Error; err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// touch moves a conversation's last message time forward
+func touch(conversationID uint, at time.Time) {
+	database.DB.Model(&models.Conversation{}).
+		Where("id = ? AND (last_message_at IS NULL OR last_message_at < ?)", conversationID, at).
+		Update("last_message_at", at)
+}
+
+// fail marks an outgoing MMS as failed
+func fail(message *models.MMSMessage, reason string) {
+	message.Status = StatusFailed
+	message.ErrorMessage = reason
+	database.DB.Model(message).Updates(map[string]interface{}{
+		"status":        StatusFailed,
+		"error_message": reason,
+		"total_size":    message.TotalSize,
+	})
+}
+
+// messageLimit returns the bytes all parts of a message may take, or -1 without a limit
+func messageLimit() int64 {
+	limit := int64(config.AppConfig.Media.MaxMessageKB) * 1024
+	if limit <= 0 {
+		return -1
+	}
+	return limit
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// APIKey lets a backend service call the API without a user session. Requests act as
+// the owning user, limited to the key's permissions and scopes.
+type APIKey struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	Name           string     `json:"name" gorm:"not null"`
+	Description    string     `json:"description"`
+	Prefix         string     `json:"prefix" gorm:"uniqueIndex;not null"`                // Leading characters of the key, safe to show
+	KeyHash        string     `json:"-" gorm:"uniqueIndex;not null"`                     // SHA-256 of the key
+	UserID         uint       `json:"user_id" gorm:"not null;index"`                     // Owner the key acts as
+	Permissions    []string   `json:"permissions" gorm:"type:text;serializer:json"`      // resource:action pairs, e.g. sms:write
+	SiteIDs        []uint     `json:"site_ids" gorm:"type:text;serializer:json"`         // Sites whose devices may be used, empty for all
+	DeviceGroupIDs []uint     `json:"device_group_ids" gorm:"type:text;serializer:json"` // Device groups that may be used, empty for all
+	AllowedIPs     []string   `json:"allowed_ips" gorm:"type:text;serializer:json"`      // IPs or CIDR ranges, empty for any
+	RateLimit      int        `json:"rate_limit"`                                        // Requests per minute, 0 is unlimited
+	ExpiresAt      *time.Time `json:"expires_at"`
+	IsActive       bool       `json:"is_active" gorm:"default:true"`
+	RevokedAt      *time.Time `json:"revoked_at"`
+	LastUsedAt     *time.Time `json:"last_used_at"`
+	LastUsedIP     string     `json:"last_used_ip"`
+	UsageCount     int64      `json:"usage_count" gorm:"default:0"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+
+	// Relations
+	User *User `json:"user,omitempty" gorm:"foreignKey:UserID"`
+}
+
+// APIKeyUsage counts the requests of an API key per day
+type APIKeyUsage struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	APIKeyID    uint      `json:"api_key_id" gorm:"not null;uniqueIndex:idx_api_key_usage_day"`
+	Day         string    `json:"day" gorm:"not null;uniqueIndex:idx_api_key_usage_day"` // YYYY-MM-DD
+	Requests    int64     `json:"requests"`
+	Errors      int64     `json:"errors"`       // Responses with status 400 and above
+	RateLimited int64     `json:"rate_limited"` // Requests rejected by the rate limit
+	UpdatedAt   time.Time `json:"updated_at"`
+}
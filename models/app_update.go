@@ -0,0 +1,79 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AppRelease represents an uploaded build of the Android client
+type AppRelease struct {
+	ID                uint           `json:"id" gorm:"primaryKey"`
+	VersionName       string         `json:"version_name" gorm:"not null"`
+	VersionCode       int            `json:"version_code" gorm:"uniqueIndex;not null"`
+	FileName          string         `json:"file_name"`
+	FilePath          string         `json:"-"`
+	FileSize          int64          `json:"file_size"`
+	SHA256            string         `json:"sha256" gorm:"not null"`
+	SigningCertSHA256 string         `json:"signing_cert_sha256"` // SHA-256 of the APK signing certificate
+	ReleaseNotes      string         `json:"release_notes" gorm:"type:text"`
+	UploadedBy        uint           `json:"uploaded_by"`
+	CreatedAt         time.Time      `json:"created_at"`
+	UpdatedAt         time.Time      `json:"updated_at"`
+	DeletedAt         gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// AppRollout stages an app release across a device group in percentage steps
+type AppRollout struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	AppReleaseID      uint       `json:"app_release_id" gorm:"not null;index"`
+	DeviceGroupID     uint       `json:"device_group_id" gorm:"not null;index"`
+	PreviousReleaseID *uint      `json:"previous_release_id"`                    // Release installed again on rollback
+	Status            string     `json:"status" gorm:"default:pending"`          // pending, running, paused, halted, completed, rolling_back, rolled_back
+	Steps             []int      `json:"steps" gorm:"type:text;serializer:json"` // Cumulative device percentages, e.g. [5, 25, 100]
+	CurrentStep       int        `json:"current_step" gorm:"default:0"`          // Index into Steps
+	StepInterval      int        `json:"step_interval" gorm:"default:3600"`      // Seconds to wait on a step before advancing
+	MaxErrorRate      float64    `json:"max_error_rate" gorm:"default:0.1"`      // Failed share of finished updates that halts the rollout
+	MinSampleSize     int        `json:"min_sample_size" gorm:"default:5"`       // Finished updates needed before the error rate counts
+	HaltReason        string     `json:"halt_reason"`
+	BaselineInstalled int64      `json:"baseline_installed"` // Installed updates when last resumed from a halt, left out of the error rate
+	BaselineFailed    int64      `json:"baseline_failed"`    // Failed updates when last resumed from a halt, left out of the error rate
+	CreatedBy         uint       `json:"created_by"`
+	StartedAt         *time.Time `json:"started_at"`
+	StepStartedAt     *time.Time `json:"step_started_at"`
+	CompletedAt       *time.Time `json:"completed_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+
+	// Relations
+	AppRelease      AppRelease  `json:"app_release" gorm:"foreignKey:AppReleaseID"`
+	PreviousRelease *AppRelease `json:"previous_release,omitempty" gorm:"foreignKey:PreviousReleaseID"`
+	DeviceGroup     DeviceGroup `json:"device_group" gorm:"foreignKey:DeviceGroupID"`
+}
+
+// AppUpdateTask tracks the update of one device within a rollout
+type AppUpdateTask struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	AppRolloutID uint       `json:"app_rollout_id" gorm:"not null;uniqueIndex:idx_app_update_task"`
+	DeviceID     string     `json:"device_id" gorm:"not null;uniqueIndex:idx_app_update_task;index"`
+	IsRollback   bool       `json:"is_rollback" gorm:"default:false;uniqueIndex:idx_app_update_task"`
+	AppReleaseID uint       `json:"app_release_id" gorm:"not null"`
+	Step         int        `json:"step"`
+	Status       string     `json:"status" gorm:"default:pending;index"` // pending, sent, downloading, installing, installed, failed, skipped
+	Progress     int        `json:"progress" gorm:"default:0"`           // 0-100
+	FromVersion  string     `json:"from_version"`
+	ErrorMessage string     `json:"error_message"`
+	SentAt       *time.Time `json:"sent_at"`
+	CompletedAt  *time.Time `json:"completed_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+
+	// Relations
+	AppRollout AppRollout `json:"-" gorm:"foreignKey:AppRolloutID"`
+	AppRelease AppRelease `json:"-" gorm:"foreignKey:AppReleaseID"`
+}
+
+// IsFinished checks if the update reached a final state
+func (t *AppUpdateTask) IsFinished() bool {
+	return t.Status == "installed" || t.Status == "failed" || t.Status == "skipped"
+}
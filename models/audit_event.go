@@ -0,0 +1,47 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrAuditAppendOnly is returned when changing or deleting an audit event
+var ErrAuditAppendOnly = errors.New("audit events are append-only")
+
+// AuditEvent is an entry of the audit log of administrative and messaging actions: who
+// did what to which target, and how the target changed. Entries are never updated.
+type AuditEvent struct {
+	ID         uint                        `json:"id" gorm:"primaryKey"`
+	ActorID    *uint                       `json:"actor_id" gorm:"index"` // User who acted, the key's owner for API keys
+	ActorName  string                      `json:"actor_name"`
+	APIKeyID   *uint                       `json:"api_key_id"`             // Key the request was made with, nil for user sessions
+	TenantID   *uint                       `json:"tenant_id" gorm:"index"` // Tenant the actor acted in, nil for super-admins across tenants
+	IPAddress  string                      `json:"ip_address" gorm:"index"`
+	UserAgent  string                      `json:"user_agent"`
+	Action     string                      `json:"action" gorm:"not null;index"` // Method and route, e.g. POST /api/v1/devices/:id/disable
+	TargetType string                      `json:"target_type" gorm:"index"`     // e.g. devices, users, sms_messages
+	TargetID   string                      `json:"target_id" gorm:"index"`
+	Status     int                         `json:"status"` // HTTP status of the response
+	Before     map[string]interface{}      `json:"before,omitempty" gorm:"type:text;serializer:json"`
+	After      map[string]interface{}      `json:"after,omitempty" gorm:"type:text;serializer:json"`
+	Diff       map[string]AuditFieldChange `json:"diff,omitempty" gorm:"type:text;serializer:json"` // Fields that differ between before and after
+	CreatedAt  time.Time                   `json:"created_at" gorm:"index"`
+}
+
+// AuditFieldChange is the value of a field before and after an action
+type AuditFieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// BeforeUpdate keeps audit events append-only
+func (e *AuditEvent) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditAppendOnly
+}
+
+// BeforeDelete keeps audit events append-only
+func (e *AuditEvent) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditAppendOnly
+}
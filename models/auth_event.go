@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// AuthEvent is an entry of the authentication audit trail: logins, lockouts, MFA changes,
+// registrations and other changes to how users sign in. Entries are never updated.
+type AuthEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Event     string    `json:"event" gorm:"not null;index"` // login_success, login_failure, account_locked, ...
+	UserID    *uint     `json:"user_id" gorm:"index"`        // Nil when the login matched no user
+	Username  string    `json:"username" gorm:"index"`       // As entered, or the user's username
+	ActorID   *uint     `json:"actor_id"`                    // Authenticated user who caused the event, e.g. the admin who unlocked the user
+	IPAddress string    `json:"ip_address" gorm:"index"`
+	UserAgent string    `json:"user_agent"`
+	Details   string    `json:"details"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
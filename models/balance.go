@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// OperatorBalanceConfig describes how balance is queried and parsed for an operator
+type OperatorBalanceConfig struct {
+	ID                  uint      `json:"id" gorm:"primaryKey"`
+	Name                string    `json:"name" gorm:"not null"`
+	MCC                 string    `json:"mcc" gorm:"index:idx_operator_balance_network"`
+	MNC                 string    `json:"mnc" gorm:"index:idx_operator_balance_network"`
+	Operator            string    `json:"operator"`                            // Operator name reported by the SIM, used when MCC/MNC are empty
+	USSDCode            string    `json:"ussd_code"`                           // e.g. *123#
+	ParserType          string    `json:"parser_type" gorm:"default:template"` // regex, template
+	Pattern             string    `json:"pattern" gorm:"type:text"`            // Regex with amount/currency groups or template with {amount}/{currency}
+	Currency            string    `json:"currency"`                            // Used when the response carries no currency
+	LowBalanceThreshold float64   `json:"low_balance_threshold"`
+	CheckInterval       int       `json:"check_interval"` // minutes, 0 uses the server default
+	IsActive            bool      `json:"is_active" gorm:"default:true"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+// SIMBalanceCheck is one balance query of a SIM card and its parsed result
+type SIMBalanceCheck struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	SIMCardID    uint       `json:"sim_card_id" gorm:"not null;index"`
+	DeviceID     string     `json:"device_id" gorm:"not null;index"`
+	SimSlot      int        `json:"sim_slot"`
+	USSDCode     string     `json:"ussd_code"`
+	Status       string     `json:"status" gorm:"default:pending;index"` // pending, completed, failed, timeout
+	RawResponse  string     `json:"raw_response" gorm:"type:text"`
+	Amount       *float64   `json:"amount"`
+	Currency     string     `json:"currency"`
+	ErrorMessage string     `json:"error_message"`
+	Scheduled    bool       `json:"scheduled"` // Started by the scheduler rather than a user
+	CompletedAt  *time.Time `json:"completed_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+
+	// Relations
+	SIMCard *SIMCard `json:"sim_card,omitempty" gorm:"foreignKey:SIMCardID"`
+}
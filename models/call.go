@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// CallLog records a voice call placed or seen by a device
+type CallLog struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	DeviceID     string     `json:"device_id" gorm:"not null;index"`
+	SIMCardID    *uint      `json:"sim_card_id" gorm:"index"`
+	SimSlot      int        `json:"sim_slot"`
+	Direction    string     `json:"direction" gorm:"index"` // incoming, outgoing
+	Number       string     `json:"number" gorm:"index"`    // Remote party
+	Status       string     `json:"status" gorm:"index"`    // pending, dialing, ringing, answered, completed, missed, rejected, busy, no_answer, failed
+	Purpose      string     `json:"purpose"`                // manual, flash_call, balance_line; empty for incoming calls
+	DeviceCallID string     `json:"device_call_id" gorm:"index"`
+	MaxDuration  int        `json:"max_duration"`  // Seconds after which the device hangs up
+	Duration     int        `json:"duration"`      // Seconds connected
+	RingDuration int        `json:"ring_duration"` // Seconds ringing before being answered or missed
+	ErrorMessage string     `json:"error_message"`
+	RequestedBy  *uint      `json:"requested_by"`
+	StartedAt    time.Time  `json:"started_at"`
+	AnsweredAt   *time.Time `json:"answered_at"`
+	EndedAt      *time.Time `json:"ended_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+
+	// Relations
+	Device  *Device  `json:"device,omitempty" gorm:"foreignKey:DeviceID;references:DeviceID"`
+	SIMCard *SIMCard `json:"sim_card,omitempty" gorm:"foreignKey:SIMCardID"`
+}
+
+// FlashCallVerification proves ownership of a number by the caller ID of a call we place to it
+type FlashCallVerification struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	Number      string     `json:"number" gorm:"not null;index"`
+	CallLogID   *uint      `json:"call_log_id"`
+	DeviceID    string     `json:"device_id"`
+	SIMCardID   uint       `json:"sim_card_id"`
+	Code        string     `json:"-"` // Trailing digits of the calling SIM's number
+	CodeLength  int        `json:"code_length"`
+	Status      string     `json:"status" gorm:"default:pending;index"` // pending, verified, failed, expired
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"max_attempts"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	VerifiedAt  *time.Time `json:"verified_at"`
+	RequestedBy *uint      `json:"requested_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+
+	// Relations
+	CallLog *CallLog `json:"call_log,omitempty" gorm:"foreignKey:CallLogID"`
+}
@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// DeviceSettings are the app settings pushed to devices. Nil fields are not set
+// at that level and are inherited from the level below.
+type DeviceSettings struct {
+	HeartbeatInterval *int    `json:"heartbeat_interval,omitempty"` // seconds
+	StatusInterval    *int    `json:"status_interval,omitempty"`    // seconds between device_status reports
+	SendThrottle      *int    `json:"send_throttle,omitempty"`      // max SMS per minute, 0 = unlimited
+	EnabledSIMSlots   []int   `json:"enabled_sim_slots,omitempty"`
+	LogLevel          *string `json:"log_level,omitempty"`    // debug, info, warn, error
+	USSDTimeout       *int    `json:"ussd_timeout,omitempty"` // seconds
+}
+
+// DeviceGroupConfig holds the settings shared by all devices of a group
+type DeviceGroupConfig struct {
+	ID            uint           `json:"id" gorm:"primaryKey"`
+	DeviceGroupID uint           `json:"device_group_id" gorm:"uniqueIndex;not null"`
+	Settings      DeviceSettings `json:"settings" gorm:"type:text;serializer:json"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+
+	// Relations
+	DeviceGroup *DeviceGroup `json:"device_group,omitempty" gorm:"foreignKey:DeviceGroupID"`
+}
+
+// DeviceConfigState tracks per-device overrides plus the desired and reported configuration
+type DeviceConfigState struct {
+	ID              uint           `json:"id" gorm:"primaryKey"`
+	DeviceID        string         `json:"device_id" gorm:"uniqueIndex;not null"`
+	Overrides       DeviceSettings `json:"overrides" gorm:"type:text;serializer:json"`
+	Desired         DeviceSettings `json:"desired" gorm:"type:text;serializer:json"`
+	DesiredVersion  int            `json:"desired_version" gorm:"default:0"`
+	Reported        DeviceSettings `json:"reported" gorm:"type:text;serializer:json"`
+	ReportedVersion int            `json:"reported_version" gorm:"default:0"`
+	InSync          bool           `json:"in_sync" gorm:"default:false"`
+	PushedAt        *time.Time     `json:"pushed_at"`
+	ReportedAt      *time.Time     `json:"reported_at"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+}
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// DiagnosticRequest is a diagnostic command sent to a device and its outcome
+type DiagnosticRequest struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	DeviceID       string     `json:"device_id" gorm:"not null;index"`
+	Command        string     `json:"command" gorm:"not null"`       // logs, screenshot, ping, connectivity, reboot, restart_app
+	Params         string     `json:"params" gorm:"type:text"`       // JSON parameters sent with the command
+	Status         string     `json:"status" gorm:"default:pending"` // pending, sent, receiving, completed, failed, timeout
+	Result         string     `json:"result" gorm:"type:text"`       // JSON result reported by the device
+	ErrorMessage   string     `json:"error_message"`
+	LatencyMs      int64      `json:"latency_ms"` // Round-trip time from send to result
+	ChunksTotal    int        `json:"chunks_total"`
+	ChunksReceived int        `json:"chunks_received"`
+	RequestedBy    uint       `json:"requested_by"`
+	SentAt         *time.Time `json:"sent_at"`
+	CompletedAt    *time.Time `json:"completed_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+
+	// Relations
+	Device    *Device              `json:"device,omitempty" gorm:"foreignKey:DeviceID;references:DeviceID"`
+	Artifacts []DiagnosticArtifact `json:"artifacts,omitempty" gorm:"foreignKey:DiagnosticRequestID"`
+}
+
+// DiagnosticArtifact is a file uploaded by a device in answer to a diagnostic request
+type DiagnosticArtifact struct {
+	ID                  uint      `json:"id" gorm:"primaryKey"`
+	DiagnosticRequestID uint      `json:"diagnostic_request_id" gorm:"not null;index"`
+	DeviceID            string    `json:"device_id" gorm:"not null;index"`
+	Kind                string    `json:"kind"` // logs, screenshot
+	FileName            string    `json:"file_name"`
+	FilePath            string    `json:"-"`
+	ContentType         string    `json:"content_type"`
+	Size                int64     `json:"size"`
+	SHA256              string    `json:"sha256"`
+	CreatedAt           time.Time `json:"created_at"`
+
+	// Relations
+	Device *Device `json:"device,omitempty" gorm:"foreignKey:DeviceID;references:DeviceID"`
+}
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// Geofence defines the allowed area for devices of a site
+type Geofence struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	SiteID       uint      `json:"site_id" gorm:"uniqueIndex;not null"`
+	FenceType    string    `json:"fence_type" gorm:"not null;default:radius"` // "radius", "polygon"
+	RadiusMeters float64   `json:"radius_meters"`                             // Radius around Site.Latitude/Longitude
+	Polygon      string    `json:"polygon" gorm:"type:text"`                  // JSON array of [latitude, longitude] pairs
+	IsActive     bool      `json:"is_active" gorm:"default:true"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	// Relations
+	Site *Site `json:"site,omitempty" gorm:"foreignKey:SiteID"`
+}
+
+// DeviceFenceState holds the latest geofence evaluation of a device
+type DeviceFenceState struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	DeviceID       string     `json:"device_id" gorm:"uniqueIndex;not null"`
+	SiteID         uint       `json:"site_id"`
+	Inside         bool       `json:"inside"`
+	DistanceMeters float64    `json:"distance_meters"` // Distance from the site center
+	Latitude       float64    `json:"latitude"`
+	Longitude      float64    `json:"longitude"`
+	LastJumpKmh    float64    `json:"last_jump_kmh"` // Speed implied by the last position change
+	CheckedAt      time.Time  `json:"checked_at"`
+	ExitedAt       *time.Time `json:"exited_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Invitation lets someone register while registration requires an invitation
+type Invitation struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex;not null"` // SHA-256 of the invitation token
+	Email     string     `json:"email"`                         // Only this email can register with it, empty for any
+	RoleID    *uint      `json:"role_id"`                       // Role granted on registration, viewer when nil
+	TenantID  *uint      `json:"tenant_id" gorm:"index"`        // Tenant the new user joins
+	CreatedBy uint       `json:"created_by"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"index"`
+	UsedAt    *time.Time `json:"used_at"`
+	UsedByID  *uint      `json:"used_by_id"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	// Relations
+	Role   *Role   `json:"role,omitempty" gorm:"foreignKey:RoleID"`
+	Tenant *Tenant `json:"tenant,omitempty" gorm:"foreignKey:TenantID"`
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// UserMFA is a user's TOTP authenticator. It is pending until confirmed with a first code.
+type UserMFA struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"uniqueIndex;not null"`
+	Secret    string     `json:"-" gorm:"not null"` // Base32 TOTP secret
+	Enabled   bool       `json:"enabled" gorm:"default:false"`
+	EnabledAt *time.Time `json:"enabled_at"`
+	LastStep  int64      `json:"-"` // Time step of the last accepted code, older or equal steps are replays
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+
+	// Relations
+	User *User `json:"user,omitempty" gorm:"foreignKey:UserID"`
+}
+
+// MFARecoveryCode is a one-time code that replaces a TOTP code when the authenticator is lost
+type MFARecoveryCode struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	CodeHash  string     `json:"-" gorm:"uniqueIndex;not null"` // SHA-256 of the code
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// MFAChallenge is the short-lived second login step between the password and the code.
+// Enrollment challenges let a user who must use MFA set it up before the first session.
+type MFAChallenge struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	UserID     uint       `json:"user_id" gorm:"not null;index"`
+	TokenHash  string     `json:"-" gorm:"uniqueIndex;not null"` // SHA-256 of the challenge token
+	Enrollment bool       `json:"enrollment"`
+	Attempts   int        `json:"attempts" gorm:"default:0"`
+	IPAddress  string     `json:"ip_address"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"index"`
+	UsedAt     *time.Time `json:"used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// Conversation groups the messages exchanged between a device and a remote number
+type Conversation struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	DeviceID      string     `json:"device_id" gorm:"not null;uniqueIndex:idx_conversation_peer"`
+	PeerNumber    string     `json:"peer_number" gorm:"not null;uniqueIndex:idx_conversation_peer"`
+	LastMessageAt *time.Time `json:"last_message_at" gorm:"index"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	// Relations
+	Device *Device `json:"device,omitempty" gorm:"foreignKey:DeviceID;references:DeviceID"`
+}
+
+// MMSMessage represents a sent or received MMS
+type MMSMessage struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	ConversationID uint       `json:"conversation_id" gorm:"not null;index"`
+	DeviceID       string     `json:"device_id" gorm:"not null;index"`
+	Type           string     `json:"type"` // "incoming", "outgoing"
+	Target         string     `json:"target"`
+	From           string     `json:"from"`
+	Subject        string     `json:"subject"`
+	Text           string     `json:"text"`
+	SimSlot        int        `json:"sim_slot"`
+	SIMCardID      *uint      `json:"sim_card_id" gorm:"index"`
+	Status         string     `json:"status" gorm:"default:pending"` // "pending", "sent", "failed", "received"
+	ErrorMessage   string     `json:"error_message"`
+	TotalSize      int64      `json:"total_size"` // Bytes of all parts
+	SentBy         *uint      `json:"sent_by"`
+	Timestamp      int64      `json:"timestamp"`
+	SentAt         *time.Time `json:"sent_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+
+	// Relations
+	Parts        []MMSMedia    `json:"parts,omitempty" gorm:"foreignKey:MMSMessageID"`
+	Conversation *Conversation `json:"conversation,omitempty" gorm:"foreignKey:ConversationID"`
+	SentByUser   *User         `json:"sent_by_user,omitempty" gorm:"foreignKey:SentBy"`
+}
+
+// MMSMedia is one stored part of an MMS
+type MMSMedia struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	MMSMessageID   uint      `json:"mms_message_id" gorm:"not null;index"`
+	ConversationID uint      `json:"conversation_id" gorm:"not null;index"`
+	Seq            int       `json:"seq"` // Position within the message
+	ContentType    string    `json:"content_type"`
+	FileName       string    `json:"file_name"`
+	Size           int64     `json:"size"`
+	SHA256         string    `json:"sha256"`
+	Storage        string    `json:"storage"`           // local, s3
+	StorageKey     string    `json:"-" gorm:"not null"` // Object key within the store
+	CreatedAt      time.Time `json:"created_at"`
+}
@@ -10,6 +10,7 @@ import (
 // Site represents a physical location or SMS hub
 type Site struct {
 	ID          uint      `json:"id" gorm:"primaryKey"`
+	TenantID    *uint     `json:"tenant_id" gorm:"index"` // Owning organization
 	Name        string    `json:"name" gorm:"not null"`
 	Description string    `json:"description"`
 	Country     string    `json:"country" gorm:"not null"`    // TR, US, UK, etc.
@@ -25,6 +26,7 @@ type Site struct {
 	UpdatedAt   time.Time `json:"updated_at"`
 
 	// Relations
+	Tenant       *Tenant       `json:"tenant,omitempty" gorm:"foreignKey:TenantID"`
 	DeviceGroups []DeviceGroup `json:"device_groups" gorm:"foreignKey:SiteID"`
 }
 
@@ -62,6 +64,7 @@ type Device struct {
 	IsActive       bool           `json:"is_active" gorm:"default:true"`
 	IsAvailable    bool           `json:"is_available" gorm:"default:false"` // Available for SMS sending
 	LastSeen       time.Time      `json:"last_seen"`
+	OfflineSince   *time.Time     `json:"offline_since"`
 	IPAddress      string         `json:"ip_address"`
 	Location       string         `json:"location"`
 	Latitude       float64        `json:"latitude"`
@@ -73,12 +76,13 @@ type Device struct {
 	DeletedAt      gorm.DeletedAt `json:"-" gorm:"index"`
 
 	// Relations
-	DeviceGroup    *DeviceGroup   `json:"device_group" gorm:"foreignKey:DeviceGroupID"`
-	SIMCards       []SIMCard      `json:"sim_cards" gorm:"foreignKey:DeviceID;references:DeviceID"`
-	DeviceStatuses []DeviceStatus `json:"device_statuses" gorm:"foreignKey:DeviceID;references:DeviceID"`
-	SMSMessages    []SMSMessage   `json:"sms_messages" gorm:"foreignKey:DeviceID;references:DeviceID"`
-	USSDCommands   []USSDCommand  `json:"ussd_commands" gorm:"foreignKey:DeviceID;references:DeviceID"`
-	Alarms         []Alarm        `json:"alarms" gorm:"foreignKey:DeviceID;references:DeviceID"`
+	DeviceGroup    *DeviceGroup      `json:"device_group" gorm:"foreignKey:DeviceGroupID"`
+	SIMCards       []SIMCard         `json:"sim_cards" gorm:"foreignKey:DeviceID;references:DeviceID"`
+	DeviceStatuses []DeviceStatus    `json:"device_statuses" gorm:"foreignKey:DeviceID;references:DeviceID"`
+	SMSMessages    []SMSMessage      `json:"sms_messages" gorm:"foreignKey:DeviceID;references:DeviceID"`
+	USSDCommands   []USSDCommand     `json:"ussd_commands" gorm:"foreignKey:DeviceID;references:DeviceID"`
+	Alarms         []Alarm           `json:"alarms" gorm:"foreignKey:DeviceID;references:DeviceID"`
+	FenceState     *DeviceFenceState `json:"fence_state,omitempty" gorm:"foreignKey:DeviceID;references:DeviceID"`
 }
 
 // IsReadyForSMS checks if device is ready to send SMS
@@ -91,27 +95,58 @@ func (d *Device) IsReadyForSMS() bool {
 
 // SIMCard represents a SIM card
 type SIMCard struct {
-	ID             uint           `json:"id" gorm:"primaryKey"`
-	DeviceID       string         `json:"device_id" gorm:"not null"`
-	Identifier     string         `json:"identifier"`
-	IMSI           string         `json:"imsi"`
-	IMEI           string         `json:"imei"`
-	Operator       string         `json:"operator"`
-	PhoneNumber    string         `json:"phone_number"`
-	SignalStrength int            `json:"signal_strength"`
-	NetworkType    string         `json:"network_type"`
-	MCC            string         `json:"mcc"`
-	MNC            string         `json:"mnc"`
-	IsActive       bool           `json:"is_active"`
-	IsEnabled      bool           `json:"is_enabled" gorm:"default:true"`
-	CreatedAt      time.Time      `json:"created_at"`
-	UpdatedAt      time.Time      `json:"updated_at"`
-	DeletedAt      gorm.DeletedAt `json:"-" gorm:"index"`
+	ID               uint           `json:"id" gorm:"primaryKey"`
+	DeviceID         string         `json:"device_id" gorm:"not null"`
+	Identifier       string         `json:"identifier"` // SIM slot on the device
+	IMSI             string         `json:"imsi" gorm:"index"`
+	ICCID            string         `json:"iccid" gorm:"column:iccid;uniqueIndex:idx_sim_cards_iccid_unique,where:iccid <> ''"` // One record per card, removed ones included
+	IMEI             string         `json:"imei"`
+	Operator         string         `json:"operator"`
+	PhoneNumber      string         `json:"phone_number"`
+	NumberVerifiedAt *time.Time     `json:"number_verified_at"` // Set once the number was confirmed by discovery
+	NumberMethod     string         `json:"number_method"`      // How the number was obtained: device, ussd, sms_loopback
+	SignalStrength   int            `json:"signal_strength"`
+	NetworkType      string         `json:"network_type"`
+	MCC              string         `json:"mcc"`
+	MNC              string         `json:"mnc"`
+	IsActive         bool           `json:"is_active"`
+	IsEnabled        bool           `json:"is_enabled" gorm:"default:true"`
+	LastSeenAt       time.Time      `json:"last_seen_at"` // Last time the device reported this SIM
+	Balance          *float64       `json:"balance"`
+	BalanceCurrency  string         `json:"balance_currency"`
+	BalanceCheckedAt *time.Time     `json:"balance_checked_at"`
+	BalanceFailures  int            `json:"balance_failures" gorm:"default:0"`    // Consecutive failed balance checks
+	HealthScore      *int           `json:"health_score"`                         // 0-100 routing score, nil until first computed
+	HealthStatus     string         `json:"health_status" gorm:"default:unknown"` // unknown, healthy, degraded, unhealthy
+	HealthCheckedAt  *time.Time     `json:"health_checked_at"`
+	DailySMSLimit    int            `json:"daily_sms_limit" gorm:"default:0"`    // Outgoing SMS allowed per day, 0 is unlimited
+	IsQuarantined    bool           `json:"is_quarantined" gorm:"default:false"` // Taken out of routing after carrier block detection
+	CreatedAt        time.Time      `json:"created_at"`
+	UpdatedAt        time.Time      `json:"updated_at"`
+	DeletedAt        gorm.DeletedAt `json:"-" gorm:"index"` // Set while the SIM is removed from any device
 
 	// Relations
 	Device *Device `json:"device" gorm:"foreignKey:DeviceID;references:DeviceID"`
 }
 
+// SIMCardEvent records SIM insertions, removals and moves between devices
+type SIMCardEvent struct {
+	ID               uint      `json:"id" gorm:"primaryKey"`
+	SIMCardID        uint      `json:"sim_card_id" gorm:"index;not null"`
+	EventType        string    `json:"event_type"` // "inserted", "removed", "moved", "slot_changed"
+	DeviceID         string    `json:"device_id" gorm:"index"`
+	PreviousDeviceID string    `json:"previous_device_id"`
+	Slot             string    `json:"slot"`
+	PreviousSlot     string    `json:"previous_slot"`
+	IMSI             string    `json:"imsi"`
+	ICCID            string    `json:"iccid" gorm:"column:iccid"`
+	Operator         string    `json:"operator"`
+	CreatedAt        time.Time `json:"created_at"`
+
+	// Relations
+	SIMCard *SIMCard `json:"sim_card,omitempty" gorm:"foreignKey:SIMCardID"`
+}
+
 // DeviceStatus represents device status updates
 type DeviceStatus struct {
 	ID            uint      `json:"id" gorm:"primaryKey"`
@@ -136,6 +171,7 @@ type SMSMessage struct {
 	From           string     `json:"from"`
 	Message        string     `json:"message"`
 	SimSlot        int        `json:"sim_slot"`
+	SIMCardID      *uint      `json:"sim_card_id" gorm:"index"` // Sending SIM, when known
 	InternalLogID  int        `json:"internal_log_id"`
 	Status         string     `json:"status" gorm:"default:pending"` // "pending", "sent", "delivered", "failed"
 	DeliveryReport string     `json:"delivery_report"`
@@ -195,19 +231,22 @@ type Alarm struct {
 
 // User represents system users
 type User struct {
-	ID        uint           `json:"id" gorm:"primaryKey"`
-	Username  string         `json:"username" gorm:"uniqueIndex;not null"`
-	Email     string         `json:"email" gorm:"uniqueIndex;not null"`
-	Password  string         `json:"-" gorm:"not null"`
-	FirstName string         `json:"first_name"`
-	LastName  string         `json:"last_name"`
-	IsActive  bool           `json:"is_active" gorm:"default:true"`
-	LastLogin *time.Time     `json:"last_login"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+	ID           uint           `json:"id" gorm:"primaryKey"`
+	Username     string         `json:"username" gorm:"uniqueIndex;not null"`
+	Email        string         `json:"email" gorm:"uniqueIndex;not null"`
+	Password     string         `json:"-" gorm:"not null"`
+	FirstName    string         `json:"first_name"`
+	LastName     string         `json:"last_name"`
+	TenantID     *uint          `json:"tenant_id" gorm:"index"`              // Organization the user belongs to
+	IsSuperAdmin bool           `json:"is_super_admin" gorm:"default:false"` // Sees every tenant and may switch between them
+	IsActive     bool           `json:"is_active" gorm:"default:true"`
+	LastLogin    *time.Time     `json:"last_login"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+	DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
 
 	// Relations
+	Tenant    *Tenant    `json:"tenant,omitempty" gorm:"foreignKey:TenantID"`
 	UserRoles []UserRole `json:"user_roles" gorm:"foreignKey:UserID"`
 	Sessions  []Session  `json:"sessions" gorm:"foreignKey:UserID"`
 }
@@ -230,17 +269,21 @@ func (u *User) CheckPassword(password string) bool {
 
 // Session represents user sessions
 type Session struct {
-	ID               uint      `json:"id" gorm:"primaryKey"`
-	UserID           uint      `json:"user_id" gorm:"not null"`
-	AccessToken      string    `json:"access_token" gorm:"uniqueIndex;not null"`
-	RefreshToken     string    `json:"refresh_token" gorm:"uniqueIndex;not null"`
-	ExpiresAt        time.Time `json:"expires_at"`
-	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
-	IPAddress        string    `json:"ip_address"`
-	UserAgent        string    `json:"user_agent"`
-	IsActive         bool      `json:"is_active" gorm:"default:true"`
-	CreatedAt        time.Time `json:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at"`
+	ID               uint       `json:"id" gorm:"primaryKey"`
+	UserID           uint       `json:"user_id" gorm:"not null"`
+	AccessToken      string     `json:"access_token" gorm:"uniqueIndex;not null"`
+	RefreshToken     string     `json:"refresh_token" gorm:"uniqueIndex;not null"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	RefreshExpiresAt time.Time  `json:"refresh_expires_at"`
+	IPAddress        string     `json:"ip_address"`
+	UserAgent        string     `json:"user_agent"`
+	TenantID         *uint      `json:"tenant_id"`              // Tenant a super-admin switched to, nil for all
+	FamilyID         string     `json:"family_id" gorm:"index"` // Login the session descends from, shared by all its rotations
+	RotatedAt        *time.Time `json:"rotated_at"`             // Refresh token was exchanged, using it again revokes the family
+	ReplacedByID     *uint      `json:"replaced_by_id"`         // Session issued by the rotation
+	IsActive         bool       `json:"is_active" gorm:"default:true"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
 
 	// Relations
 	User *User `json:"user" gorm:"foreignKey:UserID"`
@@ -252,6 +295,7 @@ type Role struct {
 	Name        string         `json:"name" gorm:"uniqueIndex;not null"`
 	DisplayName string         `json:"display_name"`
 	Description string         `json:"description"`
+	MFARequired bool           `json:"mfa_required" gorm:"default:false"` // Users with the role must use two-factor authentication
 	IsActive    bool           `json:"is_active" gorm:"default:true"`
 	CreatedAt   time.Time      `json:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at"`
@@ -281,15 +325,19 @@ type Permission struct {
 
 // UserRole represents user-role relationships
 type UserRole struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	UserID    uint      `json:"user_id" gorm:"not null"`
-	RoleID    uint      `json:"role_id" gorm:"not null"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	UserID        uint      `json:"user_id" gorm:"not null"`
+	RoleID        uint      `json:"role_id" gorm:"not null"`
+	SiteID        *uint     `json:"site_id" gorm:"index"`         // limits the role to one site, nil for every site
+	DeviceGroupID *uint     `json:"device_group_id" gorm:"index"` // limits the role to one device group
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
 
 	// Relations
-	User *User `json:"user" gorm:"foreignKey:UserID"`
-	Role *Role `json:"role" gorm:"foreignKey:RoleID"`
+	User        *User        `json:"user" gorm:"foreignKey:UserID"`
+	Role        *Role        `json:"role" gorm:"foreignKey:RoleID"`
+	Site        *Site        `json:"site,omitempty" gorm:"foreignKey:SiteID"`
+	DeviceGroup *DeviceGroup `json:"device_group,omitempty" gorm:"foreignKey:DeviceGroupID"`
 
 	// Composite index
 	gorm.Model `gorm:"-"`
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// UserIdentity links a user to an account at an OpenID Connect identity provider
+type UserIdentity struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	UserID      uint       `json:"user_id" gorm:"not null;index"`
+	Provider    string     `json:"provider" gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"` // Name of the configured provider
+	Subject     string     `json:"subject" gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"`  // "sub" claim, stable at the provider
+	Email       string     `json:"email"`
+	Groups      string     `json:"groups"` // Comma-separated groups of the last login
+	LastLoginAt *time.Time `json:"last_login_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+
+	// Relations
+	User *User `json:"user,omitempty" gorm:"foreignKey:UserID"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// PasswordHistory is an earlier password of a user, kept so it is not used again
+type PasswordHistory struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"user_id" gorm:"index;not null"`
+	Hash      string    `json:"-" gorm:"not null"` // bcrypt hash of the password
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PasswordReset is a link sent by email to set a new password
+type PasswordReset struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"index;not null"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex;not null"` // SHA-256 of the reset token
+	IPAddress string     `json:"ip_address"`                    // Address the reset was requested from
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	// Relations
+	User *User `json:"user,omitempty" gorm:"foreignKey:UserID"`
+}
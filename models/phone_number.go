@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// OperatorNumberConfig describes how an operator reveals the phone number of a SIM
+type OperatorNumberConfig struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name" gorm:"not null"`
+	MCC       string    `json:"mcc" gorm:"index:idx_operator_number_network"`
+	MNC       string    `json:"mnc" gorm:"index:idx_operator_number_network"`
+	Operator  string    `json:"operator"`                 // Operator name reported by the SIM, used when MCC/MNC are empty
+	USSDCode  string    `json:"ussd_code"`                // e.g. *135#
+	Pattern   string    `json:"pattern" gorm:"type:text"` // Optional regex with a number group, any phone number otherwise
+	IsActive  bool      `json:"is_active" gorm:"default:true"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PhoneNumberDiscovery is one attempt to find out the phone number of a SIM card
+type PhoneNumberDiscovery struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	SIMCardID     uint       `json:"sim_card_id" gorm:"not null;index"`
+	DeviceID      string     `json:"device_id" gorm:"not null;index"`
+	SimSlot       int        `json:"sim_slot"`
+	Method        string     `json:"method"`                              // ussd, sms_loopback
+	Status        string     `json:"status" gorm:"default:pending;index"` // pending, completed, failed, timeout
+	USSDCode      string     `json:"ussd_code"`
+	PeerSIMCardID *uint      `json:"peer_sim_card_id"`            // SIM that receives the loop-back SMS
+	PeerDeviceID  string     `json:"peer_device_id" gorm:"index"` // Device of the peer SIM
+	Token         string     `json:"-" gorm:"index"`              // Code carried by the loop-back SMS
+	RawResponse   string     `json:"raw_response" gorm:"type:text"`
+	PhoneNumber   string     `json:"phone_number"`
+	ErrorMessage  string     `json:"error_message"`
+	Automatic     bool       `json:"automatic"` // Started for a newly inserted SIM rather than by a user
+	CompletedAt   *time.Time `json:"completed_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	// Relations
+	SIMCard *SIMCard `json:"sim_card,omitempty" gorm:"foreignKey:SIMCardID"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// SIMQuarantine records a SIM taken out of routing because its operator appears to block it
+type SIMQuarantine struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	SIMCardID     uint       `json:"sim_card_id" gorm:"not null;index"`
+	DeviceID      string     `json:"device_id" gorm:"not null;index"`
+	SimSlot       int        `json:"sim_slot"`
+	Reason        string     `json:"reason"` // consecutive_failures, error_code
+	Details       string     `json:"details"`
+	ErrorCode     string     `json:"error_code"`                         // Error that triggered the quarantine
+	Failures      int        `json:"failures"`                           // Consecutive failures at the time
+	Status        string     `json:"status" gorm:"default:active;index"` // active, released, expired
+	CooldownUntil *time.Time `json:"cooldown_until"`                     // Released automatically afterwards when enabled
+	ReleasedAt    *time.Time `json:"released_at"`
+	ReleasedBy    *uint      `json:"released_by"`
+	ReleaseNote   string     `json:"release_note"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	// Relations
+	SIMCard        *SIMCard `json:"sim_card,omitempty" gorm:"foreignKey:SIMCardID"`
+	ReleasedByUser *User    `json:"released_by_user,omitempty" gorm:"foreignKey:ReleasedBy"`
+}
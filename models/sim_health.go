@@ -0,0 +1,49 @@
+package models
+
+import "time"
+
+// SIMLoopbackTest is one test SMS sent between two of our own SIM cards
+type SIMLoopbackTest struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	SenderSIMCardID   uint       `json:"sender_sim_card_id" gorm:"not null;index"`
+	SenderDeviceID    string     `json:"sender_device_id" gorm:"not null"`
+	SenderSlot        int        `json:"sender_slot"`
+	ReceiverSIMCardID uint       `json:"receiver_sim_card_id" gorm:"not null;index"`
+	ReceiverDeviceID  string     `json:"receiver_device_id" gorm:"not null;index"`
+	ReceiverNumber    string     `json:"receiver_number"`
+	SMSMessageID      *uint      `json:"sms_message_id"`                      // Outgoing test message
+	Token             string     `json:"-" gorm:"index"`                      // Code carried by the test SMS
+	Status            string     `json:"status" gorm:"default:pending;index"` // pending, received, failed, timeout
+	LatencyMs         *int64     `json:"latency_ms"`                          // From sending the command to the receiver reporting the SMS
+	ErrorMessage      string     `json:"error_message"`
+	Scheduled         bool       `json:"scheduled"` // Started by the scheduler rather than a user
+	SentAt            time.Time  `json:"sent_at"`
+	CompletedAt       *time.Time `json:"completed_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+
+	// Relations
+	SenderSIMCard   *SIMCard `json:"sender_sim_card,omitempty" gorm:"foreignKey:SenderSIMCardID"`
+	ReceiverSIMCard *SIMCard `json:"receiver_sim_card,omitempty" gorm:"foreignKey:ReceiverSIMCardID"`
+}
+
+// SIMRoutingStats holds the running figures the routing score of a SIM is computed from.
+// Rates and averages are exponentially weighted so each event updates them in place.
+type SIMRoutingStats struct {
+	SIMCardID       uint       `json:"sim_card_id" gorm:"primaryKey;autoIncrement:false"`
+	Sent            int64      `json:"sent"`
+	SendFailures    int64      `json:"send_failures"`
+	Delivered       int64      `json:"delivered"`
+	Undelivered     int64      `json:"undelivered"`
+	SendSuccessRate *float64   `json:"send_success_rate"` // 0-1
+	DeliveryRate    *float64   `json:"delivery_rate"`     // 0-1
+	DLRLatencyMs    *float64   `json:"dlr_latency_ms"`    // From sending to the delivery report
+	SignalLevel     *float64   `json:"signal_level"`      // 0-1
+	LoopbackScore   *int       `json:"loopback_score"`    // 0-100 from loopback tests
+	ErrorPenalty    float64    `json:"error_penalty"`     // Points that decay over time
+	Failures        int        `json:"failures"`          // Failed sends and deliveries since the last delivery
+	LastErrorCode   string     `json:"last_error_code"`
+	LastErrorAt     *time.Time `json:"last_error_at"`
+	SentToday       int        `json:"sent_today"`
+	QuotaDay        string     `json:"quota_day"` // Day SentToday counts for, YYYY-MM-DD
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
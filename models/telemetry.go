@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// TelemetrySample is a single raw measurement reported by a device or one of its SIM cards
+type TelemetrySample struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	DeviceID   string    `json:"device_id" gorm:"not null;index:idx_telemetry_sample_series"`
+	SIMCardID  uint      `json:"sim_card_id" gorm:"default:0;index:idx_telemetry_sample_series"` // 0 for device-level metrics
+	Metric     string    `json:"metric" gorm:"not null;index:idx_telemetry_sample_series"`       // battery_level, latitude, longitude, signal_strength
+	Value      float64   `json:"value"`
+	Label      string    `json:"label"` // Categorical value such as the network type
+	RecordedAt time.Time `json:"recorded_at" gorm:"not null;index:idx_telemetry_sample_series;index"`
+}
+
+// TelemetryRollup aggregates samples of one series into a fixed time bucket
+type TelemetryRollup struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	DeviceID    string    `json:"device_id" gorm:"not null;uniqueIndex:idx_telemetry_rollup_bucket"`
+	SIMCardID   uint      `json:"sim_card_id" gorm:"default:0;uniqueIndex:idx_telemetry_rollup_bucket"`
+	Metric      string    `json:"metric" gorm:"not null;uniqueIndex:idx_telemetry_rollup_bucket"`
+	Resolution  string    `json:"resolution" gorm:"not null;uniqueIndex:idx_telemetry_rollup_bucket"` // "1m", "1h"
+	BucketStart time.Time `json:"bucket_start" gorm:"not null;uniqueIndex:idx_telemetry_rollup_bucket;index"`
+	SampleCount int64     `json:"sample_count"`
+	SumValue    float64   `json:"sum_value"`
+	MinValue    float64   `json:"min_value"`
+	MaxValue    float64   `json:"max_value"`
+	AvgValue    float64   `json:"avg_value"`
+	LastLabel   string    `json:"last_label"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
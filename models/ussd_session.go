@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// USSDSession is an interactive USSD menu dialog with a device
+type USSDSession struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	SessionID    string     `json:"session_id" gorm:"uniqueIndex;not null"`
+	DeviceID     string     `json:"device_id" gorm:"not null;index"`
+	SimSlot      int        `json:"sim_slot"`
+	USSDCode     string     `json:"ussd_code" gorm:"not null"`     // Code that opened the session, e.g. *123#
+	Status       string     `json:"status" gorm:"default:pending"` // pending, open, completed, cancelled, timeout, failed
+	LastResponse string     `json:"last_response" gorm:"type:text"`
+	ErrorMessage string     `json:"error_message"`
+	StartedBy    uint       `json:"started_by"`
+	ExpiresAt    time.Time  `json:"expires_at"` // Session times out when no step happens before this
+	ClosedAt     *time.Time `json:"closed_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+
+	// Relations
+	Device *Device           `json:"device,omitempty" gorm:"foreignKey:DeviceID;references:DeviceID"`
+	Steps  []USSDSessionStep `json:"steps,omitempty" gorm:"foreignKey:USSDSessionID"`
+}
+
+// USSDSessionStep is one input sent in a USSD session and the menu it produced
+type USSDSessionStep struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	USSDSessionID uint       `json:"ussd_session_id" gorm:"not null;uniqueIndex:idx_ussd_session_step"`
+	Sequence      int        `json:"sequence" gorm:"not null;uniqueIndex:idx_ussd_session_step"` // 1 for the initial code
+	Input         string     `json:"input"`
+	Response      string     `json:"response" gorm:"type:text"`
+	Status        string     `json:"status" gorm:"default:pending"` // pending, answered, failed
+	ErrorMessage  string     `json:"error_message"`
+	SentAt        time.Time  `json:"sent_at"`
+	RespondedAt   *time.Time `json:"responded_at"`
+}
+
+// IsActive checks if the session still accepts replies or responses
+func (s *USSDSession) IsActive() bool {
+	return s.Status == "pending" || s.Status == "open"
+}
@@ -0,0 +1,335 @@
+// Package mockidp is an OpenID Connect identity provider for development and tests. Anyone
+// can log in as one of its users; it issues RS256 ID tokens for the authorization code flow
+// with PKCE.
+package mockidp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// User is an account of the mock identity provider
+type User struct {
+	Subject       string
+	Username      string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+	Groups        []string
+}
+
+// DefaultUsers are the accounts of a new provider, one per role mapping in config.yaml
+var DefaultUsers = []User{
+	{Subject: "mock-alice", Username: "alice", Email: "alice@example.com", EmailVerified: true, GivenName: "Alice", FamilyName: "Admin", Groups: []string{"tsim-admins"}},
+	{Subject: "mock-oscar", Username: "oscar", Email: "oscar@example.com", EmailVerified: true, GivenName: "Oscar", FamilyName: "Operator", Groups: []string{"tsim-operators"}},
+	{Subject: "mock-victor", Username: "victor", Email: "victor@example.com", EmailVerified: true, GivenName: "Victor", FamilyName: "Viewer"},
+}
+
+// authCode is an issued authorization code waiting to be redeemed
+type authCode struct {
+	user        User
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	expiresAt   time.Time
+}
+
+// Server is the mock identity provider
+type Server struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+
+	mu      sync.Mutex
+	key     *rsa.PrivateKey
+	keyID   string
+	keySeq  int
+	users   []User
+	codes   map[string]authCode
+	nonceFn func(nonce string) string
+}
+
+// New creates a provider for an issuer URL that accepts one client. An empty client secret
+// makes it a public client.
+func New(issuer, clientID, clientSecret string) (*Server, error) {
+	s := &Server{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		users:        append([]User(nil), DefaultUsers...),
+		codes:        make(map[string]authCode),
+	}
+	if err := s.RotateKey(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Register adds the provider's endpoints to a router
+func (s *Server) Register(router fiber.Router) {
+	router.Get("/.well-known/openid-configuration", s.discovery)
+	router.Get("/jwks", s.jwks)
+	router.Get("/authorize", s.authorize)
+	router.Post("/token", s.token)
+}
+
+// Users returns the accounts of the provider
+func (s *Server) Users() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]User(nil), s.users...)
+}
+
+// AddUser adds an account, replacing one with the same username
+func (s *Server) AddUser(user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.users {
+		if s.users[i].Username == user.Username {
+			s.users[i] = user
+			return
+		}
+	}
+	s.users = append(s.users, user)
+}
+
+// RotateKey replaces the signing key with a new one under a new key ID. Tokens signed before
+// no longer verify against the JWKS document.
+func (s *Server) RotateKey() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keySeq++
+	s.key = key
+	s.keyID = fmt.Sprintf("mock-idp-%d", s.keySeq)
+	return nil
+}
+
+// KeyID returns the ID of the current signing key
+func (s *Server) KeyID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keyID
+}
+
+// SetNonce makes the provider put the nonce returned by fn in its ID tokens instead of the
+// requested one, to test clients that must reject them. Nil restores the requested nonce.
+func (s *Server) SetNonce(fn func(nonce string) string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonceFn = fn
+}
+
+// discovery serves the OpenID Connect discovery document
+func (s *Server) discovery(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"issuer":                                s.issuer,
+		"authorization_endpoint":                s.issuer + "/authorize",
+		"token_endpoint":                        s.issuer + "/token",
+		"jwks_uri":                              s.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+}
+
+// jwks serves the public signing key
+func (s *Server) jwks(c *fiber.Ctx) error {
+	s.mu.Lock()
+	key, keyID := s.key, s.keyID
+	s.mu.Unlock()
+
+	return c.JSON(fiber.Map{
+		"keys": []fiber.Map{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize logs in as the user named by login_hint, or shows a page to pick one
+func (s *Server) authorize(c *fiber.Ctx) error {
+	if c.Query("response_type") != "code" {
+		return c.Status(400).SendString("response_type must be code")
+	}
+	if c.Query("client_id") != s.clientID {
+		return c.Status(400).SendString("unknown client_id")
+	}
+	redirectURI := c.Query("redirect_uri")
+	if redirectURI == "" {
+		return c.Status(400).SendString("redirect_uri is required")
+	}
+	if c.Query("code_challenge") == "" || c.Query("code_challenge_method") != "S256" {
+		return c.Status(400).SendString("PKCE with code_challenge_method S256 is required")
+	}
+
+	users := s.Users()
+	hint := c.Query("login_hint")
+	if hint == "" {
+		var page strings.Builder
+		page.WriteString("<html><body><h1>Mock IdP</h1><p>Log in as:</p><ul>")
+		for _, user := range users {
+			params := url.Values{}
+			for key, value := range c.Queries() {
+				params.Set(key, value)
+			}
+			params.Set("login_hint", user.Username)
+			page.WriteString(fmt.Sprintf(`<li><a href="/authorize?%s">%s</a> %s</li>`,
+				html.EscapeString(params.Encode()), html.EscapeString(user.Username), html.EscapeString(strings.Join(user.Groups, ", "))))
+		}
+		page.WriteString("</ul></body></html>")
+		c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		return c.SendString(page.String())
+	}
+
+	var user *User
+	for i := range users {
+		if users[i].Username == hint || users[i].Email == hint {
+			user = &users[i]
+		}
+	}
+	if user == nil {
+		return c.Status(404).SendString("unknown user " + hint)
+	}
+
+	code, err := randomString()
+	if err != nil {
+		return c.Status(500).SendString("failed to create code")
+	}
+	s.mu.Lock()
+	s.codes[code] = authCode{
+		user:        *user,
+		clientID:    s.clientID,
+		redirectURI: redirectURI,
+		challenge:   c.Query("code_challenge"),
+		nonce:       c.Query("nonce"),
+		expiresAt:   time.Now().Add(time.Minute),
+	}
+	s.mu.Unlock()
+
+	params := url.Values{}
+	params.Set("code", code)
+	params.Set("state", c.Query("state"))
+	separator := "?"
+	if strings.Contains(redirectURI, "?") {
+		separator = "&"
+	}
+	return c.Redirect(redirectURI + separator + params.Encode())
+}
+
+// token redeems an authorization code for an ID token
+func (s *Server) token(c *fiber.Ctx) error {
+	if c.FormValue("grant_type") != "authorization_code" {
+		return tokenError(c, "unsupported_grant_type", "only authorization_code is supported")
+	}
+
+	clientID, clientSecret := c.FormValue("client_id"), c.FormValue("client_secret")
+	if header := c.Get(fiber.HeaderAuthorization); strings.HasPrefix(header, "Basic ") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+		if err != nil {
+			return tokenError(c, "invalid_client", "malformed basic authentication")
+		}
+		id, secret, _ := strings.Cut(string(decoded), ":")
+		clientID, _ = url.QueryUnescape(id)
+		clientSecret, _ = url.QueryUnescape(secret)
+	}
+	if clientID != s.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(s.clientSecret)) != 1 {
+		return tokenError(c, "invalid_client", "wrong client credentials")
+	}
+
+	s.mu.Lock()
+	code, ok := s.codes[c.FormValue("code")]
+	delete(s.codes, c.FormValue("code"))
+	key, keyID, nonceFn := s.key, s.keyID, s.nonceFn
+	s.mu.Unlock()
+	if !ok || time.Now().After(code.expiresAt) || code.clientID != clientID {
+		return tokenError(c, "invalid_grant", "unknown or expired code")
+	}
+	if code.redirectURI != c.FormValue("redirect_uri") {
+		return tokenError(c, "invalid_grant", "redirect_uri does not match")
+	}
+	challenge := sha256.Sum256([]byte(c.FormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge {
+		return tokenError(c, "invalid_grant", "code_verifier does not match")
+	}
+
+	nonce := code.nonce
+	if nonceFn != nil {
+		nonce = nonceFn(nonce)
+	}
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                s.issuer,
+		"sub":                code.user.Subject,
+		"aud":                clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              nonce,
+		"email":              code.user.Email,
+		"email_verified":     code.user.EmailVerified,
+		"preferred_username": code.user.Username,
+		"given_name":         code.user.GivenName,
+		"family_name":        code.user.FamilyName,
+		"groups":             code.user.Groups,
+	})
+	idToken.Header["kid"] = keyID
+	signed, err := idToken.SignedString(key)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "server_error"})
+	}
+
+	accessToken, err := randomString()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "server_error"})
+	}
+	return c.JSON(fiber.Map{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
+
+// tokenError returns an OAuth 2.0 error response
+func tokenError(c *fiber.Ctx, code, description string) error {
+	return c.Status(400).JSON(fiber.Map{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// randomString returns a random URL-safe string for codes and tokens
+func randomString() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,337 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"tsimserver/cache"
+	"tsimserver/config"
+	"tsimserver/models"
+)
+
+// stateKeyPrefix starts the Redis keys of logins waiting for the provider's callback
+const stateKeyPrefix = "tsimserver:oidc:state:"
+
+var (
+	// ErrUnknownProvider is returned for a provider name that is not configured
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	// ErrInvalidState is returned for a callback without a matching, unexpired login
+	ErrInvalidState = errors.New("invalid or expired login state")
+	// ErrProvider is returned when the identity provider cannot be reached or rejects a request
+	ErrProvider = errors.New("identity provider request failed")
+	// ErrInvalidIDToken is returned for an ID token that fails verification
+	ErrInvalidIDToken = errors.New("invalid ID token")
+)
+
+// ProviderInfo describes a configured provider to clients choosing how to log in
+type ProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	LoginURL    string `json:"login_url"`
+}
+
+// Claims are the identity claims of a verified ID token
+type Claims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string // preferred_username
+	GivenName     string
+	FamilyName    string
+	Groups        []string
+}
+
+// metadata is the part of the provider's discovery document the login flow needs
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// provider is a configured identity provider with its discovered endpoints and signing keys
+type provider struct {
+	cfg config.OIDCProviderConfig
+
+	mu        sync.Mutex
+	meta      *metadata
+	keys      map[string]interface{} // signing keys by key ID
+	keysAt    time.Time
+	refreshAt time.Time // last forced refresh for an unknown key ID
+}
+
+// loginState is stored in Redis between the redirect to the provider and its callback
+type loginState struct {
+	Provider string `json:"provider"`
+	Verifier string `json:"verifier"` // PKCE code verifier
+	Nonce    string `json:"nonce"`
+	Binding  string `json:"binding"` // SHA-256 of the value the browser that started the login keeps
+}
+
+var (
+	providersMu sync.Mutex
+	providers   = make(map[string]*provider)
+)
+
+// Providers lists the configured identity providers
+func Providers() []ProviderInfo {
+	infos := make([]ProviderInfo, 0, len(config.AppConfig.OIDC.Providers))
+	for _, cfg := range config.AppConfig.OIDC.Providers {
+		displayName := cfg.DisplayName
+		if displayName == "" {
+			displayName = cfg.Name
+		}
+		infos = append(infos, ProviderInfo{
+			Name:        cfg.Name,
+			DisplayName: displayName,
+			LoginURL:    "/api/v1/auth/oidc/" + cfg.Name + "/login",
+		})
+	}
+	return infos
+}
+
+// BeginLogin starts an authorization code login with PKCE and returns the provider URL
+// to send the user to, and a binding value for the browser to keep until the callback. A
+// callback only finishes the login with the same binding, so nobody can log a victim's
+// browser into their own account by sending it their callback URL.
+func BeginLogin(ctx context.Context, name string) (string, string, error) {
+	p, err := getProvider(name)
+	if err != nil {
+		return "", "", err
+	}
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	binding, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	data, err := json.Marshal(loginState{Provider: name, Verifier: verifier, Nonce: nonce, Binding: hashBinding(binding)})
+	if err != nil {
+		return "", "", err
+	}
+	ttl := time.Duration(config.AppConfig.OIDC.StateTTL) * time.Second
+	if err := cache.Set(stateKeyPrefix+state, data, ttl); err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.cfg.ClientID)
+	params.Set("redirect_uri", p.cfg.RedirectURL)
+	params.Set("scope", strings.Join(p.scopes(), " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return meta.AuthorizationEndpoint + separator + params.Encode(), binding, nil
+}
+
+// FinishLogin handles the provider's callback in the browser holding the login's binding:
+// it exchanges the code, verifies the ID token and returns the matching user, provisioning
+// it and syncing its roles from the groups
+func FinishLogin(ctx context.Context, name, code, state, binding string) (*models.User, error) {
+	p, err := getProvider(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// A state can only be used once
+	data, err := cache.RedisClient.GetDel(ctx, stateKeyPrefix+state).Result()
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+	var login loginState
+	if err := json.Unmarshal([]byte(data), &login); err != nil || login.Provider != name {
+		return nil, ErrInvalidState
+	}
+	if subtle.ConstantTimeCompare([]byte(login.Binding), []byte(hashBinding(binding))) != 1 {
+		return nil, ErrInvalidState
+	}
+
+	idToken, err := p.exchange(ctx, code, login.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.verify(ctx, idToken, login.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return provision(p, claims)
+}
+
+// getProvider returns a configured provider, keeping its discovered state between logins
+func getProvider(name string) (*provider, error) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if p, ok := providers[name]; ok {
+		return p, nil
+	}
+	for _, cfg := range config.AppConfig.OIDC.Providers {
+		if cfg.Name == name {
+			p := &provider{cfg: cfg}
+			providers[name] = p
+			return p, nil
+		}
+	}
+	return nil, ErrUnknownProvider
+}
+
+// scopes returns the requested scopes, always including openid
+func (p *provider) scopes() []string {
+	scopes := []string{"openid"}
+	for _, scope := range p.cfg.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// discover fetches the provider's discovery document once
+func (p *provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	var meta metadata
+	endpoint := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(ctx, endpoint, &meta); err != nil {
+		return nil, err
+	}
+	if meta.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("%w: discovery issuer %q does not match %q", ErrProvider, meta.Issuer, p.cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: incomplete discovery document", ErrProvider)
+	}
+
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// exchange redeems an authorization code and returns the ID token
+func (p *provider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.cfg.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("%w: token response: %v", ErrProvider, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("%w: token endpoint returned %d %s %s", ErrProvider, resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("%w: token response has no id_token", ErrProvider)
+	}
+	return body.IDToken, nil
+}
+
+// getJSON fetches and decodes a JSON document from the provider
+func getJSON(ctx context.Context, endpoint string, target interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %d", ErrProvider, endpoint, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrProvider, endpoint, err)
+	}
+	return nil
+}
+
+// httpClient returns the client for requests to providers
+func httpClient() *http.Client {
+	return &http.Client{Timeout: time.Duration(config.AppConfig.OIDC.HTTPTimeout) * time.Second}
+}
+
+// randomString returns n random bytes encoded for URLs
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashBinding returns the stored form of a login's browser binding
+func hashBinding(binding string) string {
+	sum := sha256.Sum256([]byte(binding))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,531 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+	"tsimserver/auth"
+	"tsimserver/cache"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/oidc/mockidp"
+	"tsimserver/testutil"
+
+	gormadapter "github.com/casbin/gorm-adapter/v3"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+const redirectURL = "http://localhost:8080/api/v1/auth/oidc/mock/callback"
+
+// testIdP is a mock identity provider serving on a local port, configured as provider "mock"
+type testIdP struct {
+	*mockidp.Server
+	cfg       *config.OIDCProviderConfig
+	jwksCalls atomic.Int32
+}
+
+// setup starts a mock identity provider with the database, Redis and Casbin the login flow
+// needs, and seeds the default tenant and the admin, operator, viewer and auditor roles
+func setup(t *testing.T) *testIdP {
+	t.Helper()
+
+	appConfig := testutil.LoadConfig(t)
+	testutil.OpenDatabase(t, &models.Tenant{}, &models.User{}, &models.Role{}, &models.Permission{},
+		&models.RolePermission{}, &models.Site{}, &models.DeviceGroup{}, &models.UserRole{},
+		&models.UserIdentity{}, &gormadapter.CasbinRule{})
+	testutil.StartRedis(t)
+
+	previousEnforcer := auth.Enforcer
+	if err := auth.InitEnforcer(testutil.RepoPath("casbin", "model.conf")); err != nil {
+		t.Fatalf("creating enforcer: %v", err)
+	}
+
+	idp := &testIdP{}
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/jwks" {
+			idp.jwksCalls.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	var err error
+	idp.Server, err = mockidp.New(server.URL, "tsimserver", "mock-secret")
+	if err != nil {
+		t.Fatalf("creating mock IdP: %v", err)
+	}
+	app := fiber.New()
+	idp.Register(app)
+	handler = adaptor.FiberApp(app)
+
+	appConfig.OIDC.Providers = []config.OIDCProviderConfig{{
+		Name:          "mock",
+		Issuer:        server.URL,
+		ClientID:      "tsimserver",
+		ClientSecret:  "mock-secret",
+		RedirectURL:   redirectURL,
+		Scopes:        []string{"openid", "profile", "email"},
+		GroupsClaim:   "groups",
+		AutoProvision: true,
+		Tenant:        "default",
+		DefaultRole:   "viewer",
+		RoleMappings: []config.OIDCRoleMapping{
+			{Group: "tsim-admins", Role: "admin"},
+			{Group: "tsim-operators", Role: "operator"},
+		},
+	}}
+	idp.cfg = &appConfig.OIDC.Providers[0]
+	resetProviders()
+
+	t.Cleanup(func() {
+		server.Close()
+		resetProviders()
+		auth.Enforcer = previousEnforcer
+	})
+
+	if err := database.DB.Create(&models.Tenant{Name: "Default", Slug: "default", IsActive: true}).Error; err != nil {
+		t.Fatalf("creating tenant: %v", err)
+	}
+	for _, name := range []string{"admin", "operator", "viewer", "auditor"} {
+		if err := database.DB.Create(&models.Role{Name: name, IsActive: true}).Error; err != nil {
+			t.Fatalf("creating role %s: %v", name, err)
+		}
+	}
+	return idp
+}
+
+// resetProviders drops the discovered providers so the next login reads the configuration
+func resetProviders() {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers = make(map[string]*provider)
+}
+
+// authorize starts a login and logs in at the provider as username, returning the code and
+// state of the callback and the binding the browser keeps
+func authorize(t *testing.T, username string) (code, state, binding string) {
+	t.Helper()
+
+	loginURL, binding, err := BeginLogin(context.Background(), "mock")
+	if err != nil {
+		t.Fatalf("BeginLogin: %v", err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(loginURL + "&login_hint=" + url.QueryEscape(username))
+	if err != nil {
+		t.Fatalf("authorize request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d, want a redirect", resp.StatusCode)
+	}
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parsing callback URL: %v", err)
+	}
+	return callback.Query().Get("code"), callback.Query().Get("state"), binding
+}
+
+// login runs the whole authorization code flow as username
+func login(t *testing.T, username string) (*models.User, error) {
+	t.Helper()
+	code, state, binding := authorize(t, username)
+	return FinishLogin(context.Background(), "mock", code, state, binding)
+}
+
+// roleNames returns the names of the roles assigned to a user in every site
+func roleNames(t *testing.T, userID uint) []string {
+	t.Helper()
+
+	var names []string
+	err := database.DB.Model(&models.UserRole{}).
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Where("user_roles.user_id = ? AND user_roles.site_id IS NULL AND user_roles.device_group_id IS NULL", userID).
+		Order("roles.name").
+		Pluck("roles.name", &names).Error
+	if err != nil {
+		t.Fatalf("loading roles: %v", err)
+	}
+	return names
+}
+
+// roleID returns the ID of a role
+func roleID(t *testing.T, name string) uint {
+	t.Helper()
+
+	var role models.Role
+	if err := database.DB.Where("name = ?", name).First(&role).Error; err != nil {
+		t.Fatalf("loading role %s: %v", name, err)
+	}
+	return role.ID
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLoginProvisionsUser(t *testing.T) {
+	setup(t)
+
+	user, err := login(t, "alice")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if user.Username != "alice" || user.Email != "alice@example.com" || user.FirstName != "Alice" {
+		t.Errorf("provisioned user = %+v", user)
+	}
+	if user.TenantID == nil {
+		t.Error("provisioned user has no tenant")
+	}
+
+	var identity models.UserIdentity
+	if err := database.DB.Where("provider = ? AND subject = ?", "mock", "mock-alice").First(&identity).Error; err != nil {
+		t.Fatalf("loading identity: %v", err)
+	}
+	if identity.UserID != user.ID || identity.Groups != "tsim-admins" || identity.LastLoginAt == nil {
+		t.Errorf("identity = %+v", identity)
+	}
+
+	// The next login finds the same user through the identity
+	again, err := login(t, "alice")
+	if err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+	if again.ID != user.ID {
+		t.Errorf("second login returned user %d, want %d", again.ID, user.ID)
+	}
+}
+
+func TestBeginLoginSendsPKCEChallenge(t *testing.T) {
+	setup(t)
+
+	loginURL, _, err := BeginLogin(context.Background(), "mock")
+	if err != nil {
+		t.Fatalf("BeginLogin: %v", err)
+	}
+	parsed, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatalf("parsing login URL: %v", err)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("redirect_uri") != redirectURL || query.Get("nonce") == "" {
+		t.Fatalf("login URL parameters = %v", query)
+	}
+
+	var stored loginState
+	data, err := cache.Get(stateKeyPrefix + query.Get("state"))
+	if err != nil {
+		t.Fatalf("loading login state: %v", err)
+	}
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		t.Fatalf("decoding login state: %v", err)
+	}
+	challenge := sha256.Sum256([]byte(stored.Verifier))
+	if query.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		t.Error("code_challenge is not the S256 hash of the stored verifier")
+	}
+	if stored.Nonce != query.Get("nonce") || stored.Provider != "mock" {
+		t.Errorf("stored login state = %+v", stored)
+	}
+}
+
+func TestFinishLoginRejectsWrongVerifier(t *testing.T) {
+	setup(t)
+
+	code, state, binding := authorize(t, "alice")
+	data, err := cache.Get(stateKeyPrefix + state)
+	if err != nil {
+		t.Fatalf("loading login state: %v", err)
+	}
+	var stored loginState
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		t.Fatalf("decoding login state: %v", err)
+	}
+	stored.Verifier = "not-the-verifier"
+	tampered, _ := json.Marshal(stored)
+	if err := cache.Set(stateKeyPrefix+state, tampered, time.Minute); err != nil {
+		t.Fatalf("storing login state: %v", err)
+	}
+
+	if _, err := FinishLogin(context.Background(), "mock", code, state, binding); !errors.Is(err, ErrProvider) {
+		t.Fatalf("FinishLogin with a wrong verifier = %v, want ErrProvider", err)
+	}
+}
+
+func TestFinishLoginRejectsInvalidState(t *testing.T) {
+	setup(t)
+
+	code, state, binding := authorize(t, "alice")
+	if _, err := FinishLogin(context.Background(), "mock", code, "unknown-state", binding); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("FinishLogin with an unknown state = %v, want ErrInvalidState", err)
+	}
+
+	if _, err := FinishLogin(context.Background(), "mock", code, state, binding); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	// A state is used once, even with a fresh code
+	code, _, _ = authorize(t, "alice")
+	if _, err := FinishLogin(context.Background(), "mock", code, state, binding); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("FinishLogin with a used state = %v, want ErrInvalidState", err)
+	}
+}
+
+func TestFinishLoginRejectsStateOfOtherProvider(t *testing.T) {
+	idp := setup(t)
+
+	other := *idp.cfg
+	other.Name = "other"
+	config.AppConfig.OIDC.Providers = append(config.AppConfig.OIDC.Providers, other)
+
+	code, state, binding := authorize(t, "alice")
+	if _, err := FinishLogin(context.Background(), "other", code, state, binding); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("FinishLogin at another provider = %v, want ErrInvalidState", err)
+	}
+	// The state was consumed by the failed attempt
+	if _, err := FinishLogin(context.Background(), "mock", code, state, binding); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("FinishLogin after the failed attempt = %v, want ErrInvalidState", err)
+	}
+}
+
+func TestFinishLoginRejectsOtherBrowser(t *testing.T) {
+	setup(t)
+
+	// Someone else's callback URL opened in a browser without their binding
+	code, state, binding := authorize(t, "alice")
+	for _, other := range []string{"", "not-the-binding"} {
+		if _, err := FinishLogin(context.Background(), "mock", code, state, other); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("FinishLogin with binding %q = %v, want ErrInvalidState", other, err)
+		}
+	}
+	// The failed attempt consumed the state, the browser that started the login starts over
+	if _, err := FinishLogin(context.Background(), "mock", code, state, binding); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("FinishLogin after the failed attempt = %v, want ErrInvalidState", err)
+	}
+	if _, err := login(t, "alice"); err != nil {
+		t.Errorf("login: %v", err)
+	}
+}
+
+func TestFinishLoginRejectsWrongNonce(t *testing.T) {
+	idp := setup(t)
+	idp.SetNonce(func(string) string { return "replayed-nonce" })
+
+	if _, err := login(t, "alice"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("login with a wrong nonce = %v, want ErrInvalidIDToken", err)
+	}
+	var count int64
+	database.DB.Model(&models.User{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d users provisioned from a rejected token", count)
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	idp := setup(t)
+
+	if _, err := login(t, "alice"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if idp.jwksCalls.Load() != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", idp.jwksCalls.Load())
+	}
+
+	// A token signed with a new key makes the keys be fetched again
+	if err := idp.RotateKey(); err != nil {
+		t.Fatalf("rotating key: %v", err)
+	}
+	if _, err := login(t, "alice"); err != nil {
+		t.Fatalf("login after rotation: %v", err)
+	}
+	if idp.jwksCalls.Load() != 2 {
+		t.Fatalf("JWKS fetched %d times after rotation, want 2", idp.jwksCalls.Load())
+	}
+
+	// Unknown key IDs refetch the keys at most once per keyRefreshInterval
+	if err := idp.RotateKey(); err != nil {
+		t.Fatalf("rotating key: %v", err)
+	}
+	if _, err := login(t, "alice"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("login after a second rotation = %v, want ErrInvalidIDToken", err)
+	}
+	if idp.jwksCalls.Load() != 2 {
+		t.Fatalf("JWKS fetched %d times within the refresh interval, want 2", idp.jwksCalls.Load())
+	}
+
+	p, err := getProvider("mock")
+	if err != nil {
+		t.Fatalf("getProvider: %v", err)
+	}
+	p.mu.Lock()
+	p.refreshAt = time.Now().Add(-keyRefreshInterval - time.Second)
+	p.mu.Unlock()
+	if _, err := login(t, "alice"); err != nil {
+		t.Fatalf("login after the refresh interval: %v", err)
+	}
+	if idp.jwksCalls.Load() != 3 {
+		t.Errorf("JWKS fetched %d times after the refresh interval, want 3", idp.jwksCalls.Load())
+	}
+}
+
+func TestLinkUserByEmail(t *testing.T) {
+	tests := []struct {
+		name          string
+		linkByEmail   bool
+		emailVerified bool
+		wantErr       error
+	}{
+		{name: "linking off", linkByEmail: false, emailVerified: true, wantErr: ErrEmailInUse},
+		{name: "unverified email", linkByEmail: true, emailVerified: false, wantErr: ErrEmailInUse},
+		{name: "verified email", linkByEmail: true, emailVerified: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := setup(t)
+			idp.cfg.LinkByEmail = tt.linkByEmail
+			idp.AddUser(mockidp.User{Subject: "mock-erin", Username: "erin", Email: "Erin@Example.com", EmailVerified: tt.emailVerified})
+
+			existing := models.User{Username: "erin.local", Email: "erin@example.com", IsActive: true}
+			if err := database.DB.Create(&existing).Error; err != nil {
+				t.Fatalf("creating user: %v", err)
+			}
+
+			user, err := login(t, "erin")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("login = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				var count int64
+				database.DB.Model(&models.UserIdentity{}).Count(&count)
+				if count != 0 {
+					t.Errorf("%d identities linked after a refused login", count)
+				}
+				return
+			}
+			if user.ID != existing.ID {
+				t.Errorf("login returned user %d, want the existing user %d", user.ID, existing.ID)
+			}
+		})
+	}
+}
+
+func TestLinkUserWithoutProvisioning(t *testing.T) {
+	idp := setup(t)
+	idp.cfg.AutoProvision = false
+
+	if _, err := login(t, "alice"); !errors.Is(err, ErrNotProvisioned) {
+		t.Fatalf("login = %v, want ErrNotProvisioned", err)
+	}
+
+	idp.AddUser(mockidp.User{Subject: "mock-nomail", Username: "nomail", EmailVerified: true})
+	idp.cfg.AutoProvision = true
+	resetProviders()
+	if _, err := login(t, "nomail"); !errors.Is(err, ErrMissingEmail) {
+		t.Fatalf("login without email = %v, want ErrMissingEmail", err)
+	}
+}
+
+func TestProvisionPicksFreeUsername(t *testing.T) {
+	setup(t)
+
+	taken := models.User{Username: "alice", Email: "other-alice@example.com", IsActive: true}
+	if err := database.DB.Create(&taken).Error; err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+
+	user, err := login(t, "alice")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if user.Username != "alice-2" {
+		t.Errorf("username = %q, want alice-2", user.Username)
+	}
+}
+
+func TestSyncRoles(t *testing.T) {
+	idp := setup(t)
+
+	user, err := login(t, "alice")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if got := roleNames(t, user.ID); !equalStrings(got, []string{"admin"}) {
+		t.Fatalf("roles after login = %v, want [admin]", got)
+	}
+
+	// Roles outside the mappings and site-limited assignments are left alone
+	site := models.Site{Name: "Lab"}
+	if err := database.DB.Create(&site).Error; err != nil {
+		t.Fatalf("creating site: %v", err)
+	}
+	err = database.DB.Create([]models.UserRole{
+		{UserID: user.ID, RoleID: roleID(t, "auditor")},
+		{UserID: user.ID, RoleID: roleID(t, "operator"), SiteID: &site.ID},
+	}).Error
+	if err != nil {
+		t.Fatalf("assigning roles: %v", err)
+	}
+
+	idp.AddUser(mockidp.User{Subject: "mock-alice", Username: "alice", Email: "alice@example.com", EmailVerified: true,
+		Groups: []string{"tsim-operators", "unmapped"}})
+	if _, err := login(t, "alice"); err != nil {
+		t.Fatalf("login with new groups: %v", err)
+	}
+	if got := roleNames(t, user.ID); !equalStrings(got, []string{"auditor", "operator"}) {
+		t.Errorf("roles after group change = %v, want [auditor operator]", got)
+	}
+	var siteRoles int64
+	database.DB.Model(&models.UserRole{}).Where("user_id = ? AND site_id = ?", user.ID, site.ID).Count(&siteRoles)
+	if siteRoles != 1 {
+		t.Errorf("%d site-limited assignments, want 1", siteRoles)
+	}
+
+	// No mapped group gives the default role
+	idp.AddUser(mockidp.User{Subject: "mock-alice", Username: "alice", Email: "alice@example.com", EmailVerified: true})
+	if _, err := login(t, "alice"); err != nil {
+		t.Fatalf("login without groups: %v", err)
+	}
+	if got := roleNames(t, user.ID); !equalStrings(got, []string{"auditor", "viewer"}) {
+		t.Errorf("roles without groups = %v, want [auditor viewer]", got)
+	}
+
+	// The policies follow the assignments
+	policies, err := auth.Enforcer.GetFilteredGroupingPolicy(0, "user:"+itoa(user.ID))
+	if err != nil {
+		t.Fatalf("loading policies: %v", err)
+	}
+	var granted []string
+	for _, policy := range policies {
+		granted = append(granted, policy[1]+"@"+policy[2])
+	}
+	sort.Strings(granted)
+	want := []string{"auditor@*", "operator@site:" + itoa(site.ID), "viewer@*"}
+	if !equalStrings(granted, want) {
+		t.Errorf("grouping policies = %v, want %v", granted, want)
+	}
+}
+
+func itoa(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
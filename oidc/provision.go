@@ -0,0 +1,207 @@
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"tsimserver/auth"
+	"tsimserver/database"
+	"tsimserver/models"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrNotProvisioned is returned for an identity without a user when provisioning is off
+	ErrNotProvisioned = errors.New("no user is linked to this identity")
+	// ErrInactiveUser is returned for an identity linked to a deactivated user
+	ErrInactiveUser = errors.New("account is deactivated")
+	// ErrEmailInUse is returned when provisioning a user whose email belongs to an unlinked user
+	ErrEmailInUse = errors.New("email belongs to an existing user that is not linked to this identity")
+	// ErrMissingEmail is returned when provisioning a user whose ID token has no email
+	ErrMissingEmail = errors.New("identity provider returned no email")
+)
+
+// unsafeUsernameChars are replaced in usernames taken from claims
+var unsafeUsernameChars = regexp.MustCompile(`[^a-z0-9._@-]`)
+
+// provision returns the user linked to an identity, linking or creating one as the provider
+// allows, and syncs its roles from the identity's groups
+func provision(p *provider, claims *Claims) (*models.User, error) {
+	var user models.User
+	var identity models.UserIdentity
+	err := database.DB.Where("provider = ? AND subject = ?", p.cfg.Name, claims.Subject).First(&identity).Error
+	switch {
+	case err == nil:
+		if err := database.DB.Where("id = ?", identity.UserID).First(&user).Error; err != nil {
+			return nil, ErrNotProvisioned
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		linked, err := linkUser(p, claims)
+		if err != nil {
+			return nil, err
+		}
+		user = *linked
+		identity = models.UserIdentity{UserID: user.ID, Provider: p.cfg.Name, Subject: claims.Subject}
+	default:
+		return nil, err
+	}
+
+	if !user.IsActive {
+		return nil, ErrInactiveUser
+	}
+
+	now := time.Now()
+	identity.Email = claims.Email
+	identity.Groups = strings.Join(claims.Groups, ",")
+	identity.LastLoginAt = &now
+	if err := database.DB.Save(&identity).Error; err != nil {
+		return nil, err
+	}
+
+	if err := syncRoles(p, user.ID, claims.Groups); err != nil {
+		return nil, fmt.Errorf("syncing roles: %w", err)
+	}
+	return &user, nil
+}
+
+// linkUser finds the existing user of a new identity by verified email, or creates one
+func linkUser(p *provider, claims *Claims) (*models.User, error) {
+	var user models.User
+	if claims.Email != "" {
+		if err := database.DB.Where("LOWER(email) = ?", claims.Email).First(&user).Error; err == nil {
+			if p.cfg.LinkByEmail && claims.EmailVerified {
+				return &user, nil
+			}
+			return nil, ErrEmailInUse
+		}
+	}
+
+	if !p.cfg.AutoProvision {
+		return nil, ErrNotProvisioned
+	}
+	if claims.Email == "" {
+		return nil, ErrMissingEmail
+	}
+
+	user = models.User{
+		Username:  uniqueUsername(claims),
+		Email:     claims.Email,
+		FirstName: claims.GivenName,
+		LastName:  claims.FamilyName,
+		IsActive:  true,
+		// No password: the user logs in through the provider
+	}
+	if p.cfg.Tenant != "" {
+		var tenant models.Tenant
+		if err := database.DB.Where("slug = ?", p.cfg.Tenant).First(&tenant).Error; err != nil {
+			return nil, fmt.Errorf("tenant %q of identity provider %s: %w", p.cfg.Tenant, p.cfg.Name, err)
+		}
+		user.TenantID = &tenant.ID
+	}
+	if err := database.DB.Create(&user).Error; err != nil {
+		return nil, err
+	}
+
+	log.Printf("Provisioned user %s from identity provider %s", user.Username, p.cfg.Name)
+	return &user, nil
+}
+
+// uniqueUsername derives a free username from the preferred username or email
+func uniqueUsername(claims *Claims) string {
+	base := claims.Username
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = unsafeUsernameChars.ReplaceAllString(strings.ToLower(base), "-")
+	if base == "" {
+		base = "user"
+	}
+
+	username := base
+	for i := 2; ; i++ {
+		var count int64
+		database.DB.Unscoped().Model(&models.User{}).Where("username = ?", username).Count(&count)
+		if count == 0 {
+			return username
+		}
+		username = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// syncRoles assigns the roles mapped from a user's groups, or the default role when no group
+// is mapped, and removes the other roles the provider manages. Roles outside the provider's
+// mappings, and role assignments limited to a site or device group, are left alone.
+func syncRoles(p *provider, userID uint, groups []string) error {
+	managed := make(map[string]bool)
+	wanted := make(map[string]bool)
+	for _, mapping := range p.cfg.RoleMappings {
+		managed[mapping.Role] = true
+		for _, group := range groups {
+			if group == mapping.Group {
+				wanted[mapping.Role] = true
+			}
+		}
+	}
+	if p.cfg.DefaultRole != "" {
+		managed[p.cfg.DefaultRole] = true
+		if len(wanted) == 0 {
+			wanted[p.cfg.DefaultRole] = true
+		}
+	}
+	if len(managed) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(managed))
+	for name := range managed {
+		names = append(names, name)
+	}
+	var roles []models.Role
+	if err := database.DB.Where("name IN ?", names).Find(&roles).Error; err != nil {
+		return err
+	}
+	if len(roles) < len(names) {
+		log.Printf("Identity provider %s maps groups to roles that do not exist", p.cfg.Name)
+	}
+
+	var current []models.UserRole
+	if err := database.DB.Where("user_id = ? AND site_id IS NULL AND device_group_id IS NULL", userID).Find(&current).Error; err != nil {
+		return err
+	}
+	assigned := make(map[uint]bool)
+	for _, userRole := range current {
+		assigned[userRole.RoleID] = true
+	}
+
+	var add, remove []uint
+	for _, role := range roles {
+		switch {
+		case wanted[role.Name] && !assigned[role.ID]:
+			add = append(add, role.ID)
+		case !wanted[role.Name] && assigned[role.ID]:
+			remove = append(remove, role.ID)
+		}
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	return auth.UpdatePolicies(func(tx *gorm.DB) error {
+		if len(remove) > 0 {
+			if err := tx.Where("user_id = ? AND role_id IN ? AND site_id IS NULL AND device_group_id IS NULL", userID, remove).
+				Delete(&models.UserRole{}).Error; err != nil {
+				return err
+			}
+		}
+		for _, roleID := range add {
+			if err := tx.Create(&models.UserRole{UserID: userID, RoleID: roleID}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
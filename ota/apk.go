@@ -0,0 +1,231 @@
+package ota
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// APK Signature Scheme block IDs
+const (
+	signatureSchemeV2 = 0x7109871a
+	signatureSchemeV3 = 0xf05368c0
+)
+
+const (
+	eocdMagic      = 0x06054b50
+	eocdMinSize    = 22
+	maxCommentSize = 0xffff
+)
+
+var apkSigBlockMagic = []byte("APK Sig Block 42")
+
+// signatureAlgorithms maps APK signature algorithm IDs to x509 algorithms
+var signatureAlgorithms = map[uint32]x509.SignatureAlgorithm{
+	0x0101: x509.SHA256WithRSAPSS,
+	0x0102: x509.SHA512WithRSAPSS,
+	0x0103: x509.SHA256WithRSA,
+	0x0104: x509.SHA512WithRSA,
+	0x0201: x509.ECDSAWithSHA256,
+	0x0202: x509.ECDSAWithSHA512,
+	0x0301: x509.DSAWithSHA256,
+}
+
+// SigningCertificate extracts the signing certificate of an APK from its v2/v3
+// signature block and verifies the signer's signature over the signed data.
+// The content digests themselves are verified by Android at install time.
+func SigningCertificate(r io.ReaderAt, size int64) (*x509.Certificate, error) {
+	block, err := signingBlock(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// The block is a sequence of uint64-length-prefixed (uint32 ID, value) pairs
+	pairs := block
+	var scheme []byte
+	var schemeID uint32
+	for len(pairs) >= 8 {
+		length := binary.LittleEndian.Uint64(pairs)
+		if length < 4 || length > uint64(len(pairs)-8) {
+			return nil, errors.New("malformed APK signing block")
+		}
+		pair := pairs[8 : 8+length]
+		id := binary.LittleEndian.Uint32(pair)
+		if id == signatureSchemeV3 || (id == signatureSchemeV2 && scheme == nil) {
+			scheme = pair[4:]
+			schemeID = id
+		}
+		pairs = pairs[8+length:]
+	}
+	if scheme == nil {
+		return nil, errors.New("APK is not signed with signature scheme v2 or v3")
+	}
+
+	signers, err := lengthPrefixed(scheme)
+	if err != nil {
+		return nil, err
+	}
+	signer, _, err := nextLengthPrefixed(signers)
+	if err != nil {
+		return nil, err
+	}
+
+	signedData, rest, err := nextLengthPrefixed(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	// v3 signers carry min/max SDK versions between the signed data and signatures
+	if schemeID == signatureSchemeV3 {
+		if len(rest) < 8 {
+			return nil, errors.New("malformed APK signature block")
+		}
+		rest = rest[8:]
+	}
+	signatures, _, err := nextLengthPrefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	_, afterDigests, err := nextLengthPrefixed(signedData)
+	if err != nil {
+		return nil, err
+	}
+	certificates, _, err := nextLengthPrefixed(afterDigests)
+	if err != nil {
+		return nil, err
+	}
+	certDER, _, err := nextLengthPrefixed(certificates)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing certificate: %v", err)
+	}
+
+	if err := verifySignedData(cert, signedData, signatures); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// CertificateFingerprint returns the hex SHA-256 of a certificate
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifySignedData checks the first supported signature over the signed data
+func verifySignedData(cert *x509.Certificate, signedData, signatures []byte) error {
+	for len(signatures) > 0 {
+		entry, rest, err := nextLengthPrefixed(signatures)
+		if err != nil {
+			return err
+		}
+		signatures = rest
+
+		if len(entry) < 4 {
+			return errors.New("malformed APK signature")
+		}
+		algorithm, ok := signatureAlgorithms[binary.LittleEndian.Uint32(entry)]
+		if !ok {
+			continue
+		}
+		signature, _, err := nextLengthPrefixed(entry[4:])
+		if err != nil {
+			return err
+		}
+
+		if err := cert.CheckSignature(algorithm, signedData, signature); err != nil {
+			return fmt.Errorf("APK signature verification failed: %v", err)
+		}
+		return nil
+	}
+	return errors.New("APK has no signature with a supported algorithm")
+}
+
+// signingBlock locates the APK Signing Block that precedes the ZIP central directory
+func signingBlock(r io.ReaderAt, size int64) ([]byte, error) {
+	if size < eocdMinSize {
+		return nil, errors.New("file is too small to be an APK")
+	}
+
+	// The end of central directory record sits at the end, followed by an optional comment
+	tailSize := int64(eocdMinSize + maxCommentSize)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := r.ReadAt(tail, size-tailSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	eocd := -1
+	for i := len(tail) - eocdMinSize; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == eocdMagic {
+			eocd = i
+			break
+		}
+	}
+	if eocd < 0 {
+		return nil, errors.New("file is not a ZIP archive")
+	}
+
+	cdOffset := int64(binary.LittleEndian.Uint32(tail[eocd+16:]))
+	if cdOffset < 32 || cdOffset > size {
+		return nil, errors.New("APK is not signed with signature scheme v2 or v3")
+	}
+
+	// Footer: uint64 block size followed by the 16 byte magic
+	footer := make([]byte, 24)
+	if _, err := r.ReadAt(footer, cdOffset-24); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[8:], apkSigBlockMagic) {
+		return nil, errors.New("APK is not signed with signature scheme v2 or v3")
+	}
+
+	blockSize := int64(binary.LittleEndian.Uint64(footer))
+	if blockSize < 24 || blockSize+8 > cdOffset {
+		return nil, errors.New("malformed APK signing block")
+	}
+
+	// The pairs sit between the leading size field and the footer
+	pairs := make([]byte, blockSize-24)
+	if _, err := r.ReadAt(pairs, cdOffset-blockSize); err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+// lengthPrefixed returns the contents of a uint32-length-prefixed field that must fill data
+func lengthPrefixed(data []byte) ([]byte, error) {
+	value, rest, err := nextLengthPrefixed(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("malformed APK signature block")
+	}
+	return value, nil
+}
+
+// nextLengthPrefixed splits the next uint32-length-prefixed field off data
+func nextLengthPrefixed(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("malformed APK signature block")
+	}
+	length := binary.LittleEndian.Uint32(data)
+	if uint64(length) > uint64(len(data)-4) {
+		return nil, nil, errors.New("malformed APK signature block")
+	}
+	return data[4 : 4+length], data[4+length:], nil
+}
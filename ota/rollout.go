@@ -0,0 +1,568 @@
+package ota
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/dispatch"
+	"tsimserver/models"
+	"tsimserver/types"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Rollout states
+const (
+	RolloutPending     = "pending"
+	RolloutRunning     = "running"
+	RolloutPaused      = "paused"
+	RolloutHalted      = "halted"
+	RolloutCompleted   = "completed"
+	RolloutRollingBack = "rolling_back"
+	RolloutRolledBack  = "rolled_back"
+)
+
+// Update task states
+const (
+	TaskPending     = "pending"
+	TaskSent        = "sent"
+	TaskDownloading = "downloading"
+	TaskInstalling  = "installing"
+	TaskInstalled   = "installed"
+	TaskFailed      = "failed"
+	TaskSkipped     = "skipped" // the device did not come online in time to get the update
+)
+
+// openTaskStates are the states of tasks that have not finished yet
+var openTaskStates = []string{TaskPending, TaskSent, TaskDownloading, TaskInstalling}
+
+// activeRolloutStates are the states that keep a device group busy
+var activeRolloutStates = []string{RolloutPending, RolloutRunning, RolloutPaused, RolloutHalted, RolloutRollingBack}
+
+// ErrInvalidState is returned when a rollout cannot make the requested transition
+var ErrInvalidState = errors.New("rollout is not in a state that allows this action")
+
+// TaskSummary counts the update tasks of a rollout
+type TaskSummary struct {
+	Total     int64   `json:"total"`
+	Open      int64   `json:"open"`
+	Installed int64   `json:"installed"`
+	Failed    int64   `json:"failed"`
+	Skipped   int64   `json:"skipped"`
+	ErrorRate float64 `json:"error_rate"` // Failed share of installed and failed tasks
+}
+
+// ValidateSteps checks that steps are increasing percentages ending at 100
+func ValidateSteps(steps []int) error {
+	if len(steps) == 0 {
+		return errors.New("steps cannot be empty")
+	}
+	previous := 0
+	for _, step := range steps {
+		if step <= previous || step > 100 {
+			return errors.New("steps must be increasing percentages between 1 and 100")
+		}
+		previous = step
+	}
+	if previous != 100 {
+		return errors.New("the last step must be 100")
+	}
+	return nil
+}
+
+// Create validates and stores a new pending rollout
+func Create(rollout *models.AppRollout) error {
+	if err := ValidateSteps(rollout.Steps); err != nil {
+		return err
+	}
+	if rollout.MaxErrorRate < 0 || rollout.MaxErrorRate > 1 {
+		return errors.New("max_error_rate must be between 0 and 1")
+	}
+	if rollout.StepInterval < 0 || rollout.MinSampleSize < 0 {
+		return errors.New("step_interval and min_sample_size cannot be negative")
+	}
+
+	var release models.AppRelease
+	if err := database.DB.Where("id = ?", rollout.AppReleaseID).First(&release).Error; err != nil {
+		return errors.New("app release not found")
+	}
+	if rollout.PreviousReleaseID != nil {
+		var previous models.AppRelease
+		if err := database.DB.Where("id = ?", *rollout.PreviousReleaseID).First(&previous).Error; err != nil {
+			return errors.New("previous app release not found")
+		}
+	}
+
+	var group models.DeviceGroup
+	if err := database.DB.Where("id = ?", rollout.DeviceGroupID).First(&group).Error; err != nil {
+		return errors.New("device group not found")
+	}
+
+	var active int64
+	database.DB.Model(&models.AppRollout{}).
+		Where("device_group_id = ? AND status IN ?", rollout.DeviceGroupID, activeRolloutStates).
+		Count(&active)
+	if active > 0 {
+		return errors.New("device group already has an active rollout")
+	}
+
+	rollout.Status = RolloutPending
+	rollout.CurrentStep = 0
+	return database.DB.Omit(clause.Associations).Create(rollout).Error
+}
+
+// Start begins the first step of a pending rollout
+func Start(rolloutID uint) (*models.AppRollout, error) {
+	rollout, err := load(rolloutID)
+	if err != nil {
+		return nil, err
+	}
+	if rollout.Status != RolloutPending {
+		return nil, ErrInvalidState
+	}
+
+	now := time.Now()
+	rollout.Status = RolloutRunning
+	rollout.CurrentStep = 0
+	rollout.StartedAt = &now
+	rollout.StepStartedAt = &now
+	if err := save(rollout).Error; err != nil {
+		return nil, err
+	}
+
+	if err := assignStep(rollout, now); err != nil {
+		return nil, err
+	}
+	sendPending(rollout)
+	return rollout, nil
+}
+
+// Pause stops a running rollout from sending new updates
+func Pause(rolloutID uint) (*models.AppRollout, error) {
+	rollout, err := load(rolloutID)
+	if err != nil {
+		return nil, err
+	}
+	if rollout.Status != RolloutRunning {
+		return nil, ErrInvalidState
+	}
+
+	rollout.Status = RolloutPaused
+	return rollout, save(rollout).Error
+}
+
+// Resume continues a paused or halted rollout. Updates finished before resuming from a
+// halt no longer count towards the error rate, so the rollout is judged on what follows.
+func Resume(rolloutID uint) (*models.AppRollout, error) {
+	rollout, err := load(rolloutID)
+	if err != nil {
+		return nil, err
+	}
+	if rollout.Status != RolloutPaused && rollout.Status != RolloutHalted {
+		return nil, ErrInvalidState
+	}
+
+	if rollout.Status == RolloutHalted {
+		summary, err := Summarize(rollout.ID, false)
+		if err != nil {
+			return nil, err
+		}
+		rollout.BaselineInstalled = summary.Installed
+		rollout.BaselineFailed = summary.Failed
+	}
+	rollout.Status = RolloutRunning
+	rollout.HaltReason = ""
+	if err := save(rollout).Error; err != nil {
+		return nil, err
+	}
+
+	// Pending updates get a full task_timeout again to reach their devices
+	if err := database.DB.Model(&models.AppUpdateTask{}).
+		Where("app_rollout_id = ? AND status = ?", rollout.ID, TaskPending).
+		Update("updated_at", time.Now()).Error; err != nil {
+		return nil, err
+	}
+
+	sendPending(rollout)
+	return rollout, nil
+}
+
+// Rollback cancels unfinished updates and reinstalls the previous release on updated devices
+func Rollback(rolloutID uint) (*models.AppRollout, error) {
+	rollout, err := load(rolloutID)
+	if err != nil {
+		return nil, err
+	}
+	switch rollout.Status {
+	case RolloutRunning, RolloutPaused, RolloutHalted, RolloutCompleted:
+	default:
+		return nil, ErrInvalidState
+	}
+	if rollout.PreviousReleaseID == nil {
+		return nil, errors.New("rollout has no previous release to roll back to")
+	}
+
+	now := time.Now()
+	if err := database.DB.Model(&models.AppUpdateTask{}).
+		Where("app_rollout_id = ? AND is_rollback = ? AND status IN ?", rollout.ID, false, openTaskStates).
+		Updates(map[string]interface{}{
+			"status":        TaskFailed,
+			"error_message": "cancelled by rollback",
+			"completed_at":  now,
+		}).Error; err != nil {
+		return nil, err
+	}
+
+	var updated []models.AppUpdateTask
+	if err := database.DB.Where("app_rollout_id = ? AND is_rollback = ? AND status = ?", rollout.ID, false, TaskInstalled).
+		Find(&updated).Error; err != nil {
+		return nil, err
+	}
+
+	rollbackTasks := make([]models.AppUpdateTask, 0, len(updated))
+	for _, task := range updated {
+		rollbackTasks = append(rollbackTasks, models.AppUpdateTask{
+			AppRolloutID: rollout.ID,
+			DeviceID:     task.DeviceID,
+			IsRollback:   true,
+			AppReleaseID: *rollout.PreviousReleaseID,
+			Step:         rollout.CurrentStep,
+			Status:       TaskPending,
+			FromVersion:  rollout.AppRelease.VersionName,
+		})
+	}
+	if len(rollbackTasks) > 0 {
+		if err := database.DB.Create(&rollbackTasks).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	rollout.Status = RolloutRollingBack
+	if err := save(rollout).Error; err != nil {
+		return nil, err
+	}
+
+	sendPending(rollout)
+	return rollout, nil
+}
+
+// Summarize counts the forward or rollback tasks of a rollout
+func Summarize(rolloutID uint, rollback bool) (TaskSummary, error) {
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	err := database.DB.Model(&models.AppUpdateTask{}).
+		Select("status, COUNT(*) AS count").
+		Where("app_rollout_id = ? AND is_rollback = ?", rolloutID, rollback).
+		Group("status").Scan(&rows).Error
+	if err != nil {
+		return TaskSummary{}, err
+	}
+
+	var summary TaskSummary
+	for _, row := range rows {
+		summary.Total += row.Count
+		switch row.Status {
+		case TaskInstalled:
+			summary.Installed += row.Count
+		case TaskFailed:
+			summary.Failed += row.Count
+		case TaskSkipped:
+			summary.Skipped += row.Count
+		default:
+			summary.Open += row.Count
+		}
+	}
+	if finished := summary.Installed + summary.Failed; finished > 0 {
+		summary.ErrorRate = float64(summary.Failed) / float64(finished)
+	}
+	return summary, nil
+}
+
+// StartEngine starts the background job that advances rollouts
+func StartEngine() {
+	interval := time.Duration(config.AppConfig.OTA.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			Process(now)
+		}
+	}()
+
+	log.Printf("OTA rollout engine started (interval %s)", interval)
+}
+
+// Process runs one engine pass over all running and rolling back rollouts
+func Process(now time.Time) {
+	var rollouts []models.AppRollout
+	if err := database.DB.Preload("AppRelease").
+		Where("status IN ?", []string{RolloutRunning, RolloutRollingBack}).
+		Find(&rollouts).Error; err != nil {
+		log.Printf("Failed to load rollouts: %v", err)
+		return
+	}
+
+	for i := range rollouts {
+		if err := processRollout(&rollouts[i], now); err != nil {
+			log.Printf("Failed to process rollout %d: %v", rollouts[i].ID, err)
+		}
+	}
+}
+
+// processRollout expires stale tasks, resends pending ones and decides whether to halt or advance
+func processRollout(rollout *models.AppRollout, now time.Time) error {
+	if err := expireTasks(rollout, now); err != nil {
+		return err
+	}
+	sendPending(rollout)
+
+	if rollout.Status == RolloutRollingBack {
+		summary, err := Summarize(rollout.ID, true)
+		if err != nil {
+			return err
+		}
+		if summary.Open > 0 {
+			return nil
+		}
+		rollout.Status = RolloutRolledBack
+		rollout.CompletedAt = &now
+		return save(rollout).Error
+	}
+
+	summary, err := Summarize(rollout.ID, false)
+	if err != nil {
+		return err
+	}
+
+	// Only updates finished since the last resume from a halt count
+	failed := summary.Failed - rollout.BaselineFailed
+	finished := summary.Installed + summary.Failed - rollout.BaselineInstalled - rollout.BaselineFailed
+	if finished > 0 && finished >= int64(rollout.MinSampleSize) && float64(failed)/float64(finished) > rollout.MaxErrorRate {
+		rollout.Status = RolloutHalted
+		rollout.HaltReason = fmt.Sprintf("error rate %.0f%% exceeded %.0f%% (%d of %d updates failed)",
+			float64(failed)/float64(finished)*100, rollout.MaxErrorRate*100, failed, finished)
+		log.Printf("Rollout %d halted: %s", rollout.ID, rollout.HaltReason)
+		return save(rollout).Error
+	}
+
+	// Wait for the current step to finish and soak before widening
+	if summary.Open > 0 {
+		return nil
+	}
+	if rollout.StepStartedAt != nil && now.Sub(*rollout.StepStartedAt) < time.Duration(rollout.StepInterval)*time.Second {
+		return nil
+	}
+
+	if rollout.CurrentStep+1 >= len(rollout.Steps) {
+		rollout.Status = RolloutCompleted
+		rollout.CompletedAt = &now
+		return save(rollout).Error
+	}
+
+	rollout.CurrentStep++
+	rollout.StepStartedAt = &now
+	if err := save(rollout).Error; err != nil {
+		return err
+	}
+
+	if err := assignStep(rollout, now); err != nil {
+		return err
+	}
+	sendPending(rollout)
+	return nil
+}
+
+// assignStep creates tasks until the current step's share of the group is covered
+func assignStep(rollout *models.AppRollout, now time.Time) error {
+	var total int64
+	if err := database.DB.Model(&models.Device{}).
+		Where("device_group_id = ? AND is_active = ?", rollout.DeviceGroupID, true).
+		Count(&total).Error; err != nil {
+		return err
+	}
+
+	percent := int64(rollout.Steps[rollout.CurrentStep])
+	target := (total*percent + 99) / 100
+
+	var assigned int64
+	database.DB.Model(&models.AppUpdateTask{}).
+		Where("app_rollout_id = ? AND is_rollback = ?", rollout.ID, false).
+		Count(&assigned)
+	if target <= assigned {
+		return nil
+	}
+
+	var devices []models.Device
+	if err := database.DB.
+		Where("device_group_id = ? AND is_active = ?", rollout.DeviceGroupID, true).
+		Where("device_id NOT IN (?)", database.DB.Model(&models.AppUpdateTask{}).
+			Select("device_id").Where("app_rollout_id = ? AND is_rollback = ?", rollout.ID, false)).
+		Order("device_id").Limit(int(target - assigned)).
+		Find(&devices).Error; err != nil {
+		return err
+	}
+
+	tasks := make([]models.AppUpdateTask, 0, len(devices))
+	for _, device := range devices {
+		task := models.AppUpdateTask{
+			AppRolloutID: rollout.ID,
+			DeviceID:     device.DeviceID,
+			AppReleaseID: rollout.AppReleaseID,
+			Step:         rollout.CurrentStep,
+			Status:       TaskPending,
+			FromVersion:  device.AppVersion,
+		}
+		// Devices already on the release count as updated
+		if device.AppVersion == rollout.AppRelease.VersionName {
+			task.Status = TaskInstalled
+			task.Progress = 100
+			task.CompletedAt = &now
+		}
+		tasks = append(tasks, task)
+	}
+
+	if len(tasks) == 0 {
+		return nil
+	}
+	return database.DB.Create(&tasks).Error
+}
+
+// sendPending sends update_app commands for pending tasks of online devices
+func sendPending(rollout *models.AppRollout) {
+	var tasks []models.AppUpdateTask
+	if err := database.DB.Preload("AppRelease").
+		Joins("JOIN devices ON devices.device_id = app_update_tasks.device_id AND devices.deleted_at IS NULL").
+		Where("app_update_tasks.app_rollout_id = ? AND app_update_tasks.status = ?", rollout.ID, TaskPending).
+		Where("devices.operator_status = ?", "online").
+		Find(&tasks).Error; err != nil {
+		log.Printf("Failed to load pending update tasks for rollout %d: %v", rollout.ID, err)
+		return
+	}
+
+	for i := range tasks {
+		task := &tasks[i]
+		command := types.UpdateAppCommand{
+			Type:              "update_app",
+			TaskID:            task.ID,
+			VersionName:       task.AppRelease.VersionName,
+			VersionCode:       task.AppRelease.VersionCode,
+			DownloadURL:       DownloadURL(&task.AppRelease),
+			FileSize:          task.AppRelease.FileSize,
+			SHA256:            task.AppRelease.SHA256,
+			SigningCertSHA256: task.AppRelease.SigningCertSHA256,
+			AllowDowngrade:    task.IsRollback,
+		}
+
+		if err := dispatch.ToDevice(task.DeviceID, command); err != nil {
+			log.Printf("Failed to send update to device %s: %v", task.DeviceID, err)
+			continue
+		}
+
+		now := time.Now()
+		database.DB.Model(task).Updates(map[string]interface{}{
+			"status":  TaskSent,
+			"sent_at": now,
+		})
+	}
+}
+
+// expireTasks fails updates that stopped reporting progress and skips updates whose device
+// stayed offline, so neither keeps a step open forever
+func expireTasks(rollout *models.AppRollout, now time.Time) error {
+	timeout := time.Duration(config.AppConfig.OTA.TaskTimeout) * time.Second
+	if timeout <= 0 {
+		return nil
+	}
+
+	if err := database.DB.Model(&models.AppUpdateTask{}).
+		Where("app_rollout_id = ? AND status = ? AND updated_at < ?", rollout.ID, TaskPending, now.Add(-timeout)).
+		Updates(map[string]interface{}{
+			"status":        TaskSkipped,
+			"error_message": "device did not come online",
+			"completed_at":  now,
+		}).Error; err != nil {
+		return err
+	}
+
+	return database.DB.Model(&models.AppUpdateTask{}).
+		Where("app_rollout_id = ? AND status IN ? AND updated_at < ?",
+			rollout.ID, []string{TaskSent, TaskDownloading, TaskInstalling}, now.Add(-timeout)).
+		Updates(map[string]interface{}{
+			"status":        TaskFailed,
+			"error_message": "timed out waiting for progress",
+			"completed_at":  now,
+		}).Error
+}
+
+// ApplyProgress records an update_progress report from a device
+func ApplyProgress(deviceID string, report types.UpdateProgress) error {
+	var task models.AppUpdateTask
+	if err := database.DB.Preload("AppRelease").
+		Where("id = ? AND device_id = ?", report.TaskID, deviceID).
+		First(&task).Error; err != nil {
+		return fmt.Errorf("update task %d not found for device %s", report.TaskID, deviceID)
+	}
+
+	// Late reports for cancelled or timed out tasks are ignored
+	if task.IsFinished() {
+		return nil
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{}
+
+	switch report.Status {
+	case TaskDownloading, TaskInstalling:
+		updates["status"] = report.Status
+		updates["progress"] = report.Progress
+	case TaskInstalled:
+		if report.VersionCode != 0 && report.VersionCode != task.AppRelease.VersionCode {
+			updates["status"] = TaskFailed
+			updates["error_message"] = fmt.Sprintf("device reports version code %d, expected %d",
+				report.VersionCode, task.AppRelease.VersionCode)
+			updates["completed_at"] = now
+			break
+		}
+		updates["status"] = TaskInstalled
+		updates["progress"] = 100
+		updates["completed_at"] = now
+
+		if err := database.DB.Model(&models.Device{}).Where("device_id = ?", deviceID).
+			Update("app_version", task.AppRelease.VersionName).Error; err != nil {
+			return err
+		}
+	case TaskFailed:
+		updates["status"] = TaskFailed
+		updates["error_message"] = report.ErrorMessage
+		updates["completed_at"] = now
+	default:
+		return fmt.Errorf("unknown update status %q", report.Status)
+	}
+
+	return database.DB.Model(&task).Updates(updates).Error
+}
+
+// save persists rollout fields without touching the preloaded release
+func save(rollout *models.AppRollout) *gorm.DB {
+	return database.DB.Omit(clause.Associations).Save(rollout)
+}
+
+// load returns a rollout with its release
+func load(rolloutID uint) (*models.AppRollout, error) {
+	var rollout models.AppRollout
+	if err := database.DB.Preload("AppRelease").Where("id = ?", rolloutID).First(&rollout).Error; err != nil {
+		return nil, err
+	}
+	return &rollout, nil
+}
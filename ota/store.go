@@ -0,0 +1,112 @@
+package ota
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+)
+
+// ErrUntrustedSigner is returned when an APK is not signed with the configured certificate
+var ErrUntrustedSigner = errors.New("APK is not signed with the trusted signing certificate")
+
+// SaveRelease stores an uploaded APK, verifies its checksum and signature and creates the release.
+// expectedSHA256 is optional; when set the upload must match it.
+func SaveRelease(file *multipart.FileHeader, release *models.AppRelease, expectedSHA256 string) error {
+	cfg := config.AppConfig.OTA
+	if maxSize := int64(cfg.MaxUploadMB) * 1024 * 1024; maxSize > 0 && file.Size > maxSize {
+		return fmt.Errorf("APK exceeds the %d MB upload limit", cfg.MaxUploadMB)
+	}
+
+	if err := os.MkdirAll(cfg.StoragePath, 0755); err != nil {
+		return err
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(cfg.StoragePath, "upload-*.apk")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	keep := false
+	defer func() {
+		tmp.Close()
+		if !keep {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), src)
+	if err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+
+	if expectedSHA256 != "" && !strings.EqualFold(expectedSHA256, checksum) {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", expectedSHA256, checksum)
+	}
+
+	cert, err := SigningCertificate(tmp, size)
+	if err != nil {
+		return err
+	}
+	fingerprint := CertificateFingerprint(cert)
+	if cfg.SigningCertSHA256 != "" && !strings.EqualFold(cfg.SigningCertSHA256, fingerprint) {
+		return ErrUntrustedSigner
+	}
+
+	finalPath := filepath.Join(cfg.StoragePath, fmt.Sprintf("%d-%s.apk", release.VersionCode, checksum[:12]))
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return err
+	}
+
+	release.FileName = filepath.Base(file.Filename)
+	release.FilePath = finalPath
+	release.FileSize = size
+	release.SHA256 = checksum
+	release.SigningCertSHA256 = fingerprint
+
+	if err := database.DB.Create(release).Error; err != nil {
+		os.Remove(finalPath)
+		return err
+	}
+
+	keep = true
+	return nil
+}
+
+// DownloadToken returns the token devices present to download a release
+func DownloadToken(releaseID uint) string {
+	mac := hmac.New(sha256.New, []byte(config.AppConfig.JWT.Secret))
+	fmt.Fprintf(mac, "app_release:%d", releaseID)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyDownloadToken checks a download token for a release
+func VerifyDownloadToken(releaseID uint, token string) bool {
+	return hmac.Equal([]byte(DownloadToken(releaseID)), []byte(token))
+}
+
+// DownloadURL returns the URL a device downloads a release from
+func DownloadURL(release *models.AppRelease) string {
+	base := strings.TrimRight(config.AppConfig.OTA.PublicURL, "/")
+	return fmt.Sprintf("%s/api/v1/ota/releases/%d/download?token=%s", base, release.ID, DownloadToken(release.ID))
+}
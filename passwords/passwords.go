@@ -0,0 +1,77 @@
+package passwords
+
+import (
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Change sets a new password of an existing user after checking it against the policy
+// and the user's earlier passwords. Sessions are left to the caller.
+func Change(user *models.User, password string) error {
+	if err := Check(password); err != nil {
+		return err
+	}
+	if Reused(user.ID, password) {
+		return ErrReused
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Update("password", string(hash)).Error; err != nil {
+			return err
+		}
+		return Remember(tx, user.ID, string(hash))
+	})
+	if err != nil {
+		return err
+	}
+	user.Password = string(hash)
+	return nil
+}
+
+// Reused reports whether a password is the current password of a user or one of their
+// last password.history_size passwords
+func Reused(userID uint, password string) bool {
+	size := config.AppConfig.Password.HistorySize
+	if size <= 0 {
+		return false
+	}
+
+	var current models.User
+	if err := database.DB.Select("id", "password").Where("id = ?", userID).First(&current).Error; err == nil &&
+		current.Password != "" && current.CheckPassword(password) {
+		return true
+	}
+
+	var history []models.PasswordHistory
+	database.DB.Where("user_id = ?", userID).Order("id DESC").Limit(size).Find(&history)
+	for _, earlier := range history {
+		if bcrypt.CompareHashAndPassword([]byte(earlier.Hash), []byte(password)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Remember adds the hash of a new password to the user's history and forgets passwords
+// beyond password.history_size
+func Remember(tx *gorm.DB, userID uint, hash string) error {
+	size := config.AppConfig.Password.HistorySize
+	if size <= 0 {
+		return nil
+	}
+
+	if err := tx.Create(&models.PasswordHistory{UserID: userID, Hash: hash}).Error; err != nil {
+		return err
+	}
+	return tx.Where("user_id = ? AND id NOT IN (?)", userID,
+		tx.Model(&models.PasswordHistory{}).Select("id").Where("user_id = ?", userID).Order("id DESC").Limit(size)).
+		Delete(&models.PasswordHistory{}).Error
+}
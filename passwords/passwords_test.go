@@ -0,0 +1,99 @@
+package passwords
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/testutil"
+)
+
+// setupUsers loads the configuration without the breach list and creates the tables the
+// password functions use
+func setupUsers(t *testing.T) *config.Config {
+	t.Helper()
+
+	cfg := testutil.LoadConfig(t)
+	cfg.Password.BreachList = ""
+	testutil.OpenDatabase(t, &models.Tenant{}, &models.User{}, &models.Session{},
+		&models.PasswordHistory{}, &models.PasswordReset{})
+	return cfg
+}
+
+// createUser creates an active user with a password
+func createUser(t *testing.T, username, password string) *models.User {
+	t.Helper()
+
+	user := &models.User{Username: username, Email: username + "@example.com", Password: password, IsActive: true}
+	if err := user.HashPassword(); err != nil {
+		t.Fatalf("hashing password: %v", err)
+	}
+	if err := database.DB.Create(user).Error; err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	return user
+}
+
+func TestChangeRejectsReusedPasswords(t *testing.T) {
+	cfg := setupUsers(t)
+	cfg.Password.HistorySize = 2
+	user := createUser(t, "alice", "Initial-Pass-1")
+
+	if err := Change(user, "Initial-Pass-1"); !errors.Is(err, ErrReused) {
+		t.Fatalf("changing to the current password = %v, want ErrReused", err)
+	}
+	for i := 2; i <= 4; i++ {
+		if err := Change(user, fmt.Sprintf("Changed-Pass-%d", i)); err != nil {
+			t.Fatalf("changing password %d: %v", i, err)
+		}
+	}
+
+	// The current password and the last two in the history are refused, older ones not
+	for _, password := range []string{"Changed-Pass-4", "Changed-Pass-3"} {
+		if err := Change(user, password); !errors.Is(err, ErrReused) {
+			t.Errorf("changing to %s = %v, want ErrReused", password, err)
+		}
+	}
+	if Reused(user.ID, "Changed-Pass-2") {
+		t.Error("a password beyond the history is refused")
+	}
+
+	var kept int64
+	database.DB.Model(&models.PasswordHistory{}).Where("user_id = ?", user.ID).Count(&kept)
+	if kept != 2 {
+		t.Errorf("%d passwords kept in the history, want 2", kept)
+	}
+
+	var stored models.User
+	database.DB.First(&stored, user.ID)
+	if !stored.CheckPassword("Changed-Pass-4") {
+		t.Error("stored password is not the last one set")
+	}
+}
+
+func TestChangeChecksPolicy(t *testing.T) {
+	setupUsers(t)
+	user := createUser(t, "alice", "Initial-Pass-1")
+
+	var policyErr *PolicyError
+	if err := Change(user, "short"); !errors.As(err, &policyErr) {
+		t.Fatalf("changing to a short password = %v, want a *PolicyError", err)
+	}
+	var history int64
+	database.DB.Model(&models.PasswordHistory{}).Count(&history)
+	if history != 0 {
+		t.Errorf("%d history entries after a refused change", history)
+	}
+}
+
+func TestReusedWithoutHistory(t *testing.T) {
+	cfg := setupUsers(t)
+	cfg.Password.HistorySize = 0
+	user := createUser(t, "alice", "Initial-Pass-1")
+
+	if Reused(user.ID, "Initial-Pass-1") {
+		t.Error("password reuse is refused with history_size 0")
+	}
+}
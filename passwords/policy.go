@@ -0,0 +1,165 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"tsimserver/config"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrReused is returned for a password the user had before
+var ErrReused = errors.New("password was used before")
+
+// PolicyError lists the rules a password breaks
+type PolicyError struct {
+	Violations []string
+}
+
+// Error implements error
+func (e *PolicyError) Error() string {
+	return "password " + strings.Join(e.Violations, ", ")
+}
+
+// Policy describes the password rules, for clients to show before a password is sent
+type Policy struct {
+	MinLength     int  `json:"min_length"`
+	MaxLength     int  `json:"max_length"`
+	RequireUpper  bool `json:"require_upper"`
+	RequireLower  bool `json:"require_lower"`
+	RequireDigit  bool `json:"require_digit"`
+	RequireSymbol bool `json:"require_symbol"`
+	BreachCheck   bool `json:"breach_check"`
+	HistorySize   int  `json:"history_size"`
+}
+
+// breached holds the breach list, passwords lowercased and SHA-1 hashes in upper case hex
+var breached = struct {
+	plain  map[string]struct{}
+	hashes map[string]struct{}
+}{}
+
+// Init loads the breach list configured under password.breach_list. Lines are passwords
+// or SHA-1 hashes of passwords, optionally followed by ":count"; empty lines and lines
+// starting with # are skipped.
+func Init() error {
+	path := config.AppConfig.Password.BreachList
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open password breach list: %v", err)
+	}
+	defer file.Close()
+
+	plain := make(map[string]struct{})
+	hashes := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1(hash) {
+			hashes[strings.ToUpper(hash)] = struct{}{}
+			continue
+		}
+		plain[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read password breach list: %v", err)
+	}
+
+	breached.plain = plain
+	breached.hashes = hashes
+	return nil
+}
+
+// CurrentPolicy returns the configured password rules
+func CurrentPolicy() Policy {
+	cfg := config.AppConfig.Password
+	return Policy{
+		MinLength:     cfg.MinLength,
+		MaxLength:     cfg.MaxLength,
+		RequireUpper:  cfg.RequireUpper,
+		RequireLower:  cfg.RequireLower,
+		RequireDigit:  cfg.RequireDigit,
+		RequireSymbol: cfg.RequireSymbol,
+		BreachCheck:   cfg.BreachList != "",
+		HistorySize:   cfg.HistorySize,
+	}
+}
+
+// Check returns a *PolicyError when a password breaks the length, character class or
+// breach list rules
+func Check(password string) error {
+	cfg := config.AppConfig.Password
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+
+	var violations []string
+	if utf8.RuneCountInString(password) < cfg.MinLength {
+		violations = append(violations, fmt.Sprintf("must have at least %d characters", cfg.MinLength))
+	}
+	if cfg.MaxLength > 0 && len(password) > cfg.MaxLength {
+		violations = append(violations, fmt.Sprintf("must have at most %d bytes", cfg.MaxLength))
+	}
+	if cfg.RequireUpper && !upper {
+		violations = append(violations, "must contain an uppercase letter")
+	}
+	if cfg.RequireLower && !lower {
+		violations = append(violations, "must contain a lowercase letter")
+	}
+	if cfg.RequireDigit && !digit {
+		violations = append(violations, "must contain a digit")
+	}
+	if cfg.RequireSymbol && !symbol {
+		violations = append(violations, "must contain a symbol")
+	}
+	if Breached(password) {
+		violations = append(violations, "appears in a list of breached passwords")
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// Breached reports whether a password is on the breach list
+func Breached(password string) bool {
+	if _, ok := breached.plain[strings.ToLower(password)]; ok {
+		return true
+	}
+	sum := sha1.Sum([]byte(password))
+	_, ok := breached.hashes[strings.ToUpper(hex.EncodeToString(sum[:]))]
+	return ok
+}
+
+// isSHA1 reports whether s is a hex encoded SHA-1 hash
+func isSHA1(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
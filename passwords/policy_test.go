@@ -0,0 +1,153 @@
+package passwords
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"tsimserver/config"
+	"tsimserver/testutil"
+)
+
+// useBreachList loads a breach list with the given lines until the test ends
+func useBreachList(t *testing.T, cfg *config.Config, lines ...string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatalf("writing breach list: %v", err)
+	}
+	previous := breached
+	t.Cleanup(func() {
+		breached = previous
+	})
+
+	cfg.Password.BreachList = path
+	if err := Init(); err != nil {
+		t.Fatalf("loading breach list: %v", err)
+	}
+}
+
+// violations returns the rules a password breaks
+func violations(t *testing.T, password string) []string {
+	t.Helper()
+
+	err := Check(password)
+	if err == nil {
+		return nil
+	}
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("Check(%q) = %v, want a *PolicyError", password, err)
+	}
+	return policyErr.Violations
+}
+
+func TestCheckCharacterClasses(t *testing.T) {
+	cfg := testutil.LoadConfig(t)
+	cfg.Password.BreachList = ""
+	cfg.Password.MinLength = 10
+	cfg.Password.MaxLength = 72
+	cfg.Password.RequireUpper = true
+	cfg.Password.RequireLower = true
+	cfg.Password.RequireDigit = true
+	cfg.Password.RequireSymbol = true
+
+	tests := []struct {
+		password string
+		want     []string
+	}{
+		{password: "Correct-Horse-7", want: nil},
+		{password: "Sh0rt!", want: []string{"must have at least 10 characters"}},
+		{password: "correct-horse-7", want: []string{"must contain an uppercase letter"}},
+		{password: "CORRECT-HORSE-7", want: []string{"must contain a lowercase letter"}},
+		{password: "Correct-Horse-X", want: []string{"must contain a digit"}},
+		{password: "CorrectHorse77", want: []string{"must contain a symbol"}},
+		{password: "ÄÖÜäöü-ÄÖÜ-7", want: nil},
+		{password: "Aa1-" + strings.Repeat("x", 69), want: []string{"must have at most 72 bytes"}},
+		{password: "abc", want: []string{
+			"must have at least 10 characters",
+			"must contain an uppercase letter",
+			"must contain a digit",
+			"must contain a symbol",
+		}},
+	}
+	for _, tt := range tests {
+		got := violations(t, tt.password)
+		if strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+			t.Errorf("Check(%q) violations = %q, want %q", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCountsCharactersNotBytes(t *testing.T) {
+	cfg := testutil.LoadConfig(t)
+	cfg.Password.BreachList = ""
+	cfg.Password.MinLength = 10
+	cfg.Password.RequireUpper = false
+	cfg.Password.RequireLower = false
+	cfg.Password.RequireDigit = false
+	cfg.Password.RequireSymbol = false
+
+	// Nine characters, eighteen bytes
+	if got := violations(t, "äöüäöüäöü"); len(got) != 1 {
+		t.Errorf("violations of a nine character password = %q, want the length rule", got)
+	}
+}
+
+func TestCheckBreachList(t *testing.T) {
+	cfg := testutil.LoadConfig(t)
+	cfg.Password.RequireUpper = false
+	cfg.Password.RequireLower = false
+	cfg.Password.RequireDigit = false
+	cfg.Password.RequireSymbol = false
+	cfg.Password.MinLength = 1
+
+	sum := sha1.Sum([]byte("Hashed-Secret-42"))
+	useBreachList(t, cfg,
+		"# breached passwords",
+		"",
+		"Summer2024!",
+		strings.ToLower(hex.EncodeToString(sum[:]))+":1234",
+	)
+
+	tests := []struct {
+		password string
+		breached bool
+	}{
+		{password: "Summer2024!", breached: true},
+		{password: "SUMMER2024!", breached: true}, // plain entries ignore case
+		{password: "Hashed-Secret-42", breached: true},
+		{password: "hashed-secret-42", breached: false}, // hashes match the exact password
+		{password: "# breached passwords", breached: false},
+		{password: "Autumn2024!", breached: false},
+	}
+	for _, tt := range tests {
+		if got := Breached(tt.password); got != tt.breached {
+			t.Errorf("Breached(%q) = %v, want %v", tt.password, got, tt.breached)
+		}
+		got := violations(t, tt.password)
+		if breachedRule := len(got) == 1 && got[0] == "appears in a list of breached passwords"; breachedRule != tt.breached {
+			t.Errorf("Check(%q) violations = %q", tt.password, got)
+		}
+	}
+}
+
+func TestShippedBreachListLoads(t *testing.T) {
+	cfg := testutil.LoadConfig(t)
+	previous := breached
+	t.Cleanup(func() {
+		breached = previous
+	})
+
+	cfg.Password.BreachList = testutil.RepoPath(cfg.Password.BreachList)
+	if err := Init(); err != nil {
+		t.Fatalf("loading %s: %v", cfg.Password.BreachList, err)
+	}
+	if len(breached.plain)+len(breached.hashes) == 0 {
+		t.Error("shipped breach list is empty")
+	}
+}
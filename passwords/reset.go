@@ -0,0 +1,155 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/lockout"
+	"tsimserver/mailer"
+	"tsimserver/models"
+	"tsimserver/sessions"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// ResetTokenPrefix starts every password reset token
+const ResetTokenPrefix = "pwr_"
+
+// ErrInvalidToken is returned for an unknown, used or expired reset token
+var ErrInvalidToken = errors.New("invalid or expired reset token")
+
+// RequestReset emails a reset link to the active user with an email and returns the user,
+// or nil when nothing was sent: for unknown emails, users who only log in with single
+// sign-on, and within password.reset_interval of the last link. Callers answer the same in
+// every case, and the email is sent in the background, so neither the answer nor its
+// timing tells whether an account exists.
+func RequestReset(email, ipAddress string) (*models.User, error) {
+	cfg := config.AppConfig.Password
+
+	var user models.User
+	if err := database.DB.Where("LOWER(email) = ? AND is_active = ?", strings.ToLower(strings.TrimSpace(email)), true).
+		First(&user).Error; err != nil || user.Password == "" {
+		return nil, nil
+	}
+
+	var recent int64
+	database.DB.Model(&models.PasswordReset{}).
+		Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-time.Duration(cfg.ResetInterval)*time.Second)).
+		Count(&recent)
+	if recent > 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	token := ResetTokenPrefix + hex.EncodeToString(buf)
+	ttl := time.Duration(cfg.ResetTokenTTL) * time.Minute
+
+	// Only the latest link works
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.PasswordReset{}).
+			Where("user_id = ? AND used_at IS NULL AND expires_at > ?", user.ID, time.Now()).
+			Update("expires_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.PasswordReset{
+			UserID:    user.ID,
+			TokenHash: hash(token),
+			IPAddress: ipAddress,
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	link := cfg.ResetURL + "?token=" + url.QueryEscape(token)
+	if strings.Contains(cfg.ResetURL, "?") {
+		link = cfg.ResetURL + "&token=" + url.QueryEscape(token)
+	}
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your TsimServer password",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"a password reset was requested for your TsimServer account from %s. "+
+			"Open this link within %d minutes to choose a new password:\n\n%s\n\n"+
+			"If you did not ask for it, ignore this email and your password stays the same.\n",
+			user.Username, ipAddress, cfg.ResetTokenTTL, link),
+	}
+	go func() {
+		if err := mailer.Send(msg); err != nil {
+			log.Printf("Failed to send password reset email to user %d: %v", user.ID, err)
+		}
+	}()
+	return &user, nil
+}
+
+// Reset sets a new password with a reset token and returns the user. The token works
+// once; the user's sessions are revoked and a login lockout is lifted.
+func Reset(token, password string) (*models.User, error) {
+	var reset models.PasswordReset
+	if err := database.DB.Preload("User").
+		Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hash(token), time.Now()).
+		First(&reset).Error; err != nil || reset.User == nil || !reset.User.IsActive {
+		return nil, ErrInvalidToken
+	}
+	user := reset.User
+
+	// A rejected password leaves the token usable for another try
+	if err := Check(password); err != nil {
+		return nil, err
+	}
+	if Reused(user.ID, password) {
+		return nil, ErrReused
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.PasswordReset{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidToken
+		}
+		if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Update("password", string(passwordHash)).Error; err != nil {
+			return err
+		}
+		if err := Remember(tx, user.ID, string(passwordHash)); err != nil {
+			return err
+		}
+		return tx.Model(&models.Session{}).Where("user_id = ? AND is_active = ?", user.ID, true).
+			Update("is_active", false).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sessions.Invalidate(user.ID)
+	if err := lockout.Unlock(lockout.UserAccount(user.ID)); err != nil {
+		log.Printf("Failed to lift login lockout of user %d: %v", user.ID, err)
+	}
+	return user, nil
+}
+
+// hash returns the stored form of a token
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,184 @@
+package passwords
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/mailer"
+	"tsimserver/models"
+	"tsimserver/testutil"
+)
+
+// resetTokenPattern finds the token in a reset email
+var resetTokenPattern = regexp.MustCompile(ResetTokenPrefix + `[0-9a-f]+`)
+
+// useLogMailer sends email to a LogMailer until the test ends
+func useLogMailer(t *testing.T) *mailer.LogMailer {
+	t.Helper()
+
+	previous, _ := mailer.Default()
+	logMailer := &mailer.LogMailer{}
+	mailer.SetDefault(logMailer)
+	t.Cleanup(func() {
+		mailer.SetDefault(previous)
+	})
+	return logMailer
+}
+
+// requestToken requests a reset for a user and returns the token from the email, which is
+// sent in the background
+func requestToken(t *testing.T, logMailer *mailer.LogMailer, user *models.User) string {
+	t.Helper()
+
+	before := len(logMailer.Sent())
+	requested, err := RequestReset(strings.ToUpper(user.Email), "192.0.2.1")
+	if err != nil {
+		t.Fatalf("RequestReset: %v", err)
+	}
+	if requested == nil || requested.ID != user.ID {
+		t.Fatalf("RequestReset returned %v, want user %d", requested, user.ID)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(logMailer.Sent()) == before {
+		if time.Now().After(deadline) {
+			t.Fatal("reset email was not sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	msg := logMailer.Sent()[before]
+	if msg.To != user.Email {
+		t.Errorf("reset email sent to %s, want %s", msg.To, user.Email)
+	}
+	token := resetTokenPattern.FindString(msg.Body)
+	if token == "" {
+		t.Fatalf("no reset token in email:\n%s", msg.Body)
+	}
+	return token
+}
+
+// setupReset prepares a user, Redis and a LogMailer for password resets
+func setupReset(t *testing.T) (*models.User, *mailer.LogMailer) {
+	t.Helper()
+
+	cfg := setupUsers(t)
+	cfg.Password.ResetInterval = 0
+	testutil.StartRedis(t)
+	return createUser(t, "alice", "Initial-Pass-1"), useLogMailer(t)
+}
+
+func TestResetSetsPasswordOnce(t *testing.T) {
+	user, logMailer := setupReset(t)
+	token := requestToken(t, logMailer, user)
+
+	if _, err := Reset(token, "Reset-Pass-2"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	var stored models.User
+	database.DB.First(&stored, user.ID)
+	if !stored.CheckPassword("Reset-Pass-2") {
+		t.Error("password was not changed")
+	}
+
+	if _, err := Reset(token, "Reset-Pass-3"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("second Reset with the token = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestResetKeepsTokenAfterRejectedPassword(t *testing.T) {
+	user, logMailer := setupReset(t)
+	token := requestToken(t, logMailer, user)
+
+	var policyErr *PolicyError
+	if _, err := Reset(token, "weak"); !errors.As(err, &policyErr) {
+		t.Fatalf("Reset with a weak password = %v, want a *PolicyError", err)
+	}
+	if _, err := Reset(token, "Initial-Pass-1"); !errors.Is(err, ErrReused) {
+		t.Fatalf("Reset with the current password = %v, want ErrReused", err)
+	}
+	if _, err := Reset(token, "Reset-Pass-2"); err != nil {
+		t.Fatalf("Reset after rejected passwords: %v", err)
+	}
+}
+
+func TestResetTokenExpires(t *testing.T) {
+	user, logMailer := setupReset(t)
+	token := requestToken(t, logMailer, user)
+
+	database.DB.Model(&models.PasswordReset{}).Where("user_id = ?", user.ID).
+		Update("expires_at", time.Now().Add(-time.Second))
+	if _, err := Reset(token, "Reset-Pass-2"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Reset with an expired token = %v, want ErrInvalidToken", err)
+	}
+	if _, err := Reset("pwr_unknown", "Reset-Pass-2"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Reset with an unknown token = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestOnlyLatestResetLinkWorks(t *testing.T) {
+	user, logMailer := setupReset(t)
+	first := requestToken(t, logMailer, user)
+	second := requestToken(t, logMailer, user)
+
+	if _, err := Reset(first, "Reset-Pass-2"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Reset with the earlier token = %v, want ErrInvalidToken", err)
+	}
+	if _, err := Reset(second, "Reset-Pass-2"); err != nil {
+		t.Errorf("Reset with the latest token: %v", err)
+	}
+}
+
+func TestRequestResetInterval(t *testing.T) {
+	user, logMailer := setupReset(t)
+	requestToken(t, logMailer, user)
+
+	config.AppConfig.Password.ResetInterval = 60
+	requested, err := RequestReset(user.Email, "192.0.2.1")
+	if err != nil || requested != nil {
+		t.Errorf("RequestReset within the interval = %v, %v, want nothing sent", requested, err)
+	}
+}
+
+func TestRequestResetSkipsUnknownAndPasswordlessUsers(t *testing.T) {
+	_, logMailer := setupReset(t)
+	sso := &models.User{Username: "sso", Email: "sso@example.com", IsActive: true}
+	if err := database.DB.Create(sso).Error; err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+
+	for _, email := range []string{"nobody@example.com", sso.Email} {
+		requested, err := RequestReset(email, "192.0.2.1")
+		if err != nil || requested != nil {
+			t.Errorf("RequestReset(%s) = %v, %v, want nothing sent", email, requested, err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if sent := logMailer.Sent(); len(sent) != 0 {
+		t.Errorf("%d emails sent, want none", len(sent))
+	}
+}
+
+func TestResetRevokesSessions(t *testing.T) {
+	user, logMailer := setupReset(t)
+	for _, token := range []string{"a", "b"} {
+		session := models.Session{UserID: user.ID, AccessToken: "access-" + token, RefreshToken: "refresh-" + token,
+			ExpiresAt: time.Now().Add(time.Hour), RefreshExpiresAt: time.Now().Add(time.Hour), IsActive: true}
+		if err := database.DB.Create(&session).Error; err != nil {
+			t.Fatalf("creating session: %v", err)
+		}
+	}
+	token := requestToken(t, logMailer, user)
+
+	if _, err := Reset(token, "Reset-Pass-2"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	var active int64
+	database.DB.Model(&models.Session{}).Where("user_id = ? AND is_active = ?", user.ID, true).Count(&active)
+	if active != 0 {
+		t.Errorf("%d sessions still active after the reset", active)
+	}
+}
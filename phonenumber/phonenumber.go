@@ -0,0 +1,473 @@
+package phonenumber
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/dispatch"
+	"tsimserver/models"
+	"tsimserver/simhealth"
+	"tsimserver/types"
+	"tsimserver/utils"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Ways a SIM phone number is obtained
+const (
+	MethodDevice   = "device"
+	MethodUSSD     = "ussd"
+	MethodLoopback = "sms_loopback"
+)
+
+// Discovery states
+const (
+	StatusPending   = "pending"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusTimeout   = "timeout"
+)
+
+var (
+	// ErrInProgress is returned when the SIM already has a running discovery
+	ErrInProgress = errors.New("a phone number discovery is already running for this SIM")
+	// ErrNoUSSDCode is returned when a USSD discovery has no code to dial
+	ErrNoUSSDCode = errors.New("no number USSD code configured for this SIM's operator")
+	// ErrNoPeer is returned when no SIM can receive a loop-back SMS
+	ErrNoPeer = errors.New("no online SIM with a verified number is available for an SMS loop-back")
+	// ErrInvalidMethod is returned for unknown discovery methods
+	ErrInvalidMethod = errors.New("method must be ussd or sms_loopback")
+)
+
+// phonePattern finds phone numbers in free text such as USSD responses
+var phonePattern = regexp.MustCompile(`\+?[0-9][0-9 ()-]{5,20}[0-9]`)
+
+// OperatorConfig returns the active number configuration matching a SIM card.
+// A network (MCC/MNC) match wins over an operator name match.
+func OperatorConfig(sim *models.SIMCard) (*models.OperatorNumberConfig, error) {
+	var cfg models.OperatorNumberConfig
+	result := database.DB.
+		Where("is_active = ?", true).
+		Where("(mcc <> '' AND mcc = ? AND mnc = ?) OR (mcc = '' AND LOWER(operator) = LOWER(?))", sim.MCC, sim.MNC, sim.Operator).
+		Order("mcc DESC").Limit(1).Find(&cfg)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &cfg, nil
+}
+
+// Discover starts a phone number discovery for a SIM card. Without a method the operator
+// USSD code is used when there is one and an SMS loop-back otherwise; ussdCode overrides
+// the operator code.
+func Discover(sim *models.SIMCard, method, ussdCode string, automatic bool) (*models.PhoneNumberDiscovery, error) {
+	var running int64
+	database.DB.Model(&models.PhoneNumberDiscovery{}).
+		Where("sim_card_id = ? AND status = ?", sim.ID, StatusPending).
+		Count(&running)
+	if running > 0 {
+		return nil, ErrInProgress
+	}
+
+	switch method {
+	case "", MethodUSSD:
+		if ussdCode == "" {
+			cfg, err := OperatorConfig(sim)
+			if err != nil {
+				return nil, err
+			}
+			if cfg != nil {
+				ussdCode = cfg.USSDCode
+			}
+		}
+		if ussdCode != "" {
+			return discoverByUSSD(sim, ussdCode, automatic)
+		}
+		if method == MethodUSSD {
+			return nil, ErrNoUSSDCode
+		}
+		return discoverByLoopback(sim, automatic)
+	case MethodLoopback:
+		return discoverByLoopback(sim, automatic)
+	}
+
+	return nil, ErrInvalidMethod
+}
+
+// DiscoverNew starts automatic discoveries for SIMs that appeared without a verified number
+func DiscoverNew(simIDs []uint) {
+	if !config.AppConfig.PhoneNumber.AutoDiscover {
+		return
+	}
+
+	for _, id := range simIDs {
+		var sim models.SIMCard
+		if err := database.DB.Where("id = ?", id).First(&sim).Error; err != nil {
+			continue
+		}
+		if sim.NumberVerifiedAt != nil {
+			continue
+		}
+
+		if _, err := Discover(&sim, "", "", true); err != nil && !errors.Is(err, ErrInProgress) {
+			log.Printf("Failed to start phone number discovery for SIM %d: %v", sim.ID, err)
+		}
+	}
+}
+
+// ApplyResult records the answer to a USSD discovery and falls back to a loop-back on failure
+func ApplyResult(deviceID string, result types.PhoneNumberResult) error {
+	var discovery models.PhoneNumberDiscovery
+	if err := database.DB.Where("id = ? AND device_id = ? AND method = ?", result.InternalLogID, deviceID, MethodUSSD).
+		First(&discovery).Error; err != nil {
+		return fmt.Errorf("phone number discovery %d not found for device %s", result.InternalLogID, deviceID)
+	}
+
+	// Late results after a timeout are ignored
+	if discovery.Status != StatusPending {
+		return nil
+	}
+
+	discovery.RawResponse = result.Result
+	if !result.Success {
+		return fallback(&discovery, StatusFailed, result.ErrorMessage)
+	}
+
+	number := Normalize(result.PhoneNumber)
+	if number == "" {
+		var sim models.SIMCard
+		if err := database.DB.Unscoped().Where("id = ?", discovery.SIMCardID).First(&sim).Error; err != nil {
+			return err
+		}
+		cfg, err := OperatorConfig(&sim)
+		if err != nil {
+			return err
+		}
+
+		number, err = Parse(cfg, result.Result)
+		if err != nil {
+			return fallback(&discovery, StatusFailed, err.Error())
+		}
+	}
+
+	return complete(&discovery, number)
+}
+
+// MatchIncomingSMS completes the loop-back discovery whose token an incoming SMS carries.
+// It reports whether the message was a loop-back SMS.
+func MatchIncomingSMS(deviceID, from, message string) (bool, error) {
+	var discoveries []models.PhoneNumberDiscovery
+	if err := database.DB.Where("peer_device_id = ? AND method = ? AND status = ?", deviceID, MethodLoopback, StatusPending).
+		Find(&discoveries).Error; err != nil {
+		return false, err
+	}
+
+	for i := range discoveries {
+		discovery := &discoveries[i]
+		if discovery.Token == "" || !strings.Contains(message, discovery.Token) {
+			continue
+		}
+
+		discovery.RawResponse = message
+		number := Normalize(from)
+		if number == "" {
+			return true, fail(discovery, StatusFailed, fmt.Sprintf("sender %q is not a phone number", from))
+		}
+		return true, complete(discovery, number)
+	}
+
+	return false, nil
+}
+
+// Parse extracts a phone number from a USSD response. The operator pattern must capture
+// a number group; without one the first phone number in the text is used.
+func Parse(cfg *models.OperatorNumberConfig, response string) (string, error) {
+	if cfg != nil && cfg.Pattern != "" {
+		re, err := CompilePattern(cfg.Pattern)
+		if err != nil {
+			return "", err
+		}
+		match := re.FindStringSubmatch(response)
+		if match != nil {
+			if number := Normalize(match[re.SubexpIndex("number")]); number != "" {
+				return number, nil
+			}
+		}
+		return "", errors.New("response does not match the number pattern")
+	}
+
+	for _, candidate := range phonePattern.FindAllString(response, -1) {
+		if number := Normalize(candidate); number != "" {
+			return number, nil
+		}
+	}
+	return "", errors.New("no phone number found in the response")
+}
+
+// CompilePattern compiles an operator number pattern
+func CompilePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("(?is)" + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	if re.SubexpIndex("number") < 0 {
+		return nil, errors.New("pattern must capture a number group")
+	}
+	return re, nil
+}
+
+// Normalize strips formatting from a phone number; it returns an empty string for
+// values that cannot be an E.164 number
+func Normalize(raw string) string {
+	raw = strings.TrimSpace(raw)
+
+	var b strings.Builder
+	if strings.HasPrefix(raw, "+") {
+		b.WriteByte('+')
+	}
+	digits := 0
+	for _, r := range raw {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+			digits++
+		}
+	}
+
+	if digits < 7 || digits > 15 {
+		return ""
+	}
+	return b.String()
+}
+
+// StartMonitor starts the background job that times out unanswered discoveries
+func StartMonitor() {
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			expireDiscoveries(now)
+		}
+	}()
+
+	log.Println("Phone number discovery monitor started")
+}
+
+// discoverByUSSD asks the device to dial the operator's number USSD code
+func discoverByUSSD(sim *models.SIMCard, ussdCode string, automatic bool) (*models.PhoneNumberDiscovery, error) {
+	discovery := models.PhoneNumberDiscovery{
+		SIMCardID: sim.ID,
+		DeviceID:  sim.DeviceID,
+		SimSlot:   slotOf(sim),
+		Method:    MethodUSSD,
+		Status:    StatusPending,
+		USSDCode:  ussdCode,
+		Automatic: automatic,
+	}
+	if err := database.DB.Create(&discovery).Error; err != nil {
+		return nil, err
+	}
+
+	// The discovery ID doubles as the internal log ID so results map back without collisions
+	command := types.DiscoverPhoneNumberCommand{
+		Type:          "discover_phone_number",
+		SimSlot:       discovery.SimSlot,
+		USSDCode:      ussdCode,
+		InternalLogID: int(discovery.ID),
+	}
+	if err := dispatch.ToDevice(sim.DeviceID, command); err != nil {
+		fail(&discovery, StatusFailed, err.Error())
+		return &discovery, err
+	}
+
+	return &discovery, nil
+}
+
+// discoverByLoopback has the SIM text a token to a SIM whose number is already verified;
+// the sender number the peer sees is the number we are looking for
+func discoverByLoopback(sim *models.SIMCard, automatic bool) (*models.PhoneNumberDiscovery, error) {
+	peer, err := findPeer(sim)
+	if err != nil {
+		return nil, err
+	}
+	if peer == nil {
+		return nil, ErrNoPeer
+	}
+
+	token, err := utils.RandomDigits(8)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery := models.PhoneNumberDiscovery{
+		SIMCardID:     sim.ID,
+		DeviceID:      sim.DeviceID,
+		SimSlot:       slotOf(sim),
+		Method:        MethodLoopback,
+		Status:        StatusPending,
+		PeerSIMCardID: &peer.ID,
+		PeerDeviceID:  peer.DeviceID,
+		Token:         token,
+		Automatic:     automatic,
+	}
+	if err := database.DB.Create(&discovery).Error; err != nil {
+		return nil, err
+	}
+
+	internalLogID, err := utils.RandomDigits(6)
+	if err != nil {
+		return nil, err
+	}
+	logID, _ := strconv.Atoi(internalLogID)
+
+	message := strings.TrimSpace(config.AppConfig.PhoneNumber.LoopbackPrefix + " " + token)
+	sms := models.SMSMessage{
+		DeviceID:      sim.DeviceID,
+		Type:          "outgoing",
+		Target:        peer.PhoneNumber,
+		Message:       message,
+		SimSlot:       discovery.SimSlot,
+		SIMCardID:     &sim.ID,
+		InternalLogID: logID,
+		Status:        "pending",
+		Timestamp:     time.Now().Unix(),
+	}
+	if err := database.DB.Create(&sms).Error; err != nil {
+		return nil, err
+	}
+
+	command := types.SendSMSCommand{
+		Type:          "send_sms",
+		Target:        peer.PhoneNumber,
+		SimSlot:       discovery.SimSlot,
+		Message:       message,
+		InternalLogID: logID,
+	}
+	sendErr := dispatch.ToDevice(sim.DeviceID, command)
+	if err := simhealth.RecordSend(sim.ID, sendErr); err != nil {
+		log.Printf("Failed to update routing stats of SIM %d: %v", sim.ID, err)
+	}
+	if sendErr != nil {
+		database.DB.Model(&sms).Updates(map[string]interface{}{"status": "failed", "error_message": sendErr.Error()})
+		fail(&discovery, StatusFailed, sendErr.Error())
+		return &discovery, sendErr
+	}
+
+	return &discovery, nil
+}
+
+// findPeer picks an online SIM with a verified number, preferring the same country
+func findPeer(sim *models.SIMCard) (*models.SIMCard, error) {
+	var peer models.SIMCard
+	result := database.DB.
+		Joins("JOIN devices ON devices.device_id = sim_cards.device_id AND devices.deleted_at IS NULL").
+		Where("sim_cards.id <> ? AND sim_cards.number_verified_at IS NOT NULL AND sim_cards.phone_number <> ''", sim.ID).
+		Where("sim_cards.is_active = ? AND sim_cards.is_enabled = ?", true, true).
+		Where("devices.operator_status = ? AND devices.is_active = ?", "online", true).
+		Order(clause.OrderBy{Expression: clause.Expr{
+			SQL:                "CASE WHEN sim_cards.mcc = ? THEN 0 ELSE 1 END, sim_cards.number_verified_at DESC",
+			Vars:               []interface{}{sim.MCC},
+			WithoutParentheses: true,
+		}}).
+		Limit(1).Find(&peer)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &peer, nil
+}
+
+// complete stores a discovered number on the discovery and its SIM
+func complete(discovery *models.PhoneNumberDiscovery, number string) error {
+	now := time.Now()
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(discovery).Updates(map[string]interface{}{
+			"status":       StatusCompleted,
+			"raw_response": discovery.RawResponse,
+			"phone_number": number,
+			"completed_at": now,
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Model(&models.SIMCard{}).Where("id = ?", discovery.SIMCardID).Updates(map[string]interface{}{
+			"phone_number":       number,
+			"number_verified_at": now,
+			"number_method":      discovery.Method,
+		}).Error
+	})
+}
+
+// fail closes a discovery without a number
+func fail(discovery *models.PhoneNumberDiscovery, status, message string) error {
+	now := time.Now()
+	discovery.Status = status
+	discovery.ErrorMessage = message
+	discovery.CompletedAt = &now
+
+	return database.DB.Model(discovery).Updates(map[string]interface{}{
+		"status":        status,
+		"raw_response":  discovery.RawResponse,
+		"error_message": message,
+		"completed_at":  now,
+	}).Error
+}
+
+// fallback fails a USSD discovery and retries the SIM with an SMS loop-back when enabled
+func fallback(discovery *models.PhoneNumberDiscovery, status, message string) error {
+	if err := fail(discovery, status, message); err != nil {
+		return err
+	}
+	if discovery.Method != MethodUSSD || !config.AppConfig.PhoneNumber.LoopbackFallback {
+		return nil
+	}
+
+	var sim models.SIMCard
+	if err := database.DB.Where("id = ?", discovery.SIMCardID).First(&sim).Error; err != nil {
+		// The SIM was removed in the meantime
+		return nil
+	}
+
+	if _, err := discoverByLoopback(&sim, discovery.Automatic); err != nil {
+		log.Printf("Failed to start SMS loop-back for SIM %d: %v", sim.ID, err)
+	}
+	return nil
+}
+
+// expireDiscoveries closes discoveries the devices never answered
+func expireDiscoveries(now time.Time) {
+	timeout := time.Duration(config.AppConfig.PhoneNumber.DiscoveryTimeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+
+	var discoveries []models.PhoneNumberDiscovery
+	if err := database.DB.Where("status = ? AND created_at < ?", StatusPending, now.Add(-timeout)).
+		Find(&discoveries).Error; err != nil {
+		log.Printf("Failed to load stale phone number discoveries: %v", err)
+		return
+	}
+
+	for i := range discoveries {
+		if err := fallback(&discoveries[i], StatusTimeout, "no answer in time"); err != nil {
+			log.Printf("Failed to expire phone number discovery %d: %v", discoveries[i].ID, err)
+		}
+	}
+}
+
+// slotOf returns the SIM slot number stored in the SIM identifier
+func slotOf(sim *models.SIMCard) int {
+	slot, _ := strconv.Atoi(sim.Identifier)
+	return slot
+}
@@ -0,0 +1,276 @@
+package presence
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"tsimserver/alarms"
+	"tsimserver/cache"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/queue"
+)
+
+// Device presence states stored in Device.OperatorStatus
+const (
+	StatusOnline     = "online"
+	StatusOffline    = "offline"
+	StatusConnecting = "connecting"
+)
+
+// OfflineAlarmType is the alarm type raised when a device stays offline
+const OfflineAlarmType = "device_offline"
+
+// minBatteryForSMS mirrors the battery threshold used by Device.IsReadyForSMS
+const minBatteryForSMS = 10
+
+// Event represents a presence transition published to the device queue
+type Event struct {
+	Type      string `json:"type"`
+	DeviceID  string `json:"device_id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// StatusUpdate carries the device state reported in a device_status message
+type StatusUpdate struct {
+	BatteryLevel   int
+	BatteryStatus  string
+	SignalStrength int
+	Latitude       float64
+	Longitude      float64
+}
+
+// MarkOnline transitions a device to online after a successful WebSocket authentication
+func MarkOnline(deviceID string) error {
+	now := time.Now()
+	touchHeartbeat(deviceID, now)
+
+	var device models.Device
+	if err := database.DB.Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return err
+	}
+
+	previous := device.OperatorStatus
+	updates := map[string]interface{}{
+		"operator_status": StatusOnline,
+		"offline_since":   nil,
+		"last_seen":       now,
+		"is_available":    isAvailable(&device, StatusOnline, device.BatteryLevel),
+	}
+
+	if err := database.DB.Model(&device).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	if previous != StatusOnline {
+		publish(deviceID, previous, StatusOnline, "connected")
+	}
+
+	// Device is back, clear any pending offline alarm
+	if err := alarms.Resolve(deviceID, OfflineAlarmType); err != nil {
+		log.Printf("Failed to resolve offline alarm for device %s: %v", deviceID, err)
+	}
+
+	return nil
+}
+
+// MarkOffline transitions a device to offline
+func MarkOffline(deviceID, reason string) error {
+	cache.SetDeviceStatus(deviceID, StatusOffline)
+
+	var device models.Device
+	if err := database.DB.Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return err
+	}
+
+	if device.OperatorStatus == StatusOffline {
+		return nil
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"operator_status": StatusOffline,
+		"is_available":    false,
+		"offline_since":   now,
+	}
+
+	if err := database.DB.Model(&device).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	publish(deviceID, device.OperatorStatus, StatusOffline, reason)
+	return nil
+}
+
+// Heartbeat records that the device is alive without touching the database
+func Heartbeat(deviceID string) {
+	if deviceID == "" {
+		return
+	}
+	touchHeartbeat(deviceID, time.Now())
+}
+
+// ApplyStatus stores the battery, signal and location reported by the device and
+// recomputes its availability for SMS routing
+func ApplyStatus(deviceID string, update StatusUpdate) error {
+	now := time.Now()
+	touchHeartbeat(deviceID, now)
+
+	var device models.Device
+	if err := database.DB.Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return err
+	}
+
+	status := device.OperatorStatus
+	if status != StatusOnline {
+		// A status report can only come over a live connection
+		publish(deviceID, status, StatusOnline, "status_report")
+		status = StatusOnline
+	}
+
+	updates := map[string]interface{}{
+		"operator_status": status,
+		"offline_since":   nil,
+		"battery_level":   update.BatteryLevel,
+		"battery_status":  update.BatteryStatus,
+		"signal_strength": update.SignalStrength,
+		"last_seen":       now,
+		"is_available":    isAvailable(&device, status, update.BatteryLevel),
+	}
+
+	if update.Latitude != 0 || update.Longitude != 0 {
+		updates["latitude"] = update.Latitude
+		updates["longitude"] = update.Longitude
+	}
+
+	return database.DB.Model(&device).Updates(updates).Error
+}
+
+// StartMonitor starts the heartbeat monitor in the background
+func StartMonitor() {
+	cfg := config.AppConfig.Presence
+	interval := time.Duration(cfg.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			checkHeartbeats()
+			checkOfflineAlarms()
+		}
+	}()
+
+	log.Printf("Presence monitor started (interval %s)", interval)
+}
+
+// checkHeartbeats marks devices offline when their heartbeat is older than the timeout
+func checkHeartbeats() {
+	timeout := time.Duration(config.AppConfig.Presence.HeartbeatTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 90 * time.Second
+	}
+
+	var devices []models.Device
+	if err := database.DB.Where("operator_status <> ?", StatusOffline).Find(&devices).Error; err != nil {
+		log.Printf("Presence monitor failed to fetch devices: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, device := range devices {
+		lastBeat := device.LastSeen
+		if beat, err := cache.GetDeviceHeartbeat(device.DeviceID); err == nil && beat.After(lastBeat) {
+			lastBeat = beat
+		}
+
+		if now.Sub(lastBeat) > timeout {
+			if err := MarkOffline(device.DeviceID, "heartbeat_timeout"); err != nil {
+				log.Printf("Failed to mark device %s offline: %v", device.DeviceID, err)
+			}
+			continue
+		}
+
+		// Persist the cached heartbeat so last_seen stays meaningful
+		if lastBeat.After(device.LastSeen) {
+			database.DB.Model(&device).Update("last_seen", lastBeat)
+		}
+	}
+}
+
+// checkOfflineAlarms raises an alarm for active devices that stay offline past the threshold
+func checkOfflineAlarms() {
+	after := time.Duration(config.AppConfig.Presence.OfflineAlarmAfter) * time.Second
+	if after <= 0 {
+		return
+	}
+
+	var devices []models.Device
+	cutoff := time.Now().Add(-after)
+	if err := database.DB.Where("operator_status = ? AND is_active = ? AND offline_since < ?", StatusOffline, true, cutoff).
+		Find(&devices).Error; err != nil {
+		log.Printf("Presence monitor failed to fetch offline devices: %v", err)
+		return
+	}
+
+	for _, device := range devices {
+		message := fmt.Sprintf("Device %s has been offline since %s", device.DeviceID, device.OfflineSince.Format(time.RFC3339))
+		if _, _, err := alarms.RaiseOnce(device.DeviceID, OfflineAlarmType, "Device offline", message, "high"); err != nil {
+			log.Printf("Failed to raise offline alarm for device %s: %v", device.DeviceID, err)
+		}
+	}
+}
+
+// isAvailable decides whether the device can take SMS traffic
+func isAvailable(device *models.Device, status string, batteryLevel int) bool {
+	if !device.IsActive || status != StatusOnline || batteryLevel < minBatteryForSMS {
+		return false
+	}
+
+	var usableSIMs int64
+	database.DB.Model(&models.SIMCard{}).
+		Where("device_id = ? AND is_active = ? AND is_enabled = ?", device.DeviceID, true, true).
+		Count(&usableSIMs)
+
+	return usableSIMs > 0
+}
+
+// touchHeartbeat refreshes the heartbeat and online status kept in Redis
+func touchHeartbeat(deviceID string, at time.Time) {
+	ttl := 2 * time.Duration(config.AppConfig.Presence.HeartbeatTimeout) * time.Second
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+
+	cache.SetDeviceHeartbeat(deviceID, at, ttl)
+	cache.SetDeviceStatus(deviceID, StatusOnline)
+}
+
+// publish emits a presence transition event
+func publish(deviceID, from, to, reason string) {
+	if from == "" {
+		from = StatusOffline
+	}
+
+	event := Event{
+		Type:      "presence",
+		DeviceID:  deviceID,
+		From:      from,
+		To:        to,
+		Reason:    reason,
+		Timestamp: time.Now().Unix(),
+	}
+
+	log.Printf("Device %s presence: %s -> %s (%s)", deviceID, from, to, reason)
+
+	if err := queue.PublishMessage(queue.DeviceQueue, event); err != nil {
+		log.Printf("Failed to publish presence event for device %s: %v", deviceID, err)
+	}
+}
@@ -0,0 +1,247 @@
+package quarantine
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"tsimserver/alarms"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/dispatch"
+	"tsimserver/models"
+	"tsimserver/types"
+
+	"gorm.io/gorm"
+)
+
+// Quarantine states
+const (
+	StatusActive   = "active"
+	StatusReleased = "released"
+	StatusExpired  = "expired"
+)
+
+// Reasons a SIM is quarantined for
+const (
+	ReasonConsecutiveFailures = "consecutive_failures"
+	ReasonErrorCode           = "error_code"
+)
+
+// AlarmSIMQuarantined is raised when a SIM is taken out of routing
+const AlarmSIMQuarantined = "sim_quarantined"
+
+// ErrNotQuarantined is returned when releasing a SIM that is not quarantined
+var ErrNotQuarantined = errors.New("SIM is not quarantined")
+
+// Evaluate quarantines a SIM whose latest failure matches a block pattern. failures is the
+// number of failed sends and deliveries in a row, errorCode the error of the latest one.
+func Evaluate(simID uint, failures int, errorCode string) (*models.SIMQuarantine, error) {
+	cfg := config.AppConfig.Quarantine
+	if !cfg.Enabled || failures == 0 {
+		return nil, nil
+	}
+
+	switch {
+	case errorCode != "" && blockCode(errorCode):
+		return Quarantine(simID, ReasonErrorCode,
+			fmt.Sprintf("operator reported error %s", errorCode), errorCode, failures)
+	case cfg.ConsecutiveFailures > 0 && failures >= cfg.ConsecutiveFailures:
+		return Quarantine(simID, ReasonConsecutiveFailures,
+			fmt.Sprintf("%d sends or deliveries failed in a row", failures), errorCode, failures)
+	}
+	return nil, nil
+}
+
+// Quarantine takes a SIM out of routing, disables it on its device and notifies operators.
+// A SIM that is already quarantined is left as it is.
+func Quarantine(simID uint, reason, details, errorCode string, failures int) (*models.SIMQuarantine, error) {
+	var sim models.SIMCard
+	if err := database.DB.Where("id = ?", simID).First(&sim).Error; err != nil {
+		return nil, err
+	}
+	if sim.IsQuarantined {
+		return nil, nil
+	}
+
+	slot, _ := strconv.Atoi(sim.Identifier)
+	entry := models.SIMQuarantine{
+		SIMCardID: sim.ID,
+		DeviceID:  sim.DeviceID,
+		SimSlot:   slot,
+		Reason:    reason,
+		Details:   details,
+		ErrorCode: errorCode,
+		Failures:  failures,
+		Status:    StatusActive,
+	}
+	if minutes := config.AppConfig.Quarantine.Cooldown; minutes > 0 {
+		until := time.Now().Add(time.Duration(minutes) * time.Minute)
+		entry.CooldownUntil = &until
+	}
+
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+		return tx.Model(&sim).Updates(map[string]interface{}{
+			"is_enabled":     false,
+			"is_quarantined": true,
+		}).Error
+	}); err != nil {
+		return nil, err
+	}
+
+	command := types.DisableSIMCommand{
+		Type:     "disable_sim",
+		DeviceID: sim.DeviceID,
+		SimSlot:  slot,
+	}
+	if err := dispatch.ToDevice(sim.DeviceID, command); err != nil {
+		log.Printf("Failed to send disable command for quarantined SIM %d: %v", sim.ID, err)
+	}
+
+	message := fmt.Sprintf("SIM in slot %s was quarantined: %s", sim.Identifier, details)
+	if entry.CooldownUntil != nil {
+		message += fmt.Sprintf(" (cooldown until %s)", entry.CooldownUntil.Format(time.RFC3339))
+	}
+	if _, err := alarms.Raise(sim.DeviceID, AlarmSIMQuarantined, "SIM quarantined", message, "high"); err != nil {
+		log.Printf("Failed to raise quarantine alarm for device %s: %v", sim.DeviceID, err)
+	}
+
+	log.Printf("SIM %d on device %s quarantined: %s", sim.ID, sim.DeviceID, details)
+	return &entry, nil
+}
+
+// Release puts a quarantined SIM back into routing and enables it on its device.
+// releasedBy is zero when the cooldown ran out.
+func Release(simID uint, releasedBy uint, note string) (*models.SIMQuarantine, error) {
+	var sim models.SIMCard
+	if err := database.DB.Where("id = ?", simID).First(&sim).Error; err != nil {
+		return nil, err
+	}
+
+	var entry models.SIMQuarantine
+	result := database.DB.Where("sim_card_id = ? AND status = ?", simID, StatusActive).
+		Order("created_at DESC").Limit(1).Find(&entry)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 && !sim.IsQuarantined {
+		return nil, ErrNotQuarantined
+	}
+
+	status := StatusExpired
+	var releasedByID *uint
+	if releasedBy != 0 {
+		status = StatusReleased
+		releasedByID = &releasedBy
+	}
+
+	now := time.Now()
+	if err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if entry.ID != 0 {
+			if err := tx.Model(&entry).Updates(map[string]interface{}{
+				"status":       status,
+				"released_at":  now,
+				"released_by":  releasedByID,
+				"release_note": note,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		// The failure streak starts over so the SIM is not quarantined again at once
+		if err := tx.Model(&models.SIMRoutingStats{}).Where("sim_card_id = ?", simID).
+			Update("failures", 0).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&sim).Updates(map[string]interface{}{
+			"is_enabled":     true,
+			"is_quarantined": false,
+		}).Error
+	}); err != nil {
+		return nil, err
+	}
+
+	slot, _ := strconv.Atoi(sim.Identifier)
+	command := types.EnableSIMCommand{
+		Type:     "enable_sim",
+		DeviceID: sim.DeviceID,
+		SimSlot:  slot,
+	}
+	if err := dispatch.ToDevice(sim.DeviceID, command); err != nil {
+		log.Printf("Failed to send enable command for released SIM %d: %v", sim.ID, err)
+	}
+
+	// Other SIMs of the device may still be quarantined
+	var quarantined int64
+	database.DB.Model(&models.SIMCard{}).
+		Where("device_id = ? AND id <> ? AND is_quarantined = ?", sim.DeviceID, sim.ID, true).
+		Count(&quarantined)
+	if quarantined == 0 {
+		if err := alarms.Resolve(sim.DeviceID, AlarmSIMQuarantined); err != nil {
+			log.Printf("Failed to resolve quarantine alarm for device %s: %v", sim.DeviceID, err)
+		}
+	}
+
+	entry.Status = status
+	entry.ReleasedAt = &now
+	entry.ReleasedBy = releasedByID
+	entry.ReleaseNote = note
+	return &entry, nil
+}
+
+// StartMonitor starts the background job that releases SIMs whose cooldown ran out
+func StartMonitor() {
+	if !config.AppConfig.Quarantine.Enabled || !config.AppConfig.Quarantine.AutoRelease {
+		log.Println("Automatic quarantine release disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			releaseExpired(now)
+		}
+	}()
+
+	log.Println("SIM quarantine monitor started")
+}
+
+// releaseExpired releases SIMs whose quarantine cooldown has passed
+func releaseExpired(now time.Time) {
+	var entries []models.SIMQuarantine
+	if err := database.DB.Where("status = ? AND cooldown_until IS NOT NULL AND cooldown_until <= ?", StatusActive, now).
+		Find(&entries).Error; err != nil {
+		log.Printf("Failed to load expired quarantines: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		_, err := Release(entry.SIMCardID, 0, "cooldown ended")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// The SIM was removed meanwhile
+			database.DB.Model(&entry).Updates(map[string]interface{}{"status": StatusExpired, "released_at": now})
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to release SIM %d from quarantine: %v", entry.SIMCardID, err)
+		}
+	}
+}
+
+// blockCode reports whether an error code is configured to quarantine a SIM at once
+func blockCode(errorCode string) bool {
+	for _, code := range config.AppConfig.Quarantine.ErrorCodes {
+		if strings.EqualFold(strings.TrimSpace(code), errorCode) {
+			return true
+		}
+	}
+	return false
+}
@@ -239,6 +239,7 @@ func SeedAuthData() error {
 			Name:        "admin",
 			DisplayName: "Administrator",
 			Description: "Full system access",
+			MFARequired: true,
 			IsActive:    true,
 		},
 		{
@@ -289,6 +290,11 @@ func SeedAuthData() error {
 		{Name: "permissions.write", DisplayName: "Write Permissions", Resource: "permissions", Action: "write", IsActive: true},
 		{Name: "permissions.delete", DisplayName: "Delete Permissions", Resource: "permissions", Action: "delete", IsActive: true},
 
+		// API key management
+		{Name: "api_keys.read", DisplayName: "Read API Keys", Resource: "api_keys", Action: "read", IsActive: true},
+		{Name: "api_keys.write", DisplayName: "Write API Keys", Resource: "api_keys", Action: "write", IsActive: true},
+		{Name: "api_keys.delete", DisplayName: "Delete API Keys", Resource: "api_keys", Action: "delete", IsActive: true},
+
 		// Device management
 		{Name: "devices.read", DisplayName: "Read Devices", Resource: "devices", Action: "read", IsActive: true},
 		{Name: "devices.write", DisplayName: "Write Devices", Resource: "devices", Action: "write", IsActive: true},
@@ -304,11 +310,20 @@ func SeedAuthData() error {
 		{Name: "ussd.write", DisplayName: "Write USSD", Resource: "ussd", Action: "write", IsActive: true},
 		{Name: "ussd.delete", DisplayName: "Delete USSD", Resource: "ussd", Action: "delete", IsActive: true},
 
+		// Call management
+		{Name: "calls.read", DisplayName: "Read Calls", Resource: "calls", Action: "read", IsActive: true},
+		{Name: "calls.write", DisplayName: "Write Calls", Resource: "calls", Action: "write", IsActive: true},
+
 		// Alarm management
 		{Name: "alarms.read", DisplayName: "Read Alarms", Resource: "alarms", Action: "read", IsActive: true},
 		{Name: "alarms.write", DisplayName: "Write Alarms", Resource: "alarms", Action: "write", IsActive: true},
 		{Name: "alarms.delete", DisplayName: "Delete Alarms", Resource: "alarms", Action: "delete", IsActive: true},
 
+		// App update management
+		{Name: "app_updates.read", DisplayName: "Read App Updates", Resource: "app_updates", Action: "read", IsActive: true},
+		{Name: "app_updates.write", DisplayName: "Write App Updates", Resource: "app_updates", Action: "write", IsActive: true},
+		{Name: "app_updates.delete", DisplayName: "Delete App Updates", Resource: "app_updates", Action: "delete", IsActive: true},
+
 		// Statistics
 		{Name: "stats.read", DisplayName: "Read Statistics", Resource: "stats", Action: "read", IsActive: true},
 
@@ -343,6 +358,9 @@ func SeedAuthData() error {
 		{Name: "device_groups.write", DisplayName: "Write Device Groups", Resource: "device_groups", Action: "write", IsActive: true},
 		{Name: "device_groups.delete", DisplayName: "Delete Device Groups", Resource: "device_groups", Action: "delete", IsActive: true},
 
+		// Audit log
+		{Name: "audit.read", DisplayName: "Read Audit Log", Resource: "audit", Action: "read", IsActive: true},
+
 		// Admin-level permissions
 		{Name: "sms.admin", DisplayName: "SMS Admin", Resource: "sms", Action: "admin", IsActive: true},
 		{Name: "devices.admin", DisplayName: "Device Admin", Resource: "devices", Action: "admin", IsActive: true},
@@ -363,12 +381,13 @@ func SeedAuthData() error {
 	var adminUser models.User
 	if err := database.DB.Where("username = ?", "admin").First(&adminUser).Error; err != nil {
 		adminUser = models.User{
-			Username:  "admin",
-			Email:     "admin@tsimserver.com",
-			Password:  "admin123",
-			FirstName: "System",
-			LastName:  "Administrator",
-			IsActive:  true,
+			Username:     "admin",
+			Email:        "admin@tsimserver.com",
+			Password:     "admin123",
+			FirstName:    "System",
+			LastName:     "Administrator",
+			IsActive:     true,
+			IsSuperAdmin: true,
 		}
 
 		// Hash password
@@ -380,7 +399,27 @@ func SeedAuthData() error {
 			return fmt.Errorf("failed to create admin user: %v", err)
 		}
 		log.Println("Created default admin user (admin/admin123)")
+	} else if !adminUser.IsSuperAdmin {
+		database.DB.Model(&adminUser).Update("is_super_admin", true)
+		log.Println("Made admin user a super-admin")
+	}
+
+	// Create the default tenant and move sites and users from before tenants into it
+	var defaultTenant models.Tenant
+	if err := database.DB.Where("slug = ?", "default").First(&defaultTenant).Error; err != nil {
+		defaultTenant = models.Tenant{
+			Name:        "Default",
+			Slug:        "default",
+			Description: "Default organization",
+			IsActive:    true,
+		}
+		if err := database.DB.Create(&defaultTenant).Error; err != nil {
+			return fmt.Errorf("failed to create default tenant: %v", err)
+		}
+		log.Println("Created default tenant")
 	}
+	database.DB.Model(&models.Site{}).Where("tenant_id IS NULL").Update("tenant_id", defaultTenant.ID)
+	database.DB.Model(&models.User{}).Where("tenant_id IS NULL AND is_super_admin = ?", false).Update("tenant_id", defaultTenant.ID)
 
 	// Assign admin role to admin user
 	var adminRole models.Role
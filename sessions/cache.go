@@ -0,0 +1,138 @@
+package sessions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+	"tsimserver/cache"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyPrefix starts the Redis keys of cached sessions and user generations
+const keyPrefix = "tsimserver:session:"
+
+// entry is a validated session with its user as cached in Redis. Users are cached without
+// their password hash.
+type entry struct {
+	Generation int64          `json:"generation"`
+	Session    models.Session `json:"session"`
+	User       models.User    `json:"user"`
+}
+
+// Validate returns the active session of an access token and its active user. Sessions
+// validated in the database are cached for sessions.cache_ttl seconds. Every change to the
+// sessions or the user bumps the user's generation, which drops all their cached sessions
+// at once, so revocation works on the next request. Without Redis sessions are checked in
+// the database.
+func Validate(accessToken string, userID uint) (*models.Session, *models.User, error) {
+	ttl := time.Duration(config.AppConfig.Sessions.CacheTTL) * time.Second
+	if ttl <= 0 {
+		return load(accessToken, userID)
+	}
+
+	ctx := context.Background()
+	key := tokenKey(accessToken)
+	values, err := cache.RedisClient.MGet(ctx, key, generationKey(userID)).Result()
+	if err != nil {
+		log.Printf("Failed to read session cache: %v", err)
+		return load(accessToken, userID)
+	}
+
+	generation := parseGeneration(values[1])
+	if cached, ok := values[0].(string); ok {
+		var e entry
+		if err := json.Unmarshal([]byte(cached), &e); err == nil &&
+			e.Generation == generation && e.Session.UserID == userID && time.Now().Before(e.Session.ExpiresAt) {
+			return &e.Session, &e.User, nil
+		}
+	}
+
+	session, user, err := load(accessToken, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// An entry read before a concurrent invalidation carries the old generation and is ignored
+	if remaining := time.Until(session.ExpiresAt); remaining < ttl {
+		ttl = remaining
+	}
+	e := entry{Generation: generation, Session: *session, User: *user}
+	e.Session.AccessToken = ""
+	e.Session.RefreshToken = ""
+	e.User.Password = ""
+	if data, err := json.Marshal(e); err == nil && ttl > 0 {
+		if err := cache.RedisClient.Set(ctx, key, data, ttl).Err(); err != nil {
+			log.Printf("Failed to cache session: %v", err)
+		}
+	}
+	return session, user, nil
+}
+
+// Invalidate drops the cached sessions of a user. Call it after revoking their sessions or
+// changing the user.
+func Invalidate(userID uint) {
+	if err := cache.RedisClient.Incr(context.Background(), generationKey(userID)).Err(); err != nil {
+		log.Printf("Failed to invalidate cached sessions of user %d: %v", userID, err)
+	}
+}
+
+// InvalidateTenant drops the cached sessions of all users of a tenant
+func InvalidateTenant(tenantID uint) {
+	var userIDs []uint
+	if err := database.DB.Model(&models.User{}).Where("tenant_id = ?", tenantID).Pluck("id", &userIDs).Error; err != nil {
+		log.Printf("Failed to list users of tenant %d: %v", tenantID, err)
+		return
+	}
+
+	ctx := context.Background()
+	_, err := cache.RedisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, userID := range userIDs {
+			pipe.Incr(ctx, generationKey(userID))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to invalidate cached sessions of tenant %d: %v", tenantID, err)
+	}
+}
+
+// load checks a session and its user in the database
+func load(accessToken string, userID uint) (*models.Session, *models.User, error) {
+	var user models.User
+	if err := database.DB.Preload("Tenant").Where("id = ? AND is_active = ?", userID, true).First(&user).Error; err != nil {
+		return nil, nil, ErrInactiveUser
+	}
+
+	var session models.Session
+	if err := database.DB.Where("access_token = ? AND is_active = ? AND user_id = ?", accessToken, true, userID).First(&session).Error; err != nil {
+		return nil, nil, ErrInvalid
+	}
+	return &session, &user, nil
+}
+
+// parseGeneration reads a generation counter, zero before the first invalidation
+func parseGeneration(value interface{}) int64 {
+	s, _ := value.(string)
+	generation, _ := strconv.ParseInt(s, 10, 64)
+	return generation
+}
+
+// tokenKey returns the key caching the session of an access token. Tokens are hashed so
+// Redis holds nothing that authenticates.
+func tokenKey(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return keyPrefix + "token:" + hex.EncodeToString(sum[:])
+}
+
+// generationKey returns the key counting invalidations of a user's sessions
+func generationKey(userID uint) string {
+	return keyPrefix + "generation:" + strconv.FormatUint(uint64(userID), 10)
+}
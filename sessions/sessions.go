@@ -0,0 +1,147 @@
+package sessions
+
+import (
+	"errors"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/utils"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrInvalid is returned for an unknown or revoked session
+	ErrInvalid = errors.New("session not found or expired")
+	// ErrExpired is returned for a refresh token past the lifetime of its login
+	ErrExpired = errors.New("refresh token expired")
+	// ErrReused is returned when a refresh token is used after it was rotated
+	ErrReused = errors.New("refresh token was already used")
+	// ErrInactiveUser is returned when the user of a session was deleted or deactivated
+	ErrInactiveUser = errors.New("user not found or inactive")
+)
+
+// Create starts a session for a user who logged in, as the first of a new family
+func Create(user *models.User, ipAddress, userAgent string) (*models.Session, error) {
+	session := models.Session{
+		UserID:           user.ID,
+		FamilyID:         uuid.New().String(),
+		RefreshExpiresAt: time.Now().Add(time.Duration(config.AppConfig.JWT.RefreshTokenExpiry) * 24 * time.Hour),
+		IPAddress:        ipAddress,
+		UserAgent:        userAgent,
+	}
+	if err := issue(database.DB, user, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Refresh exchanges a refresh token for a new session in the same family. Each refresh
+// token works once: using a rotated token again means it was copied, so every session of
+// the family is revoked and ErrReused is returned with the session of the reused token.
+// A family ends when the refresh token of its login expires, however often it rotated.
+func Refresh(refreshToken, ipAddress, userAgent string) (*models.Session, error) {
+	var current, next models.Session
+	var reused, expired bool
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Concurrent refreshes with the same token wait here, the later one sees the rotation
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("refresh_token = ?", refreshToken).First(&current).Error; err != nil {
+			return ErrInvalid
+		}
+
+		if current.RotatedAt != nil {
+			reused = true
+			return tx.Model(&models.Session{}).
+				Where("family_id = ? AND is_active = ?", current.FamilyID, true).
+				Update("is_active", false).Error
+		}
+		if !current.IsActive {
+			return ErrInvalid
+		}
+		if time.Now().After(current.RefreshExpiresAt) {
+			expired = true
+			return tx.Model(&current).Update("is_active", false).Error
+		}
+
+		var user models.User
+		if err := tx.Where("id = ? AND is_active = ?", current.UserID, true).First(&user).Error; err != nil {
+			return ErrInactiveUser
+		}
+
+		// Sessions from before rotation get a family when first refreshed
+		if current.FamilyID == "" {
+			current.FamilyID = uuid.New().String()
+		}
+		next = models.Session{
+			UserID:           user.ID,
+			FamilyID:         current.FamilyID,
+			RefreshExpiresAt: current.RefreshExpiresAt,
+			IPAddress:        ipAddress,
+			UserAgent:        userAgent,
+			TenantID:         current.TenantID,
+		}
+		if err := issue(tx, &user, &next); err != nil {
+			return err
+		}
+		next.User = &user
+
+		return tx.Model(&current).Updates(map[string]interface{}{
+			"family_id":      current.FamilyID,
+			"rotated_at":     time.Now(),
+			"replaced_by_id": next.ID,
+			"is_active":      false,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The replaced session stops working right away, not when its cache entry expires
+	Invalidate(current.UserID)
+
+	switch {
+	case reused:
+		return &current, ErrReused
+	case expired:
+		return nil, ErrExpired
+	}
+	return &next, nil
+}
+
+// RevokeAccessToken ends the session of an access token
+func RevokeAccessToken(accessToken string) error {
+	var session models.Session
+	if err := database.DB.Where("access_token = ?", accessToken).First(&session).Error; err != nil {
+		return nil
+	}
+	if err := database.DB.Model(&session).Update("is_active", false).Error; err != nil {
+		return err
+	}
+	Invalidate(session.UserID)
+	return nil
+}
+
+// issue generates the tokens of a new session and stores it
+func issue(db *gorm.DB, user *models.User, session *models.Session) error {
+	accessToken, err := utils.GenerateAccessToken(user.ID, user.Username, user.Email)
+	if err != nil {
+		return errors.New("error generating access token")
+	}
+	refreshToken, err := utils.GenerateRefreshToken(user.ID, user.Username)
+	if err != nil {
+		return errors.New("error generating refresh token")
+	}
+
+	session.AccessToken = accessToken
+	session.RefreshToken = refreshToken
+	session.ExpiresAt = time.Now().Add(time.Duration(config.AppConfig.JWT.AccessTokenExpiry) * time.Minute)
+	session.IsActive = true
+	if err := db.Create(session).Error; err != nil {
+		return errors.New("error creating session")
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package simhealth
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/dispatch"
+	"tsimserver/models"
+	"tsimserver/types"
+	"tsimserver/utils"
+
+	"gorm.io/gorm/clause"
+)
+
+// Loopback test states
+const (
+	StatusPending  = "pending"
+	StatusReceived = "received"
+	StatusFailed   = "failed"
+	StatusTimeout  = "timeout"
+)
+
+var (
+	// ErrNoReceiver is returned when no SIM can receive the test SMS
+	ErrNoReceiver = errors.New("no online SIM with a verified number is available to receive the test")
+	// ErrSenderUnavailable is returned when the sending SIM cannot send right now
+	ErrSenderUnavailable = errors.New("SIM is not active or its device is offline")
+	// ErrTestRunning is returned when the SIM already has a test in flight
+	ErrTestRunning = errors.New("a loopback test is already running for this SIM")
+)
+
+// RunTest sends a test SMS from a SIM to another of our SIMs. Without a receiver ID
+// a receiver is picked automatically.
+func RunTest(sender *models.SIMCard, receiverID uint, scheduled bool) (*models.SIMLoopbackTest, error) {
+	if !sender.IsActive || !sender.IsEnabled || !deviceOnline(sender.DeviceID) {
+		return nil, ErrSenderUnavailable
+	}
+
+	var running int64
+	database.DB.Model(&models.SIMLoopbackTest{}).
+		Where("sender_sim_card_id = ? AND status = ?", sender.ID, StatusPending).
+		Count(&running)
+	if running > 0 {
+		return nil, ErrTestRunning
+	}
+
+	receiver, err := findReceiver(sender, receiverID)
+	if err != nil {
+		return nil, err
+	}
+	if receiver == nil {
+		return nil, ErrNoReceiver
+	}
+
+	token, err := utils.RandomDigits(8)
+	if err != nil {
+		return nil, err
+	}
+
+	slot, _ := strconv.Atoi(sender.Identifier)
+	now := time.Now()
+	test := models.SIMLoopbackTest{
+		SenderSIMCardID:   sender.ID,
+		SenderDeviceID:    sender.DeviceID,
+		SenderSlot:        slot,
+		ReceiverSIMCardID: receiver.ID,
+		ReceiverDeviceID:  receiver.DeviceID,
+		ReceiverNumber:    receiver.PhoneNumber,
+		Token:             token,
+		Status:            StatusPending,
+		Scheduled:         scheduled,
+		SentAt:            now,
+	}
+	if err := database.DB.Create(&test).Error; err != nil {
+		return nil, err
+	}
+
+	message := strings.TrimSpace(config.AppConfig.Loopback.MessagePrefix + " " + token)
+	sms := models.SMSMessage{
+		DeviceID:      sender.DeviceID,
+		Type:          "outgoing",
+		Target:        receiver.PhoneNumber,
+		Message:       message,
+		SimSlot:       slot,
+		SIMCardID:     &sender.ID,
+		Status:        "pending",
+		Priority:      5, // Highest priority for test messages
+		IsTestMessage: true,
+		Timestamp:     now.Unix(),
+	}
+	if err := database.DB.Create(&sms).Error; err != nil {
+		return nil, err
+	}
+
+	// The message ID doubles as the internal log ID so delivery reports map back
+	database.DB.Model(&sms).Update("internal_log_id", int(sms.ID))
+	database.DB.Model(&test).Update("sms_message_id", sms.ID)
+	test.SMSMessageID = &sms.ID
+
+	command := types.SendSMSCommand{
+		Type:          "send_sms",
+		Target:        receiver.PhoneNumber,
+		SimSlot:       slot,
+		Message:       message,
+		InternalLogID: int(sms.ID),
+	}
+	sendErr := dispatch.ToDevice(sender.DeviceID, command)
+	if err := RecordSend(sender.ID, sendErr); err != nil {
+		log.Printf("Failed to update routing stats of SIM %d: %v", sender.ID, err)
+	}
+	if sendErr != nil {
+		database.DB.Model(&sms).Updates(map[string]interface{}{"status": "failed", "error_message": sendErr.Error()})
+		finish(&test, StatusFailed, sendErr.Error())
+		return &test, sendErr
+	}
+
+	database.DB.Model(&sms).Update("status", "sent")
+	return &test, nil
+}
+
+// MatchIncomingSMS completes the loopback test whose token an incoming SMS carries.
+// It reports whether the message was a loopback test.
+func MatchIncomingSMS(deviceID, message string) (bool, error) {
+	var tests []models.SIMLoopbackTest
+	if err := database.DB.Where("receiver_device_id = ? AND status = ?", deviceID, StatusPending).
+		Find(&tests).Error; err != nil {
+		return false, err
+	}
+
+	for i := range tests {
+		test := &tests[i]
+		if test.Token == "" || !strings.Contains(message, test.Token) {
+			continue
+		}
+
+		now := time.Now()
+		latency := now.Sub(test.SentAt).Milliseconds()
+		if err := database.DB.Model(test).Updates(map[string]interface{}{
+			"status":       StatusReceived,
+			"latency_ms":   latency,
+			"completed_at": now,
+		}).Error; err != nil {
+			return true, err
+		}
+
+		evaluatePair(test)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// StartScheduler starts the background job that tests SIMs periodically
+func StartScheduler() {
+	if !config.AppConfig.Loopback.Enabled {
+		log.Println("Loopback health tests disabled")
+		return
+	}
+
+	interval := time.Duration(config.AppConfig.Loopback.SchedulerInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			expireTests(now)
+			scheduleTests(now)
+		}
+	}()
+
+	log.Printf("Loopback health test scheduler started (interval %s)", interval)
+}
+
+// scheduleTests starts a test for every active SIM of an online device that is due
+func scheduleTests(now time.Time) {
+	var sims []models.SIMCard
+	if err := database.DB.
+		Joins("JOIN devices ON devices.device_id = sim_cards.device_id AND devices.deleted_at IS NULL").
+		Where("sim_cards.is_active = ? AND sim_cards.is_enabled = ?", true, true).
+		Where("devices.operator_status = ? AND devices.is_active = ?", "online", true).
+		Find(&sims).Error; err != nil {
+		log.Printf("Failed to load SIM cards for loopback tests: %v", err)
+		return
+	}
+
+	for i := range sims {
+		sim := &sims[i]
+		if !isDue(sim, now) {
+			continue
+		}
+
+		if _, err := RunTest(sim, 0, true); err != nil && !errors.Is(err, ErrNoReceiver) {
+			log.Printf("Failed to start loopback test for SIM %d: %v", sim.ID, err)
+		}
+	}
+}
+
+// isDue reports whether a SIM needs a new loopback test
+func isDue(sim *models.SIMCard, now time.Time) bool {
+	minutes := config.AppConfig.Loopback.TestInterval
+	if minutes <= 0 {
+		return false
+	}
+
+	var last models.SIMLoopbackTest
+	result := database.DB.Where("sender_sim_card_id = ?", sim.ID).Order("created_at DESC").Limit(1).Find(&last)
+	if result.Error != nil {
+		return false
+	}
+	if result.RowsAffected == 0 {
+		return true
+	}
+	if last.Status == StatusPending {
+		return false
+	}
+	return now.Sub(last.CreatedAt) >= time.Duration(minutes)*time.Minute
+}
+
+// expireTests fails tests whose SMS never arrived
+func expireTests(now time.Time) {
+	timeout := time.Duration(config.AppConfig.Loopback.Timeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+
+	var tests []models.SIMLoopbackTest
+	if err := database.DB.Where("status = ? AND sent_at < ?", StatusPending, now.Add(-timeout)).
+		Find(&tests).Error; err != nil {
+		log.Printf("Failed to load stale loopback tests: %v", err)
+		return
+	}
+
+	for i := range tests {
+		if err := finish(&tests[i], StatusTimeout, "test SMS was not received in time"); err != nil {
+			log.Printf("Failed to expire loopback test %d: %v", tests[i].ID, err)
+		}
+	}
+}
+
+// finish closes a test as failed and re-scores both SIMs
+func finish(test *models.SIMLoopbackTest, status, message string) error {
+	now := time.Now()
+	test.Status = status
+	test.ErrorMessage = message
+	test.CompletedAt = &now
+
+	if err := database.DB.Model(test).Updates(map[string]interface{}{
+		"status":        status,
+		"error_message": message,
+		"completed_at":  now,
+	}).Error; err != nil {
+		return err
+	}
+
+	evaluatePair(test)
+	return nil
+}
+
+// evaluatePair re-scores the sender and receiver of a finished test
+func evaluatePair(test *models.SIMLoopbackTest) {
+	for _, id := range []uint{test.SenderSIMCardID, test.ReceiverSIMCardID} {
+		if _, err := Evaluate(id); err != nil {
+			log.Printf("Failed to update health of SIM %d: %v", id, err)
+		}
+	}
+}
+
+// findReceiver loads the requested receiver or picks one. Healthy SIMs on other devices
+// in the same country are preferred so a failure points at the sender.
+func findReceiver(sender *models.SIMCard, receiverID uint) (*models.SIMCard, error) {
+	query := database.DB.
+		Joins("JOIN devices ON devices.device_id = sim_cards.device_id AND devices.deleted_at IS NULL").
+		Where("sim_cards.id <> ? AND sim_cards.number_verified_at IS NOT NULL AND sim_cards.phone_number <> ''", sender.ID).
+		Where("sim_cards.is_active = ? AND sim_cards.is_enabled = ?", true, true).
+		Where("devices.operator_status = ? AND devices.is_active = ?", "online", true)
+
+	if receiverID != 0 {
+		query = query.Where("sim_cards.id = ?", receiverID)
+	} else {
+		query = query.Order(clause.OrderBy{Expression: clause.Expr{
+			SQL: "CASE WHEN sim_cards.health_status = 'unhealthy' THEN 1 ELSE 0 END, " +
+				"CASE WHEN sim_cards.device_id <> ? THEN 0 ELSE 1 END, " +
+				"CASE WHEN sim_cards.mcc = ? THEN 0 ELSE 1 END, RANDOM()",
+			Vars:               []interface{}{sender.DeviceID, sender.MCC},
+			WithoutParentheses: true,
+		}})
+	}
+
+	var receiver models.SIMCard
+	result := query.Limit(1).Find(&receiver)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &receiver, nil
+}
+
+// deviceOnline reports whether a device is connected and active
+func deviceOnline(deviceID string) bool {
+	var device models.Device
+	if err := database.DB.Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return false
+	}
+	return device.IsActive && device.OperatorStatus == "online"
+}
@@ -0,0 +1,419 @@
+package simhealth
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/quarantine"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Routing score component weights; they add up to 100
+const (
+	weightDelivery = 40
+	weightLoopback = 20
+	weightLatency  = 15
+	weightSignal   = 15
+	weightSending  = 10
+)
+
+// Values assumed before a SIM has any history, so new SIMs get a fair share of traffic
+const (
+	priorDelivery = 0.9
+	priorLoopback = 0.8
+	priorSending  = 1.0
+)
+
+// neutralScore ranks SIMs whose routing score was never computed
+const neutralScore = 50
+
+// Delivery report outcomes
+const (
+	outcomeDelivered = "delivered"
+	outcomeFailed    = "failed"
+)
+
+// Component is one weighted part of a routing score
+type Component struct {
+	Name   string  `json:"name"`
+	Weight int     `json:"weight"`
+	Value  float64 `json:"value"`  // 0-1
+	Points float64 `json:"points"` // Value times weight
+	Detail string  `json:"detail"`
+}
+
+// Explanation shows how the routing score of a SIM is made up and where it ranks
+type Explanation struct {
+	SIMCardID    uint                    `json:"sim_card_id"`
+	Score        int                     `json:"score"`
+	Routable     bool                    `json:"routable"`
+	Reasons      []string                `json:"reasons"` // Why the SIM is kept out of routing
+	Components   []Component             `json:"components"`
+	ErrorPenalty float64                 `json:"error_penalty"`
+	SentToday    int                     `json:"sent_today"`
+	DailyLimit   int                     `json:"daily_limit"`
+	Rank         int                     `json:"rank"`          // Position among routable SIMs, 0 when excluded
+	RoutableSIMs int64                   `json:"routable_sims"` // Active, enabled and healthy SIMs of active devices
+	Stats        *models.SIMRoutingStats `json:"stats"`
+}
+
+// RecordSend updates a SIM's figures after a send command was dispatched or failed
+func RecordSend(simID uint, sendErr error) error {
+	failures := 0
+	if err := updateStats(simID, func(stats *models.SIMRoutingStats, sim *models.SIMCard, now time.Time) {
+		stats.Sent++
+		stats.SentToday++
+		if sendErr != nil {
+			stats.SendFailures++
+			stats.Failures++
+			failures = stats.Failures
+			stats.SendSuccessRate = average(stats.SendSuccessRate, 0)
+			penalize(stats, "send_failed", now)
+			return
+		}
+		stats.SendSuccessRate = average(stats.SendSuccessRate, 1)
+	}); err != nil {
+		return err
+	}
+
+	_, err := quarantine.Evaluate(simID, failures, "")
+	return err
+}
+
+// RecordDelivery updates the sending SIM's figures from a delivery report. previousStatus is
+// the message status before the report so repeated final reports are counted once.
+func RecordDelivery(sms *models.SMSMessage, previousStatus, errorCode string) error {
+	if deliveryOutcome(previousStatus) != "" {
+		return nil
+	}
+	outcome := deliveryOutcome(sms.Status)
+	if outcome == "" {
+		return nil
+	}
+
+	simID := sendingSIM(sms)
+	if simID == 0 {
+		return nil
+	}
+
+	latency := float64(time.Since(sms.CreatedAt).Milliseconds())
+	failures := 0
+	if err := updateStats(simID, func(stats *models.SIMRoutingStats, sim *models.SIMCard, now time.Time) {
+		if outcome == outcomeDelivered {
+			stats.Delivered++
+			stats.Failures = 0
+			stats.DeliveryRate = average(stats.DeliveryRate, 1)
+			stats.DLRLatencyMs = average(stats.DLRLatencyMs, latency)
+			return
+		}
+		stats.Undelivered++
+		stats.Failures++
+		failures = stats.Failures
+		stats.DeliveryRate = average(stats.DeliveryRate, 0)
+		penalize(stats, errorCode, now)
+	}); err != nil {
+		return err
+	}
+
+	// A run of failures or a block error code takes the SIM out of routing
+	_, err := quarantine.Evaluate(simID, failures, errorCode)
+	return err
+}
+
+// RecordSignals folds the current signal strength of a device's SIMs into their history
+func RecordSignals(deviceID string) error {
+	var sims []models.SIMCard
+	if err := database.DB.Where("device_id = ? AND is_active = ?", deviceID, true).Find(&sims).Error; err != nil {
+		return err
+	}
+
+	for _, sim := range sims {
+		if err := updateStats(sim.ID, func(stats *models.SIMRoutingStats, sim *models.SIMCard, now time.Time) {
+			stats.SignalLevel = average(stats.SignalLevel, signalLevel(sim.SignalStrength))
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Explain returns how the routing score of a SIM is made up
+func Explain(simID uint) (*Explanation, error) {
+	var sim models.SIMCard
+	if err := database.DB.Unscoped().Where("id = ?", simID).First(&sim).Error; err != nil {
+		return nil, err
+	}
+
+	stats := models.SIMRoutingStats{SIMCardID: simID}
+	if err := database.DB.Where("sim_card_id = ?", simID).Limit(1).Find(&stats).Error; err != nil {
+		return nil, err
+	}
+
+	explanation := explain(&sim, &stats, time.Now())
+	explanation.Stats = &stats
+
+	routable := database.DB.Model(&models.SIMCard{}).
+		Joins("JOIN devices ON devices.device_id = sim_cards.device_id AND devices.deleted_at IS NULL").
+		Where("sim_cards.is_active = ? AND sim_cards.is_enabled = ? AND devices.is_active = ?", true, true, true).
+		Where("sim_cards.health_status <> ?", HealthUnhealthy)
+	routable.Count(&explanation.RoutableSIMs)
+
+	if explanation.Routable {
+		var better int64
+		routable.Where("sim_cards.health_score > ?", explanation.Score).Count(&better)
+		explanation.Rank = int(better) + 1
+	}
+
+	return explanation, nil
+}
+
+// Routable reports whether the router may send through a SIM
+func Routable(sim *models.SIMCard) bool {
+	if !sim.IsActive || !sim.IsEnabled || sim.HealthStatus == HealthUnhealthy {
+		return false
+	}
+	if sim.DailySMSLimit <= 0 {
+		return true
+	}
+
+	var stats models.SIMRoutingStats
+	if err := database.DB.Where("sim_card_id = ?", sim.ID).Limit(1).Find(&stats).Error; err != nil {
+		return true
+	}
+	return sentToday(&stats, time.Now()) < sim.DailySMSLimit
+}
+
+// RankScore returns the score the router orders SIMs by
+func RankScore(sim *models.SIMCard) int {
+	if sim.HealthScore == nil {
+		return neutralScore
+	}
+	return *sim.HealthScore
+}
+
+// setLoopbackScore stores the latest loopback score of a SIM and re-scores it
+func setLoopbackScore(simID uint, score *int) error {
+	return updateStats(simID, func(stats *models.SIMRoutingStats, sim *models.SIMCard, now time.Time) {
+		stats.LoopbackScore = score
+	})
+}
+
+// updateStats applies an event to a SIM's figures under a row lock and stores the new score
+func updateStats(simID uint, apply func(stats *models.SIMRoutingStats, sim *models.SIMCard, now time.Time)) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var sim models.SIMCard
+		if err := tx.Unscoped().Where("id = ?", simID).First(&sim).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&models.SIMRoutingStats{SIMCardID: simID}).Error; err != nil {
+			return err
+		}
+
+		var stats models.SIMRoutingStats
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("sim_card_id = ?", simID).First(&stats).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		stats.ErrorPenalty = decayedPenalty(&stats, now)
+		stats.SentToday = sentToday(&stats, now)
+		stats.QuotaDay = now.Format("2006-01-02")
+
+		apply(&stats, &sim, now)
+		if err := tx.Save(&stats).Error; err != nil {
+			return err
+		}
+
+		explanation := explain(&sim, &stats, now)
+		return tx.Unscoped().Model(&sim).Update("health_score", explanation.Score).Error
+	})
+}
+
+// explain computes the routing score of a SIM from its figures
+func explain(sim *models.SIMCard, stats *models.SIMRoutingStats, now time.Time) *Explanation {
+	explanation := &Explanation{
+		SIMCardID:    sim.ID,
+		ErrorPenalty: math.Round(decayedPenalty(stats, now)*10) / 10,
+		SentToday:    sentToday(stats, now),
+		DailyLimit:   sim.DailySMSLimit,
+		Reasons:      []string{},
+	}
+
+	delivery := component("delivery", weightDelivery, valueOr(stats.DeliveryRate, priorDelivery),
+		fmt.Sprintf("%d delivered, %d undelivered", stats.Delivered, stats.Undelivered))
+
+	loopback := component("loopback", weightLoopback, priorLoopback, "no loopback tests yet")
+	if stats.LoopbackScore != nil {
+		loopback = component("loopback", weightLoopback, float64(*stats.LoopbackScore)/100,
+			fmt.Sprintf("loopback score %d", *stats.LoopbackScore))
+	}
+
+	latency := component("dlr_latency", weightLatency, 1, "no delivery reports yet")
+	if stats.DLRLatencyMs != nil {
+		latency = component("dlr_latency", weightLatency, latencyValue(*stats.DLRLatencyMs),
+			fmt.Sprintf("average delivery report after %.1fs", *stats.DLRLatencyMs/1000))
+	}
+
+	signal := component("signal", weightSignal, valueOr(stats.SignalLevel, signalLevel(sim.SignalStrength)),
+		fmt.Sprintf("current signal strength %d", sim.SignalStrength))
+
+	sending := component("sending", weightSending, valueOr(stats.SendSuccessRate, priorSending),
+		fmt.Sprintf("%d sent, %d failed to dispatch", stats.Sent, stats.SendFailures))
+
+	explanation.Components = []Component{delivery, loopback, latency, signal, sending}
+
+	total := -explanation.ErrorPenalty
+	for _, c := range explanation.Components {
+		total += c.Points
+	}
+	explanation.Score = int(math.Round(math.Max(0, math.Min(100, total))))
+
+	if !sim.IsActive {
+		explanation.Reasons = append(explanation.Reasons, "SIM is not active")
+	}
+	if sim.IsQuarantined {
+		explanation.Reasons = append(explanation.Reasons, "SIM is quarantined")
+	} else if !sim.IsEnabled {
+		explanation.Reasons = append(explanation.Reasons, "SIM is disabled")
+	}
+	if sim.HealthStatus == HealthUnhealthy {
+		explanation.Reasons = append(explanation.Reasons, "SIM failed its recent loopback tests")
+	}
+	if sim.DailySMSLimit > 0 && explanation.SentToday >= sim.DailySMSLimit {
+		explanation.Reasons = append(explanation.Reasons, fmt.Sprintf("daily limit of %d SMS reached", sim.DailySMSLimit))
+	}
+	explanation.Routable = len(explanation.Reasons) == 0
+
+	return explanation
+}
+
+// component builds a weighted score component
+func component(name string, weight int, value float64, detail string) Component {
+	value = math.Max(0, math.Min(1, value))
+	return Component{
+		Name:   name,
+		Weight: weight,
+		Value:  math.Round(value*1000) / 1000,
+		Points: math.Round(value*float64(weight)*10) / 10,
+		Detail: detail,
+	}
+}
+
+// penalize adds error points for a failed send or delivery
+func penalize(stats *models.SIMRoutingStats, errorCode string, now time.Time) {
+	points := config.AppConfig.Routing.ErrorPenalty
+	for _, code := range config.AppConfig.Routing.SevereErrorCodes {
+		if errorCode != "" && strings.EqualFold(code, errorCode) {
+			points = config.AppConfig.Routing.SevereErrorPenalty
+			break
+		}
+	}
+
+	stats.ErrorPenalty += points
+	stats.LastErrorCode = errorCode
+	stats.LastErrorAt = &now
+}
+
+// decayedPenalty halves error points every configured half-life since the last update
+func decayedPenalty(stats *models.SIMRoutingStats, now time.Time) float64 {
+	halfLife := config.AppConfig.Routing.PenaltyHalfLife
+	if stats.ErrorPenalty <= 0 || halfLife <= 0 || stats.UpdatedAt.IsZero() {
+		return stats.ErrorPenalty
+	}
+
+	hours := now.Sub(stats.UpdatedAt).Hours()
+	penalty := stats.ErrorPenalty * math.Pow(0.5, hours/float64(halfLife))
+	if penalty < 0.1 {
+		return 0
+	}
+	return penalty
+}
+
+// sentToday returns the SMS a SIM sent on the current day
+func sentToday(stats *models.SIMRoutingStats, now time.Time) int {
+	if stats.QuotaDay != now.Format("2006-01-02") {
+		return 0
+	}
+	return stats.SentToday
+}
+
+// latencyValue scores delivery report latency from 1 at the configured latency to 0 at four times it
+func latencyValue(latencyMs float64) float64 {
+	slow := float64(config.AppConfig.Routing.SlowDLRLatency) * 1000
+	if slow <= 0 || latencyMs <= slow {
+		return 1
+	}
+	return 1 - (latencyMs-slow)/(3*slow)
+}
+
+// average folds a sample into an exponentially weighted average
+func average(current *float64, sample float64) *float64 {
+	if current == nil {
+		return &sample
+	}
+
+	alpha := config.AppConfig.Routing.Smoothing
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.1
+	}
+	value := *current + alpha*(sample-*current)
+	return &value
+}
+
+// valueOr returns a running value or the fallback when there is none yet
+func valueOr(value *float64, fallback float64) float64 {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
+
+// signalLevel maps a reported signal strength to 0-1. Devices report either
+// Android signal bars (0-4) or a percentage.
+func signalLevel(strength int) float64 {
+	switch {
+	case strength <= 0:
+		return 0
+	case strength <= 4:
+		return float64(strength) / 4
+	case strength >= 100:
+		return 1
+	}
+	return float64(strength) / 100
+}
+
+// deliveryOutcome classifies a message status as a final delivery result
+func deliveryOutcome(status string) string {
+	switch strings.ToUpper(strings.TrimSpace(status)) {
+	case "DELIVRD", "DELIVERED":
+		return outcomeDelivered
+	case "UNDELIV", "UNDELIVERED", "REJECTD", "REJECTED", "EXPIRED", "DELETED", "FAILED":
+		return outcomeFailed
+	}
+	return ""
+}
+
+// sendingSIM returns the SIM a message was sent from, looking it up by slot for older messages
+func sendingSIM(sms *models.SMSMessage) uint {
+	if sms.SIMCardID != nil {
+		return *sms.SIMCardID
+	}
+
+	var sim models.SIMCard
+	result := database.DB.Where("device_id = ? AND identifier = ?", sms.DeviceID, strconv.Itoa(sms.SimSlot)).
+		Limit(1).Find(&sim)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return 0
+	}
+	return sim.ID
+}
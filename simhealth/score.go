@@ -0,0 +1,169 @@
+package simhealth
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"tsimserver/alarms"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+)
+
+// SIM health states
+const (
+	HealthUnknown   = "unknown"
+	HealthHealthy   = "healthy"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+)
+
+// AlarmSIMUnhealthy is raised when a SIM keeps failing loopback tests
+const AlarmSIMUnhealthy = "sim_unhealthy"
+
+// healthyScore is the lowest score a SIM counts as healthy with
+const healthyScore = 80
+
+// Report explains the loopback health of a SIM
+type Report struct {
+	SIMCardID       uint   `json:"sim_card_id"`
+	Score           *int   `json:"score"`
+	Status          string `json:"status"`
+	Tests           int    `json:"tests"`            // Finished tests in the window
+	Received        int    `json:"received"`         // Tests whose SMS arrived
+	AvgLatencyMs    int64  `json:"avg_latency_ms"`   // Average latency of received tests
+	LatencyPenalty  int    `json:"latency_penalty"`  // Points taken off for slow delivery
+	SendFailures    int    `json:"send_failures"`    // Consecutive failed tests as sender
+	ReceiveFailures int    `json:"receive_failures"` // Consecutive failed tests as receiver
+}
+
+// Assess computes the health of a SIM from its most recent finished loopback tests
+func Assess(simID uint) (*Report, error) {
+	window := config.AppConfig.Loopback.Window
+	if window <= 0 {
+		window = 10
+	}
+
+	var tests []models.SIMLoopbackTest
+	if err := database.DB.Where("(sender_sim_card_id = ? OR receiver_sim_card_id = ?) AND status <> ?", simID, simID, StatusPending).
+		Order("created_at DESC").Limit(window).Find(&tests).Error; err != nil {
+		return nil, err
+	}
+
+	report := &Report{SIMCardID: simID, Status: HealthUnknown, Tests: len(tests)}
+	if len(tests) == 0 {
+		return report, nil
+	}
+
+	var latencyTotal int64
+	sendStreak, receiveStreak := true, true
+	for _, test := range tests {
+		if test.Status == StatusReceived {
+			report.Received++
+			if test.LatencyMs != nil {
+				latencyTotal += *test.LatencyMs
+			}
+		}
+
+		// Failures only count while they are unbroken from the newest test
+		if test.SenderSIMCardID == simID && sendStreak {
+			if test.Status == StatusReceived {
+				sendStreak = false
+			} else {
+				report.SendFailures++
+			}
+		}
+		if test.ReceiverSIMCardID == simID && receiveStreak {
+			if test.Status == StatusReceived {
+				receiveStreak = false
+			} else {
+				report.ReceiveFailures++
+			}
+		}
+	}
+
+	score := report.Received * 100 / report.Tests
+	if report.Received > 0 {
+		report.AvgLatencyMs = latencyTotal / int64(report.Received)
+		report.LatencyPenalty = latencyPenalty(report.AvgLatencyMs)
+		score -= report.LatencyPenalty
+	}
+	if score < 0 {
+		score = 0
+	}
+	report.Score = &score
+
+	limit := config.AppConfig.Loopback.UnhealthyAfter
+	switch {
+	case limit > 0 && (report.SendFailures >= limit || report.ReceiveFailures >= limit):
+		report.Status = HealthUnhealthy
+	case score >= healthyScore:
+		report.Status = HealthHealthy
+	default:
+		report.Status = HealthDegraded
+	}
+
+	return report, nil
+}
+
+// Evaluate recomputes and stores the loopback health of a SIM, raising or resolving its alarm
+func Evaluate(simID uint) (*Report, error) {
+	report, err := Assess(simID)
+	if err != nil {
+		return nil, err
+	}
+
+	var sim models.SIMCard
+	if err := database.DB.Unscoped().Where("id = ?", simID).First(&sim).Error; err != nil {
+		return nil, err
+	}
+
+	if err := database.DB.Unscoped().Model(&sim).Updates(map[string]interface{}{
+		"health_status":     report.Status,
+		"health_checked_at": time.Now(),
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	// The loopback score feeds the routing score
+	if err := setLoopbackScore(simID, report.Score); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case report.Status == HealthUnhealthy && sim.HealthStatus != HealthUnhealthy:
+		message := fmt.Sprintf("SIM in slot %s failed %d loopback tests as sender and %d as receiver in a row",
+			sim.Identifier, report.SendFailures, report.ReceiveFailures)
+		if _, _, err := alarms.RaiseOnce(sim.DeviceID, AlarmSIMUnhealthy, "SIM unhealthy", message, "high"); err != nil {
+			log.Printf("Failed to raise SIM health alarm for device %s: %v", sim.DeviceID, err)
+		}
+	case report.Status != HealthUnhealthy && sim.HealthStatus == HealthUnhealthy:
+		// Other SIMs of the device may still be unhealthy
+		var unhealthy int64
+		database.DB.Model(&models.SIMCard{}).
+			Where("device_id = ? AND id <> ? AND health_status = ?", sim.DeviceID, sim.ID, HealthUnhealthy).
+			Count(&unhealthy)
+		if unhealthy == 0 {
+			if err := alarms.Resolve(sim.DeviceID, AlarmSIMUnhealthy); err != nil {
+				log.Printf("Failed to resolve SIM health alarm for device %s: %v", sim.DeviceID, err)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// latencyPenalty takes up to 20 points off for deliveries slower than the configured
+// latency, reaching the maximum at four times that latency
+func latencyPenalty(avgMs int64) int {
+	slow := int64(config.AppConfig.Loopback.SlowLatency) * 1000
+	if slow <= 0 || avgMs <= slow {
+		return 0
+	}
+
+	penalty := int((avgMs - slow) * 20 / (3 * slow))
+	if penalty > 20 {
+		penalty = 20
+	}
+	return penalty
+}
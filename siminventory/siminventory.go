@@ -0,0 +1,265 @@
+package siminventory
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+	"tsimserver/alarms"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/phonenumber"
+	"tsimserver/types"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SIM card event types recorded in the inventory history
+const (
+	EventInserted    = "inserted"
+	EventRemoved     = "removed"
+	EventMoved       = "moved"
+	EventSlotChanged = "slot_changed"
+)
+
+// Alarm types raised by the inventory
+const (
+	AlarmSIMRemoved = "sim_card_removed"
+	AlarmSIMMoved   = "sim_card_moved"
+)
+
+// iccidConflict skips inserting a card whose ICCID a concurrent report inserted first. The
+// target repeats the predicate of the partial unique index, the database matches it literally.
+var iccidConflict = clause.OnConflict{
+	Columns:     []clause.Column{{Name: "iccid"}},
+	TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "iccid <> ''"}}},
+	DoNothing:   true,
+}
+
+// pendingAlarm is raised after the inventory transaction commits
+type pendingAlarm struct {
+	deviceID  string
+	alarmType string
+	title     string
+	message   string
+}
+
+// Sync reconciles the SIM cards reported by a device with the inventory.
+// SIMs keep their ID across reports; they are matched by ICCID, then IMSI, then slot.
+// SIMs that appear on the device get their phone number discovered.
+func Sync(deviceID string, reported []types.SIMCardInfo) error {
+	var raised []pendingAlarm
+	var appeared []uint
+	now := time.Now()
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var current []models.SIMCard
+		if err := tx.Where("device_id = ?", deviceID).Find(&current).Error; err != nil {
+			return err
+		}
+
+		seen := make(map[uint]bool)
+		for _, info := range reported {
+			sim, err := findSIM(tx, deviceID, info)
+			if err != nil {
+				return err
+			}
+
+			if sim == nil {
+				created := &models.SIMCard{DeviceID: deviceID, IsEnabled: true}
+				applyInfo(created, info, now)
+				result := tx.Clauses(iccidConflict).Create(created)
+				if result.Error != nil {
+					return result.Error
+				}
+				if result.RowsAffected > 0 {
+					if err := recordEvent(tx, created, EventInserted, "", ""); err != nil {
+						return err
+					}
+					seen[created.ID] = true
+					appeared = append(appeared, created.ID)
+					continue
+				}
+
+				// Another report inserted the card since the lookup, update its record
+				if sim, err = findSIM(tx, deviceID, info); err != nil {
+					return err
+				}
+				if sim == nil {
+					return fmt.Errorf("SIM %s was inserted concurrently but cannot be found", info.ICCID)
+				}
+			}
+
+			previousDevice := sim.DeviceID
+			previousSlot := sim.Identifier
+			wasRemoved := sim.DeletedAt.Valid
+
+			sim.DeviceID = deviceID
+			sim.DeletedAt = gorm.DeletedAt{}
+			applyInfo(sim, info, now)
+			if err := tx.Unscoped().Save(sim).Error; err != nil {
+				return err
+			}
+			seen[sim.ID] = true
+
+			switch {
+			case previousDevice != deviceID:
+				if err := recordEvent(tx, sim, EventMoved, previousDevice, previousSlot); err != nil {
+					return err
+				}
+				appeared = append(appeared, sim.ID)
+				raised = append(raised, pendingAlarm{
+					deviceID:  deviceID,
+					alarmType: AlarmSIMMoved,
+					title:     "SIM card moved",
+					message: fmt.Sprintf("SIM %s moved from device %s slot %s to device %s slot %s",
+						simLabel(sim), previousDevice, previousSlot, deviceID, sim.Identifier),
+				})
+			case wasRemoved:
+				if err := recordEvent(tx, sim, EventInserted, "", previousSlot); err != nil {
+					return err
+				}
+				appeared = append(appeared, sim.ID)
+			case previousSlot != sim.Identifier:
+				if err := recordEvent(tx, sim, EventSlotChanged, "", previousSlot); err != nil {
+					return err
+				}
+			}
+		}
+
+		// SIMs the device no longer reports have been taken out
+		for i := range current {
+			sim := &current[i]
+			if seen[sim.ID] {
+				continue
+			}
+
+			if err := tx.Delete(sim).Error; err != nil {
+				return err
+			}
+			if err := recordEvent(tx, sim, EventRemoved, "", ""); err != nil {
+				return err
+			}
+			raised = append(raised, pendingAlarm{
+				deviceID:  deviceID,
+				alarmType: AlarmSIMRemoved,
+				title:     "SIM card removed",
+				message:   fmt.Sprintf("SIM %s disappeared from device %s slot %s", simLabel(sim), deviceID, sim.Identifier),
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, alarm := range raised {
+		if _, err := alarms.Raise(alarm.deviceID, alarm.alarmType, alarm.title, alarm.message, "medium"); err != nil {
+			log.Printf("Failed to raise %s alarm for device %s: %v", alarm.alarmType, alarm.deviceID, err)
+		}
+	}
+
+	phonenumber.DiscoverNew(appeared)
+	return nil
+}
+
+// SIMCardIDForSlot returns the ID of the SIM in a device slot, or nil when the slot is empty
+func SIMCardIDForSlot(deviceID string, slot int) *uint {
+	var simCard models.SIMCard
+	result := database.DB.Where("device_id = ? AND identifier = ?", deviceID, strconv.Itoa(slot)).Limit(1).Find(&simCard)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil
+	}
+	return &simCard.ID
+}
+
+// findSIM looks up an existing SIM, including removed ones, for a reported SIM. It tries
+// the ICCID, then the IMSI, then the slot, so a SIM first seen with fewer identifiers is
+// still found once the device reports more of them.
+func findSIM(tx *gorm.DB, deviceID string, info types.SIMCardInfo) (*models.SIMCard, error) {
+	var lookups []*gorm.DB
+	if info.ICCID != "" {
+		lookups = append(lookups, tx.Unscoped().Where("iccid = ?", info.ICCID))
+	}
+	if info.IMSI != "" {
+		// A record with another ICCID is a different SIM card with the same subscription
+		query := tx.Unscoped().Where("imsi = ?", info.IMSI)
+		if info.ICCID != "" {
+			query = query.Where("iccid = ?", "")
+		}
+		lookups = append(lookups, query)
+	}
+	// Without a known identity we can only assume the slot still holds the same SIM
+	lookups = append(lookups, tx.Where("device_id = ? AND identifier = ? AND iccid = ? AND imsi = ?",
+		deviceID, info.Identifier, "", ""))
+
+	for _, query := range lookups {
+		var sim models.SIMCard
+		result := query.Order("updated_at DESC").Limit(1).Find(&sim)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected > 0 {
+			return &sim, nil
+		}
+	}
+	return nil, nil
+}
+
+// applyInfo copies the reported SIM details onto the inventory record
+func applyInfo(sim *models.SIMCard, info types.SIMCardInfo, now time.Time) {
+	sim.Identifier = info.Identifier
+	sim.IMEI = info.IMEI
+	sim.Operator = info.Operator
+	sim.SignalStrength = info.SignalStrength
+	sim.NetworkType = info.NetworkType
+	sim.MCC = info.MCC
+	sim.MNC = info.MNC
+	sim.IsActive = info.IsActive
+	sim.LastSeenAt = now
+
+	// Identifiers fill in as the device reports them and are not lost when it cannot
+	if info.ICCID != "" {
+		sim.ICCID = info.ICCID
+	}
+	if info.IMSI != "" {
+		sim.IMSI = info.IMSI
+	}
+
+	// Keep a discovered number when the device cannot read it, and never let
+	// the number stored on the SIM override a verified one
+	if info.PhoneNumber != "" && sim.NumberVerifiedAt == nil {
+		sim.PhoneNumber = info.PhoneNumber
+		sim.NumberMethod = phonenumber.MethodDevice
+	}
+}
+
+// recordEvent appends an entry to the SIM history
+func recordEvent(tx *gorm.DB, sim *models.SIMCard, eventType, previousDeviceID, previousSlot string) error {
+	event := models.SIMCardEvent{
+		SIMCardID:        sim.ID,
+		EventType:        eventType,
+		DeviceID:         sim.DeviceID,
+		PreviousDeviceID: previousDeviceID,
+		Slot:             sim.Identifier,
+		PreviousSlot:     previousSlot,
+		IMSI:             sim.IMSI,
+		ICCID:            sim.ICCID,
+		Operator:         sim.Operator,
+	}
+
+	return tx.Create(&event).Error
+}
+
+// simLabel returns a human readable identity for alarm messages
+func simLabel(sim *models.SIMCard) string {
+	if sim.ICCID != "" {
+		return sim.ICCID
+	}
+	if sim.IMSI != "" {
+		return sim.IMSI
+	}
+	return fmt.Sprintf("#%d", sim.ID)
+}
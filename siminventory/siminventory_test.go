@@ -0,0 +1,80 @@
+package siminventory
+
+import (
+	"testing"
+	"tsimserver/database"
+	"tsimserver/models"
+	"tsimserver/testutil"
+	"tsimserver/types"
+
+	"gorm.io/gorm"
+)
+
+// setupInventory creates the inventory tables without automatic number discovery
+func setupInventory(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	cfg := testutil.LoadConfig(t)
+	cfg.PhoneNumber.AutoDiscover = false
+	return testutil.OpenDatabase(t, &models.SIMCard{}, &models.SIMCardEvent{})
+}
+
+// simCount returns the number of records of a card, removed ones included
+func simCount(t *testing.T, iccid string) int64 {
+	t.Helper()
+
+	var count int64
+	database.DB.Unscoped().Model(&models.SIMCard{}).Where("iccid = ?", iccid).Count(&count)
+	return count
+}
+
+func TestICCIDIsUnique(t *testing.T) {
+	db := setupInventory(t)
+
+	if err := db.Create(&models.SIMCard{DeviceID: "device-a", ICCID: "8990001"}).Error; err != nil {
+		t.Fatalf("creating SIM: %v", err)
+	}
+	if err := db.Create(&models.SIMCard{DeviceID: "device-b", ICCID: "8990001"}).Error; err == nil {
+		t.Error("a second record with the same ICCID was created")
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.Create(&models.SIMCard{DeviceID: "device-a"}).Error; err != nil {
+			t.Errorf("creating a SIM without ICCID: %v", err)
+		}
+	}
+}
+
+func TestSyncUpdatesCardInsertedConcurrently(t *testing.T) {
+	db := setupInventory(t)
+
+	// Insert the card from another report right before Sync inserts it
+	raced := false
+	err := db.Callback().Create().Before("gorm:create").Register("test:race", func(tx *gorm.DB) {
+		if raced || tx.Statement.Table != "sim_cards" {
+			return
+		}
+		raced = true
+		tx.Session(&gorm.Session{NewDB: true}).Exec(
+			"INSERT INTO sim_cards (device_id, identifier, iccid, is_enabled) VALUES (?, ?, ?, ?)",
+			"device-a", "1", "8990001", true)
+	})
+	if err != nil {
+		t.Fatalf("registering callback: %v", err)
+	}
+
+	reported := []types.SIMCardInfo{{Identifier: "1", ICCID: "8990001", Operator: "Turkcell", IsActive: true}}
+	if err := Sync("device-a", reported); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if !raced {
+		t.Fatal("the concurrent insert did not run")
+	}
+	if count := simCount(t, "8990001"); count != 1 {
+		t.Fatalf("%d records of the card, want 1", count)
+	}
+	var sim models.SIMCard
+	database.DB.Where("iccid = ?", "8990001").First(&sim)
+	if sim.Operator != "Turkcell" || !sim.IsActive {
+		t.Errorf("the concurrently inserted record was not updated: %+v", sim)
+	}
+}
@@ -0,0 +1,175 @@
+package telemetry
+
+import (
+	"fmt"
+	"time"
+	"tsimserver/database"
+	"tsimserver/models"
+)
+
+// maxRawPoints caps raw series so a wide range cannot pull the whole table
+const maxRawPoints = 10000
+
+// Query selects telemetry series for a device
+type Query struct {
+	DeviceID   string
+	SIMCardID  *uint
+	Metric     string
+	From       time.Time
+	To         time.Time
+	Resolution string // raw, 1m, 1h or empty for automatic
+}
+
+// Point is one chart point of a series
+type Point struct {
+	Time  time.Time `json:"t"`
+	Avg   float64   `json:"avg"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Count int64     `json:"count"`
+	Label string    `json:"label,omitempty"`
+}
+
+// Series is an ordered list of points for one device or SIM card metric
+type Series struct {
+	DeviceID   string  `json:"device_id"`
+	SIMCardID  uint    `json:"sim_card_id"`
+	Metric     string  `json:"metric"`
+	Resolution string  `json:"resolution"`
+	Points     []Point `json:"points"`
+}
+
+// IsValidMetric reports whether the metric is recorded by the telemetry subsystem
+func IsValidMetric(metric string) bool {
+	switch metric {
+	case MetricBatteryLevel, MetricLatitude, MetricLongitude, MetricSignalStrength:
+		return true
+	}
+	return false
+}
+
+// ChooseResolution picks a resolution that keeps the number of points chartable
+func ChooseResolution(from, to time.Time) string {
+	span := to.Sub(from)
+	switch {
+	case span <= 2*time.Hour:
+		return ResolutionRaw
+	case span <= 3*24*time.Hour:
+		return ResolutionMinute
+	default:
+		return ResolutionHour
+	}
+}
+
+// QuerySeries returns one series per SIM card (or a single device series) for the query
+func QuerySeries(q Query) ([]Series, error) {
+	if !IsValidMetric(q.Metric) {
+		return nil, fmt.Errorf("unknown metric %q", q.Metric)
+	}
+	if !q.From.Before(q.To) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+
+	resolution := q.Resolution
+	if resolution == "" {
+		resolution = ChooseResolution(q.From, q.To)
+	}
+
+	switch resolution {
+	case ResolutionRaw:
+		return queryRaw(q)
+	case ResolutionMinute, ResolutionHour:
+		return queryRollups(q, resolution)
+	default:
+		return nil, fmt.Errorf("unknown resolution %q", resolution)
+	}
+}
+
+// queryRaw returns raw samples as single-sample points
+func queryRaw(q Query) ([]Series, error) {
+	query := database.DB.Where("device_id = ? AND metric = ? AND recorded_at >= ? AND recorded_at < ?",
+		q.DeviceID, q.Metric, q.From, q.To)
+	if q.SIMCardID != nil {
+		query = query.Where("sim_card_id = ?", *q.SIMCardID)
+	}
+
+	var samples []models.TelemetrySample
+	if err := query.Order("recorded_at ASC").Limit(maxRawPoints).Find(&samples).Error; err != nil {
+		return nil, err
+	}
+
+	grouped := newGrouper(q, ResolutionRaw)
+	for _, sample := range samples {
+		grouped.add(sample.SIMCardID, Point{
+			Time:  sample.RecordedAt,
+			Avg:   sample.Value,
+			Min:   sample.Value,
+			Max:   sample.Value,
+			Count: 1,
+			Label: sample.Label,
+		})
+	}
+
+	return grouped.series, nil
+}
+
+// queryRollups returns pre-aggregated buckets
+func queryRollups(q Query, resolution string) ([]Series, error) {
+	query := database.DB.Where("device_id = ? AND metric = ? AND resolution = ? AND bucket_start >= ? AND bucket_start < ?",
+		q.DeviceID, q.Metric, resolution, q.From, q.To)
+	if q.SIMCardID != nil {
+		query = query.Where("sim_card_id = ?", *q.SIMCardID)
+	}
+
+	var rollups []models.TelemetryRollup
+	if err := query.Order("bucket_start ASC").Find(&rollups).Error; err != nil {
+		return nil, err
+	}
+
+	grouped := newGrouper(q, resolution)
+	for _, rollup := range rollups {
+		grouped.add(rollup.SIMCardID, Point{
+			Time:  rollup.BucketStart,
+			Avg:   rollup.AvgValue,
+			Min:   rollup.MinValue,
+			Max:   rollup.MaxValue,
+			Count: rollup.SampleCount,
+			Label: rollup.LastLabel,
+		})
+	}
+
+	return grouped.series, nil
+}
+
+// grouper splits ordered points into one series per SIM card
+type grouper struct {
+	query      Query
+	resolution string
+	index      map[uint]int
+	series     []Series
+}
+
+func newGrouper(q Query, resolution string) *grouper {
+	return &grouper{
+		query:      q,
+		resolution: resolution,
+		index:      make(map[uint]int),
+		series:     []Series{},
+	}
+}
+
+func (g *grouper) add(simCardID uint, point Point) {
+	i, ok := g.index[simCardID]
+	if !ok {
+		g.series = append(g.series, Series{
+			DeviceID:   g.query.DeviceID,
+			SIMCardID:  simCardID,
+			Metric:     g.query.Metric,
+			Resolution: g.resolution,
+			Points:     []Point{},
+		})
+		i = len(g.series) - 1
+		g.index[simCardID] = i
+	}
+	g.series[i].Points = append(g.series[i].Points, point)
+}
@@ -0,0 +1,129 @@
+package telemetry
+
+import (
+	"log"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/models"
+)
+
+// rollupMinuteSQL aggregates raw samples into 1m buckets
+const rollupMinuteSQL = `
+INSERT INTO telemetry_rollups
+	(device_id, sim_card_id, metric, resolution, bucket_start, sample_count, sum_value, min_value, max_value, avg_value, last_label, created_at, updated_at)
+SELECT device_id, sim_card_id, metric, '1m', date_trunc('minute', recorded_at),
+	COUNT(*), SUM(value), MIN(value), MAX(value), AVG(value),
+	(array_agg(label ORDER BY recorded_at DESC))[1], NOW(), NOW()
+FROM telemetry_samples
+WHERE recorded_at >= ? AND recorded_at < ?
+GROUP BY device_id, sim_card_id, metric, date_trunc('minute', recorded_at)
+ON CONFLICT (device_id, sim_card_id, metric, resolution, bucket_start) DO UPDATE SET
+	sample_count = EXCLUDED.sample_count,
+	sum_value = EXCLUDED.sum_value,
+	min_value = EXCLUDED.min_value,
+	max_value = EXCLUDED.max_value,
+	avg_value = EXCLUDED.avg_value,
+	last_label = EXCLUDED.last_label,
+	updated_at = NOW()`
+
+// rollupHourSQL aggregates 1m buckets into 1h buckets
+const rollupHourSQL = `
+INSERT INTO telemetry_rollups
+	(device_id, sim_card_id, metric, resolution, bucket_start, sample_count, sum_value, min_value, max_value, avg_value, last_label, created_at, updated_at)
+SELECT device_id, sim_card_id, metric, '1h', date_trunc('hour', bucket_start),
+	SUM(sample_count), SUM(sum_value), MIN(min_value), MAX(max_value), SUM(sum_value) / SUM(sample_count),
+	(array_agg(last_label ORDER BY bucket_start DESC))[1], NOW(), NOW()
+FROM telemetry_rollups
+WHERE resolution = '1m' AND bucket_start >= ? AND bucket_start < ?
+GROUP BY device_id, sim_card_id, metric, date_trunc('hour', bucket_start)
+ON CONFLICT (device_id, sim_card_id, metric, resolution, bucket_start) DO UPDATE SET
+	sample_count = EXCLUDED.sample_count,
+	sum_value = EXCLUDED.sum_value,
+	min_value = EXCLUDED.min_value,
+	max_value = EXCLUDED.max_value,
+	avg_value = EXCLUDED.avg_value,
+	last_label = EXCLUDED.last_label,
+	updated_at = NOW()`
+
+// StartRollups starts the background downsampling and retention job
+func StartRollups() {
+	interval := time.Duration(config.AppConfig.Telemetry.RollupInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastCleanup := time.Time{}
+		for now := range ticker.C {
+			if err := Rollup(now); err != nil {
+				log.Printf("Telemetry rollup failed: %v", err)
+			}
+
+			if now.Sub(lastCleanup) >= time.Hour {
+				if err := ApplyRetention(now); err != nil {
+					log.Printf("Telemetry retention failed: %v", err)
+				}
+				lastCleanup = now
+			}
+		}
+	}()
+
+	log.Printf("Telemetry rollups started (interval %s)", interval)
+}
+
+// Rollup recomputes the recent 1m and 1h buckets. Buckets are recomputed from
+// their source rows, so running it repeatedly or on several instances is safe.
+func Rollup(now time.Time) error {
+	// Late samples land in buckets a few minutes back, so recompute a short window
+	minuteEnd := now.Truncate(time.Minute)
+	minuteStart := minuteEnd.Add(-10 * time.Minute)
+	if err := database.DB.Exec(rollupMinuteSQL, minuteStart, minuteEnd).Error; err != nil {
+		return err
+	}
+
+	// The current hour is included so charts show a partial bucket
+	hourEnd := minuteEnd
+	hourStart := now.Truncate(time.Hour).Add(-time.Hour)
+	return database.DB.Exec(rollupHourSQL, hourStart, hourEnd).Error
+}
+
+// ApplyRetention deletes samples, rollups and device status rows past their retention
+func ApplyRetention(now time.Time) error {
+	cfg := config.AppConfig.Telemetry
+
+	if cfg.RawRetentionHours > 0 {
+		cutoff := now.Add(-time.Duration(cfg.RawRetentionHours) * time.Hour)
+		if err := database.DB.Where("recorded_at < ?", cutoff).Delete(&models.TelemetrySample{}).Error; err != nil {
+			return err
+		}
+	}
+
+	if cfg.MinuteRetentionDays > 0 {
+		cutoff := now.AddDate(0, 0, -cfg.MinuteRetentionDays)
+		if err := database.DB.Where("resolution = ? AND bucket_start < ?", ResolutionMinute, cutoff).
+			Delete(&models.TelemetryRollup{}).Error; err != nil {
+			return err
+		}
+	}
+
+	if cfg.HourRetentionDays > 0 {
+		cutoff := now.AddDate(0, 0, -cfg.HourRetentionDays)
+		if err := database.DB.Where("resolution = ? AND bucket_start < ?", ResolutionHour, cutoff).
+			Delete(&models.TelemetryRollup{}).Error; err != nil {
+			return err
+		}
+	}
+
+	if cfg.StatusRetentionDays > 0 {
+		cutoff := now.AddDate(0, 0, -cfg.StatusRetentionDays)
+		if err := database.DB.Where("created_at < ?", cutoff).Delete(&models.DeviceStatus{}).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
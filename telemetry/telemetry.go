@@ -0,0 +1,65 @@
+package telemetry
+
+import (
+	"time"
+	"tsimserver/database"
+	"tsimserver/models"
+)
+
+// Metric names stored in telemetry samples
+const (
+	MetricBatteryLevel   = "battery_level"
+	MetricLatitude       = "latitude"
+	MetricLongitude      = "longitude"
+	MetricSignalStrength = "signal_strength"
+)
+
+// Series resolutions
+const (
+	ResolutionRaw    = "raw"
+	ResolutionMinute = "1m"
+	ResolutionHour   = "1h"
+)
+
+// RecordDevice stores battery and location samples for a device
+func RecordDevice(deviceID string, batteryLevel int, latitude, longitude float64, at time.Time) error {
+	samples := []models.TelemetrySample{
+		{DeviceID: deviceID, Metric: MetricBatteryLevel, Value: float64(batteryLevel), RecordedAt: at},
+	}
+
+	// 0,0 means the device has no location fix
+	if latitude != 0 || longitude != 0 {
+		samples = append(samples,
+			models.TelemetrySample{DeviceID: deviceID, Metric: MetricLatitude, Value: latitude, RecordedAt: at},
+			models.TelemetrySample{DeviceID: deviceID, Metric: MetricLongitude, Value: longitude, RecordedAt: at},
+		)
+	}
+
+	return database.DB.Create(&samples).Error
+}
+
+// RecordSIMs stores signal strength and network type samples for the SIM cards currently in a device
+func RecordSIMs(deviceID string, at time.Time) error {
+	var simCards []models.SIMCard
+	if err := database.DB.Where("device_id = ? AND is_active = ?", deviceID, true).Find(&simCards).Error; err != nil {
+		return err
+	}
+
+	if len(simCards) == 0 {
+		return nil
+	}
+
+	samples := make([]models.TelemetrySample, 0, len(simCards))
+	for _, sim := range simCards {
+		samples = append(samples, models.TelemetrySample{
+			DeviceID:   deviceID,
+			SIMCardID:  sim.ID,
+			Metric:     MetricSignalStrength,
+			Value:      float64(sim.SignalStrength),
+			Label:      sim.NetworkType,
+			RecordedAt: at,
+		})
+	}
+
+	return database.DB.Create(&samples).Error
+}
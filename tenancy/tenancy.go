@@ -0,0 +1,173 @@
+package tenancy
+
+import (
+	"context"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type contextKey struct{}
+
+// Tenants own sites directly and everything else through them:
+// sites -> device groups -> devices -> device data.
+const (
+	tenantSites   = "SELECT id FROM sites WHERE tenant_id = ?"
+	tenantGroups  = "SELECT id FROM device_groups WHERE site_id IN (" + tenantSites + ")"
+	tenantDevices = "SELECT device_id FROM devices WHERE device_group_id IN (" + tenantGroups + ")"
+	tenantSIMs    = "SELECT id FROM sim_cards WHERE device_id IN (" + tenantDevices + ")"
+	tenantUsers   = "SELECT id FROM users WHERE tenant_id = ?"
+)
+
+// conditions maps each tenant-owned table to the condition limiting it to one tenant.
+// Every condition takes the tenant ID as its only parameter.
+var conditions = map[string]string{
+	"sites":         "sites.tenant_id = ?",
+	"users":         "users.tenant_id = ?",
+	"sessions":      "sessions.user_id IN (" + tenantUsers + ")",
+	"user_roles":    "user_roles.user_id IN (" + tenantUsers + ")",
+	"api_keys":      "api_keys.user_id IN (" + tenantUsers + ")",
+	"user_mfas":     "user_mfas.user_id IN (" + tenantUsers + ")",
+	"device_groups": "device_groups.site_id IN (" + tenantSites + ")",
+	"geofences":     "geofences.site_id IN (" + tenantSites + ")",
+	"devices":       "devices.device_group_id IN (" + tenantGroups + ")",
+
+	"user_identities":      "user_identities.user_id IN (" + tenantUsers + ")",
+	"auth_events":          "auth_events.user_id IN (" + tenantUsers + ")",
+	"audit_events":         "audit_events.tenant_id = ?",
+	"password_histories":   "password_histories.user_id IN (" + tenantUsers + ")",
+	"password_resets":      "password_resets.user_id IN (" + tenantUsers + ")",
+	"invitations":          "invitations.tenant_id = ?",
+	"device_group_configs": "device_group_configs.device_group_id IN (" + tenantGroups + ")",
+	"app_rollouts":         "app_rollouts.device_group_id IN (" + tenantGroups + ")",
+	"sim_routing_stats":    "sim_routing_stats.sim_card_id IN (" + tenantSIMs + ")",
+	"sim_loopback_tests":   "sim_loopback_tests.sender_sim_card_id IN (" + tenantSIMs + ")",
+	"mms_media":            "mms_media.mms_message_id IN (SELECT id FROM mms_messages WHERE device_id IN (" + tenantDevices + "))",
+	"ussd_session_steps":   "ussd_session_steps.ussd_session_id IN (SELECT id FROM ussd_sessions WHERE device_id IN (" + tenantDevices + "))",
+	"mfa_challenges":       "mfa_challenges.user_id IN (" + tenantUsers + ")",
+	"mfa_recovery_codes":   "mfa_recovery_codes.user_id IN (" + tenantUsers + ")",
+	"api_key_usages":       "api_key_usages.api_key_id IN (SELECT id FROM api_keys WHERE user_id IN (" + tenantUsers + "))",
+}
+
+// deviceTables are tenant-owned through their device_id column
+var deviceTables = []string{
+	"alarms",
+	"app_update_tasks",
+	"call_logs",
+	"conversations",
+	"device_config_states",
+	"device_fence_states",
+	"device_statuses",
+	"diagnostic_artifacts",
+	"diagnostic_requests",
+	"flash_call_verifications",
+	"mms_messages",
+	"phone_number_discoveries",
+	"sim_balance_checks",
+	"sim_card_events",
+	"sim_cards",
+	"sim_quarantines",
+	"sms_messages",
+	"telemetry_rollups",
+	"telemetry_samples",
+	"ussd_commands",
+	"ussd_sessions",
+}
+
+func init() {
+	for _, table := range deviceTables {
+		conditions[table] = table + ".device_id IN (" + tenantDevices + ")"
+	}
+}
+
+// WithTenant returns a context whose queries are limited to a tenant
+func WithTenant(ctx context.Context, tenantID uint) context.Context {
+	return context.WithValue(ctx, contextKey{}, tenantID)
+}
+
+// FromContext returns the tenant a context is limited to
+func FromContext(ctx context.Context) (uint, bool) {
+	if ctx == nil {
+		return 0, false
+	}
+	tenantID, ok := ctx.Value(contextKey{}).(uint)
+	return tenantID, ok
+}
+
+// Register installs the callbacks that scope queries run with a tenant context
+// (db.WithContext) to that tenant and assign it to new sites and users
+func Register(db *gorm.DB) error {
+	callbacks := db.Callback()
+	if err := callbacks.Query().Before("gorm:query").Register("tenancy:scope", scope); err != nil {
+		return err
+	}
+	if err := callbacks.Row().Before("gorm:row").Register("tenancy:scope", scope); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register("tenancy:scope", scope); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("gorm:delete").Register("tenancy:scope", scope); err != nil {
+		return err
+	}
+	return callbacks.Create().Before("gorm:create").Register("tenancy:assign", assign)
+}
+
+// scope adds the tenant condition of the statement's table to its WHERE clause
+func scope(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || stmt.SQL.Len() > 0 {
+		// Raw SQL is not rewritten
+		return
+	}
+	tenantID, ok := FromContext(stmt.Context)
+	if !ok {
+		return
+	}
+	condition, ok := conditions[stmt.Table]
+	if !ok {
+		return
+	}
+
+	// Group the existing conditions so an OR in them cannot bypass the tenant
+	where := clause.Where{}
+	if existing, ok := stmt.Clauses["WHERE"]; ok {
+		if w, ok := existing.Expression.(clause.Where); ok && len(w.Exprs) > 0 {
+			where.Exprs = append(where.Exprs, clause.And(w.Exprs...))
+		}
+		delete(stmt.Clauses, "WHERE")
+	}
+	where.Exprs = append(where.Exprs, clause.Expr{SQL: condition, Vars: []interface{}{tenantID}})
+	stmt.AddClause(where)
+}
+
+// assign sets the tenant of new records that have a TenantID, overriding any given
+// so tenant users cannot create records for other tenants
+func assign(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || stmt.Schema == nil {
+		return
+	}
+	tenantID, ok := FromContext(stmt.Context)
+	if !ok {
+		return
+	}
+	field := stmt.Schema.LookUpField("TenantID")
+	if field == nil {
+		return
+	}
+
+	set := func(value reflect.Value) {
+		id := tenantID
+		db.AddError(field.Set(stmt.Context, value, &id))
+	}
+	switch stmt.ReflectValue.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < stmt.ReflectValue.Len(); i++ {
+			set(reflect.Indirect(stmt.ReflectValue.Index(i)))
+		}
+	case reflect.Struct:
+		set(stmt.ReflectValue)
+	}
+}
@@ -0,0 +1,427 @@
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"tsimserver/cache"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis is an in-memory server speaking enough of the Redis protocol for the cache, session,
+// lockout and login state code: strings with expiry, counters and key deletion. Lua is not
+// interpreted; scripts run as Go functions given to HandleScript. Transactions and pub/sub
+// are not supported.
+type Redis struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+	scripts map[string]ScriptFunc
+}
+
+// ScriptFunc does in Go what a Lua script does. call runs a Redis command and returns its
+// reply like redis.call: a string, an int64, nil or a []interface{}.
+type ScriptFunc func(call func(args ...string) interface{}, keys, argv []string) interface{}
+
+// StartRedis starts a server and connects cache.RedisClient to it until the test ends
+func StartRedis(t testing.TB) *Redis {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("starting fake Redis: %v", err)
+	}
+	r := &Redis{
+		listener: listener,
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+		scripts:  make(map[string]ScriptFunc),
+	}
+	go r.serve()
+
+	previous := cache.RedisClient
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: listener.Addr().String(), Protocol: 2})
+	t.Cleanup(func() {
+		cache.RedisClient.Close()
+		cache.RedisClient = previous
+		listener.Close()
+	})
+	return r
+}
+
+// Get returns the value of a key, for assertions
+func (r *Redis) Get(key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookup(key)
+}
+
+// HandleScript runs fn for the scripts whose source contains marker
+func (r *Redis) HandleScript(marker string, fn ScriptFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scripts[marker] = fn
+}
+
+// serve accepts connections until the listener is closed
+func (r *Redis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+// handle answers the commands of one connection
+func (r *Redis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		r.execute(writer, args)
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// execute runs a command and writes its reply
+func (r *Redis) execute(w *bufio.Writer, args []string) {
+	if len(args) == 0 {
+		writeError(w, "ERR empty command")
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.run(w, args)
+}
+
+// run runs a command and writes its reply. The caller holds r.mu.
+func (r *Redis) run(w *bufio.Writer, args []string) {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		w.WriteString("+PONG\r\n")
+	case "CLIENT", "SELECT":
+		w.WriteString("+OK\r\n")
+	case "SET":
+		r.set(w, args[1:])
+	case "GET":
+		value, ok := r.lookup(args[1])
+		writeBulk(w, value, ok)
+	case "GETDEL":
+		value, ok := r.lookup(args[1])
+		r.remove(args[1])
+		writeBulk(w, value, ok)
+	case "MGET":
+		fmt.Fprintf(w, "*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			value, ok := r.lookup(key)
+			writeBulk(w, value, ok)
+		}
+	case "DEL":
+		removed := 0
+		for _, key := range args[1:] {
+			if _, ok := r.lookup(key); ok {
+				removed++
+			}
+			r.remove(key)
+		}
+		writeInt(w, int64(removed))
+	case "EXISTS":
+		count := 0
+		for _, key := range args[1:] {
+			if _, ok := r.lookup(key); ok {
+				count++
+			}
+		}
+		writeInt(w, int64(count))
+	case "INCR", "DECR":
+		value, _ := r.lookup(args[1])
+		n, err := strconv.ParseInt(value, 10, 64)
+		if value != "" && err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return
+		}
+		if strings.ToUpper(args[0]) == "INCR" {
+			n++
+		} else {
+			n--
+		}
+		r.values[args[1]] = strconv.FormatInt(n, 10)
+		writeInt(w, n)
+	case "EXPIRE", "PEXPIRE":
+		amount, _ := strconv.ParseInt(args[2], 10, 64)
+		unit := time.Second
+		if strings.ToUpper(args[0]) == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		if _, ok := r.lookup(args[1]); !ok {
+			writeInt(w, 0)
+			return
+		}
+		r.expires[args[1]] = time.Now().Add(time.Duration(amount) * unit)
+		writeInt(w, 1)
+	case "TTL", "PTTL":
+		unit := time.Second
+		if strings.ToUpper(args[0]) == "PTTL" {
+			unit = time.Millisecond
+		}
+		if _, ok := r.lookup(args[1]); !ok {
+			writeInt(w, -2)
+			return
+		}
+		expiresAt, ok := r.expires[args[1]]
+		if !ok {
+			writeInt(w, -1)
+			return
+		}
+		writeInt(w, int64(time.Until(expiresAt)/unit))
+	case "PUBLISH":
+		writeInt(w, 0)
+	case "EVALSHA":
+		// Scripts are never cached, so clients send their source with EVAL
+		writeError(w, "NOSCRIPT No matching script. Please use EVAL.")
+	case "EVAL":
+		r.eval(w, args[1:])
+	default:
+		writeError(w, "ERR unknown command '"+args[0]+"'")
+	}
+}
+
+// eval runs the handler of a script with its keys and arguments. The caller holds r.mu.
+func (r *Redis) eval(w *bufio.Writer, args []string) {
+	if len(args) < 2 {
+		writeError(w, "ERR wrong number of arguments for 'eval' command")
+		return
+	}
+	var fn ScriptFunc
+	for marker, handler := range r.scripts {
+		if strings.Contains(args[0], marker) {
+			fn = handler
+		}
+	}
+	if fn == nil {
+		writeError(w, "ERR script has no handler in the fake Redis")
+		return
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys < 0 || numKeys > len(args)-2 {
+		writeError(w, "ERR invalid number of keys")
+		return
+	}
+
+	call := func(callArgs ...string) interface{} {
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		r.run(bw, callArgs)
+		bw.Flush()
+		reply, _ := readReply(bufio.NewReader(&buf))
+		return reply
+	}
+	writeReply(w, fn(call, args[2:2+numKeys], args[2+numKeys:]))
+}
+
+// set handles SET with its EX, PX, NX and XX options
+func (r *Redis) set(w *bufio.Writer, args []string) {
+	if len(args) < 2 {
+		writeError(w, "ERR wrong number of arguments for 'set' command")
+		return
+	}
+	key, value := args[0], args[1]
+
+	var ttl time.Duration
+	var onlyNew, onlyExisting bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				writeError(w, "ERR syntax error")
+				return
+			}
+			amount, _ := strconv.ParseInt(args[i+1], 10, 64)
+			ttl = time.Duration(amount) * time.Second
+			if strings.ToUpper(args[i]) == "PX" {
+				ttl = time.Duration(amount) * time.Millisecond
+			}
+			i++
+		case "NX":
+			onlyNew = true
+		case "XX":
+			onlyExisting = true
+		}
+	}
+
+	_, exists := r.lookup(key)
+	if (onlyNew && exists) || (onlyExisting && !exists) {
+		writeBulk(w, "", false)
+		return
+	}
+	r.values[key] = value
+	delete(r.expires, key)
+	if ttl > 0 {
+		r.expires[key] = time.Now().Add(ttl)
+	}
+	w.WriteString("+OK\r\n")
+}
+
+// lookup returns the value of a key that has not expired. The caller holds r.mu.
+func (r *Redis) lookup(key string) (string, bool) {
+	if expiresAt, ok := r.expires[key]; ok && !time.Now().Before(expiresAt) {
+		r.remove(key)
+	}
+	value, ok := r.values[key]
+	return value, ok
+}
+
+// remove deletes a key. The caller holds r.mu.
+func (r *Redis) remove(key string) {
+	delete(r.values, key)
+	delete(r.expires, key)
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		header, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(header, "$") {
+			return nil, fmt.Errorf("expected bulk string, got %q", header)
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line without its CRLF
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readReply reads a reply as a string, an int64, nil, an error or a []interface{}
+func readReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := readLine(reader)
+	if err != nil || line == "" {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return fmt.Errorf("%s", line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := readReply(reader)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// writeReply writes the result of a script
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch value := reply.(type) {
+	case nil:
+		writeBulk(w, "", false)
+	case string:
+		writeBulk(w, value, true)
+	case int:
+		writeInt(w, int64(value))
+	case int64:
+		writeInt(w, value)
+	case error:
+		writeError(w, value.Error())
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(value))
+		for _, item := range value {
+			writeReply(w, item)
+		}
+	default:
+		writeError(w, fmt.Sprintf("ERR unsupported script reply %T", reply))
+	}
+}
+
+// writeBulk writes a bulk string, or a null reply when ok is false
+func writeBulk(w *bufio.Writer, value string, ok bool) {
+	if !ok {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(value), value)
+}
+
+// writeInt writes an integer reply
+func writeInt(w *bufio.Writer, n int64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+// writeError writes an error reply
+func writeError(w *bufio.Writer, message string) {
+	w.WriteString("-" + message + "\r\n")
+}
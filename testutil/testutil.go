@@ -0,0 +1,68 @@
+// Package testutil sets up the configuration, an SQLite database and a fake Redis for
+// tests of packages that use them through their globals.
+package testutil
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/tenancy"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// RepoPath returns the path of a file relative to the repository root
+func RepoPath(elem ...string) string {
+	_, file, _, _ := runtime.Caller(0)
+	root := filepath.Dir(filepath.Dir(file))
+	return filepath.Join(append([]string{root}, elem...)...)
+}
+
+// LoadConfig loads config.yaml with its defaults into config.AppConfig. Tests change the
+// returned configuration as they need; it is restored when the test ends.
+func LoadConfig(t testing.TB) *config.Config {
+	t.Helper()
+
+	previous := config.AppConfig
+	if err := config.Load(RepoPath("config.yaml")); err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	t.Cleanup(func() {
+		config.AppConfig = previous
+	})
+	return config.AppConfig
+}
+
+// OpenDatabase points database.DB at a new SQLite database with tenant scoping and the
+// tables of the given models until the test ends
+func OpenDatabase(t testing.TB, models ...interface{}) *gorm.DB {
+	t.Helper()
+
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	if err := tenancy.Register(db); err != nil {
+		t.Fatalf("registering tenant scoping: %v", err)
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatalf("migrating test database: %v", err)
+	}
+
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		database.DB = previous
+	})
+	return db
+}
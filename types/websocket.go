@@ -27,6 +27,7 @@ type AuthResponse struct {
 type SIMCardInfo struct {
 	Identifier     string `json:"identifier"`
 	IMSI           string `json:"imsi"`
+	ICCID          string `json:"iccid"`
 	IMEI           string `json:"imei"`
 	Operator       string `json:"operator"`
 	PhoneNumber    string `json:"phoneNumber"`
@@ -95,6 +96,91 @@ type SMSDeliveryReport struct {
 	Text       string `json:"text"`
 }
 
+// SendMMSCommand represents MMS sending command from server
+type SendMMSCommand struct {
+	Type          string    `json:"type"`
+	Target        string    `json:"target"`
+	SimSlot       int       `json:"simSlot"`
+	Subject       string    `json:"subject,omitempty"`
+	Text          string    `json:"text,omitempty"`
+	Parts         []MMSPart `json:"parts"`
+	InternalLogID int       `json:"internalLogId"`
+}
+
+// MMSPart is an attachment the device downloads before sending an MMS
+type MMSPart struct {
+	Seq         int    `json:"seq"`
+	ContentType string `json:"contentType"`
+	FileName    string `json:"fileName"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	URL         string `json:"url"`
+}
+
+// IncomingMMS represents incoming MMS from client with its parts inline
+type IncomingMMS struct {
+	Type      string            `json:"type"`
+	From      string            `json:"from"`
+	SimSlot   int               `json:"simSlot"`
+	Subject   string            `json:"subject"`
+	Text      string            `json:"text"`
+	Parts     []IncomingMMSPart `json:"parts"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// IncomingMMSPart is one attachment of an incoming MMS
+type IncomingMMSPart struct {
+	ContentType string `json:"contentType"`
+	FileName    string `json:"fileName"`
+	Data        string `json:"data"` // base64
+}
+
+// MakeCallCommand asks a device to place a voice call
+type MakeCallCommand struct {
+	Type          string `json:"type"`
+	Target        string `json:"target"`
+	SimSlot       int    `json:"simSlot"`
+	MaxDuration   int    `json:"maxDuration"` // seconds, the device hangs up afterwards
+	InternalLogID int    `json:"internalLogId"`
+}
+
+// EndCallCommand asks a device to hang up a call it placed
+type EndCallCommand struct {
+	Type          string `json:"type"`
+	InternalLogID int    `json:"internalLogId"`
+}
+
+// CallStatus reports the progress of a call placed on server request
+type CallStatus struct {
+	Type          string `json:"type"`
+	InternalLogID int    `json:"internalLogId"`
+	State         string `json:"state"`    // dialing, ringing, answered, ended, busy, failed
+	Duration      int    `json:"duration"` // seconds connected, with ended
+	ErrorMessage  string `json:"errorMessage"`
+	Timestamp     int64  `json:"timestamp"`
+}
+
+// IncomingCall represents an incoming call event from client
+type IncomingCall struct {
+	Type      string `json:"type"`
+	CallID    string `json:"callId"` // device-local ID tying the events of one call together
+	From      string `json:"from"`
+	SimSlot   int    `json:"simSlot"`
+	State     string `json:"state"`    // ringing, answered, ended, rejected
+	Duration  int    `json:"duration"` // seconds connected, with ended
+	Timestamp int64  `json:"timestamp"`
+}
+
+// MissedCall represents an incoming call that was not answered
+type MissedCall struct {
+	Type         string `json:"type"`
+	CallID       string `json:"callId"`
+	From         string `json:"from"`
+	SimSlot      int    `json:"simSlot"`
+	RingDuration int    `json:"ringDuration"` // seconds
+	Timestamp    int64  `json:"timestamp"`
+}
+
 // USSDCommand represents USSD command from server
 type USSDCommand struct {
 	Type          string `json:"type"`
@@ -176,6 +262,108 @@ type PhoneNumberResult struct {
 	InternalLogID int    `json:"internalLogId"`
 	Success       bool   `json:"success"`
 	PhoneNumber   string `json:"phoneNumber"`
+	Result        string `json:"result"` // Raw USSD response, parsed when phoneNumber is empty
+	ErrorMessage  string `json:"errorMessage"`
+	Timestamp     int64  `json:"timestamp"`
+}
+
+// ConfigUpdateCommand pushes the desired app configuration to a device
+type ConfigUpdateCommand struct {
+	Type     string      `json:"type"`
+	Version  int         `json:"version"`
+	Settings interface{} `json:"settings"`
+}
+
+// ConfigReport represents the configuration currently applied on a device
+type ConfigReport struct {
+	Type     string          `json:"type"`
+	Version  int             `json:"version"`
+	Settings json.RawMessage `json:"settings"`
+}
+
+// UpdateAppCommand asks a device to download and install an app release
+type UpdateAppCommand struct {
+	Type              string `json:"type"`
+	TaskID            uint   `json:"taskId"`
+	VersionName       string `json:"versionName"`
+	VersionCode       int    `json:"versionCode"`
+	DownloadURL       string `json:"downloadUrl"`
+	FileSize          int64  `json:"fileSize"`
+	SHA256            string `json:"sha256"`
+	SigningCertSHA256 string `json:"signingCertSha256"`
+	AllowDowngrade    bool   `json:"allowDowngrade"`
+}
+
+// UpdateProgress represents app update progress reported by the client
+type UpdateProgress struct {
+	Type         string `json:"type"`
+	TaskID       uint   `json:"taskId"`
+	Status       string `json:"status"`   // downloading, installing, installed, failed
+	Progress     int    `json:"progress"` // 0-100
+	VersionCode  int    `json:"versionCode"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+// DiagnosticCommand asks a device to run a diagnostic action
+type DiagnosticCommand struct {
+	Type      string          `json:"type"`
+	RequestID uint            `json:"requestId"`
+	Command   string          `json:"command"` // logs, screenshot, ping, connectivity, reboot, restart_app
+	Params    json.RawMessage `json:"params,omitempty"`
+	ChunkSize int             `json:"chunkSize,omitempty"` // max bytes per diagnostic_chunk
+	SentAt    int64           `json:"sentAt"`
+}
+
+// DiagnosticResult represents the answer of a device to a diagnostic command
+type DiagnosticResult struct {
+	Type         string          `json:"type"`
+	RequestID    uint            `json:"requestId"`
+	Success      bool            `json:"success"`
+	Result       json.RawMessage `json:"result,omitempty"`
+	ErrorMessage string          `json:"errorMessage"`
+	Timestamp    int64           `json:"timestamp"`
+}
+
+// DiagnosticChunk is one part of a file uploaded by a device
+type DiagnosticChunk struct {
+	Type        string `json:"type"`
+	RequestID   uint   `json:"requestId"`
+	Index       int    `json:"index"` // 0-based
+	Total       int    `json:"total"`
+	FileName    string `json:"fileName"`
+	ContentType string `json:"contentType"`
+	SHA256      string `json:"sha256"` // checksum of the whole file
+	Data        string `json:"data"`   // base64 encoded
+}
+
+// USSDSessionCommand starts, continues or cancels a USSD session on a device
+type USSDSessionCommand struct {
+	Type      string `json:"type"` // ussd_session_start, ussd_session_reply, ussd_session_cancel
+	SessionID string `json:"sessionId"`
+	SimSlot   int    `json:"simSlot"`
+	USSDCode  string `json:"ussdCode,omitempty"`
+	Input     string `json:"input,omitempty"`
+	Step      int    `json:"step,omitempty"`
+}
+
+// USSDSessionResponse represents a USSD menu response from client
+type USSDSessionResponse struct {
+	Type         string `json:"type"`
+	SessionID    string `json:"sessionId"`
+	Step         int    `json:"step"`
+	Success      bool   `json:"success"`
+	Message      string `json:"message"`
+	SessionOpen  bool   `json:"sessionOpen"` // Menu expects another reply
+	ErrorMessage string `json:"errorMessage"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+// BalanceResult represents balance check result from client
+type BalanceResult struct {
+	Type          string `json:"type"`
+	InternalLogID int    `json:"internalLogId"`
+	Success       bool   `json:"success"`
+	Result        string `json:"result"` // Raw USSD response text
 	ErrorMessage  string `json:"errorMessage"`
 	Timestamp     int64  `json:"timestamp"`
 }
@@ -0,0 +1,325 @@
+package ussdsession
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+	"tsimserver/config"
+	"tsimserver/database"
+	"tsimserver/dispatch"
+	"tsimserver/models"
+	"tsimserver/types"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Session states
+const (
+	StatusPending   = "pending"
+	StatusOpen      = "open"
+	StatusCompleted = "completed"
+	StatusCancelled = "cancelled"
+	StatusTimeout   = "timeout"
+	StatusFailed    = "failed"
+)
+
+// Step states
+const (
+	StepPending  = "pending"
+	StepAnswered = "answered"
+	StepFailed   = "failed"
+)
+
+// validInput matches USSD codes and menu replies; 182 characters is the USSD limit
+var validInput = regexp.MustCompile(`^[0-9*#+]{1,182}$`)
+
+var (
+	// ErrSessionBusy is returned when the device already runs a USSD session
+	ErrSessionBusy = errors.New("device already has an active USSD session")
+	// ErrNotActive is returned when the session is no longer open
+	ErrNotActive = errors.New("USSD session is not active")
+	// ErrAwaitingResponse is returned when a reply is sent before the menu answered
+	ErrAwaitingResponse = errors.New("USSD session is waiting for the device to respond")
+	// ErrInvalidInput is returned for codes or replies a USSD menu cannot accept
+	ErrInvalidInput = errors.New("input may only contain digits, *, # and +")
+)
+
+// Start opens a USSD session on a device with the initial code
+func Start(deviceID string, simSlot int, code string, startedBy uint) (*models.USSDSession, error) {
+	if !validInput.MatchString(code) {
+		return nil, ErrInvalidInput
+	}
+
+	var device models.Device
+	if err := database.DB.Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return nil, err
+	}
+
+	// Android runs one USSD dialog at a time
+	var active int64
+	database.DB.Model(&models.USSDSession{}).
+		Where("device_id = ? AND status IN ?", deviceID, []string{StatusPending, StatusOpen}).
+		Count(&active)
+	if active > 0 {
+		return nil, ErrSessionBusy
+	}
+
+	now := time.Now()
+	session := models.USSDSession{
+		SessionID: uuid.New().String(),
+		DeviceID:  deviceID,
+		SimSlot:   simSlot,
+		USSDCode:  code,
+		Status:    StatusPending,
+		StartedBy: startedBy,
+		ExpiresAt: now.Add(timeout()),
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		step := models.USSDSessionStep{
+			USSDSessionID: session.ID,
+			Sequence:      1,
+			Input:         code,
+			Status:        StepPending,
+			SentAt:        now,
+		}
+		return tx.Create(&step).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	command := types.USSDSessionCommand{
+		Type:      "ussd_session_start",
+		SessionID: session.SessionID,
+		SimSlot:   simSlot,
+		USSDCode:  code,
+		Step:      1,
+	}
+	if err := dispatch.ToDevice(deviceID, command); err != nil {
+		finish(&session, StatusFailed, err.Error())
+		return nil, err
+	}
+
+	return Get(session.SessionID)
+}
+
+// Reply sends the next menu input to an open session
+func Reply(sessionID, input string) (*models.USSDSession, error) {
+	if !validInput.MatchString(input) {
+		return nil, ErrInvalidInput
+	}
+
+	session, err := Get(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.Status != StatusOpen {
+		if session.Status == StatusPending {
+			return nil, ErrAwaitingResponse
+		}
+		return nil, ErrNotActive
+	}
+
+	last := session.Steps[len(session.Steps)-1]
+	if last.Status == StepPending {
+		return nil, ErrAwaitingResponse
+	}
+	if maxSteps := config.AppConfig.USSD.MaxSteps; maxSteps > 0 && last.Sequence >= maxSteps {
+		return nil, fmt.Errorf("USSD session reached the limit of %d steps", maxSteps)
+	}
+
+	now := time.Now()
+	step := models.USSDSessionStep{
+		USSDSessionID: session.ID,
+		Sequence:      last.Sequence + 1,
+		Input:         input,
+		Status:        StepPending,
+		SentAt:        now,
+	}
+	if err := database.DB.Create(&step).Error; err != nil {
+		return nil, err
+	}
+	database.DB.Model(session).Update("expires_at", now.Add(timeout()))
+
+	command := types.USSDSessionCommand{
+		Type:      "ussd_session_reply",
+		SessionID: session.SessionID,
+		SimSlot:   session.SimSlot,
+		Input:     input,
+		Step:      step.Sequence,
+	}
+	if err := dispatch.ToDevice(session.DeviceID, command); err != nil {
+		finish(session, StatusFailed, err.Error())
+		return nil, err
+	}
+
+	return Get(sessionID)
+}
+
+// Cancel closes an active session and tells the device to dismiss the dialog
+func Cancel(sessionID string) (*models.USSDSession, error) {
+	session, err := Get(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !session.IsActive() {
+		return nil, ErrNotActive
+	}
+
+	sendCancel(session)
+	if err := finish(session, StatusCancelled, ""); err != nil {
+		return nil, err
+	}
+	return Get(sessionID)
+}
+
+// Get returns a session with its steps in order
+func Get(sessionID string) (*models.USSDSession, error) {
+	var session models.USSDSession
+	if err := database.DB.Preload("Steps", func(db *gorm.DB) *gorm.DB {
+		return db.Order("sequence ASC")
+	}).Where("session_id = ?", sessionID).First(&session).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ApplyResponse records the menu text a device received for a session step
+func ApplyResponse(deviceID string, response types.USSDSessionResponse) error {
+	var session models.USSDSession
+	if err := database.DB.Where("session_id = ? AND device_id = ?", response.SessionID, deviceID).
+		First(&session).Error; err != nil {
+		return fmt.Errorf("USSD session %s not found for device %s", response.SessionID, deviceID)
+	}
+
+	// Late responses after a cancel or timeout are ignored
+	if !session.IsActive() {
+		return nil
+	}
+
+	var step models.USSDSessionStep
+	query := database.DB.Where("ussd_session_id = ?", session.ID)
+	if response.Step > 0 {
+		query = query.Where("sequence = ?", response.Step)
+	} else {
+		query = query.Order("sequence DESC")
+	}
+	if err := query.First(&step).Error; err != nil {
+		return fmt.Errorf("step %d not found in USSD session %s", response.Step, session.SessionID)
+	}
+
+	now := time.Now()
+	stepUpdates := map[string]interface{}{
+		"response":     response.Message,
+		"responded_at": now,
+		"status":       StepAnswered,
+	}
+	if !response.Success {
+		stepUpdates["status"] = StepFailed
+		stepUpdates["error_message"] = response.ErrorMessage
+	}
+	if err := database.DB.Model(&step).Updates(stepUpdates).Error; err != nil {
+		return err
+	}
+
+	sessionUpdates := map[string]interface{}{
+		"last_response": response.Message,
+		"expires_at":    now.Add(timeout()),
+	}
+	switch {
+	case !response.Success:
+		sessionUpdates["status"] = StatusFailed
+		sessionUpdates["error_message"] = response.ErrorMessage
+		sessionUpdates["closed_at"] = now
+	case response.SessionOpen:
+		sessionUpdates["status"] = StatusOpen
+	default:
+		// Final menu screen, the network closed the dialog
+		sessionUpdates["status"] = StatusCompleted
+		sessionUpdates["closed_at"] = now
+	}
+
+	return database.DB.Model(&session).Updates(sessionUpdates).Error
+}
+
+// StartMonitor starts the background job that times out idle sessions
+func StartMonitor() {
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			expireSessions(now)
+		}
+	}()
+
+	log.Println("USSD session monitor started")
+}
+
+// expireSessions closes sessions that passed their deadline
+func expireSessions(now time.Time) {
+	var sessions []models.USSDSession
+	if err := database.DB.Where("status IN ? AND expires_at < ?", []string{StatusPending, StatusOpen}, now).
+		Find(&sessions).Error; err != nil {
+		log.Printf("Failed to load expired USSD sessions: %v", err)
+		return
+	}
+
+	for i := range sessions {
+		sendCancel(&sessions[i])
+		if err := finish(&sessions[i], StatusTimeout, "session timed out"); err != nil {
+			log.Printf("Failed to expire USSD session %s: %v", sessions[i].SessionID, err)
+		}
+	}
+}
+
+// sendCancel asks the device to dismiss the USSD dialog
+func sendCancel(session *models.USSDSession) {
+	command := types.USSDSessionCommand{
+		Type:      "ussd_session_cancel",
+		SessionID: session.SessionID,
+		SimSlot:   session.SimSlot,
+	}
+	if err := dispatch.ToDevice(session.DeviceID, command); err != nil {
+		log.Printf("Failed to cancel USSD session %s on device %s: %v", session.SessionID, session.DeviceID, err)
+	}
+}
+
+// finish moves a session and its pending step to a final state
+func finish(session *models.USSDSession, status, message string) error {
+	now := time.Now()
+	session.Status = status
+	session.ErrorMessage = message
+	session.ClosedAt = &now
+
+	if err := database.DB.Model(&models.USSDSessionStep{}).
+		Where("ussd_session_id = ? AND status = ?", session.ID, StepPending).
+		Updates(map[string]interface{}{
+			"status":        StepFailed,
+			"error_message": status,
+		}).Error; err != nil {
+		return err
+	}
+
+	return database.DB.Model(session).Updates(map[string]interface{}{
+		"status":        status,
+		"error_message": message,
+		"closed_at":     now,
+	}).Error
+}
+
+// timeout returns how long a session may wait for its next step
+func timeout() time.Duration {
+	seconds := config.AppConfig.USSD.SessionTimeout
+	if seconds <= 0 {
+		seconds = 120
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -6,6 +6,7 @@ import (
 	"tsimserver/config"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 // JWTClaims represents JWT claims
@@ -28,6 +29,7 @@ func GenerateAccessToken(userID uint, username, email string) (string, error) {
 			NotBefore: jwt.NewNumericDate(time.Now()),
 			Issuer:    "tsimserver",
 			Subject:   username,
+			ID:        uuid.New().String(),
 		},
 	}
 
@@ -43,6 +45,7 @@ func GenerateRefreshToken(userID uint, username string) (string, error) {
 		NotBefore: jwt.NewNumericDate(time.Now()),
 		Issuer:    "tsimserver",
 		Subject:   username,
+		ID:        uuid.New().String(), // tokens issued in the same second still differ
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
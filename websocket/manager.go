@@ -6,11 +6,24 @@ import (
 	"log"
 	"sync"
 	"time"
+	"tsimserver/balance"
 	"tsimserver/cache"
+	"tsimserver/calls"
 	"tsimserver/database"
+	"tsimserver/deviceconfig"
+	"tsimserver/diagnostics"
+	"tsimserver/geofence"
+	"tsimserver/mms"
 	"tsimserver/models"
+	"tsimserver/ota"
+	"tsimserver/phonenumber"
+	"tsimserver/presence"
 	"tsimserver/queue"
+	"tsimserver/simhealth"
+	"tsimserver/siminventory"
+	"tsimserver/telemetry"
 	"tsimserver/types"
+	"tsimserver/ussdsession"
 
 	"github.com/gofiber/websocket/v2"
 	"github.com/google/uuid"
@@ -74,25 +87,27 @@ func (h *Hub) Run() {
 			h.Clients[client.ID] = client
 			h.mutex.Unlock()
 
-			// Store connection in Redis
-			cache.SetDeviceConnection(client.DeviceID, client.ID)
-			cache.SetDeviceStatus(client.DeviceID, "online")
-
+			// Device presence is set once the client authenticates
 			log.Printf("Client registered: %s (Device: %s)", client.ID, client.DeviceID)
 
 		case client := <-h.Unregister:
 			h.mutex.Lock()
-			if _, ok := h.Clients[client.ID]; ok {
+			_, ok := h.Clients[client.ID]
+			if ok {
 				delete(h.Clients, client.ID)
 				close(client.Send)
+			}
+			stillConnected := h.isDeviceConnected(client.DeviceID)
+			h.mutex.Unlock()
 
-				// Remove connection from Redis
-				cache.RemoveDeviceConnection(client.DeviceID)
-				cache.SetDeviceStatus(client.DeviceID, "offline")
+			if ok {
+				// Only mark the device offline when its last connection goes away
+				if client.DeviceID != "" && !stillConnected {
+					go h.deviceDisconnected(client.DeviceID)
+				}
 
 				log.Printf("Client unregistered: %s (Device: %s)", client.ID, client.DeviceID)
 			}
-			h.mutex.Unlock()
 
 		case message := <-h.Broadcast:
 			h.mutex.RLock()
@@ -134,6 +149,37 @@ func (h *Hub) sendToDevice(deviceID string, message []byte) {
 	log.Printf("Device %s not found for message delivery", deviceID)
 }
 
+// deviceDisconnected marks a device offline after its last connection went away. It runs
+// outside Run so Redis and the database do not hold up the hub, and skips devices that
+// reconnected in the meantime.
+func (h *Hub) deviceDisconnected(deviceID string) {
+	h.mutex.RLock()
+	connected := h.isDeviceConnected(deviceID)
+	h.mutex.RUnlock()
+	if connected {
+		return
+	}
+
+	cache.RemoveDeviceConnection(deviceID)
+	if err := presence.MarkOffline(deviceID, "disconnected"); err != nil {
+		log.Printf("Failed to mark device %s offline: %v", deviceID, err)
+	}
+}
+
+// isDeviceConnected reports whether any registered client belongs to the device.
+// Callers must hold the hub mutex.
+func (h *Hub) isDeviceConnected(deviceID string) bool {
+	if deviceID == "" {
+		return false
+	}
+	for _, client := range h.Clients {
+		if client.DeviceID == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
 // SendMessageToDevice sends message to specific device by device ID
 func (h *Hub) SendMessageToDevice(deviceID string, message interface{}) error {
 	data, err := json.Marshal(message)
@@ -170,6 +216,7 @@ func (c *Client) ReadPump() {
 	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.Conn.SetPongHandler(func(string) error {
 		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		presence.Heartbeat(c.DeviceID)
 		return nil
 	})
 
@@ -181,6 +228,7 @@ func (c *Client) ReadPump() {
 		}
 
 		c.LastSeen = time.Now()
+		presence.Heartbeat(c.DeviceID)
 		if err := c.handleMessage(message); err != nil {
 			log.Printf("Error handling message from client %s: %v", c.ID, err)
 		}
@@ -225,6 +273,12 @@ func (c *Client) handleMessage(data []byte) error {
 		return err
 	}
 
+	// Every other message acts for the device the client authenticated as, before that
+	// it would be stored for an empty or a forged device ID
+	if msg.Type != "auth" && c.DeviceID == "" {
+		return fmt.Errorf("%s message from unauthenticated client %s", msg.Type, c.ID)
+	}
+
 	switch msg.Type {
 	case "auth":
 		return c.handleAuth(msg.Data)
@@ -234,14 +288,34 @@ func (c *Client) handleMessage(data []byte) error {
 		return c.handleDeviceStatus(msg.Data)
 	case "incoming_sms":
 		return c.handleIncomingSMS(msg.Data)
+	case "incoming_mms":
+		return c.handleIncomingMMS(msg.Data)
 	case "sms_delivery_report":
 		return c.handleSMSDeliveryReport(msg.Data)
+	case "incoming_call":
+		return c.handleIncomingCall(msg.Data)
+	case "missed_call":
+		return c.handleMissedCall(msg.Data)
+	case "call_status":
+		return c.handleCallStatus(msg.Data)
 	case "ussd_result":
 		return c.handleUSSDResult(msg.Data)
+	case "ussd_session_response":
+		return c.handleUSSDSessionResponse(msg.Data)
+	case "balance_result":
+		return c.handleBalanceResult(msg.Data)
 	case "phone_number_result":
 		return c.handlePhoneNumberResult(msg.Data)
 	case "alarm":
 		return c.handleClientAlarm(msg.Data)
+	case "config_report":
+		return c.handleConfigReport(msg.Data)
+	case "update_progress":
+		return c.handleUpdateProgress(msg.Data)
+	case "diagnostic_result":
+		return c.handleDiagnosticResult(msg.Data)
+	case "diagnostic_chunk":
+		return c.handleDiagnosticChunk(msg.Data)
 	default:
 		log.Printf("Unknown message type: %s", msg.Type)
 	}
@@ -273,9 +347,11 @@ func (c *Client) handleAuth(data json.RawMessage) error {
 	// Update client with device info
 	c.DeviceID = device.DeviceID
 
-	// Update device last seen
-	device.LastSeen = time.Now()
-	database.DB.Save(&device)
+	// Store connection in Redis and mark the device online
+	cache.SetDeviceConnection(device.DeviceID, c.ID)
+	if err := presence.MarkOnline(device.DeviceID); err != nil {
+		log.Printf("Failed to mark device %s online: %v", device.DeviceID, err)
+	}
 
 	// Send auth success
 	response := types.AuthResponse{
@@ -286,7 +362,16 @@ func (c *Client) handleAuth(data json.RawMessage) error {
 		DeviceName: device.DeviceName,
 	}
 
-	return c.sendMessage(response)
+	if err := c.sendMessage(response); err != nil {
+		return err
+	}
+
+	// Bring the app configuration up to date after reconnects
+	if _, err := deviceconfig.ReconcileAndPush(device.DeviceID); err != nil {
+		log.Printf("Failed to push config to device %s: %v", device.DeviceID, err)
+	}
+
+	return nil
 }
 
 // sendMessage sends a message to the client
@@ -311,9 +396,10 @@ func (c *Client) handleDeviceRegistration(data json.RawMessage) error {
 		return err
 	}
 
-	// Update device info
+	// Update device info. The payload's device ID is not trusted, the client is the device
+	// it authenticated as.
 	var device models.Device
-	if err := database.DB.Where("device_id = ?", deviceReg.Payload.DeviceID).First(&device).Error; err != nil {
+	if err := database.DB.Where("device_id = ?", c.DeviceID).First(&device).Error; err != nil {
 		return err
 	}
 
@@ -328,47 +414,35 @@ func (c *Client) handleDeviceRegistration(data json.RawMessage) error {
 	}
 
 	// Update SIM cards
-	if err := c.updateSIMCards(deviceReg.Payload.DeviceID, deviceReg.Payload.SIMCards); err != nil {
+	if err := c.updateSIMCards(deviceReg.Payload.SIMCards); err != nil {
 		return err
 	}
 
-	// Save device status
-	return c.saveDeviceStatus(deviceReg.Payload)
-}
+	// Refresh presence columns used for routing
+	if err := presence.ApplyStatus(c.DeviceID, statusUpdate(deviceReg.Payload)); err != nil {
+		return err
+	}
 
-// updateSIMCards updates device SIM cards
-func (c *Client) updateSIMCards(deviceID string, simCards []types.SIMCardInfo) error {
-	// Delete existing SIM cards
-	database.DB.Where("device_id = ?", deviceID).Delete(&models.SIMCard{})
-
-	// Add new SIM cards
-	for _, simInfo := range simCards {
-		simCard := models.SIMCard{
-			DeviceID:       deviceID,
-			Identifier:     simInfo.Identifier,
-			IMSI:           simInfo.IMSI,
-			IMEI:           simInfo.IMEI,
-			Operator:       simInfo.Operator,
-			PhoneNumber:    simInfo.PhoneNumber,
-			SignalStrength: simInfo.SignalStrength,
-			NetworkType:    simInfo.NetworkType,
-			MCC:            simInfo.MCC,
-			MNC:            simInfo.MNC,
-			IsActive:       simInfo.IsActive,
-		}
+	recordTelemetry(c.DeviceID, deviceReg.Payload)
 
-		if err := database.DB.Create(&simCard).Error; err != nil {
-			return err
-		}
+	// Compare the reported position with the site geofence
+	if err := geofence.Check(c.DeviceID, deviceReg.Payload.Latitude, deviceReg.Payload.Longitude, time.Now()); err != nil {
+		log.Printf("Geofence check failed for device %s: %v", c.DeviceID, err)
 	}
 
-	return nil
+	// Save device status
+	return c.saveDeviceStatus(deviceReg.Payload)
+}
+
+// updateSIMCards reconciles the reported SIM cards with the SIM inventory of the device
+func (c *Client) updateSIMCards(simCards []types.SIMCardInfo) error {
+	return siminventory.Sync(c.DeviceID, simCards)
 }
 
 // saveDeviceStatus saves device status to database
 func (c *Client) saveDeviceStatus(payload types.DeviceRegistrationPayload) error {
 	status := models.DeviceStatus{
-		DeviceID:      payload.DeviceID,
+		DeviceID:      c.DeviceID,
 		BatteryLevel:  payload.BatteryLevel,
 		BatteryStatus: payload.BatteryStatus,
 		Latitude:      payload.Latitude,
@@ -387,14 +461,63 @@ func (c *Client) handleDeviceStatus(data json.RawMessage) error {
 	}
 
 	// Update SIM cards
-	if err := c.updateSIMCards(deviceStatus.Payload.DeviceID, deviceStatus.Payload.SIMCards); err != nil {
+	if err := c.updateSIMCards(deviceStatus.Payload.SIMCards); err != nil {
 		return err
 	}
 
+	// Refresh presence columns used for routing
+	if err := presence.ApplyStatus(c.DeviceID, statusUpdate(deviceStatus.Payload)); err != nil {
+		return err
+	}
+
+	recordTelemetry(c.DeviceID, deviceStatus.Payload)
+
+	// Compare the reported position with the site geofence
+	if err := geofence.Check(c.DeviceID, deviceStatus.Payload.Latitude, deviceStatus.Payload.Longitude, time.Now()); err != nil {
+		log.Printf("Geofence check failed for device %s: %v", c.DeviceID, err)
+	}
+
 	// Save device status
 	return c.saveDeviceStatus(deviceStatus.Payload)
 }
 
+// recordTelemetry stores battery, location and SIM signal samples from a status payload of
+// a device
+func recordTelemetry(deviceID string, payload types.DeviceRegistrationPayload) {
+	now := time.Now()
+
+	if err := telemetry.RecordDevice(deviceID, payload.BatteryLevel, payload.Latitude, payload.Longitude, now); err != nil {
+		log.Printf("Failed to record device telemetry for %s: %v", deviceID, err)
+	}
+
+	if err := telemetry.RecordSIMs(deviceID, now); err != nil {
+		log.Printf("Failed to record SIM telemetry for %s: %v", deviceID, err)
+	}
+
+	if err := simhealth.RecordSignals(deviceID); err != nil {
+		log.Printf("Failed to update SIM signal history for %s: %v", deviceID, err)
+	}
+}
+
+// statusUpdate builds a presence update from a device status payload
+func statusUpdate(payload types.DeviceRegistrationPayload) presence.StatusUpdate {
+	// Device signal is the best signal among its active SIM cards
+	signal := 0
+	for _, sim := range payload.SIMCards {
+		if sim.IsActive && sim.SignalStrength > signal {
+			signal = sim.SignalStrength
+		}
+	}
+
+	return presence.StatusUpdate{
+		BatteryLevel:   payload.BatteryLevel,
+		BatteryStatus:  payload.BatteryStatus,
+		SignalStrength: signal,
+		Latitude:       payload.Latitude,
+		Longitude:      payload.Longitude,
+	}
+}
+
 // handleIncomingSMS handles incoming SMS messages
 func (c *Client) handleIncomingSMS(data json.RawMessage) error {
 	var incomingSMS types.IncomingSMS
@@ -415,6 +538,17 @@ func (c *Client) handleIncomingSMS(data json.RawMessage) error {
 		return err
 	}
 
+	// Loop-back SMS verify the number of the sending SIM or test its health
+	matched, err := phonenumber.MatchIncomingSMS(c.DeviceID, incomingSMS.From, incomingSMS.Message)
+	if err != nil {
+		log.Printf("Failed to match phone number loop-back on device %s: %v", c.DeviceID, err)
+	}
+	if !matched {
+		if _, err := simhealth.MatchIncomingSMS(c.DeviceID, incomingSMS.Message); err != nil {
+			log.Printf("Failed to match loopback test on device %s: %v", c.DeviceID, err)
+		}
+	}
+
 	// Publish to queue for processing
 	return queue.PublishMessage(queue.SMSQueue, map[string]interface{}{
 		"type":      "incoming_sms",
@@ -425,6 +559,32 @@ func (c *Client) handleIncomingSMS(data json.RawMessage) error {
 	})
 }
 
+// handleIncomingMMS stores an incoming MMS with its media parts
+func (c *Client) handleIncomingMMS(data json.RawMessage) error {
+	var incomingMMS types.IncomingMMS
+	if err := json.Unmarshal(data, &incomingMMS); err != nil {
+		return err
+	}
+
+	message, err := mms.Receive(c.DeviceID, incomingMMS)
+	if err != nil {
+		return err
+	}
+
+	// Publish to queue for processing
+	return queue.PublishMessage(queue.SMSQueue, map[string]interface{}{
+		"type":            "incoming_mms",
+		"device_id":       c.DeviceID,
+		"mms_id":          message.ID,
+		"conversation_id": message.ConversationID,
+		"from":            incomingMMS.From,
+		"subject":         incomingMMS.Subject,
+		"text":            incomingMMS.Text,
+		"parts":           len(message.Parts),
+		"timestamp":       message.Timestamp,
+	})
+}
+
 // handleSMSDeliveryReport handles SMS delivery reports
 func (c *Client) handleSMSDeliveryReport(data json.RawMessage) error {
 	var dlr types.SMSDeliveryReport
@@ -438,11 +598,50 @@ func (c *Client) handleSMSDeliveryReport(data json.RawMessage) error {
 		return err
 	}
 
+	previousStatus := sms.Status
 	sms.Status = dlr.Stat
 	sms.DeliveryReport = fmt.Sprintf("sub:%d dlvrd:%d submit_date:%s done_date:%s stat:%s err:%s",
 		dlr.Sub, dlr.Dlvrd, dlr.SubmitDate, dlr.DoneDate, dlr.Stat, dlr.Err)
 
-	return database.DB.Save(&sms).Error
+	if err := database.DB.Save(&sms).Error; err != nil {
+		return err
+	}
+
+	// Delivery outcomes feed the routing score of the sending SIM
+	if err := simhealth.RecordDelivery(&sms, previousStatus, dlr.Err); err != nil {
+		log.Printf("Failed to update routing stats for SMS %d: %v", sms.ID, err)
+	}
+	return nil
+}
+
+// handleIncomingCall records an incoming call event
+func (c *Client) handleIncomingCall(data json.RawMessage) error {
+	var event types.IncomingCall
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+
+	return calls.ApplyIncoming(c.DeviceID, event)
+}
+
+// handleMissedCall records a missed incoming call
+func (c *Client) handleMissedCall(data json.RawMessage) error {
+	var event types.MissedCall
+	if err := json.Unmarshal(data, &event); err != nil {
+		return err
+	}
+
+	return calls.ApplyMissed(c.DeviceID, event)
+}
+
+// handleCallStatus records the progress of a call placed on server request
+func (c *Client) handleCallStatus(data json.RawMessage) error {
+	var status types.CallStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return err
+	}
+
+	return calls.ApplyStatus(c.DeviceID, status)
 }
 
 // handleUSSDResult handles USSD command results
@@ -467,25 +666,34 @@ func (c *Client) handleUSSDResult(data json.RawMessage) error {
 	return database.DB.Save(&ussd).Error
 }
 
-// handlePhoneNumberResult handles phone number discovery results
-func (c *Client) handlePhoneNumberResult(data json.RawMessage) error {
-	var phoneResult types.PhoneNumberResult
-	if err := json.Unmarshal(data, &phoneResult); err != nil {
+// handleUSSDSessionResponse handles menu responses of interactive USSD sessions
+func (c *Client) handleUSSDSessionResponse(data json.RawMessage) error {
+	var response types.USSDSessionResponse
+	if err := json.Unmarshal(data, &response); err != nil {
 		return err
 	}
 
-	// Update phone number in SIM card
-	var simCard models.SIMCard
-	if err := database.DB.Where("device_id = ? AND id = ?", c.DeviceID, phoneResult.InternalLogID).First(&simCard).Error; err != nil {
+	return ussdsession.ApplyResponse(c.DeviceID, response)
+}
+
+// handleBalanceResult handles balance check results
+func (c *Client) handleBalanceResult(data json.RawMessage) error {
+	var result types.BalanceResult
+	if err := json.Unmarshal(data, &result); err != nil {
 		return err
 	}
 
-	if phoneResult.Success {
-		simCard.PhoneNumber = phoneResult.PhoneNumber
-		return database.DB.Save(&simCard).Error
+	return balance.ApplyResult(c.DeviceID, result)
+}
+
+// handlePhoneNumberResult handles phone number discovery results
+func (c *Client) handlePhoneNumberResult(data json.RawMessage) error {
+	var phoneResult types.PhoneNumberResult
+	if err := json.Unmarshal(data, &phoneResult); err != nil {
+		return err
 	}
 
-	return nil
+	return phonenumber.ApplyResult(c.DeviceID, phoneResult)
 }
 
 // handleClientAlarm handles alarms from clients
@@ -513,6 +721,46 @@ func (c *Client) handleClientAlarm(data json.RawMessage) error {
 	return queue.PublishAlarm(c.DeviceID, clientAlarm.AlarmType, clientAlarm.Message, "medium")
 }
 
+// handleConfigReport stores the configuration the device reports as applied
+func (c *Client) handleConfigReport(data json.RawMessage) error {
+	var report types.ConfigReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return err
+	}
+
+	return deviceconfig.ApplyReport(c.DeviceID, report)
+}
+
+// handleUpdateProgress records app update progress reported by the device
+func (c *Client) handleUpdateProgress(data json.RawMessage) error {
+	var progress types.UpdateProgress
+	if err := json.Unmarshal(data, &progress); err != nil {
+		return err
+	}
+
+	return ota.ApplyProgress(c.DeviceID, progress)
+}
+
+// handleDiagnosticResult records the answer to a diagnostic request
+func (c *Client) handleDiagnosticResult(data json.RawMessage) error {
+	var result types.DiagnosticResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+
+	return diagnostics.ApplyResult(c.DeviceID, result)
+}
+
+// handleDiagnosticChunk stores one part of a diagnostic upload
+func (c *Client) handleDiagnosticChunk(data json.RawMessage) error {
+	var chunk types.DiagnosticChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return err
+	}
+
+	return diagnostics.ApplyChunk(c.DeviceID, chunk)
+}
+
 // NewClient creates a new WebSocket client
 func NewClient(conn *websocket.Conn, hub *Hub) *Client {
 	return &Client{